@@ -40,6 +40,9 @@ func getLinks(lat, lng, proj string, r *http.Request) (Links, error) {
 	query := client.Query(granuleQuery)
 	query.QueryConfig.UseStandardSQL = true
 	rows, err := query.Read(ctx)
+	if err != nil {
+		return links, err
+	}
 
 	for {
 		var row []bigquery.Value
@@ -51,7 +54,10 @@ func getLinks(lat, lng, proj string, r *http.Request) (Links, error) {
 			return links, err
 		}
 
-		granuleID := row[baseGranuleColumn].(string)
+		granuleID, ok := row[baseGranuleColumn].(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected column type: column %d is %T, expected STRING", baseGranuleColumn, row[baseGranuleColumn])
+		}
 		links = append(links, granuleID)
 	}
 }
@@ -13,20 +13,62 @@ package satservice
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"regexp"
+	"strings"
 )
 
 // init is run before the application starts serving
 func init() {
 	http.HandleFunc("/", redirect)
 	http.Handle("/images", appHandler(images))
+	route, err := validDefaultRoute(DefaultRoute)
+	if err != nil {
+		log.Fatalf("Invalid DEFAULT_ROUTE: %v", err)
+	}
+	DefaultRoute = route
+}
+
+// DefaultRoute is the route clients are redirected to from all unknown routes, e.g. DEFAULT_ROUTE=/images
+var DefaultRoute = os.Getenv("DEFAULT_ROUTE")
+
+// Returns the default route if it is a route of the service, where an unset route falls back to /images
+// An unknown route is an error, since a misconfigured service would otherwise redirect clients to a route it does not serve
+func validDefaultRoute(route string) (string, error) {
+	if len(route) == 0 {
+		return "/images", nil
+	}
+	if route != "/images" {
+		return "", fmt.Errorf("%q is not a route of the service", route)
+	}
+	return route, nil
 }
 
-// redirect ensures that client is redirected to correct route
+// BaseURL is the scheme and host clients are redirected to, e.g. BASE_URL=https://example.com, where empty means the host of the request
+var BaseURL = strings.TrimSuffix(os.Getenv("BASE_URL"), "/")
+
+// redirect ensures that client is redirected to correct route, i.e. DefaultRoute
 func redirect(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, "https://tvao-178408.appspot.com/images", 301)
+	http.Redirect(w, r, baseURL(r)+DefaultRoute, 301)
+}
+
+// Returns the base URL of redirects, which is BaseURL if configured or else the host of the request
+// The scheme is that of X-Forwarded-Proto, set by proxies terminating TLS (e.g. App Engine), or else that of the connection
+func baseURL(r *http.Request) string {
+	if len(BaseURL) > 0 {
+		return BaseURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := strings.ToLower(r.Header.Get("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
 }
 
 // Basic regular expressions for validating user input and column number for granules
@@ -35,6 +77,12 @@ const (
 	Longitude string = "^[-+]?(180(\\.0+)?|((1[0-7]\\d)|([1-9]?\\d))(\\.\\d+)?)$"
 )
 
+// Compiled regular expressions of the coordinates, which are compiled once rather than on every request
+var (
+	latitudePattern  = regexp.MustCompile(Latitude)
+	longitudePattern = regexp.MustCompile(Longitude)
+)
+
 // Define custom HTTP appHandler that includes error return value to reduce repetition in error handling
 type appHandler func(http.ResponseWriter, *http.Request) *appError
 
@@ -68,7 +116,7 @@ func images(w http.ResponseWriter, r *http.Request) *appError {
 		lat, lng = r.Form.Get("lat"), r.Form.Get("lng")
 	}
 
-	validLat, validLng := regexp.MustCompile(Latitude).MatchString(lat), regexp.MustCompile(Longitude).MatchString(lng)
+	validLat, validLng := latitudePattern.MatchString(lat), longitudePattern.MatchString(lng)
 
 	if !validLat && !validLng {
 		return &appError{errors.New("Invalid coordinates"), "Please provide a valid latitude and longitude", http.StatusBadRequest}
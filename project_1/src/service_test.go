@@ -0,0 +1,30 @@
+// Package satservice : this contains unit tests of the redirect of unknown routes
+package satservice
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// Redirects should follow the default route, where an unset route falls back to /images and unknown routes are rejected
+func TestRedirect_DefaultRoute(t *testing.T) {
+	defer func(route string) { DefaultRoute = route }(DefaultRoute)
+	defer func(base string) { BaseURL = base }(BaseURL)
+	BaseURL = ""
+	for _, route := range []string{"", "/images"} {
+		var err error
+		if DefaultRoute, err = validDefaultRoute(route); err != nil {
+			t.Fatalf("valid default route %q was rejected: %v", route, err)
+		}
+		rr := httptest.NewRecorder()
+		redirect(rr, httptest.NewRequest("GET", "http://satellites.example.com/unknown", nil))
+		if location := rr.Header().Get("Location"); location != "http://satellites.example.com/images" {
+			t.Errorf("wrong redirect of default route %q: got %v want http://satellites.example.com/images", route, location)
+		}
+	}
+	for _, route := range []string{"/area", "images"} {
+		if _, err := validDefaultRoute(route); err == nil {
+			t.Errorf("unknown default route %q was accepted", route)
+		}
+	}
+}
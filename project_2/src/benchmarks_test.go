@@ -4,6 +4,7 @@ package main
 import (
 	"net/http/httptest"
 	"net/url"
+	"regexp"
 	"testing"
 
 	"google.golang.org/appengine/aetest"
@@ -63,3 +64,25 @@ func BenchmarkArea(b *testing.B) {
 	}
 
 }
+
+// Benchmark the validation of the coordinates of a request, where compiling the regular expressions on every request
+// allocates far more than matching the package-level compiled expressions, e.g. go test -bench Validate -benchmem
+func BenchmarkValidateCoordinates(b *testing.B) {
+	lat, lng := "55.660797", "12.5896"
+	b.Run("PerRequest", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if !regexp.MustCompile(Latitude).MatchString(lat) || !regexp.MustCompile(Longitude).MatchString(lng) {
+				b.Fatal("valid coordinates rejected")
+			}
+		}
+	})
+	b.Run("PackageLevel", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if !latitudePattern.MatchString(lat) || !longitudePattern.MatchString(lng) {
+				b.Fatal("valid coordinates rejected")
+			}
+		}
+	})
+}
@@ -0,0 +1,147 @@
+// Package satservice : this contains unit tests of the worker pool fetching images from image folders concurrently
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// The pool should return the images of exactly as many folders as links, instead of waiting for a result too many
+func TestPool_ReturnsWithoutHanging(t *testing.T) {
+	links := Links{
+		"gcp-public-data-sentinel-2/tiles/32/U/NG/S2A.SAFE/GRANULE/A/IMG_DATA/",
+		"gcp-public-data-sentinel-2/tiles/32/U/NG/S2A.SAFE/GRANULE/B/IMG_DATA/",
+		"gcp-public-data-sentinel-2/tiles/32/U/NG/S2A.SAFE/GRANULE/C/IMG_DATA/",
+	}
+	fetch := func(bucketName, objectName string) (Links, error) {
+		return Links{bucketName + "/" + objectName + "/B04.jp2"}, nil
+	}
+
+	done := make(chan Links)
+	go func() {
+		images, err := pool(links, fetch)
+		if err != nil {
+			t.Errorf("Failed to fetch images: %v", err)
+		}
+		done <- images
+	}()
+	select {
+	case images := <-done:
+		sort.Strings(images)
+		if len(images) != len(links) {
+			t.Fatalf("wrong number of images: got %v want %v", len(images), len(links))
+		}
+		for i, link := range links {
+			if expected := link + "B04.jp2"; images[i] != expected {
+				t.Errorf("missing image: got %v want %v", images[i], expected)
+			}
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pool did not return after fetching all folders")
+	}
+}
+
+// A failing bucket should make the area handler respond with 500 instead of exiting the process, i.e. the test completes at all
+func TestAreaHandler_FailingBucket(t *testing.T) {
+	defer func(folders func(string, string, string, string, string, *http.Request) (Links, error)) {
+		fetchImageFolders = folders
+	}(fetchImageFolders)
+	defer func(images func(string, string, []string, *http.Request) (Links, error)) { fetchImages = images }(fetchImages)
+	fetchImageFolders = func(lat1, lng1, lat2, lng2, proj string, r *http.Request) (Links, error) {
+		return Links{
+			"gcp-public-data-sentinel-2/tiles/32/U/NG/S2A.SAFE/GRANULE/A/IMG_DATA/",
+			"gcp-public-data-sentinel-2/tiles/32/U/NG/S2A.SAFE/GRANULE/B/IMG_DATA/",
+		}, nil
+	}
+
+	for err, code := range map[error]int{errors.New("bucket unavailable"): http.StatusInternalServerError, storage.ErrBucketNotExist: http.StatusNotFound} {
+		err := err
+		fetchImages = func(bucketName, objectName string, bands []string, r *http.Request) (Links, error) {
+			if strings.Contains(objectName, "/B/") {
+				return nil, err
+			}
+			return Links{bucketName + "/" + objectName + "/B04.jp2"}, nil
+		}
+
+		rr := httptest.NewRecorder()
+		appHandler(area).ServeHTTP(rr, httptest.NewRequest("GET", "/area?lat1=55.616879&lng1=12.506052&lat2=55.698473&lng2=12.652524", nil))
+		if status := rr.Code; status != code {
+			t.Errorf("handler returned wrong status code for %v: got %v want %v", err, status, code)
+		}
+	}
+}
+
+// failingWriter is a response whose body cannot be written, e.g. because the client disconnected
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (f failingWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("client disconnected")
+}
+
+// A response that cannot be written should make the area handler fail with 500 instead of exiting the process
+func TestAreaHandler_EncodeError(t *testing.T) {
+	defer func(folders func(string, string, string, string, string, *http.Request) (Links, error)) {
+		fetchImageFolders = folders
+	}(fetchImageFolders)
+	fetchImageFolders = func(lat1, lng1, lat2, lng2, proj string, r *http.Request) (Links, error) {
+		return Links{}, nil
+	}
+
+	rr := failingWriter{httptest.NewRecorder()}
+	appHandler(area).ServeHTTP(rr, httptest.NewRequest("GET", "/area?lat1=55.616879&lng1=12.506052&lat2=55.698473&lng2=12.652524", nil))
+	if status := rr.Code; status != http.StatusInternalServerError {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusInternalServerError)
+	}
+}
+
+// fakeObjects is a fake object list of a bucket folder
+type fakeObjects struct {
+	names []string
+}
+
+func (f *fakeObjects) Next() (*storage.ObjectAttrs, error) {
+	if len(f.names) == 0 {
+		return nil, iterator.Done
+	}
+	attrs := &storage.ObjectAttrs{Name: f.names[0]}
+	f.names = f.names[1:]
+	return attrs, nil
+}
+
+// Only images of the requested bands should be returned, whereas no bands should return all images
+func TestReadImages_Bands(t *testing.T) {
+	folder := "tiles/32/U/NG/S2A.SAFE/GRANULE/L1C_T32UNG_A012345_20171010T103021/IMG_DATA/"
+	names := []string{folder + "T32UNG_20171010T103021_B01.jp2", folder + "T32UNG_20171010T103021_B04.jp2",
+		folder + "T32UNG_20171010T103021_B08.jp2", folder + "T32UNG_20171010T103021_B8A.jp2", folder + "T32UNG_20171010T103021_TCI.jp2"}
+
+	bands, err := parseBands("B04,b08, TCI")
+	if err != nil {
+		t.Fatalf("Failed to parse bands: %v", err)
+	}
+	images, err := readImages("gcp-public-data-sentinel-2", &fakeObjects{names: names}, bands)
+	if err != nil {
+		t.Fatalf("Failed to read images: %v", err)
+	}
+	expected := Links{"gcp-public-data-sentinel-2/" + names[1], "gcp-public-data-sentinel-2/" + names[2], "gcp-public-data-sentinel-2/" + names[4]}
+	if !reflect.DeepEqual(images, expected) {
+		t.Errorf("wrong images: got %v want %v", images, expected)
+	}
+
+	if images, _ := readImages("gcp-public-data-sentinel-2", &fakeObjects{names: names}, nil); len(images) != len(names) {
+		t.Errorf("wrong number of images without bands: got %v want %v", len(images), len(names))
+	}
+	if _, err := parseBands("B04,B13"); err == nil {
+		t.Error("invalid band accepted")
+	}
+}
@@ -2,9 +2,10 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"path"
 	"strings"
 
 	"cloud.google.com/go/bigquery"
@@ -22,67 +23,71 @@ const (
 // Links encapsulates the links (i.e. granule ids)  fetched from Google Cloud via BigQuery
 type Links []string
 
-// Retrieves links (i.e. granule ids) of all satellite images via a location based on a latitude and longitude
-func getLinks(lat, lng, proj string, r *http.Request) (Links, error) {
-	granuleQuery := strings.TrimSpace(fmt.Sprintf(
-		`SELECT granule_id
+// Templates of the queries of the sentinel-2 index, where argument 1 quotes the table and the following arguments are coordinates
+const (
+	pointQueryTemplate = `SELECT granule_id
 		 FROM %[1]sbigquery-public-data.cloud_storage_geo_index.sentinel_2_index%[1]s
 		 WHERE %[2]s < north_lat
 		 AND south_lat < %[2]s
 		 AND %[3]s < east_lon
-		 AND west_lon < %[3]s;`, "`", lat, lng))
-
-	var links Links
-	ctx := appengine.NewContext(r)
-	client, err := bigquery.NewClient(ctx, proj)
-	if err != nil {
-		return links, err
-	}
-
-	query := client.Query(granuleQuery)
-	query.QueryConfig.UseStandardSQL = true
-	rows, err := query.Read(ctx)
-
-	for {
-		var row []bigquery.Value
-		err := rows.Next(&row) // No rows left
-		if err == iterator.Done {
-			return links, nil // Returns result
-		}
-		if err != nil {
-			return links, err
-		}
+		 AND west_lon < %[3]s;`
+	boxQueryTemplate = `SELECT base_url, granule_id
+		FROM %[1]sbigquery-public-data.cloud_storage_geo_index.sentinel_2_index%[1]s
+		WHERE %[2]s < north_lat
+		AND south_lat < %[4]s
+		AND %[3]s < east_lon
+		AND west_lon < %[5]s;` // Argument 2, 3, 4, 5
+)
 
-		granuleID := row[granuleIDColumn].(string)
-		links = append(links, granuleID)
-	}
+// Retrieves links (i.e. granule ids) of all satellite images via a location based on a latitude and longitude
+func getLinks(lat, lng, proj string, r *http.Request) (Links, error) {
+	return queryLinks(proj, pointQueryTemplate, []string{lat, lng}, granuleIDLink, r)
 }
 
 // Project 2 : Image data in geographic location
 // Fetches all sentinel-2 image folders that contain image data within the specified area of interest, using the Big Query Api
 func getImageBaseURL(lat1, lng1, lat2, lng2, proj string, r *http.Request) (Links, error) {
-	imageURLQuery := strings.TrimSpace(fmt.Sprintf(
-		`SELECT base_url, granule_id 
-		FROM %[1]sbigquery-public-data.cloud_storage_geo_index.sentinel_2_index%[1]s
-		WHERE %[2]s < north_lat
-		AND south_lat < %[4]s
-		AND %[3]s < east_lon
-		AND west_lon < %[5]s;`, "`", lat1, lng1, lat2, lng2)) // Argument 2, 3, 4, 5
+	return queryLinks(proj, boxQueryTemplate, []string{lat1, lng1, lat2, lng2}, imageFolderLink, r)
+}
 
-	links := Links{}
+// Formats a query template with the quote of the table and the coordinates
+func formatQuery(template string, coords []string) string {
+	args := []interface{}{"`"}
+	for _, coord := range coords {
+		args = append(args, coord)
+	}
+	return strings.TrimSpace(fmt.Sprintf(template, args...))
+}
+
+// Queries the sentinel-2 index with the cloud project, where each row of the result is mapped to a link
+// This is shared by the point and box queries of project 2 only, since project 1 and 3 are separate apps with queries of their own
+func queryLinks(proj, template string, coords []string, link func([]bigquery.Value) (string, error), r *http.Request) (Links, error) {
 	ctx := appengine.NewContext(r)
 	client, err := bigquery.NewClient(ctx, proj)
 	if err != nil {
 		return nil, err
 	}
 
-	query := client.Query(imageURLQuery)
+	query := client.Query(formatQuery(template, coords))
 	query.QueryConfig.UseStandardSQL = true
 	rows, err := query.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return readLinks(rows, link)
+}
 
-	row := []bigquery.Value{}
-	imageBaseURL, granuleID, fullImageURL := "", "", ""
+// rowIterator iterates the rows of a query result (e.g. bigquery.RowIterator)
+type rowIterator interface {
+	Next(dst interface{}) error
+}
+
+// Maps each row of a query result to a link
+// Rows with a NULL granule id or base url are skipped
+func readLinks(rows rowIterator, link func([]bigquery.Value) (string, error)) (Links, error) {
+	var links Links // Empty results are encoded as null, as before
 	for {
+		var row []bigquery.Value
 		err := rows.Next(&row) // No rows left
 		if err == iterator.Done {
 			return links, nil // Returns result
@@ -90,29 +95,77 @@ func getImageBaseURL(lat1, lng1, lat2, lng2, proj string, r *http.Request) (Link
 		if err != nil {
 			return nil, err
 		}
-		imageBaseURL = strings.Replace(row[0].(string), "gs://", "", 1) // Removes trailing gs:// from bucket name
-		granuleID = row[1].(string)
-		fullImageURL = imageBaseURL + "/GRANULE/" + granuleID + "/IMG_DATA/"
-		links = append(links, fullImageURL)
+		l, err := link(row)
+		if err == errNullColumn {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+	}
+}
+
+// Maps a row of the point query to its granule id
+func granuleIDLink(row []bigquery.Value) (string, error) {
+	return stringColumn(row, granuleIDColumn)
+}
+
+// Maps a row of the box query to the image folder of the granule
+func imageFolderLink(row []bigquery.Value) (string, error) {
+	baseURL, err := stringColumn(row, 0)
+	if err != nil {
+		return "", err
 	}
+	granuleID, err := stringColumn(row, 1)
+	if err != nil {
+		return "", err
+	}
+	imageBaseURL := strings.Replace(baseURL, "gs://", "", 1) // Removes trailing gs:// from bucket name
+	return imageBaseURL + "/GRANULE/" + granuleID + "/IMG_DATA/", nil
+}
 
+// errNullColumn is returned for a NULL value of a column
+var errNullColumn = errors.New("unexpected NULL column")
+
+// Reads a STRING column of a row
+func stringColumn(row []bigquery.Value, column int) (string, error) {
+	if column >= len(row) {
+		return "", fmt.Errorf("unexpected column count: %d columns, column %d requested", len(row), column)
+	}
+	if row[column] == nil {
+		return "", errNullColumn
+	}
+	s, ok := row[column].(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected column type: column %d is %T, expected STRING", column, row[column])
+	}
+	return s, nil
 }
 
 // Project 2 : Image data in geographic location
 // Fetches a complete list of image ids from a specified image folder in the sentinel-2 folder, using the Cloud Bucket Storage API
-func getImagesFromBucket(bucketName, objectName string, r *http.Request) (Links, error) {
+// If bands are given (e.g. B04, B08, TCI) only images of those bands are returned
+func getImagesFromBucket(bucketName, objectName string, bands []string, r *http.Request) (Links, error) {
 	ctx := appengine.NewContext(r)
 	client, err := storage.NewClient(ctx)
 	if err != nil {
-		log.Fatalf("Failed to create client: %v", err)
 		return nil, err
 	}
 
 	query := storage.Query{Prefix: objectName, Versions: false}
+	return readImages(bucketName, client.Bucket(bucketName).Objects(ctx, &query), bands)
+}
+
+// objectIterator iterates the objects of a bucket (e.g. storage.ObjectIterator)
+type objectIterator interface {
+	Next() (*storage.ObjectAttrs, error)
+}
+
+// Reads the links of the images of the bands from the objects of a bucket
+func readImages(bucketName string, it objectIterator, bands []string) (Links, error) {
 	links := Links{}
 	fullImageURL := bytes.Buffer{}
-
-	it := client.Bucket(bucketName).Objects(ctx, &query)
 	for {
 		attrs, err := it.Next()
 
@@ -121,12 +174,29 @@ func getImagesFromBucket(bucketName, objectName string, r *http.Request) (Links,
 		}
 
 		if err != nil {
-			log.Fatalln(err)
 			return nil, err
 		}
+		if !matchesBand(attrs.Name, bands) {
+			continue // Band not requested
+		}
 		fullImageURL.WriteString(bucketName + "/" + attrs.Name)
 		links = append(links, fullImageURL.String())
 		fullImageURL.Reset()
 	}
 	return links, nil
 }
+
+// Reports whether an object (e.g. ".../IMG_DATA/T32UNG_20171010T103021_B04.jp2") is an image of one of the bands
+// No bands means all bands
+func matchesBand(objectName string, bands []string) bool {
+	if len(bands) == 0 {
+		return true
+	}
+	name := strings.TrimSuffix(objectName, path.Ext(objectName))
+	for _, band := range bands {
+		if strings.HasSuffix(name, "_"+band) {
+			return true
+		}
+	}
+	return false
+}
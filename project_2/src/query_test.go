@@ -0,0 +1,73 @@
+// Package satservice : this contains unit tests of the queries of the sentinel-2 index shared by the image and area handlers
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+// fakeRows is a fake query result that yields the given rows
+type fakeRows struct {
+	rows [][]bigquery.Value
+}
+
+func (f *fakeRows) Next(dst interface{}) error {
+	if len(f.rows) == 0 {
+		return iterator.Done
+	}
+	*dst.(*[]bigquery.Value) = f.rows[0]
+	f.rows = f.rows[1:]
+	return nil
+}
+
+// The point query should compare the same latitude and longitude against both bounds of each granule
+func TestFormatQuery_Point(t *testing.T) {
+	query := formatQuery(pointQueryTemplate, []string{"55.660797", "12.5896"})
+	for _, condition := range []string{"55.660797 < north_lat", "south_lat < 55.660797", "12.5896 < east_lon", "west_lon < 12.5896"} {
+		if !strings.Contains(query, condition) {
+			t.Errorf("query is missing %q: %v", condition, query)
+		}
+	}
+	if !strings.Contains(query, "`bigquery-public-data.cloud_storage_geo_index.sentinel_2_index`") {
+		t.Errorf("query does not quote the table: %v", query)
+	}
+
+	links, err := readLinks(&fakeRows{rows: [][]bigquery.Value{{"L1C_T32UNG_A012345_20171010T103021"}}}, granuleIDLink)
+	if err != nil || len(links) != 1 || links[0] != "L1C_T32UNG_A012345_20171010T103021" {
+		t.Errorf("wrong links: got %v %v", links, err)
+	}
+}
+
+// The box query should compare the corners of the area against the bounds of each granule and link to the image folders
+func TestFormatQuery_Box(t *testing.T) {
+	query := formatQuery(boxQueryTemplate, []string{"55.616879", "12.506052", "55.698473", "12.652524"})
+	for _, condition := range []string{"55.616879 < north_lat", "south_lat < 55.698473", "12.506052 < east_lon", "west_lon < 12.652524"} {
+		if !strings.Contains(query, condition) {
+			t.Errorf("query is missing %q: %v", condition, query)
+		}
+	}
+
+	rows := &fakeRows{rows: [][]bigquery.Value{{"gs://gcp-public-data-sentinel-2/tiles/32/U/NG/S2A.SAFE", "L1C_T32UNG_A012345_20171010T103021"}}}
+	links, err := readLinks(rows, imageFolderLink)
+	expected := "gcp-public-data-sentinel-2/tiles/32/U/NG/S2A.SAFE/GRANULE/L1C_T32UNG_A012345_20171010T103021/IMG_DATA/"
+	if err != nil || len(links) != 1 || links[0] != expected {
+		t.Errorf("wrong links: got %v %v want [%v]", links, err, expected)
+	}
+}
+
+// Rows with a NULL column should be skipped and a column of another type should be an error instead of a panic
+func TestReadLinks_ColumnTypes(t *testing.T) {
+	rows := &fakeRows{rows: [][]bigquery.Value{{nil, "L1C_T32UNG_A012345_20171010T103021"}, {"gs://bucket/S2A.SAFE", "L1C_T32UNG_A012345_20171010T103021"}}}
+	links, err := readLinks(rows, imageFolderLink)
+	if err != nil || len(links) != 1 {
+		t.Errorf("NULL row was not skipped: got %v %v", links, err)
+	}
+
+	_, err = readLinks(&fakeRows{rows: [][]bigquery.Value{{int64(1)}}}, granuleIDLink)
+	if err == nil || !strings.Contains(err.Error(), "unexpected column type") {
+		t.Errorf("expected unexpected column type error, got %v", err)
+	}
+}
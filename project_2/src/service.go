@@ -13,11 +13,15 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	_ "net/http/pprof" // Profiling
+	"os"
 	"regexp"
 	"strings"
+
+	"cloud.google.com/go/storage"
 )
 
 // init is run before the application starts serving
@@ -25,6 +29,11 @@ func init() {
 	http.HandleFunc("/", redirect)
 	http.Handle("/images", appHandler(images))
 	http.Handle("/area", appHandler(area))
+	route, err := validDefaultRoute(DefaultRoute)
+	if err != nil {
+		log.Fatalf("Invalid DEFAULT_ROUTE: %v", err)
+	}
+	DefaultRoute = route
 }
 
 // use this for local testing with go tool
@@ -35,9 +44,43 @@ func init() {
 // 	http.Handle("/area", appHandler(area))
 // }
 
-// redirect ensures that client is redirected to correct route
+// DefaultRoute is the route clients are redirected to from all unknown routes, e.g. DEFAULT_ROUTE=/images
+var DefaultRoute = os.Getenv("DEFAULT_ROUTE")
+
+// Returns the default route if it is a route of the service, where an unset route falls back to /area
+// An unknown route is an error, since a misconfigured service would otherwise redirect clients to a route it does not serve
+func validDefaultRoute(route string) (string, error) {
+	if len(route) == 0 {
+		return "/area", nil
+	}
+	if route != "/images" && route != "/area" {
+		return "", fmt.Errorf("%q is not a route of the service", route)
+	}
+	return route, nil
+}
+
+// BaseURL is the scheme and host clients are redirected to, e.g. BASE_URL=https://example.com, where empty means the host of the request
+var BaseURL = strings.TrimSuffix(os.Getenv("BASE_URL"), "/")
+
+// redirect ensures that client is redirected to correct route, i.e. DefaultRoute
 func redirect(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, "https://tvao-178408.appspot.com/area", 301)
+	http.Redirect(w, r, baseURL(r)+DefaultRoute, 301)
+}
+
+// Returns the base URL of redirects, which is BaseURL if configured or else the host of the request
+// The scheme is that of X-Forwarded-Proto, set by proxies terminating TLS (e.g. App Engine), or else that of the connection
+func baseURL(r *http.Request) string {
+	if len(BaseURL) > 0 {
+		return BaseURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := strings.ToLower(r.Header.Get("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
 }
 
 // Basic regular expressions for validating user input and column number for granules
@@ -46,6 +89,12 @@ const (
 	Longitude string = "^[-+]?(180(\\.0+)?|((1[0-7]\\d)|([1-9]?\\d))(\\.\\d+)?)$"
 )
 
+// Compiled regular expressions of the coordinates, which are compiled once rather than on every request
+var (
+	latitudePattern  = regexp.MustCompile(Latitude)
+	longitudePattern = regexp.MustCompile(Longitude)
+)
+
 // Define custom HTTP appHandler that includes error return value to reduce repetition in error handling
 type appHandler func(http.ResponseWriter, *http.Request) *appError
 
@@ -79,7 +128,7 @@ func images(w http.ResponseWriter, r *http.Request) *appError {
 		lat, lng = r.Form.Get("lat"), r.Form.Get("lng")
 	}
 
-	validLat, validLng := regexp.MustCompile(Latitude).MatchString(lat), regexp.MustCompile(Longitude).MatchString(lng)
+	validLat, validLng := latitudePattern.MatchString(lat), longitudePattern.MatchString(lng)
 
 	if !validLat && !validLng {
 		return &appError{errors.New("Invalid coordinates"), "Please provide a valid latitude and longitude", http.StatusBadRequest}
@@ -102,6 +151,7 @@ func images(w http.ResponseWriter, r *http.Request) *appError {
 // Project 2 : Image data in geographic location
 // Returns a JSON array with links to all satellite images within a marked area of interest specified with a pair of lat/lng coordinates.
 // Area of interest is specified by a pair of latitude and longitude coordinates as query parameters.
+// Images may be narrowed to spectral bands with the bands query parameter, e.g. &bands=B04,B08,TCI.
 func area(w http.ResponseWriter, r *http.Request) *appError {
 	if err := r.ParseForm(); err != nil {
 		return &appError{err, "Cannot parse data", http.StatusInternalServerError}
@@ -109,25 +159,86 @@ func area(w http.ResponseWriter, r *http.Request) *appError {
 
 	projectID := "tvao-178408"
 	lat1, lng1, lat2, lng2 := r.Form.Get("lat1"), r.Form.Get("lng1"), r.Form.Get("lat2"), r.Form.Get("lng2")
-	if !regexp.MustCompile(Latitude).MatchString(lat1) || !regexp.MustCompile(Latitude).MatchString(lat2) ||
-		!regexp.MustCompile(Longitude).MatchString(lng1) || !regexp.MustCompile(Longitude).MatchString(lng2) {
+	if !latitudePattern.MatchString(lat1) || !latitudePattern.MatchString(lat2) ||
+		!longitudePattern.MatchString(lng1) || !longitudePattern.MatchString(lng2) {
 		return &appError{errors.New("Invalid coordinates"), "Please provide a valid pair of latitude and longitude bands \n" +
 			" Example: https://tvao-178408.appspot.com/area?lat1=55.698473&lng1=12.506052&lat2=55.616879&lng2=12.652524", http.StatusBadRequest}
 	}
 
-	links, err := getImageBaseURL(lat1, lng1, lat2, lng2, projectID, r)
+	bands, err := parseBands(r.Form.Get("bands"))
+	if err != nil {
+		return &appError{err, "Please provide valid bands, e.g. &bands=B04,B08,TCI", http.StatusBadRequest}
+	}
+
+	links, err := fetchImageFolders(lat1, lng1, lat2, lng2, projectID, r)
 	if err != nil {
 		return &appError{err, "Unable to retrieve links", http.StatusInternalServerError}
 	}
 
+	imageResult, err := pool(links, func(bucketName, objectName string) (Links, error) {
+		return fetchImages(bucketName, objectName, bands, r)
+	})
+	if err == storage.ErrBucketNotExist || err == storage.ErrObjectNotExist {
+		return &appError{err, "Image folder of a granule not found", http.StatusNotFound}
+	}
+	if err != nil {
+		return &appError{err, "Could not fetch pictures from granules", http.StatusInternalServerError}
+	}
+
+	// Encode JSON result
+	encodeErr := json.NewEncoder(w).Encode(imageResult)
+	if encodeErr != nil {
+		return &appError{encodeErr, "Unable to encode JSON", http.StatusInternalServerError}
+	}
+
+	return nil // Success
+}
+
+// Queries of the image folders of an area and of the images of a folder, which tests replace to fake BigQuery and buckets
+var (
+	fetchImageFolders = getImageBaseURL
+	fetchImages       = getImagesFromBucket
+)
+
+// Spectral bands of sentinel-2 images: B01 to B12, B8A and the true color image TCI
+const Band string = "^(B(0[1-9]|1[0-2]|8A)|TCI)$"
+
+// Compiled regular expression of the bands
+var bandPattern = regexp.MustCompile(Band)
+
+// Parses a comma separated list of bands (e.g. B04,B08,TCI), where no bands means all bands
+func parseBands(bands string) ([]string, error) {
+	if len(bands) == 0 {
+		return nil, nil
+	}
+	parsed := []string{}
+	for _, band := range strings.Split(bands, ",") {
+		band = strings.ToUpper(strings.TrimSpace(band))
+		if !bandPattern.MatchString(band) {
+			return nil, fmt.Errorf("invalid band %q", band)
+		}
+		parsed = append(parsed, band)
+	}
+	return parsed, nil
+}
+
+// Images of the folders fetched by a worker, or the error of the first folder that could not be fetched
+type workerResult struct {
+	images Links
+	err    error
+}
+
+// Worker pool fetching the images of each image folder concurrently, with a worker and a result per folder
+// An error of any folder is returned instead of the images, since the result would be incomplete
+func pool(links Links, fetch func(bucketName, objectName string) (Links, error)) (Links, error) {
 	// Create a set of worker jobs for each link
 	numberOfJobs := len(links)
 	jobs := make(chan string, numberOfJobs)
-	results := make(chan Links, numberOfJobs)
+	results := make(chan workerResult, numberOfJobs)
 
 	// Setup worker pool
-	for i := 0; i <= numberOfJobs; i++ {
-		go worker(r, jobs, results)
+	for i := 0; i < numberOfJobs; i++ {
+		go worker(fetch, jobs, results)
 	}
 
 	// Send jobs
@@ -138,33 +249,40 @@ func area(w http.ResponseWriter, r *http.Request) *appError {
 
 	// Collect worker results and write them to JSON result
 	imageResult := Links{}
-	for i := 0; i <= numberOfJobs; i++ {
-		imageResult = append(imageResult, <-results...)
+	var err error
+	for i := 0; i < numberOfJobs; i++ {
+		result := <-results
+		if result.err != nil && err == nil {
+			err = result.err
+		}
+		imageResult = append(imageResult, result.images...)
 	}
 	close(results)
-
-	// Encode JSON result
-	encodeErr := json.NewEncoder(w).Encode(imageResult)
-	if encodeErr != nil {
-		log.Fatal("Error")
+	if err != nil {
+		return nil, err
 	}
-
-	return nil // Success
+	return imageResult, nil
 }
 
 // Worker receives work on jobs channel and send images for each folder job to result
-func worker(r *http.Request, jobs <-chan string, results chan<- Links) {
-	folderImages := Links{}
+// Once a folder fails the worker only drains the remaining jobs, since the pool returns the error anyway
+func worker(fetch func(bucketName, objectName string) (Links, error), jobs <-chan string, results chan<- workerResult) {
+	result := workerResult{images: Links{}}
 	for imgLink := range jobs {
+		if result.err != nil {
+			continue
+		}
 		linkAndGranule := strings.SplitAfter(imgLink, "gcp-public-data-sentinel-2")
 		bucketName := linkAndGranule[0]
 		imageObject := strings.Trim(linkAndGranule[1], "/")
-		result, err := getImagesFromBucket(bucketName, imageObject, r)
+		images, err := fetch(bucketName, imageObject)
 
 		if err != nil {
-			log.Fatalln("Error on worker")
+			log.Printf("Failed to fetch images of %s: %v", imgLink, err)
+			result.err = err
+			continue
 		}
-		folderImages = result
+		result.images = append(result.images, images...) // A worker may drain several jobs
 	}
-	results <- folderImages
+	results <- result
 }
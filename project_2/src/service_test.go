@@ -110,3 +110,49 @@ func TestAreaHandler_ValidRequest(t *testing.T) {
 			status, http.StatusOK)
 	}
 }
+
+// Redirects should follow the default route, where an unset route falls back to /area and unknown routes are rejected
+func TestRedirect_DefaultRoute(t *testing.T) {
+	defer func(route string) { DefaultRoute = route }(DefaultRoute)
+	for route, expected := range map[string]string{"": "/area", "/images": "/images", "/area": "/area"} {
+		var err error
+		if DefaultRoute, err = validDefaultRoute(route); err != nil {
+			t.Fatalf("valid default route %q was rejected: %v", route, err)
+		}
+		rr := httptest.NewRecorder()
+		redirect(rr, httptest.NewRequest("GET", "/", nil))
+		if location := rr.Header().Get("Location"); location != "http://example.com"+expected {
+			t.Errorf("wrong redirect of default route %q: got %v want %v", route, location, expected)
+		}
+	}
+	for _, route := range []string{"/geo", "images"} {
+		if _, err := validDefaultRoute(route); err == nil {
+			t.Errorf("unknown default route %q was accepted", route)
+		}
+	}
+}
+
+// Redirects should stay on the host of the request, keeping the scheme of the proxy, unless a base URL is configured
+func TestRedirect_RequestHost(t *testing.T) {
+	defer func(base string) { BaseURL = base }(BaseURL)
+	cases := []struct {
+		base, proto, expected string
+	}{
+		{"", "", "http://satellites.example.com" + DefaultRoute},
+		{"", "https", "https://satellites.example.com" + DefaultRoute},
+		{"", "gopher", "http://satellites.example.com" + DefaultRoute},
+		{"https://images.example.org", "http", "https://images.example.org" + DefaultRoute},
+	}
+	for _, c := range cases {
+		BaseURL = c.base
+		req := httptest.NewRequest("GET", "http://satellites.example.com/unknown", nil)
+		if len(c.proto) > 0 {
+			req.Header.Set("X-Forwarded-Proto", c.proto)
+		}
+		rr := httptest.NewRecorder()
+		redirect(rr, req)
+		if location := rr.Header().Get("Location"); location != c.expected {
+			t.Errorf("wrong redirect with base %q and proto %q: got %v want %v", c.base, c.proto, location, c.expected)
+		}
+	}
+}
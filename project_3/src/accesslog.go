@@ -0,0 +1,42 @@
+// Package satservice accesslog logs a line of every request, i.e. its method, path, query, status code, response size and latency
+// Query parameters holding credentials are redacted, so the access log never leaks them
+package satservice
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SensitiveParams are the query parameters whose values are redacted in the access log, e.g. the token of the profiling routes
+var SensitiveParams = map[string]bool{"key": true, "token": true, "access_token": true, "password": true, "secret": true}
+
+// Value of redacted query parameters in the access log
+const redacted = "REDACTED"
+
+// Returns the query of a request with the values of sensitive parameters redacted, ordered by parameter
+func redactedQuery(query url.Values) string {
+	params := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			if SensitiveParams[strings.ToLower(name)] {
+				value = redacted
+			}
+			params = append(params, url.QueryEscape(name)+"="+url.QueryEscape(value))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// Logs the access log line of a request, once its response is written by the status writer
+func logAccess(r *http.Request, sw *statusWriter, elapsed time.Duration) {
+	target := r.URL.Path
+	if query := redactedQuery(r.URL.Query()); len(query) > 0 {
+		target += "?" + query
+	}
+	log.Printf("access: %s %s status=%d bytes=%d latency=%v", r.Method, target, sw.code, sw.size, elapsed)
+}
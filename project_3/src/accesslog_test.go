@@ -0,0 +1,47 @@
+// Package satservice : this contains unit tests of the access log of requests
+package satservice
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A bad request should be logged with its status code, size and latency, where credentials in the query are redacted
+func TestAccessLog_BadRequest(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	rr := httptest.NewRecorder()
+	appHandler(images).ServeHTTP(rr, httptest.NewRequest("GET", "/images?lat=north&lng=12.5896&key=secret123", nil))
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+
+	line := ""
+	for _, l := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(l, "access: ") {
+			line = l
+		}
+	}
+	match := regexp.MustCompile(`access: GET /images\?key=REDACTED&lat=north&lng=12.5896 status=400 bytes=(\d+) latency=(\S+)$`).FindStringSubmatch(line)
+	if match == nil {
+		t.Fatalf("wrong access log line: got %q", line)
+	}
+	if match[1] == "0" {
+		t.Errorf("access log line has no response size: %q", line)
+	}
+	if latency, err := time.ParseDuration(match[2]); err != nil || latency <= 0 {
+		t.Errorf("access log line has no latency: %q", line)
+	}
+	if strings.Contains(logs.String(), "secret123") {
+		t.Errorf("access log leaks a credential: %v", logs.String())
+	}
+}
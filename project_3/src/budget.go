@@ -0,0 +1,73 @@
+// Package satservice budget rejects BigQuery queries that would scan more bytes than BIGQUERY_BYTE_BUDGET before they are run
+// BigQuery bills by bytes scanned, so each query is first estimated with a dry run, which is free
+package satservice
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// QueryByteBudget is the max number of bytes a single query may scan, e.g. BIGQUERY_BYTE_BUDGET=10000000000 for 10 GB
+// A budget of 0 (or an unset environment variable) means queries are run without estimating them
+var QueryByteBudget = parseByteBudget(os.Getenv("BIGQUERY_BYTE_BUDGET"))
+
+// Parses the byte budget of queries, where an invalid budget is ignored rather than failing every query
+func parseByteBudget(budget string) int64 {
+	if len(budget) == 0 {
+		return 0
+	}
+	bytes, err := strconv.ParseInt(budget, 10, 64)
+	if err != nil || bytes < 0 {
+		log.Printf("Warning: invalid BIGQUERY_BYTE_BUDGET %q, queries are run without budget", budget)
+		return 0
+	}
+	return bytes
+}
+
+// BudgetError is returned instead of running a query whose estimated bytes scanned exceed the budget
+type BudgetError struct {
+	Estimate int64 // Bytes the dry run estimated the query would scan
+	Budget   int64
+}
+
+func (e *BudgetError) Error() string {
+	return fmt.Sprintf("query too expensive: estimated %d bytes scanned exceeds the budget of %d bytes", e.Estimate, e.Budget)
+}
+
+// estimateQueryBytes estimates the bytes a query would scan, which tests replace to trip the budget without BigQuery
+var estimateQueryBytes = dryRunBytes
+
+// Estimates the bytes a query would scan with a dry run, which validates the query without running or billing it
+func dryRunBytes(ctx context.Context, query *bigquery.Query) (int64, error) {
+	dryRun := *query
+	dryRun.DryRun = true
+	job, err := dryRun.Run(ctx)
+	if err != nil {
+		return 0, err
+	}
+	status := job.LastStatus()
+	if status == nil || status.Statistics == nil {
+		return 0, fmt.Errorf("dry run of job %s has no statistics", job.ID())
+	}
+	return status.Statistics.TotalBytesProcessed, nil
+}
+
+// Returns a BudgetError if the query is estimated to scan more bytes than QueryByteBudget
+func checkQueryBudget(ctx context.Context, query *bigquery.Query) error {
+	if QueryByteBudget <= 0 {
+		return nil
+	}
+	estimate, err := estimateQueryBytes(ctx, query)
+	if err != nil {
+		return err
+	}
+	if estimate > QueryByteBudget {
+		return &BudgetError{Estimate: estimate, Budget: QueryByteBudget}
+	}
+	return nil
+}
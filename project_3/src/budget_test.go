@@ -0,0 +1,55 @@
+// Package satservice : this contains unit tests of rejecting queries that exceed the byte budget
+package satservice
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// A query estimated above the budget should be rejected before it is run, and answered with 400 and the estimate
+func TestReadQuery_OverBudget(t *testing.T) {
+	defer func(budget int64) { QueryByteBudget = budget }(QueryByteBudget)
+	defer func(estimate func(context.Context, *bigquery.Query) (int64, error)) { estimateQueryBytes = estimate }(estimateQueryBytes)
+	QueryByteBudget = 1000000000
+	estimateQueryBytes = func(ctx context.Context, query *bigquery.Query) (int64, error) {
+		return 25000000000, nil
+	}
+
+	query, err := pointQuery("granule_id", "55.660797", "12.5896")
+	if err != nil {
+		t.Fatalf("Failed to build query: %v", err)
+	}
+	_, err = readQuery(context.Background(), query) // Would fail to connect if the query was run
+	budgetErr, ok := err.(*BudgetError)
+	if !ok || budgetErr.Estimate != 25000000000 || budgetErr.Budget != QueryByteBudget {
+		t.Fatalf("query was not rejected by the budget: got %v", err)
+	}
+
+	expensive := func(w http.ResponseWriter, r *http.Request) *appError {
+		return &appError{err, "Could not get granules", http.StatusInternalServerError}
+	}
+	rr := httptest.NewRecorder()
+	appHandler(expensive).ServeHTTP(rr, httptest.NewRequest("GET", "/geo?country=russia", nil))
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+	var response errorResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil || !strings.Contains(response.Message, "25000000000 bytes") {
+		t.Errorf("error does not return the estimate: got %+v, %v", response, err)
+	}
+}
+
+// Invalid budgets should disable the budget instead of rejecting every query
+func TestParseByteBudget(t *testing.T) {
+	for budget, expected := range map[string]int64{"": 0, "10000000000": 10000000000, "10GB": 0, "-1": 0} {
+		if actual := parseByteBudget(budget); actual != expected {
+			t.Errorf("parseByteBudget(%q): got %v want %v", budget, actual, expected)
+		}
+	}
+}
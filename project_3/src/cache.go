@@ -0,0 +1,89 @@
+// Package satservice cache keeps results that change slowly (e.g. image counts of countries or geocoded addresses) in memory for a time to live
+package satservice
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// ttlCache is a least recently used cache of values that expire after a time to live, safe for concurrent use by request goroutines
+type ttlCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // Most recently used entry first
+}
+
+// A cached value, its key and the time it expires
+type ttlEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// newTTLCache creates an empty cache
+func newTTLCache() *ttlCache {
+	return &ttlCache{entries: map[string]*list.Element{}, order: list.New()}
+}
+
+// Returns the cached value of a key, unless it is missing or expired
+func (c *ttlCache) get(key string, now time.Time) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*ttlEntry)
+	if now.After(entry.expires) {
+		c.remove(element)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return entry.value, true
+}
+
+// Caches the value of a key for the time to live, keeping at most size values
+// Expired values are removed first and then the least recently used values, since keys come from requests and must not grow the cache forever
+func (c *ttlCache) put(key string, value interface{}, ttl time.Duration, size int, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for element := c.order.Front(); element != nil; {
+		next := element.Next()
+		if now.After(element.Value.(*ttlEntry).expires) {
+			c.remove(element)
+		}
+		element = next
+	}
+	entry := &ttlEntry{key: key, value: value, expires: now.Add(ttl)}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+	} else {
+		c.entries[key] = c.order.PushFront(entry)
+	}
+	for c.order.Len() > size && c.order.Len() > 0 {
+		c.remove(c.order.Back())
+	}
+}
+
+// Removes an entry of the cache, where the caller holds the lock
+func (c *ttlCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*ttlEntry).key)
+}
+
+// Removes all values of the cache
+func (c *ttlCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]*list.Element{}
+	c.order.Init()
+}
+
+// Returns the number of cached values, including expired values that are not removed yet
+func (c *ttlCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
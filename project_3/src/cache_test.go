@@ -0,0 +1,49 @@
+// Package satservice : this contains unit tests of the cache of slowly changing results
+package satservice
+
+import (
+	"testing"
+	"time"
+)
+
+// A full cache should evict the least recently used value, so keys from requests cannot grow it forever
+func TestTTLCache_Size(t *testing.T) {
+	cache := newTTLCache()
+	now := time.Now()
+	cache.put("a", 1, time.Hour, 2, now)
+	cache.put("b", 2, time.Hour, 2, now)
+	cache.get("a", now) // b is now the least recently used value
+	cache.put("c", 3, time.Hour, 2, now)
+
+	if size := cache.len(); size != 2 {
+		t.Errorf("wrong cache size: got %v want 2", size)
+	}
+	if _, ok := cache.get("b", now); ok {
+		t.Error("least recently used value was not evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := cache.get(key, now); !ok {
+			t.Errorf("recently used value %v was evicted", key)
+		}
+	}
+}
+
+// Expired values should be evicted before values that are still fresh
+func TestTTLCache_Expired(t *testing.T) {
+	cache := newTTLCache()
+	now := time.Now()
+	cache.put("old", 1, time.Minute, 2, now)
+	cache.put("fresh", 2, time.Hour, 2, now)
+	cache.get("old", now) // old is the most recently used value, but expires first
+
+	later := now.Add(2 * time.Minute)
+	cache.put("new", 3, time.Hour, 2, later)
+	if _, ok := cache.get("old", later); ok {
+		t.Error("expired value was served")
+	}
+	for _, key := range []string{"fresh", "new"} {
+		if _, ok := cache.get(key, later); !ok {
+			t.Errorf("fresh value %v was evicted", key)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+//go:build standalone
+// +build standalone
+
+// Command standalone serves the satellite image service without App Engine, e.g. on Cloud Run
+// Build with: go build -tags standalone ./cmd/standalone
+// The repository has no go.mod, so build in GOPATH mode (GO111MODULE=off) with the repository at the path of its import, see README.md
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	satservice "github.com/TVAO/scalability_of_web_systems/project_3/src"
+)
+
+func main() {
+	// Cloud Run sends SIGTERM before stopping an instance, which shuts the server down gracefully
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	if err := satservice.ListenAndServe(ctx, satservice.ListenAddress()); err != nil {
+		log.Fatalf("Server failed: %v", err)
+	}
+	log.Printf("Server stopped")
+}
@@ -0,0 +1,42 @@
+// Package satservice context creates the context of a request, with which handlers call BigQuery, the buckets and external APIs
+// On App Engine this is the App Engine context of the request, whereas elsewhere (e.g. Cloud Run or standalone) it is the context of the request itself
+package satservice
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"google.golang.org/appengine"
+)
+
+// contextFromRequest returns the context of a request, selected by the environment the service runs in
+var contextFromRequest = requestContext(appengine.IsAppEngine())
+
+// Returns the context function of the App Engine SDK, or the context of the request when not running on App Engine
+func requestContext(onAppEngine bool) func(r *http.Request) context.Context {
+	if onAppEngine {
+		return appengine.NewContext
+	}
+	return standaloneContext
+}
+
+// Returns the context of the request, which runs the service without the App Engine SDK
+func standaloneContext(r *http.Request) context.Context {
+	return r.Context()
+}
+
+// detachedContext holds the values of its parent context (e.g. of the App Engine request) but is never cancelled with it
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+// Returns a context with the values of ctx that is not cancelled when ctx is, e.g. for work that outlives the request
+func withoutCancel(ctx context.Context) context.Context {
+	return detachedContext{ctx}
+}
@@ -0,0 +1,86 @@
+// Package satservice : this contains unit tests of the context of requests outside App Engine
+package satservice
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// contextKey is the key of a value of the context of a test request
+type contextKey string
+
+// ctxQuerier records the context of the last query it ran
+type ctxQuerier struct {
+	fakeQuerier
+	ctx context.Context
+}
+
+func (q *ctxQuerier) RunQuery(ctx context.Context, sql string, params []bigquery.QueryParameter) (rowIterator, error) {
+	q.ctx = ctx
+	return q.fakeQuerier.RunQuery(ctx, sql, params)
+}
+
+// Outside App Engine a handler should query with the context of the request, without an App Engine instance
+func TestContextFromRequest_Standalone(t *testing.T) {
+	FlushLinksCache()
+	defer FlushLinksCache()
+	defer func(f func(*http.Request) context.Context) { contextFromRequest = f }(contextFromRequest)
+	contextFromRequest = requestContext(false)
+	querier := &ctxQuerier{fakeQuerier: fakeQuerier{rows: [][]bigquery.Value{{"L1C_T32UNG_A012345_20171010T103021", "S2A_MSIL1C_20171010T103021"}}}}
+	defer withQuerier(querier)()
+
+	key := contextKey("request")
+	req := httptest.NewRequest("GET", "/images?lat=55.660797&lng=12.5896", nil)
+	req = req.WithContext(context.WithValue(req.Context(), key, "standalone"))
+	rr := httptest.NewRecorder()
+	appHandler(images).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %v", status, http.StatusOK, rr.Body.String())
+	}
+	if expected := `["L1C_T32UNG_A012345_20171010T103021"]`; rr.Body.String() != expected+"\n" {
+		t.Errorf("handler returned wrong body: got %v want %v", rr.Body.String(), expected)
+	}
+	if querier.ctx == nil || querier.ctx.Value(key) != "standalone" {
+		t.Fatalf("query did not run with the context of the request: got %v", querier.ctx)
+	}
+	if _, ok := querier.ctx.Deadline(); !ok {
+		t.Errorf("query did not run with the deadline of the route")
+	}
+}
+
+// Coverage statistics should be queried with the context of contextFromRequest, like the other queries of a location
+func TestGetCoverageStats_Context(t *testing.T) {
+	key := contextKey("request")
+	defer func(f func(*http.Request) context.Context) { contextFromRequest = f }(contextFromRequest)
+	contextFromRequest = func(r *http.Request) context.Context { return context.WithValue(r.Context(), key, "app engine") }
+	querier := &ctxQuerier{}
+	defer withQuerier(querier)()
+
+	getCoverageStats("55.660797", "12.5896", GranuleFilter{}, httptest.NewRequest("GET", "/stats?lat=55.660797&lng=12.5896", nil))
+	if querier.ctx == nil || querier.ctx.Value(key) != "app engine" {
+		t.Errorf("query did not run with the context of contextFromRequest: got %v", querier.ctx)
+	}
+}
+
+// A detached context should keep the values of its parent but not be cancelled with it
+func TestWithoutCancel(t *testing.T) {
+	key := contextKey("request")
+	parent, cancel := context.WithTimeout(context.WithValue(context.Background(), key, "detached"), time.Minute)
+	ctx := withoutCancel(parent)
+	cancel()
+	if ctx.Err() != nil || ctx.Done() != nil {
+		t.Errorf("detached context was cancelled with its parent: %v", ctx.Err())
+	}
+	if _, ok := ctx.Deadline(); ok {
+		t.Errorf("detached context kept the deadline of its parent")
+	}
+	if value := ctx.Value(key); value != "detached" {
+		t.Errorf("detached context lost the values of its parent: got %v", value)
+	}
+}
@@ -7,24 +7,28 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"net/url"
+	"os"
 	"strconv"
-
-	"google.golang.org/appengine"
-	"google.golang.org/appengine/urlfetch"
+	"strings"
+	"sync"
+	"time"
 )
 
 // JSON result returned by Geolocation API
 type geoResponse struct {
 	Results []struct {
-		Geometry struct {
+		FormattedAddress string `json:"formatted_address"`
+		Geometry         struct {
 			Location struct {
 				Lat float64
 				Lng float64
 			}
 		}
 	}
+	Status string // OK, or e.g. ZERO_RESULTS if the address has no match
 }
 
 // Converts a human-like address to coordinates (latitude and longitude) via the Google Geolocation API
@@ -36,33 +40,153 @@ func convertAddressToCoords(address string, r *http.Request) (string, string, er
 		return "", "", errors.New("Invalid address input")
 	}
 
-	safeAddress := url.QueryEscape(address) // Escapes string so it is safe to place inside URL query
+	cacheKey := normalizeAddress(address)
+	cached, ok := geocodes.get(cacheKey, time.Now())
+	metrics.GeocodeCache(ok)
+	if ok {
+		coords := cached.(geocodedCoords)
+		return coords.lat, coords.lng, nil // Cached
+	}
 
-	// Geocoding API
-	fullURL := fmt.Sprintf("http://maps.googleapis.com/maps/api/geocode/json?address=%s", safeAddress)
+	res, err := geocode(url.Values{"address": {address}}, fmt.Sprintf("address %q", address), r)
+	if err != nil {
+		return "", "", err
+	}
 
-	// App engine context to interact with external service via http client
-	ctx := appengine.NewContext(r)
-	client := urlfetch.Client(ctx)
+	lat := strconv.FormatFloat(res.Results[0].Geometry.Location.Lat, 'f', 6, 64)
+	lng := strconv.FormatFloat(res.Results[0].Geometry.Location.Lng, 'f', 6, 64)
+	log.Printf("Success: converted address '%s' into lat = '%s' and lng = '%s' \n", address, lat, lng)
 
-	response, err := client.Get(fullURL)
+	geocodes.put(cacheKey, geocodedCoords{lat, lng}, GeocodeCacheTTL, GeocodeCacheSize, time.Now())
+	return lat, lng, nil // Success
+}
 
+// Converts coordinates (latitude and longitude) to the human-like address of the first match via the Google Geolocation API
+// A reverse geocoding request has the form: https://maps.googleapis.com/maps/api/geocode/json?latlng=<lat>,<lng>
+func convertCoordsToAddress(lat, lng string, r *http.Request) (string, error) {
+	res, err := geocode(url.Values{"latlng": {lat + "," + lng}}, fmt.Sprintf("location %s,%s", lat, lng), r)
 	if err != nil {
-		return "", "", err
+		return "", err
 	}
+	return res.Results[0].FormattedAddress, nil // Success
+}
+
+// errNoGeocodingMatch is returned when the Geocoding API has no result for a query
+var errNoGeocodingMatch = errors.New("no geocoding match")
 
+// Sends a request with the given parameters to the Geocoding API, returning an error unless there is at least one result
+// The query describes the request in errors, e.g. address "Rued Langgaards Vej 7"
+func geocode(params url.Values, query string, r *http.Request) (geoResponse, error) {
+	// Context of the request to interact with external service via http client, which is the App Engine context on App Engine
+	ctx := contextFromRequest(r)
+	client := geocodeClient(ctx)
+
+	var res geoResponse
+	response, err := client.Get(geocodeURL(params))
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err // The URL of the request includes the API key, which must not end up in logs or responses
+		}
+		return res, fmt.Errorf("geocoding of %s failed: %w", query, err)
+	}
 	defer response.Body.Close()
 
-	// Generate latitude and longitude from address using Google Geocoding API
 	// Use json.Decode or json.Encode for reading or writing streams of JSON data
-	var res geoResponse
 	if err := json.NewDecoder(response.Body).Decode(&res); err != nil {
-		return "", "", err
+		return res, err
+	}
+	if res.Status == "ZERO_RESULTS" || (res.Status == "OK" && len(res.Results) == 0) {
+		return res, fmt.Errorf("%w for %s", errNoGeocodingMatch, query)
+	}
+	if res.Status != "OK" || len(res.Results) == 0 {
+		return res, fmt.Errorf("geocoding of %s failed with status %q", query, res.Status)
 	}
+	return res, nil
+}
 
-	lat := strconv.FormatFloat(res.Results[0].Geometry.Location.Lat, 'f', 6, 64)
-	lng := strconv.FormatFloat(res.Results[0].Geometry.Location.Lng, 'f', 6, 64)
-	log.Printf("Success: converted address '%s' into lat = '%s' and lng = '%s' \n", address, lat, lng)
+// GeocodeKey is the API key of the Geocoding API, which is required by Google for all but a few requests
+var GeocodeKey = os.Getenv("GOOGLE_GEOCODE_KEY")
 
-	return lat, lng, nil // Success
+// Warns once that requests to the Geocoding API are sent without an API key
+var warnMissingKey sync.Once
+
+// Builds the URL of a Geocoding API request with the given parameters and the API key, if configured
+// Parameters are escaped, so they are safe to place inside the URL query
+func geocodeURL(params url.Values) string {
+	if len(GeocodeKey) > 0 {
+		params.Set("key", GeocodeKey)
+	} else {
+		warnMissingKey.Do(func() {
+			log.Printf("Warning: GOOGLE_GEOCODE_KEY is not set, Geocoding API requests are sent without key")
+		})
+	}
+	return "https://maps.googleapis.com/maps/api/geocode/json?" + params.Encode()
+}
+
+// geocodeClient creates the HTTP client used to call the Geocoding API, which tests replace with a stub
+var geocodeClient = fetchClient
+
+// Limits of the cache of geocoded addresses: the max number of addresses and how long coordinates are kept
+var (
+	GeocodeCacheSize = 10000
+	GeocodeCacheTTL  = 24 * time.Hour
+)
+
+// Normalizes an address to its cache key, so variants in case and whitespace share an entry
+func normalizeAddress(address string) string {
+	return strings.ToLower(strings.Join(strings.Fields(address), " "))
+}
+
+// Coordinates of a geocoded address
+type geocodedCoords struct {
+	lat, lng string
+}
+
+// Cache of all geocoded addresses of the instance, keyed by normalized address
+var geocodes = newTTLCache()
+
+// ClearGeocodeCache removes all cached geocoded addresses, e.g. between tests
+func ClearGeocodeCache() {
+	geocodes.flush()
+}
+
+// Supported coordinate reference systems of input coordinates: WGS84 (latitude and longitude) and Web Mercator (meters)
+const (
+	WGS84       = "4326"
+	WebMercator = "3857"
+	earthRadius = 6378137.0 // Radius of the sphere used by Web Mercator in meters
+)
+
+// Reprojects a coordinate given in the input CRS (e.g. "3857" or "EPSG:3857") into a WGS84 latitude and longitude
+// For Web Mercator the latitude is the northing (y) and the longitude is the easting (x)
+func reproject(crs, lat, lng string) (string, string, error) {
+	switch strings.TrimPrefix(strings.ToUpper(crs), "EPSG:") {
+	case WGS84:
+		return lat, lng, nil
+	case WebMercator:
+		y, err := strconv.ParseFloat(lat, 64)
+		if err != nil {
+			return "", "", err
+		}
+		x, err := strconv.ParseFloat(lng, 64)
+		if err != nil {
+			return "", "", err
+		}
+		latitude := (2*math.Atan(math.Exp(y/earthRadius)) - math.Pi/2) * 180 / math.Pi
+		longitude := x / earthRadius * 180 / math.Pi
+		return strconv.FormatFloat(latitude, 'f', 6, 64), strconv.FormatFloat(longitude, 'f', 6, 64), nil
+	default:
+		return "", "", fmt.Errorf("Unsupported input CRS %q", crs)
+	}
+}
+
+// Returns the first of the errors that is not nil
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,194 @@
+// Package satservice : this contains unit tests of the conversion of addresses and coordinates
+package satservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// A Web Mercator bounding box should reproject to the same coordinates as the equivalent WGS84 box
+func TestReproject_WebMercator(t *testing.T) {
+	box := [][2]float64{{55.660797, 12.5896}, {55.663369, 12.584670}}
+	for _, corner := range box {
+		// Project WGS84 corner to Web Mercator meters
+		x := corner[1] * math.Pi / 180 * earthRadius
+		y := math.Log(math.Tan(math.Pi/4+corner[0]*math.Pi/360)) * earthRadius
+
+		lat, lng, err := reproject("EPSG:3857", strconv.FormatFloat(y, 'f', -1, 64), strconv.FormatFloat(x, 'f', -1, 64))
+		if err != nil {
+			t.Fatalf("Failed to reproject: %v", err)
+		}
+		expectedLat, expectedLng, _ := reproject(WGS84, strconv.FormatFloat(corner[0], 'f', 6, 64), strconv.FormatFloat(corner[1], 'f', 6, 64))
+		if lat != expectedLat || lng != expectedLng {
+			t.Errorf("wrong reprojection: got (%v, %v) want (%v, %v)", lat, lng, expectedLat, expectedLng)
+		}
+	}
+
+	if _, _, err := reproject("32632", "6170000", "720000"); err == nil {
+		t.Error("reproject accepted unsupported CRS")
+	}
+}
+
+// stubTransport answers every request with the same body, or fails it with err if set, and counts the requests
+type stubTransport struct {
+	mu    sync.Mutex
+	calls int
+	query url.Values // Query of the last request
+	body  string
+	err   error
+}
+
+func (s *stubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s.mu.Lock()
+	s.calls++
+	s.query = req.URL.Query()
+	s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(s.body)),
+		Request:    req,
+	}, nil
+}
+
+// Replaces the Geocoding API client with a stub answering with the given body, until the returned restore function is called
+func stubGeocoding(body string) (*stubTransport, func()) {
+	stub := &stubTransport{body: body}
+	client := geocodeClient
+	geocodeClient = func(ctx context.Context) *http.Client { return &http.Client{Transport: stub} }
+	ClearGeocodeCache()
+	return stub, func() {
+		geocodeClient = client
+		ClearGeocodeCache()
+	}
+}
+
+// Geocoding the same address twice should only call the Geocoding API once
+func TestConvertAddressToCoords_Cache(t *testing.T) {
+	stub, restore := stubGeocoding(`{"results":[{"geometry":{"location":{"lat":55.659687,"lng":12.591335}}}],"status":"OK"}`)
+	defer restore()
+
+	req := httptest.NewRequest("GET", "/images", nil)
+	for _, address := range []string{"Rued Langgaards Vej 7", "rued langgaards  vej 7"} {
+		lat, lng, err := convertAddressToCoords(address, req)
+		if err != nil {
+			t.Fatalf("Failed to convert address: %v", err)
+		}
+		if lat != "55.659687" || lng != "12.591335" {
+			t.Errorf("wrong coordinates of %q: got (%v, %v) want (55.659687, 12.591335)", address, lat, lng)
+		}
+	}
+	if stub.calls != 1 {
+		t.Errorf("wrong number of Geocoding API calls: got %v want 1", stub.calls)
+	}
+}
+
+// An address without any geocoding match should return an error instead of panicking
+func TestConvertAddressToCoords_NoResults(t *testing.T) {
+	_, restore := stubGeocoding(`{"results":[],"status":"ZERO_RESULTS"}`)
+	defer restore()
+
+	_, _, err := convertAddressToCoords("Atlantis", httptest.NewRequest("GET", "/images", nil))
+	if err == nil || !strings.Contains(err.Error(), "no geocoding match") {
+		t.Errorf("wrong error for address without match: got %v", err)
+	}
+}
+
+// A failed request to the Geocoding API should not return the URL of the request, which includes the API key
+func TestConvertAddressToCoords_TransportErrorHidesKey(t *testing.T) {
+	defer func(key string) { GeocodeKey = key }(GeocodeKey)
+	GeocodeKey = "secret-geocode-key"
+	stub, restore := stubGeocoding("")
+	defer restore()
+	stub.err = errors.New("i/o timeout")
+
+	_, _, err := convertAddressToCoords("Rued Langgaards Vej 7", httptest.NewRequest("GET", "/images", nil))
+	if err == nil || strings.Contains(err.Error(), GeocodeKey) || !strings.Contains(err.Error(), "i/o timeout") {
+		t.Errorf("wrong error for failed request: got %v", err)
+	}
+}
+
+// Geocoding API requests should use https and include the escaped API key when configured
+func TestGeocodeURL(t *testing.T) {
+	defer func(key string) { GeocodeKey = key }(GeocodeKey)
+	GeocodeKey = "secret key&"
+
+	fullURL := geocodeURL(url.Values{"address": {"Rued Langgaards Vej 7"}})
+	parsed, err := url.Parse(fullURL)
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %v", err)
+	}
+	if parsed.Scheme != "https" {
+		t.Errorf("wrong scheme: got %v want https", parsed.Scheme)
+	}
+	if key := parsed.Query().Get("key"); key != GeocodeKey {
+		t.Errorf("wrong key: got %q want %q", key, GeocodeKey)
+	}
+	if address := parsed.Query().Get("address"); address != "Rued Langgaards Vej 7" {
+		t.Errorf("wrong address: got %q", address)
+	}
+}
+
+// Reverse geocoding should request the address of the coordinates and return the formatted address of the first result
+func TestConvertCoordsToAddress(t *testing.T) {
+	stub, restore := stubGeocoding(`{"results":[{"formatted_address":"Rued Langgaards Vej 7, 2300 København S, Denmark"},` +
+		`{"formatted_address":"København S, Denmark"}],"status":"OK"}`)
+	defer restore()
+
+	address, err := convertCoordsToAddress("55.659687", "12.591335", httptest.NewRequest("GET", "/images", nil))
+	if err != nil {
+		t.Fatalf("Failed to convert coordinates: %v", err)
+	}
+	if expected := "Rued Langgaards Vej 7, 2300 København S, Denmark"; address != expected {
+		t.Errorf("wrong address: got %q want %q", address, expected)
+	}
+	if latlng := stub.query.Get("latlng"); latlng != "55.659687,12.591335" {
+		t.Errorf("wrong reverse geocoding query: got latlng %q", latlng)
+	}
+
+	_, restore = stubGeocoding(`{"results":[],"status":"ZERO_RESULTS"}`)
+	defer restore()
+	if _, err := convertCoordsToAddress("0.0", "-160.0", httptest.NewRequest("GET", "/images", nil)); err == nil {
+		t.Error("reverse geocoding without results returned no error")
+	}
+}
+
+// Links of a location that cannot be reverse geocoded should be returned without address instead of failing the request
+func TestImagesHandler_AddressFailure(t *testing.T) {
+	_, restore := stubGeocoding(`{"results":[],"status":"ZERO_RESULTS"}`)
+	defer restore()
+	defer withQuerier(&fakeQuerier{rows: [][]bigquery.Value{{"L1C_T32UNG_A012345_20171010T103021", "S2A_MSIL1C_20171010T103021"}}})()
+	FlushLinksCache()
+	defer FlushLinksCache()
+
+	rr := httptest.NewRecorder()
+	appHandler(images).ServeHTTP(rr, httptest.NewRequest("GET", "/images?lat=55.660797&lng=12.5896&format=address", nil))
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	response := map[string]interface{}{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if _, ok := response["address"]; ok {
+		t.Errorf("response has an address without reverse geocoding: %v", response)
+	}
+	if links, ok := response["links"].([]interface{}); !ok || len(links) != 1 {
+		t.Errorf("wrong links without address: %v", response["links"])
+	}
+}
@@ -0,0 +1,72 @@
+// Package satservice cors lets browsers call the API from the origins allowed by CORS_ALLOWED_ORIGINS
+// Without the environment variable no CORS headers are sent, i.e. browsers only allow same-origin requests
+package satservice
+
+import (
+	"net/http"
+	"os"
+	"strings"
+)
+
+// AllowedOrigins are the origins browsers may call the API from, e.g. CORS_ALLOWED_ORIGINS=https://example.com,https://maps.example.com
+// An origin of * allows all origins
+var AllowedOrigins = parseOrigins(os.Getenv("CORS_ALLOWED_ORIGINS"))
+
+// Methods and headers allowed in cross-origin requests, and headers of responses that browsers expose to scripts
+const (
+	corsAllowMethods  = "GET, POST, OPTIONS"
+	corsAllowHeaders  = "Accept, Content-Type"
+	corsExposeHeaders = "X-Coordinates"
+)
+
+// Parses a comma separated list of origins, ignoring empty entries
+func parseOrigins(origins string) []string {
+	allowed := []string{}
+	for _, origin := range strings.Split(origins, ",") {
+		if origin = strings.TrimSpace(origin); len(origin) > 0 {
+			allowed = append(allowed, origin)
+		}
+	}
+	return allowed
+}
+
+// Reports whether browsers may call the API from the origin
+func allowedOrigin(origin string) bool {
+	for _, allowed := range AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the request is a CORS preflight request, which browsers send before cross-origin requests
+func preflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && len(r.Header.Get("Origin")) > 0 && len(r.Header.Get("Access-Control-Request-Method")) > 0
+}
+
+// cors wraps a handler with CORS headers of allowed origins and answers preflight requests, which never reach the handler
+// Preflight requests of other origins are forbidden, and their other requests are passed to the handler without CORS headers, so browsers block the response
+func cors(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin") // Responses differ by origin, so shared caches must not serve them to other origins
+		origin := r.Header.Get("Origin")
+		if len(origin) == 0 || !allowedOrigin(origin) {
+			if preflight(r) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			handler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if preflight(r) {
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.WriteHeader(http.StatusNoContent) // Preflight request
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		handler.ServeHTTP(w, r)
+	})
+}
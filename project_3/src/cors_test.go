@@ -0,0 +1,103 @@
+// Package satservice : this contains unit tests of the CORS handling of cross-origin requests from browsers
+package satservice
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Handler that should only be reached by requests that are not preflight requests
+func okHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// A preflight request of an allowed origin should be answered with the allowed methods and headers
+func TestCORS_Preflight(t *testing.T) {
+	defer func(origins []string) { AllowedOrigins = origins }(AllowedOrigins)
+	AllowedOrigins = parseOrigins("https://example.com, https://maps.example.com")
+
+	req := httptest.NewRequest("OPTIONS", "/images", nil)
+	req.Header.Set("Origin", "https://maps.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	rr := httptest.NewRecorder()
+	cors(http.HandlerFunc(okHandler)).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNoContent {
+		t.Errorf("preflight returned wrong status code: got %v want %v", status, http.StatusNoContent)
+	}
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":  "https://maps.example.com",
+		"Access-Control-Allow-Methods": corsAllowMethods,
+		"Access-Control-Allow-Headers": corsAllowHeaders,
+	}
+	for header, value := range expected {
+		if got := rr.Header().Get(header); got != value {
+			t.Errorf("wrong %v: got %q want %q", header, got, value)
+		}
+	}
+}
+
+// Requests of origins that are not allowed, or of any origin without allowed origins, should get no CORS headers
+func TestCORS_DisallowedOrigin(t *testing.T) {
+	defer func(origins []string) { AllowedOrigins = origins }(AllowedOrigins)
+	for _, origins := range []string{"https://example.com", ""} {
+		AllowedOrigins = parseOrigins(origins)
+
+		req := httptest.NewRequest("GET", "/images", nil)
+		req.Header.Set("Origin", "https://evil.example.org")
+		rr := httptest.NewRecorder()
+		cors(http.HandlerFunc(okHandler)).ServeHTTP(rr, req)
+
+		if got := rr.Header().Get("Access-Control-Allow-Origin"); len(got) > 0 {
+			t.Errorf("disallowed origin got CORS header with allowed origins %q: %v", origins, got)
+		}
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("request was not passed to the handler: got %v want %v", status, http.StatusOK)
+		}
+	}
+}
+
+// A preflight request of an origin that is not allowed should be forbidden without reaching the handler
+func TestCORS_DisallowedPreflight(t *testing.T) {
+	defer func(origins []string) { AllowedOrigins = origins }(AllowedOrigins)
+	for _, origins := range []string{"https://example.com", ""} {
+		AllowedOrigins = parseOrigins(origins)
+
+		req := httptest.NewRequest("OPTIONS", "/images", nil)
+		req.Header.Set("Origin", "https://evil.example.org")
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		rr := httptest.NewRecorder()
+		called := false
+		cors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true })).ServeHTTP(rr, req)
+
+		if called {
+			t.Errorf("preflight of a disallowed origin reached the handler with allowed origins %q", origins)
+		}
+		if status := rr.Code; status != http.StatusForbidden {
+			t.Errorf("preflight returned wrong status code with allowed origins %q: got %v want %v", origins, status, http.StatusForbidden)
+		}
+		if got := rr.Header().Get("Access-Control-Allow-Origin"); len(got) > 0 {
+			t.Errorf("disallowed preflight got CORS header with allowed origins %q: %v", origins, got)
+		}
+	}
+}
+
+// Responses of allowed, disallowed and missing origins should all vary by origin, so shared caches keep them apart
+func TestCORS_VaryOrigin(t *testing.T) {
+	defer func(origins []string) { AllowedOrigins = origins }(AllowedOrigins)
+	AllowedOrigins = parseOrigins("https://example.com")
+
+	for _, origin := range []string{"https://example.com", "https://evil.example.org", ""} {
+		req := httptest.NewRequest("GET", "/images", nil)
+		if len(origin) > 0 {
+			req.Header.Set("Origin", origin)
+		}
+		rr := httptest.NewRecorder()
+		cors(http.HandlerFunc(okHandler)).ServeHTTP(rr, req)
+
+		if vary := rr.Header().Get("Vary"); vary != "Origin" {
+			t.Errorf("wrong Vary of origin %q: got %q want %q", origin, vary, "Origin")
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// Package satservice csv encodes granules as CSV with a header row, so analysts can pipe results into spreadsheets
+package satservice
+
+import (
+	"encoding/csv"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// FormatCSV is the format query parameter value of CSV responses, e.g. &format=csv
+const FormatCSV = "csv"
+
+// Writes the records as a CSV attachment with the given file name, where the first record is the header row
+func writeCSV(w http.ResponseWriter, filename string, records [][]string) *appError {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	writer := csv.NewWriter(w)
+	if err := writer.WriteAll(records); err != nil { // WriteAll flushes the records
+		return &appError{err, "Unable to encode CSV", http.StatusInternalServerError}
+	}
+	return nil // Success
+}
+
+// Returns the records of links (i.e. granule ids) with a granule_id header row
+func linksCSV(links Links) [][]string {
+	records := [][]string{{"granule_id"}}
+	for _, link := range links {
+		records = append(records, []string{link})
+	}
+	return records
+}
+
+// Returns the records of the metadata of granules with a granule_id,base_url,cloud_cover,sensing_time header row
+func granulesCSV(granules []GranuleMetadata) [][]string {
+	records := [][]string{{"granule_id", "base_url", "cloud_cover", "sensing_time"}}
+	for _, granule := range granules {
+		cloudCover := "" // Unknown cloud cover is an empty field rather than 0, which would read as cloudless
+		if granule.CloudCover != nil {
+			cloudCover = strconv.FormatFloat(*granule.CloudCover, 'f', -1, 64)
+		}
+		records = append(records, []string{
+			granule.GranuleID,
+			granule.BaseURL,
+			cloudCover,
+			granule.SensingTime.UTC().Format(time.RFC3339),
+		})
+	}
+	return records
+}
@@ -0,0 +1,84 @@
+// Package satservice : this contains unit tests of the CSV encoding of granules
+package satservice
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// The CSV of links should have a header row and a row per link of the JSON result
+func TestWriteCSV_Links(t *testing.T) {
+	links := Links{"L1C_T32UNG_A012345_20171010T103021", "L1C_T33UUB_A012345_20171010T103021", "L1C_T32UPG_A012345_20171010T103021"}
+	jsonRecorder := httptest.NewRecorder()
+	if err := writeLinks(jsonRecorder, links, Sentinel2, httptest.NewRequest("GET", "/images", nil)); err != nil {
+		t.Fatalf("Failed to write JSON: %v", err.Error)
+	}
+	var jsonLinks Links
+	if err := json.NewDecoder(jsonRecorder.Body).Decode(&jsonLinks); err != nil {
+		t.Fatalf("Failed to decode JSON: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	if err := writeCSV(rr, "images.csv", linksCSV(links)); err != nil {
+		t.Fatalf("Failed to write CSV: %v", err.Error)
+	}
+	if contentType := rr.Header().Get("Content-Type"); contentType != "text/csv" {
+		t.Errorf("wrong content type: got %v want text/csv", contentType)
+	}
+	if disposition := rr.Header().Get("Content-Disposition"); disposition != `attachment; filename="images.csv"` {
+		t.Errorf("wrong content disposition: %v", disposition)
+	}
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to parse CSV: %v", err)
+	}
+	if len(records) != len(jsonLinks)+1 || records[0][0] != "granule_id" {
+		t.Fatalf("wrong records: got %v want header and %v rows", records, len(jsonLinks))
+	}
+	for i, link := range jsonLinks {
+		if records[i+1][0] != link {
+			t.Errorf("wrong row %v: got %v want %v", i, records[i+1], link)
+		}
+	}
+}
+
+// The CSV of the granules of an area should have the richer header row and a row per granule
+func TestWriteCSV_Granules(t *testing.T) {
+	sensed := time.Date(2017, 10, 10, 10, 30, 21, 0, time.UTC)
+	granules, err := readGranulesMetadata(&fakeRows{rows: [][]bigquery.Value{
+		{"L1C_T32UNG_A012345_20171010T103021", "gs://gcp-public-data-sentinel-2/tiles/32/U/NG/S2A.SAFE", sensed, 12.5, 55.9, 54.9, 12.6, 10.9},
+		{"L1C_T33UUB_A012345_20171010T103021", "gs://gcp-public-data-sentinel-2/tiles/33/U/UB/S2A.SAFE", sensed, nil, 55.9, 54.9, 13.5, 11.8},
+	}})
+	if err != nil {
+		t.Fatalf("Failed to read granules: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	if err := writeCSV(rr, "area.csv", granulesCSV(granules)); err != nil {
+		t.Fatalf("Failed to write CSV: %v", err.Error)
+	}
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to parse CSV: %v", err)
+	}
+	expected := [][]string{
+		{"granule_id", "base_url", "cloud_cover", "sensing_time"},
+		{"L1C_T32UNG_A012345_20171010T103021", "gs://gcp-public-data-sentinel-2/tiles/32/U/NG/S2A.SAFE", "12.5", "2017-10-10T10:30:21Z"},
+		{"L1C_T33UUB_A012345_20171010T103021", "gs://gcp-public-data-sentinel-2/tiles/33/U/UB/S2A.SAFE", "", "2017-10-10T10:30:21Z"},
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("wrong number of records: got %v want %v", len(records), len(expected))
+	}
+	for i := range expected {
+		for j := range expected[i] {
+			if records[i][j] != expected[i][j] {
+				t.Errorf("wrong field %v of record %v: got %v want %v", j, i, records[i][j], expected[i][j])
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Package satservice : datasets are the BigQuery indices of satellite images that can be queried, i.e. Sentinel-2 and Landsat 8
+package satservice
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Dataset is a BigQuery index of satellite images together with the details in which the indices differ
+// The indices share the bounds, base_url, product_id, sensing_time and cloud_cover columns, so a new index only takes a Dataset
+type Dataset struct {
+	Name      string        // Value of the dataset query parameter
+	Satellite string        // Satellite that acquired the images, as returned to clients
+	Table     func() string // Quoted table of the index
+	IDColumn  string        // Column identifying an image product of the index, e.g. granule_id or scene_id
+	Footprint string        // Columns identifying the footprint shared by revisits of the same area, e.g. mgrs_tile
+	Condition string        // Condition selecting the rows of the dataset, if the table indexes other datasets as well
+	Flat      bool          // Images are stored right in the base url folder, rather than in GRANULE/<id>/IMG_DATA/ as with Sentinel-2
+}
+
+// LandsatTable is the fully-qualified Landsat index in the public BigQuery datasets
+var LandsatTable = "bigquery-public-data.cloud_storage_geo_index.landsat_index"
+
+// Datasets of the dataset query parameter, where Sentinel-2 is the default
+var (
+	Sentinel2 = &Dataset{Name: "sentinel2", Satellite: "sentinel-2", Table: sentinelTable, IDColumn: "granule_id", Footprint: "mgrs_tile"}
+	Landsat8  = &Dataset{
+		Name:      "landsat8",
+		Satellite: "landsat-8",
+		Table:     func() string { return "`" + LandsatTable + "`" },
+		IDColumn:  "scene_id",
+		Footprint: "wrs_path, wrs_row",
+		Condition: "spacecraft_id = 'LANDSAT_8'",
+		Flat:      true,
+	}
+)
+
+// Datasets are the selectable datasets keyed by name
+var Datasets = map[string]*Dataset{Sentinel2.Name: Sentinel2, Landsat8.Name: Landsat8}
+
+// Parses the dataset query parameter, where no dataset means Sentinel-2
+func parseDataset(r *http.Request) (*Dataset, *appError) {
+	name := strings.ToLower(r.Form.Get("dataset"))
+	if len(name) == 0 {
+		return Sentinel2, nil
+	}
+	dataset, ok := Datasets[name]
+	if !ok {
+		return nil, &appError{errors.New("Invalid dataset"), "Please provide a valid dataset, e.g. &dataset=sentinel2 or &dataset=landsat8", http.StatusBadRequest}
+	}
+	return dataset, nil
+}
+
+// Source identifies the dataset and satellite of the results of a response, so clients know what they got
+// It is embedded in every JSON object wrapping results
+type Source struct {
+	Dataset   string `json:"dataset"`
+	Satellite string `json:"satellite"`
+}
+
+// Returns the source of results of the dataset
+func (d *Dataset) source() Source {
+	return Source{Dataset: d.Name, Satellite: d.Satellite}
+}
+
+// Adds the condition of the dataset to the WHERE clause of a query of its table
+func (d *Dataset) where(query *bigquery.Query) *bigquery.Query {
+	if len(d.Condition) > 0 {
+		query.Q = strings.TrimSuffix(query.Q, ";") + "\n\t\t AND " + d.Condition + ";"
+	}
+	return query
+}
+
+// Returns the columns of the metadata of a granule, where the id column is that of the dataset
+func (d *Dataset) metadataColumns() string {
+	return d.IDColumn + strings.TrimPrefix(metadataColumns, "granule_id")
+}
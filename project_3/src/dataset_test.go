@@ -0,0 +1,101 @@
+// Package satservice : this contains unit tests of the datasets that can be queried
+package satservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Landsat 8 queries should select scenes of the Landsat index, and link to the base url folder of each scene
+func TestDataset_LandsatQuery(t *testing.T) {
+	fake := &fakeQuerier{rows: [][]bigquery.Value{{"LC80440342013089LGN01", "gs://gcp-public-data-landsat/LC08/01/044/034/LC08_L1GT_044034_20130330_20170310_01_T2", 38.5, 36.4, -121.1, -123.8}}}
+	defer withQuerier(fake)()
+	r := httptest.NewRequest("GET", "/area", nil)
+	maxCloud := 20.0
+	filter := GranuleFilter{MaxCloud: &maxCloud, Dataset: Landsat8}
+
+	links, _, _, err := getImageBaseURL(Box{South: 37.0, West: -122.5, North: 37.8, East: -122.0}, filter, Layout{}, r)
+	if err != nil {
+		t.Fatalf("Failed to query box: %v", err)
+	}
+	for _, part := range []string{"SELECT scene_id, base_url, " + boundsColumns, "FROM `bigquery-public-data.cloud_storage_geo_index.landsat_index`",
+		"AND spacecraft_id = 'LANDSAT_8'", "AND cloud_cover <= @maxCloud"} {
+		if !strings.Contains(fake.sql, part) {
+			t.Errorf("box query is missing %q: %v", part, fake.sql)
+		}
+	}
+	if strings.Contains(fake.sql, "granule_id") || strings.Contains(fake.sql, "sentinel_2_index") {
+		t.Errorf("box query refers to Sentinel-2: %v", fake.sql)
+	}
+	expected := Links{"gcp-public-data-landsat/LC08/01/044/034/LC08_L1GT_044034_20130330_20170310_01_T2/"}
+	if !reflect.DeepEqual(links, expected) {
+		t.Errorf("wrong image folders: got %v want %v", links, expected)
+	}
+
+	query, err := Landsat8.pointQuery(Landsat8.IDColumn+", product_id", "37.4", "-122.2")
+	if err != nil {
+		t.Fatalf("Failed to build point query: %v", err)
+	}
+	if !strings.HasPrefix(query.Q, "SELECT scene_id, product_id") || !strings.HasSuffix(query.Q, "AND spacecraft_id = 'LANDSAT_8';") {
+		t.Errorf("wrong point query: %v", query.Q)
+	}
+	if sentinel, _ := pointQuery("granule_id", "37.4", "-122.2"); strings.Contains(sentinel.Q, "spacecraft_id") {
+		t.Errorf("Sentinel-2 query has the condition of Landsat 8: %v", sentinel.Q)
+	}
+	if Landsat8.metadataColumns() != "scene_id, base_url, sensing_time, cloud_cover, "+boundsColumns {
+		t.Errorf("wrong metadata columns: %v", Landsat8.metadataColumns())
+	}
+	footprint := footprintQuery(Box{South: 37.0, West: -122.5, North: 37.8, East: -122.0}, filter)
+	if !strings.Contains(footprint.Q, "ARRAY_AGG(STRUCT(scene_id, base_url") || !strings.HasSuffix(footprint.Q, "GROUP BY wrs_path, wrs_row);") {
+		t.Errorf("wrong footprint query: %v", footprint.Q)
+	}
+}
+
+// Unknown datasets, and Sentinel-2 features with Landsat 8, should be rejected before querying
+func TestDataset_Invalid(t *testing.T) {
+	for _, query := range []string{"/images?lat=55.660797&lng=12.5896&dataset=modis", "/images?lat=55.660797&lng=12.5896&dataset=landsat8&level=L2A",
+		"/images?tiles=32UNG&dataset=landsat8", "/area?lat1=55.6&lng1=12.5&lat2=55.7&lng2=12.6&dataset=landsat8&level=L1C"} {
+		handler := images
+		if strings.HasPrefix(query, "/area") {
+			handler = area
+		}
+		rr := httptest.NewRecorder()
+		appHandler(handler).ServeHTTP(rr, httptest.NewRequest("GET", query, nil))
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code for %v: got %v want %v", query, status, http.StatusBadRequest)
+		}
+	}
+}
+
+// Responses should identify the dataset that was requested, where no dataset means Sentinel-2
+func TestDataset_ResponseSource(t *testing.T) {
+	cases := []struct {
+		dataset  string
+		expected Source
+	}{
+		{"", Source{Dataset: "sentinel2", Satellite: "sentinel-2"}},
+		{"&dataset=sentinel2", Source{Dataset: "sentinel2", Satellite: "sentinel-2"}},
+		{"&dataset=LANDSAT8", Source{Dataset: "landsat8", Satellite: "landsat-8"}},
+	}
+	for _, c := range cases {
+		defer withQuerier(&fakeQuerier{rows: [][]bigquery.Value{{int64(3)}}})()
+		rr := httptest.NewRecorder()
+		appHandler(area).ServeHTTP(rr, httptest.NewRequest("GET", "/area?lat1=37.0&lng1=-122.5&lat2=37.8&lng2=-122.0&count=true"+c.dataset, nil))
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("handler returned wrong status code for %q: got %v want %v", c.dataset, status, http.StatusOK)
+		}
+		response := AreaCount{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if response.Count != 3 || response.Source != c.expected {
+			t.Errorf("wrong response for %q: got %+v want source %+v", c.dataset, response, c.expected)
+		}
+	}
+}
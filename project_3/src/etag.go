@@ -0,0 +1,99 @@
+// Package satservice etag lets polling clients revalidate responses with If-None-Match instead of downloading them again
+package satservice
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// Returns the strong ETag of a response body, i.e. a quoted prefix of its SHA-256 hash
+func bodyETag(body []byte) string {
+	hash := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+// Reports whether an If-None-Match header (e.g. "a", W/"b" or *) matches the ETag, comparing weakly as required for GET
+func etagMatch(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// etagWriter buffers the response, so its ETag can be computed once the body is complete
+// Streamed responses (e.g. newline delimited JSON) are written through on the first flush and get no ETag
+type etagWriter struct {
+	http.ResponseWriter
+	code      int
+	body      bytes.Buffer
+	streaming bool
+}
+
+func (ew *etagWriter) WriteHeader(code int) {
+	if ew.streaming {
+		return
+	}
+	ew.code = code
+}
+
+func (ew *etagWriter) Write(b []byte) (int, error) {
+	if ew.streaming {
+		return ew.ResponseWriter.Write(b)
+	}
+	return ew.body.Write(b)
+}
+
+// Flush writes through the buffered response and all later writes
+func (ew *etagWriter) Flush() {
+	if !ew.streaming {
+		ew.streaming = true
+		ew.ResponseWriter.WriteHeader(ew.code)
+		ew.ResponseWriter.Write(ew.body.Bytes())
+		ew.body.Reset()
+	}
+	if flusher, ok := ew.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// etag wraps a handler of GET requests with an ETag of successful responses and answers matching If-None-Match with 304
+// The request is counted and logged with the status of the response sent to the client, i.e. 304 rather than the status of the handler
+func etag(fn appHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		instrument(w, r, withETag(fn.handle))
+	})
+}
+
+// Writes the response of handle with an ETag, or 304 if it matches If-None-Match
+func withETag(handle http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			handle(w, r)
+			return
+		}
+		ew := &etagWriter{ResponseWriter: w, code: http.StatusOK}
+		handle(ew, r)
+		if ew.streaming {
+			return
+		}
+		if ew.code == http.StatusOK {
+			tag := bodyETag(ew.body.Bytes())
+			w.Header().Set("ETag", tag)
+			if etagMatch(r.Header.Get("If-None-Match"), tag) {
+				for _, header := range []string{"Content-Type", "Content-Length", "Content-Disposition"} {
+					w.Header().Del(header)
+				}
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.WriteHeader(ew.code)
+		w.Write(ew.body.Bytes())
+	}
+}
@@ -0,0 +1,80 @@
+// Package satservice : this contains unit tests of revalidating responses with ETags
+package satservice
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A second request with the ETag of the first response should get 304 without a body and be counted as such, while a changed count should not
+func TestETag_NotModified(t *testing.T) {
+	defer func(count func(*http.Request, string, geoOptions) (RegionCount, *appError)) { countRegion = count }(countRegion)
+	FlushGeoCache()
+	defer FlushGeoCache()
+	total := 26
+	countRegion = func(r *http.Request, country string, options geoOptions) (RegionCount, *appError) {
+		return RegionCount{Total: total}, nil
+	}
+	defer func(recorder Recorder) { metrics = recorder }(metrics)
+	recorder := &fakeRecorder{requests: map[string]int{}}
+	metrics = recorder
+	handler := etag(appHandler(geo))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/geo?country=Denmark", nil))
+	tag := rr.Header().Get("ETag")
+	if status := rr.Code; status != http.StatusOK || len(tag) == 0 {
+		t.Fatalf("first request returned %v with ETag %q, want %v with an ETag", status, tag, http.StatusOK)
+	}
+
+	req := httptest.NewRequest("GET", "/geo?country=Denmark", nil)
+	req.Header.Set("If-None-Match", tag)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusNotModified {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotModified)
+	}
+	if rr.Body.Len() > 0 || rr.Header().Get("ETag") != tag {
+		t.Errorf("304 should have the ETag and no body: got ETag %q and body %q", rr.Header().Get("ETag"), rr.Body.String())
+	}
+	if count := recorder.requests["/geo 304"]; count != 1 {
+		t.Errorf("304 was not counted as sent: got %v requests with 304, counted %v", count, recorder.requests)
+	}
+
+	total = 27
+	req = httptest.NewRequest("GET", "/geo?country=Denmark&nocache=true", nil)
+	req.Header.Set("If-None-Match", tag)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK || !strings.Contains(rr.Body.String(), `"imageCount":27`) {
+		t.Errorf("changed response returned wrong response: got %v %v want %v with an image count of 27", status, rr.Body.String(), http.StatusOK)
+	}
+}
+
+// Errors should be written as they are, without an ETag
+func TestETag_Error(t *testing.T) {
+	rr := httptest.NewRecorder()
+	etag(appHandler(geo)).ServeHTTP(rr, httptest.NewRequest("GET", "/geo?country=../../etc", nil))
+	if status := rr.Code; status != http.StatusBadRequest || len(rr.Header().Get("ETag")) > 0 {
+		t.Errorf("handler returned %v with ETag %q, want %v without an ETag", status, rr.Header().Get("ETag"), http.StatusBadRequest)
+	}
+}
+
+// If-None-Match may list several ETags, weak ETags or *
+func TestETagMatch(t *testing.T) {
+	tag := `"abc"`
+	for header, expected := range map[string]bool{
+		`"abc"`:      true,
+		`"x", "abc"`: true,
+		`W/"abc"`:    true,
+		`*`:          true,
+		`"abcd"`:     false,
+		``:           false,
+	} {
+		if actual := etagMatch(header, tag); actual != expected {
+			t.Errorf("etagMatch(%q): got %v want %v", header, actual, expected)
+		}
+	}
+}
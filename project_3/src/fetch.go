@@ -0,0 +1,54 @@
+// Package satservice fetch is the shared HTTP client of calls to external APIs, i.e. the Geocoding API and Geofabrik
+// Calls time out after FETCH_TIMEOUT, so a hung endpoint cannot hold a request until the deadline of its route
+package satservice
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/urlfetch"
+)
+
+// Timeout of calls to external APIs when FETCH_TIMEOUT is not set
+const defaultFetchTimeout = 30 * time.Second
+
+// FetchTimeout bounds each call to an external API, e.g. FETCH_TIMEOUT=10s for 10 seconds
+var FetchTimeout = parseFetchTimeout(os.Getenv("FETCH_TIMEOUT"))
+
+// Parses the timeout of calls to external APIs, where an invalid timeout falls back to the default rather than never timing out
+func parseFetchTimeout(timeout string) time.Duration {
+	if len(timeout) == 0 {
+		return defaultFetchTimeout
+	}
+	duration, err := time.ParseDuration(timeout)
+	if err != nil || duration <= 0 {
+		log.Printf("Warning: invalid FETCH_TIMEOUT %q, calls to external APIs time out after %v", timeout, defaultFetchTimeout)
+		return defaultFetchTimeout
+	}
+	return duration
+}
+
+// FetchTransport configures the connections to external APIs, which are pooled across requests
+var FetchTransport = TransportConfig{MaxConnsPerHost: 0, MaxIdleConnsPerHost: 10, IdleConnTimeout: 90 * time.Second}
+
+// Creates an HTTP client whose calls time out after the given timeout
+func newFetchClient(timeout time.Duration, transport http.RoundTripper) *http.Client {
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+// sharedClient is the client of calls to external APIs, which tests replace to stub slow endpoints
+var sharedClient = newFetchClient(FetchTimeout, FetchTransport.transport())
+
+// Returns the client of calls to external APIs during a request
+// The first generation App Engine runtime can only call external APIs via urlfetch, whose transport is bound to the request,
+// so there a client is created for each call with the timeout of the shared client
+func fetchClient(ctx context.Context) *http.Client {
+	if appengine.IsStandard() && !appengine.IsSecondGen() {
+		return newFetchClient(sharedClient.Timeout, &urlfetch.Transport{Context: ctx})
+	}
+	return sharedClient
+}
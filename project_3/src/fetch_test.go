@@ -0,0 +1,60 @@
+// Package satservice : this contains unit tests of the shared HTTP client of calls to external APIs
+package satservice
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// slowTransport is an endpoint that never answers, until the call is cancelled
+type slowTransport struct{}
+
+func (slowTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	select {
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	case <-time.After(10 * time.Second):
+		return nil, http.ErrHandlerTimeout
+	}
+}
+
+// Calls to a slow Geocoding API or Geofabrik should time out after the timeout of the shared client
+func TestFetchClient_Timeout(t *testing.T) {
+	defer func(client *http.Client) { sharedClient = client }(sharedClient)
+	sharedClient = newFetchClient(50*time.Millisecond, slowTransport{})
+	ClearGeocodeCache()
+	defer ClearGeocodeCache()
+
+	calls := map[string]func() error{
+		"geocoding": func() error {
+			_, _, err := convertAddressToCoords("Rued Langgaards Vej 7", httptest.NewRequest("GET", "/images", nil))
+			return err
+		},
+		"geofabrik": func() error { // Not via parse, which retries failed downloads
+			_, err := polyClient(context.Background()).Get("http://download.geofabrik.de/europe/denmark.poly")
+			return err
+		},
+	}
+	for name, call := range calls {
+		start := time.Now()
+		if err := call(); err == nil {
+			t.Errorf("%v call to a slow endpoint did not fail", name)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("%v call to a slow endpoint did not time out promptly: took %v", name, elapsed)
+		}
+	}
+}
+
+// Invalid timeouts should fall back to the default timeout rather than never timing out
+func TestParseFetchTimeout(t *testing.T) {
+	for timeout, expected := range map[string]time.Duration{"": defaultFetchTimeout, "10s": 10 * time.Second, "1m": time.Minute,
+		"0": defaultFetchTimeout, "-5s": defaultFetchTimeout, "slow": defaultFetchTimeout} {
+		if actual := parseFetchTimeout(timeout); actual != expected {
+			t.Errorf("wrong timeout of %q: got %v want %v", timeout, actual, expected)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// Package satservice geojson encodes granules as GeoJSON (RFC 7946), so GIS clients can overlay results on a map
+package satservice
+
+// FormatGeoJSON is the format query parameter value of GeoJSON responses, e.g. &format=geojson
+const FormatGeoJSON = "geojson"
+
+// FeatureCollection is a GeoJSON collection of features, where the source of the features is a foreign member
+type FeatureCollection struct {
+	Type      string    `json:"type"`
+	Features  []Feature `json:"features"`
+	Truncated bool      `json:"truncated,omitempty"` // Granules beyond maxResults were dropped
+	Source
+}
+
+// Feature is a GeoJSON feature of a granule, where the granule id is a property
+type Feature struct {
+	Type       string            `json:"type"`
+	Geometry   Polygon           `json:"geometry"`
+	Properties map[string]string `json:"properties"`
+}
+
+// Polygon is a GeoJSON polygon geometry, where each ring is a closed list of [longitude, latitude] positions
+type Polygon struct {
+	Type        string         `json:"type"`
+	Coordinates [][][2]float64 `json:"coordinates"`
+}
+
+// Returns the bounding box of a granule as a polygon
+// The ring is counterclockwise as required for exterior rings, i.e. south-west, south-east, north-east, north-west
+func (g GranuleBounds) polygon() Polygon {
+	ring := [][2]float64{
+		{g.West, g.South},
+		{g.East, g.South},
+		{g.East, g.North},
+		{g.West, g.North},
+		{g.West, g.South}, // First and last position are the same
+	}
+	return Polygon{Type: "Polygon", Coordinates: [][][2]float64{ring}}
+}
+
+// Creates a feature collection where each granule of the dataset is a feature with its bounding box as geometry
+func newFeatureCollection(granules []GranuleBounds, dataset *Dataset) FeatureCollection {
+	collection := FeatureCollection{Type: "FeatureCollection", Features: []Feature{}, Source: dataset.source()}
+	for _, granule := range granules {
+		collection.Features = append(collection.Features, Feature{
+			Type:       "Feature",
+			Geometry:   granule.polygon(),
+			Properties: map[string]string{"granule_id": granule.GranuleID},
+		})
+	}
+	return collection
+}
@@ -0,0 +1,65 @@
+// Package satservice : this contains unit tests of the GeoJSON encoding of granules
+package satservice
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+// The granules of a region cover should be written as a valid GeoJSON FeatureCollection with one feature per unique granule
+func TestWriteGeoJSON(t *testing.T) {
+	imageCount := newRegionCount()
+	imageCount.add("4c", []GranuleBounds{
+		{GranuleID: "L1C_T32UNG_A012345_20171010T103021", North: 55.9, South: 54.9, East: 12.6, West: 10.9},
+		{GranuleID: "L1C_T33UUB_A012345_20171010T103021", North: 55.9, South: 54.9, East: 13.5, West: 11.8},
+	})
+	imageCount.add("54", []GranuleBounds{
+		{GranuleID: "L1C_T33UUB_A012345_20171010T103021", North: 55.9, South: 54.9, East: 13.5, West: 11.8},
+	})
+
+	rr := httptest.NewRecorder()
+	if err := writeGeoJSON(rr, newFeatureCollection(imageCount.uniqueGranules(), Sentinel2)); err != nil {
+		t.Fatalf("Failed to write GeoJSON: %v", err.Error)
+	}
+	if contentType := rr.Header().Get("Content-Type"); contentType != "application/geo+json" {
+		t.Errorf("wrong content type: got %v want application/geo+json", contentType)
+	}
+
+	var collection struct {
+		Type     string
+		Features []struct {
+			Type     string
+			Geometry struct {
+				Type        string
+				Coordinates [][][]float64
+			}
+			Properties map[string]interface{}
+		}
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&collection); err != nil {
+		t.Fatalf("Failed to decode GeoJSON: %v", err)
+	}
+	if collection.Type != "FeatureCollection" || len(collection.Features) != 2 {
+		t.Fatalf("wrong feature collection: got type %v with %v features want FeatureCollection with 2 features",
+			collection.Type, len(collection.Features))
+	}
+	for _, feature := range collection.Features {
+		if feature.Type != "Feature" || feature.Geometry.Type != "Polygon" || len(feature.Geometry.Coordinates) != 1 {
+			t.Errorf("feature is not a polygon: %+v", feature)
+			continue
+		}
+		ring := feature.Geometry.Coordinates[0]
+		if len(ring) < 4 || ring[0][0] != ring[len(ring)-1][0] || ring[0][1] != ring[len(ring)-1][1] {
+			t.Errorf("polygon ring is not closed: %v", ring)
+		}
+		for _, position := range ring {
+			if len(position) != 2 || position[0] < -180 || position[0] > 180 || position[1] < -90 || position[1] > 90 {
+				t.Errorf("position is not a longitude and latitude: %v", position)
+			}
+		}
+		if _, ok := feature.Properties["granule_id"].(string); !ok {
+			t.Errorf("feature has no granule id: %v", feature.Properties)
+		}
+	}
+}
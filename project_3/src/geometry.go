@@ -4,148 +4,855 @@
 package satservice
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
+	"math"
 	"net/http"
+	"os"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"cloud.google.com/go/bigquery"
-
-	"google.golang.org/appengine/urlfetch"
-
+	"github.com/golang/geo/r1"
+	"github.com/golang/geo/s1"
 	"github.com/golang/geo/s2"
+	"golang.org/x/sync/singleflight"
 )
 
-// Match floating point numbers with exponents using a regular expression
-// Match optional - or +, 0 or more digits, optional ".", 0 or more digits, exponent, - or +, 0 or more digits
-// Example: Longitude "8.552884E+00" and Latitude "5.491803E+01"
-const (
-	floatExponentPattern = "[-+]?[0-9]*\\.[0-9]+([eE][-+]?[0-9]+)?"
-	bucketGranuleSize    = 13 // TODO: Fetch size dynamically via API call to storage client
-)
+// Average number of images in a granule folder of the bucket, used when the images of granules could not be sampled
+const bucketGranuleSize = 13
+
+// GranuleSampleSize is the number of granules of a region whose image folders are listed to sample the number of images per granule
+var GranuleSampleSize = 3
+
+// GranuleSizeFallbackTTL is how long bucketGranuleSize is counted after a sample failed, before the granules are sampled again
+var GranuleSizeFallbackTTL = 5 * time.Minute
+
+// sampledGranuleSize caches the sampled number of images per granule, where 0 means not sampled yet
+// After a failed sample bucketGranuleSize is counted until fallbackUntil, rather than sampling again for every request
+var sampledGranuleSize struct {
+	sync.Mutex
+	images        int
+	fallbackUntil time.Time
+}
+
+// Sample of the images per granule in flight, which concurrent requests share instead of listing the same folders
+var granuleSizeFlights singleflight.Group
+
+// countGranuleImages counts the images of a granule by listing its image folder, which tests replace to fake the bucket
+var countGranuleImages = func(r *http.Request, granuleID string) (int, error) {
+	granule, err := getGranule(granuleID, r)
+	if err != nil {
+		return 0, err
+	}
+	lister, err := newObjectLister(r.Context())
+	if err != nil {
+		return 0, err
+	}
+	bucketName, objectName := splitLink(Layout{}.imageFolder(granule.BaseURL, granule.GranuleID))
+	images, _, err := getImagesFromBucket(lister, bucketName, objectName, ImageFilter{}, noLimit, r)
+	return len(images), err
+}
+
+// Returns the average number of images of a sample of the granules, which is cached once a sample succeeds
+// Without granules to sample, or when the sample fails, the cached size or else bucketGranuleSize is returned
+// The folders are listed without holding the cache, where concurrent requests share a single sample
+func imagesPerGranule(r *http.Request, granules []GranuleBounds) int {
+	if images, ok := cachedGranuleSize(time.Now()); ok {
+		return images
+	}
+	if len(granules) > GranuleSampleSize {
+		granules = granules[:GranuleSampleSize]
+	}
+	if len(granules) == 0 {
+		return bucketGranuleSize
+	}
+	images, err := shareFlight(r.Context(), &granuleSizeFlights, "sample", func(ctx context.Context) (interface{}, error) {
+		return sampleGranuleSize(r.WithContext(ctx), granules), nil
+	})
+	if err != nil {
+		return bucketGranuleSize // Request done before the sample
+	}
+	return images.(int)
+}
+
+// Returns the cached images per granule, which is bucketGranuleSize for GranuleSizeFallbackTTL after a failed sample
+func cachedGranuleSize(now time.Time) (int, bool) {
+	sampledGranuleSize.Lock()
+	defer sampledGranuleSize.Unlock()
+	if sampledGranuleSize.images > 0 {
+		return sampledGranuleSize.images, true
+	}
+	if now.Before(sampledGranuleSize.fallbackUntil) {
+		return bucketGranuleSize, true
+	}
+	return 0, false
+}
 
-// normalizeCoords is a helper function returns new slice containing result
-// of "normalizing" (i.e. removing the exponent) in parsed coordinates
-// Credits: https://gobyexample.com/collection-functions
-func normalizeCoords(vs []string, f func(string, int) (float64, error)) ([]float64, error) {
-	vsm := make([]float64, len(vs))
-	for i, v := range vs {
-		f, err := f(v, -1)
+// Lists the image folders of the granules and caches their rounded average number of images
+// When a folder cannot be listed, or all folders are empty, bucketGranuleSize is cached for GranuleSizeFallbackTTL instead
+func sampleGranuleSize(r *http.Request, granules []GranuleBounds) int {
+	images := 0
+	for _, granule := range granules {
+		n, err := countGranuleImages(r, granule.GranuleID)
 		if err != nil {
-			return nil, err
+			log.Printf("Could not sample images of granule %v, counting %v images per granule: %v", granule.GranuleID, bucketGranuleSize, err)
+			return fallbackGranuleSize(time.Now())
 		}
-		vsm[i] = f //strconv.FormatFloat(f, 'f', -1, 64)
+		images += n
+	}
+	if images == 0 {
+		return fallbackGranuleSize(time.Now()) // Empty folders are not representative
+	}
+	sampledGranuleSize.Lock()
+	defer sampledGranuleSize.Unlock()
+	sampledGranuleSize.images = (images + len(granules)/2) / len(granules) // Rounded average
+	return sampledGranuleSize.images
+}
+
+// Caches bucketGranuleSize as the images per granule for GranuleSizeFallbackTTL and returns it
+func fallbackGranuleSize(now time.Time) int {
+	sampledGranuleSize.Lock()
+	defer sampledGranuleSize.Unlock()
+	sampledGranuleSize.fallbackUntil = now.Add(GranuleSizeFallbackTTL)
+	return bucketGranuleSize
+}
+
+// CountryAliases maps common variants of country names to the slugs used by Geofabrik
+// Names are matched after lowercasing and collapsing whitespace, and unknown names fall back to space-to-hyphen
+var CountryAliases = map[string]string{
+	"great britain":            "great-britain",
+	"united kingdom":           "great-britain",
+	"uk":                       "great-britain",
+	"england":                  "great-britain",
+	"usa":                      "us",
+	"united states":            "us",
+	"united states of america": "us",
+	"holland":                  "netherlands",
+	"the netherlands":          "netherlands",
+	"czechia":                  "czech-republic",
+	"russian federation":       "russia",
+	"ireland":                  "ireland-and-northern-ireland",
+	"bosnia":                   "bosnia-herzegovina",
+	"bosnia and herzegovina":   "bosnia-herzegovina",
+}
+
+// normalizeCountry maps a user specified country (e.g. "Great Britain" or "USA") to its Geofabrik slug
+func normalizeCountry(country string) string {
+	name := strings.ToLower(strings.Join(strings.Fields(country), " "))
+	if slug, ok := CountryAliases[name]; ok {
+		return slug
 	}
-	return vsm, nil
+	return strings.Replace(name, " ", "-", -1)
+}
+
+// Continents are the regions of Geofabrik that contain countries, e.g. http://download.geofabrik.de/europe/denmark.poly
+var Continents = map[string]bool{
+	"africa":            true,
+	"antarctica":        true,
+	"asia":              true,
+	"australia-oceania": true,
+	"central-america":   true,
+	"europe":            true,
+	"north-america":     true,
+	"south-america":     true,
+}
+
+// Slugs of Geofabrik are lowercase words separated by hyphens, which rules out paths such as ../../etc
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// Normalizes a continent like a country, e.g. "North America" to north-america, and validates it against the known continents
+// An empty continent is valid, since Geofabrik also has .poly files of countries outside of continents
+func validContinent(continent string) (string, bool) {
+	if len(strings.TrimSpace(continent)) == 0 {
+		return "", true
+	}
+	slug := strings.Replace(strings.ToLower(strings.Join(strings.Fields(continent), " ")), " ", "-", -1)
+	return slug, Continents[slug]
+}
+
+// Reports whether the slug of a country is safe to interpolate into a Geofabrik URL
+func validCountry(country string) bool {
+	return slugPattern.MatchString(normalizeCountry(country))
+}
+
+// polyRing is a ring of coordinates of a section of a .poly file
+// Sections of holes (named !) are parsed like other rings, since regionPolygon finds holes from the nesting of the rings
+type polyRing struct {
+	points []s2.LatLng
 }
 
 // Fetch and parse PSLG data from Geofabrik, based on a country specified by the user
-func parse(r *http.Request, country, continent string) ([]float64, error) {
-	client := urlfetch.Client(r.Context())
+func parse(r *http.Request, country, continent string) ([]polyRing, error) {
+	client := polyClient(r.Context())
 	request := ""
+	country = normalizeCountry(country)
 
 	if len(continent) > 0 {
 		request = fmt.Sprintf("http://download.geofabrik.de/%s/%s.poly", continent, country)
 	} else {
 		request = fmt.Sprintf("http://download.geofabrik.de/%s.poly", country)
 	}
-	resp, err := client.Get(request)
+	key := continent + "/" + country
+	cached, ok := polygons.get(key)
+
+	// Revalidate the cached polygon, so the file is only downloaded again when Geofabrik has changed it
+	get := func() (*http.Response, error) {
+		req, err := http.NewRequest("GET", request, nil)
+		if err != nil {
+			return nil, err
+		}
+		if ok && len(cached.etag) > 0 {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if ok && len(cached.lastModified) > 0 {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+		return client.Do(req.WithContext(r.Context()))
+	}
+	// Serves the cached polygon when Geofabrik cannot be reached, since a stale polygon beats failing the request
+	stale := func(err error) ([]polyRing, error) {
+		if !ok {
+			return nil, err
+		}
+		log.Printf("Serving stale polygon of %s: %v", key, err)
+		return cached.rings, nil
+	}
+	resp, err := get()
 	// Retry if error
 	if err != nil {
-		err := retry(DefaultRetry().MaxRetries, DefaultRetry().Duration*time.Second, func() (err error) {
-			resp, err = client.Get(request)
+		err := retry(r.Context(), DefaultRetry(), func() (err error) {
+			resp, err = get()
 			return
 		})
 		if err != nil {
-			return nil, err
+			return stale(err)
 		}
 	}
 	defer resp.Body.Close()
+	if ok && resp.StatusCode == http.StatusNotModified {
+		return cached.rings, nil
+	}
+	// Geofabrik answers unknown countries with an HTML page, which is not a .poly file
+	if resp.StatusCode == http.StatusNotFound {
+		return stale(ErrUnknownRegion)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return stale(fmt.Errorf("could not download %s: %s", request, resp.Status))
+	}
 
-	regex := regexp.MustCompile(floatExponentPattern)
-	bytes, err := ioutil.ReadAll(resp.Body)
+	rings, err := parsePoly(resp.Body)
 	if err != nil {
-		return nil, err
+		return stale(err)
 	}
-	data := regex.FindAllString(string(bytes), -1)
-	countryCoords, err := normalizeCoords(data, strconv.ParseFloat)
-	if err != nil {
+	polygons.put(key, polyEntry{rings, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")})
+	return rings, nil
+}
+
+// ErrUnknownRegion is returned when Geofabrik has no .poly file of a country or continent
+var ErrUnknownRegion = errors.New("unknown country or continent")
+
+// polyClient creates the HTTP client used to download .poly files from Geofabrik, which tests replace with a stub
+var polyClient = fetchClient
+
+// A parsed .poly file and the validators Geofabrik returned with it
+type polyEntry struct {
+	rings        []polyRing
+	etag         string
+	lastModified string
+}
+
+// polyCache keeps parsed .poly files keyed by continent/country, safe for concurrent use by request goroutines
+type polyCache struct {
+	mu      sync.Mutex
+	entries map[string]polyEntry
+}
+
+// Cache of parsed .poly files, where entries are revalidated against Geofabrik instead of expiring
+var polygons = &polyCache{entries: map[string]polyEntry{}}
+
+func (c *polyCache) get(key string) (polyEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	return entry, ok
+}
+
+func (c *polyCache) put(key string, entry polyEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = entry
+}
+
+// PolyCacheSize returns the number of parsed .poly files in the cache
+func PolyCacheSize() int {
+	polygons.mu.Lock()
+	defer polygons.mu.Unlock()
+	return len(polygons.entries)
+}
+
+// ClearPolyCache removes all parsed .poly files from the cache
+func ClearPolyCache() {
+	polygons.mu.Lock()
+	defer polygons.mu.Unlock()
+	polygons.entries = map[string]polyEntry{}
+}
+
+// Parses the rings of a .poly file, which starts with a name followed by sections and ends with END
+// Each section starts with a name, where a name starting with ! is a hole, and ends with END
+// Each line of a section is a coordinate, i.e. a longitude and latitude such as "8.552884E+00   5.491803E+01"
+// Format: https://wiki.openstreetmap.org/wiki/Osmosis/Polygon_Filter_File_Format
+func parsePoly(reader io.Reader) ([]polyRing, error) {
+	scanner := bufio.NewScanner(reader)
+	lines := 0
+	next := func() (string, bool) {
+		for scanner.Scan() {
+			lines++
+			if line := strings.TrimSpace(scanner.Text()); len(line) > 0 {
+				return line, true
+			}
+		}
+		return "", false
+	}
+
+	if _, ok := next(); !ok { // Name of the file
+		return nil, errors.New("empty .poly file")
+	}
+	rings := []polyRing{}
+	for {
+		header, ok := next()
+		if !ok {
+			return nil, fmt.Errorf("missing END of .poly file at line %d", lines)
+		}
+		if header == "END" {
+			break
+		}
+
+		ring := polyRing{}
+		for {
+			line, ok := next()
+			if !ok {
+				return nil, fmt.Errorf("missing END of section %q at line %d", header, lines)
+			}
+			if line == "END" {
+				break
+			}
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("invalid coordinate %q at line %d", line, lines)
+			}
+			lng, lngErr := strconv.ParseFloat(fields[0], 64)
+			lat, latErr := strconv.ParseFloat(fields[1], 64)
+			if err := firstError(lngErr, latErr); err != nil {
+				return nil, fmt.Errorf("invalid coordinate %q at line %d", line, lines)
+			}
+			ring.points = append(ring.points, s2.LatLngFromDegrees(lat, lng))
+		}
+		rings = append(rings, ring)
+	}
+	if err := scanner.Err(); err != nil {
 		return nil, err
 	}
-	return countryCoords, nil
+	if len(rings) == 0 {
+		return nil, errors.New("no sections in .poly file")
+	}
+	return rings, nil
+}
+
+// Default max level and max cells of region covers, where a level 15 cell is roughly 0.08 km^2
+// The max cells of a request is limited, since each cell of a region cover is a separate BigQuery query
+const (
+	defaultMaxLevel = 15
+	defaultMaxCells = 100
+	maxMaxCells     = 1000
+)
+
+// MaxCoverCells is the ceiling of the max cells of any region cover, whatever the caller asks for, e.g. MAX_COVER_CELLS=500
+// Each cell is a goroutine and a BigQuery query, so a huge cover would exhaust memory and quota
+var MaxCoverCells = parseMaxCoverCells(os.Getenv("MAX_COVER_CELLS"))
+
+// Parses the ceiling of the max cells of region covers, where an unset or invalid ceiling falls back to maxMaxCells
+func parseMaxCoverCells(cells string) int {
+	if len(cells) == 0 {
+		return maxMaxCells
+	}
+	ceiling, err := strconv.Atoi(cells)
+	if err != nil || ceiling < 1 {
+		log.Printf("Warning: invalid MAX_COVER_CELLS %q, region covers have at most %d cells", cells, maxMaxCells)
+		return maxMaxCells
+	}
+	return ceiling
 }
 
-// Construct region cover from polygon, based on country coords
+// MinCellLevel is the floor of the max level of region covers
+// Coarser levels give huge cells, where each cell query scans an enormous area of the index
+var MinCellLevel = 6
+
+// clampMaxLevel limits a max level to the range from the MinCellLevel floor to the finest level of S2 cells
+func clampMaxLevel(maxLevel int) int {
+	if maxLevel < MinCellLevel || maxLevel > s2.MaxLevel {
+		clamped := clamp(maxLevel, MinCellLevel, s2.MaxLevel)
+		log.Printf("Max level %d is outside %d to %d, using %d instead", maxLevel, MinCellLevel, s2.MaxLevel, clamped)
+		return clamped
+	}
+	return maxLevel
+}
+
+// Construct region cover from polygon, based on the rings of a country (e.g. mainland and islands)
 // Region of country is approximated as unions of cells (CellUnion)
 // MaxLevel determines the granularity of cells covering regions, where 30 = 0,48 cm^2
 // MaxCells determines how many cells are used to cover the given region
-func regionCover(coords []float64, maxLevel, maxCells int) s2.CellUnion {
-	// Parse coordinates into points
-	points := []s2.Point{}
-	for len(coords) > 0 {
-		lat, lng := coords[0], coords[1]
-		p := s2.PointFromLatLng(s2.LatLngFromDegrees(lat, lng))
-		points = append(points, p)
-		coords = coords[2:] // Rest coords
-	}
-	// Construct loop representing spherical polygon and polygon from loop
-	l1 := s2.LoopFromPoints(points)
-	loops := []*s2.Loop{l1}
-	poly := s2.PolygonFromLoops(loops)
+// Max level is clamped to 0-30 and max cells to 1-MaxCoverCells, where the effective values are returned with the cover
+func regionCover(rings []polyRing, maxLevel, maxCells int) (s2.CellUnion, int, int) {
+	if maxLevel < 0 || maxLevel > s2.MaxLevel {
+		clamped := clamp(maxLevel, 0, s2.MaxLevel)
+		log.Printf("Max level %d is outside 0 to %d, using %d instead", maxLevel, s2.MaxLevel, clamped)
+		maxLevel = clamped
+	}
+	if maxCells < 1 || maxCells > MaxCoverCells {
+		clamped := clamp(maxCells, 1, MaxCoverCells)
+		log.Printf("Max cells %d is outside 1 to %d, using %d instead", maxCells, MaxCoverCells, clamped)
+		maxCells = clamped
+	}
+
+	poly := regionPolygon(rings)
 	// Construct region cover
 	rc := &s2.RegionCoverer{MaxLevel: maxLevel, MaxCells: maxCells}
 	cover := rc.Covering(poly)
-	return cover
+	return cover, maxLevel, maxCells
+}
+
+// Limits a value to the range from min to max
+func clamp(value, min, max int) int {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
+
+// Construct polygon of the region of a country from its rings
+func regionPolygon(rings []polyRing) *s2.Polygon {
+	// Construct a loop representing a spherical polygon of each ring and a polygon from the loops
+	// Holes are found by the polygon from the nesting of the loops
+	loops := []*s2.Loop{}
+	for _, ring := range rings {
+		points := []s2.Point{}
+		for _, latLng := range ring.points {
+			points = append(points, s2.PointFromLatLng(latLng))
+		}
+		if len(points) > 1 && points[0] == points[len(points)-1] {
+			points = points[:len(points)-1] // Rings of .poly files are closed, whereas loops are implicitly closed
+		}
+		if len(points) < 3 {
+			log.Printf("Skipping degenerate ring with %d points", len(points))
+			continue // A loop needs at least 3 vertices to enclose an area
+		}
+		loop := s2.LoopFromPoints(points)
+		if signedArea(ring.points) < 0 {
+			loop.Invert() // A clockwise loop would contain the whole sphere except the ring
+		}
+		loops = append(loops, loop)
+	}
+	return s2.PolygonFromLoops(loops)
+}
+
+// Computes the signed area of a ring in square degrees with the shoelace formula, where longitude is x and latitude is y
+// The area is positive for counter-clockwise rings and negative for clockwise rings
+func signedArea(points []s2.LatLng) float64 {
+	area := 0.0
+	for i := range points {
+		p, q := points[i], points[(i+1)%len(points)]
+		area += p.Lng.Degrees()*q.Lat.Degrees() - q.Lng.Degrees()*p.Lat.Degrees()
+	}
+	return area / 2
+}
+
+// Modes of counting the images of a country: each cell of its region cover, or the bounding box of its polygon
+const (
+	ModeCover = "cover"
+	ModeBBox  = "bbox"
+)
+
+// CoverMetadata describes the region cover of a count and the tradeoff of its parameters
+type CoverMetadata struct {
+	MaxLevel int    `json:"maxLevel"`
+	MaxCells int    `json:"maxCells"`
+	Cells    int    `json:"cells"`
+	Tradeoff string `json:"tradeoff"`
+}
+
+// CoverCell is a cell of a region cover, identified by its token, and its lat/lng bounds in degrees
+type CoverCell struct {
+	Token string  `json:"token"`
+	South float64 `json:"south"`
+	West  float64 `json:"west"`
+	North float64 `json:"north"`
+	East  float64 `json:"east"`
+}
+
+// Returns the bounds of a cell as queried by the WHERE clause of BigQuery, clamping latitudes to ±90°
+// Cells containing a pole meet every meridian, so they span all longitudes
+// Cells whose longitudes wrap around ±180° keep their inverted longitudes, which are queried on each side of the antimeridian
+func cellBounds(id s2.CellID) s2.Rect {
+	rect := s2.CellFromCellID(id).RectBound()
+	lat := r1.Interval{Lo: math.Max(rect.Lat.Lo, -math.Pi/2), Hi: math.Min(rect.Lat.Hi, math.Pi/2)}
+	if lat.Lo == -math.Pi/2 || lat.Hi == math.Pi/2 {
+		return s2.Rect{Lat: lat, Lng: s1.Interval{Lo: -math.Pi, Hi: math.Pi}}
+	}
+	return s2.Rect{Lat: lat, Lng: rect.Lng}
+}
+
+// Returns the cells of a region cover with their bounds, as queried by imagesByRegion
+func coverCells(cover s2.CellUnion) []CoverCell {
+	cells := []CoverCell{}
+	for _, id := range cover {
+		rect := cellBounds(id)
+		cells = append(cells, CoverCell{
+			Token: id.ToToken(),
+			South: rect.Lo().Lat.Degrees(),
+			West:  rect.Lo().Lng.Degrees(),
+			North: rect.Hi().Lat.Degrees(),
+			East:  rect.Hi().Lng.Degrees(),
+		})
+	}
+	return cells
+}
+
+// Tradeoff between accuracy and cost of the parameters of a region cover, as returned to clients
+const coverTradeoff = "Higher maxLevel and maxCells follow the border more closely, so fewer granules outside the area are counted, " +
+	"but each cell is a separate BigQuery query. Lower values are faster for large countries but overestimate the count."
+
+// Mean radius of the Earth in kilometers, used to convert areas of the unit sphere (steradians) to km²
+const earthMeanRadiusKm = 6371.0088
+
+// Converts an area of the unit sphere, as computed by S2, to km²
+func areaKm2(steradians float64) float64 {
+	return steradians * earthMeanRadiusKm * earthMeanRadiusKm
+}
+
+// RegionCount holds the number of images in a region cover, both in total and per cell keyed by cell token
+type RegionCount struct {
+	Total       int            `json:"imageCount"`
+	AreaKm2     float64        `json:"areaKm2"` // Area of the region cover, or of the polygon of the region in bbox mode
+	Cells       map[string]int `json:"cells,omitempty"`
+	Approximate bool           `json:"approximate,omitempty"`
+	Mode        string         `json:"mode,omitempty"` // Whether the region cover (cover) or its bounding box (bbox) was counted
+	Cover       *CoverMetadata `json:"cover,omitempty"`
+	CoverCells  []CoverCell    `json:"coverCells,omitempty"` // Cells of the region cover, only included for debugging
+	Source
+
+	granules    map[string]GranuleBounds     // Unique granules of region cover, keyed by granule id
+	emit        func(granuleID string) error // Called with each unique granule as it is added, if set, where an error stops the count
+	granuleSize int                          // Images counted per granule
+}
+
+// newRegionCount creates an empty count of images in a region cover
+func newRegionCount() RegionCount {
+	return RegionCount{Cells: map[string]int{}, granules: map[string]GranuleBounds{}, granuleSize: bucketGranuleSize}
+}
+
+// resize recounts the images of the granules counted so far with the given number of images per granule
+func (rc *RegionCount) resize(granuleSize int) {
+	for token, count := range rc.Cells {
+		rc.Cells[token] = count / rc.granuleSize * granuleSize
+	}
+	rc.Total = rc.Total / rc.granuleSize * granuleSize
+	rc.granuleSize = granuleSize
+}
+
+// add counts the images of the granules found in a cell
+// Granules already found in another cell overlapping the same granule are only counted once, i.e. in the first cell
+func (rc *RegionCount) add(token string, granules []GranuleBounds) error {
+	count, err := rc.addGranules(granules)
+	rc.Cells[token] += count // Cells without granules are included in the breakdown
+	return err
+}
+
+// addGranules counts the images of granules that are not counted yet and returns their count
+// Granules stop being added once emitting one fails, e.g. because the client of a stream disconnected
+func (rc *RegionCount) addGranules(granules []GranuleBounds) (int, error) {
+	count := 0
+	var err error
+	for _, granule := range granules {
+		if _, ok := rc.granules[granule.GranuleID]; ok {
+			continue
+		}
+		rc.granules[granule.GranuleID] = granule
+		count += rc.granuleSize
+		if rc.emit != nil {
+			if err = rc.emit(granule.GranuleID); err != nil {
+				break
+			}
+		}
+	}
+	rc.Total += count
+	return count, err
 }
 
 // Count satellite images associated to a country based on its polygon representation
 // Use region cover data in combination with "query.go" to query relevant images with the Storage bucket API
-func imagesByRegion(cover s2.CellUnion, r *http.Request) (int, error) {
+// If emit is set, it is called with each unique granule as soon as the cell of the granule is counted, and the count stops once it fails
+// The images per granule are sampled from the granules of the region, see imagesPerGranule
+func imagesByRegion(cover s2.CellUnion, emit func(granuleID string) error, r *http.Request) (RegionCount, error) {
+	imageCount, err := countCells(r.Context(), cover, emit, func(ctx context.Context, results chan cellGranules, errChan chan error, token, lat1, lng1, lat2, lng2 string) {
+		getImageCount(ctx, results, errChan, token, lat1, lng1, lat2, lng2)
+	})
+	if err != nil {
+		return imageCount, err
+	}
+	imageCount.resize(imagesPerGranule(r, imageCount.uniqueGranules()))
+	return imageCount, nil
+}
+
+// cellCounter queries the granules within the bounds of a cell, sending them on results or the error on errChan
+// The query should stop once the context is done
+type cellCounter func(ctx context.Context, results chan cellGranules, errChan chan error, token, lat1, lng1, lat2, lng2 string)
+
+// MaxCellQueries bounds the number of cells of a region cover queried concurrently
+// Each cell is a BigQuery query, so large covers would otherwise exceed the quota of concurrent queries
+var MaxCellQueries = 10
+
+// Counts the images of each cell of a region cover in parallel, where each cell is queried once
+// At most MaxCellQueries cells are queried at the same time
+// Once a cell fails, the remaining cells are not queried and the queries in flight are cancelled
+func countCells(ctx context.Context, cover s2.CellUnion, emit func(granuleID string) error, countCell cellCounter) (RegionCount, error) {
 	numberOfJobs := len(cover)
-	results := make(chan int, numberOfJobs)
-	errChan := make(chan error)
-	imageCount := 0
+	jobs := make(chan s2.CellID, numberOfJobs)
+	results := make(chan cellGranules, numberOfJobs) // Buffered so workers never block on a count that returned early
+	errChan := make(chan error, numberOfJobs)
+	imageCount := newRegionCount()
+	imageCount.emit = emit
 
-	client, err := bigquery.NewClient(r.Context(), projectID)
-	if err != nil {
-		return 0, err
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // Stops workers once the count returns
+
+	for _, id := range cover {
+		jobs <- id
+	}
+	close(jobs)
+	workers := MaxCellQueries
+	if numberOfJobs < workers {
+		workers = numberOfJobs // No idle workers
 	}
-	// Fetch image base links in parallel
-	for i := 0; i < len(cover); i++ {
-		c := s2.CellFromCellID(cover[i])
-		go getImageCount(client, r, results, errChan,
-			c.RectBound().Lo().Lat.String(),
-			c.RectBound().Lo().Lng.String(),
-			c.RectBound().Hi().Lat.String(),
-			c.RectBound().Hi().Lng.String())
+	// Fetch image base links in parallel, where each worker queries cells until all cells are queried
+	for i := 0; i < workers; i++ {
+		go func() {
+			var err error
+			defer func() {
+				if err != nil {
+					errChan <- err // Buffered for every cell, so a panicking worker never blocks
+				}
+			}()
+			defer recoverPanic(&err)
+			for id := range jobs {
+				if ctx.Err() != nil {
+					return // Count returned early
+				}
+				rect := cellBounds(id)
+				countCell(ctx, results, errChan, id.ToToken(),
+					rect.Lo().Lat.String(),
+					rect.Lo().Lng.String(),
+					rect.Hi().Lat.String(),
+					rect.Hi().Lng.String())
+			}
+		}()
 	}
 	// Await concurrent results on channel
 	for range cover {
 		select {
 		case err := <-errChan:
-			return 0, err
-		case count := <-results:
-			imageCount += count
+			return imageCount, err
+		case result := <-results:
+			if err := imageCount.add(result.token, result.granules); err != nil {
+				return imageCount, err // Cancels the cells in flight
+			}
 		}
 	}
-	close(results)
-	log.Printf("Granules in region cover: %v", imageCount)
-	return imageCount * bucketGranuleSize, nil
+	log.Printf("Granules in region cover: %v", len(imageCount.granules))
+	return imageCount, nil
+}
+
+// Returns the unique granules of the region cover ordered by granule id
+func (rc RegionCount) uniqueGranules() []GranuleBounds {
+	granules := make([]GranuleBounds, 0, len(rc.granules))
+	for _, granule := range rc.granules {
+		granules = append(granules, granule)
+	}
+	sort.Slice(granules, func(i, j int) bool { return granules[i].GranuleID < granules[j].GranuleID })
+	return granules
+}
+
+// Estimates count of images within the bounding box of a region cover with a single approximate query
+func estimateImagesByRegion(cover s2.CellUnion, r *http.Request) (RegionCount, error) {
+	rect := cover.RectBound()
+	granules, err := getImageEstimate(r,
+		rect.Lo().Lat.String(),
+		rect.Lo().Lng.String(),
+		rect.Hi().Lat.String(),
+		rect.Hi().Lng.String())
+	if err != nil {
+		return RegionCount{}, err
+	}
+	return RegionCount{Total: granules * imagesPerGranule(r, nil), Approximate: true}, nil
 }
 
-// Returns count of images within bounding box of country (for testing)
-// func imagesByBox(rect s2.Rect, r *http.Request) (Links, error) {
-// 	links, err := getImageBaseURL(rect.Lo().Lat.String(),
-// 		rect.Lo().Lng.String(),
-// 		rect.Hi().Lat.String(),
-// 		rect.Hi().Lng.String(), r)
+// Counts images within bounding box of country with a single query, which is much cheaper than counting each cell of a region cover
+// The count includes granules of the bounding box outside the country, so it is at least the count of the region cover
+func imagesByBox(rect s2.Rect, emit func(granuleID string) error, r *http.Request) (RegionCount, error) {
+	imageCount, err := countBox(r.Context(), rect, emit, func(ctx context.Context, results chan cellGranules, errChan chan error, token, lat1, lng1, lat2, lng2 string) {
+		getImageCount(ctx, results, errChan, token, lat1, lng1, lat2, lng2)
+	})
+	if err != nil {
+		return imageCount, err
+	}
+	imageCount.resize(imagesPerGranule(r, imageCount.uniqueGranules()))
+	return imageCount, nil
+}
+
+// Counts the images within a bounding box as a single cell, which is not included in the breakdown of cells
+func countBox(ctx context.Context, rect s2.Rect, emit func(granuleID string) error, countCell cellCounter) (RegionCount, error) {
+	results, errChan := make(chan cellGranules, 1), make(chan error, 1)
+	imageCount := newRegionCount()
+	imageCount.emit = emit
 
-// 	if err != nil {
-// 		return nil, err
-// 	}
+	countCell(ctx, results, errChan, "bbox",
+		rect.Lo().Lat.String(),
+		rect.Lo().Lng.String(),
+		rect.Hi().Lat.String(),
+		rect.Hi().Lng.String())
+	select {
+	case err := <-errChan:
+		return imageCount, err
+	case result := <-results:
+		if _, err := imageCount.addGranules(result.granules); err != nil {
+			return imageCount, err
+		}
+	}
+	return imageCount, nil
+}
+
+// MaxRadiusKm is the largest radius of a radius search around a point
+var MaxRadiusKm = 500.0
+
+// Limits of the cover of the cap of a radius search, which only decides which granules of its bounding box are within the radius
+const (
+	radiusCoverLevel = 12
+	radiusCoverCells = 32
+)
+
+// Returns the cap of all points on the Earth within a radius in km of a center
+func radiusCap(lat, lng, radiusKm float64) s2.Cap {
+	center := s2.PointFromLatLng(s2.LatLngFromDegrees(lat, lng))
+	return s2.CapFromCenterAngle(center, s1.Angle(radiusKm/earthMeanRadiusKm))
+}
+
+// Returns the bounds of a granule as a rectangle, where a granule whose west is east of its east crosses the antimeridian
+func granuleRect(granule GranuleBounds) s2.Rect {
+	return s2.Rect{
+		Lat: r1.Interval{Lo: (s1.Angle(granule.South) * s1.Degree).Radians(), Hi: (s1.Angle(granule.North) * s1.Degree).Radians()},
+		Lng: s1.IntervalFromEndpoints((s1.Angle(granule.West) * s1.Degree).Radians(), (s1.Angle(granule.East) * s1.Degree).Radians()),
+	}
+}
+
+// Returns the box of the bounds of a rectangle, where a rectangle whose longitudes wrap around ±180° crosses the antimeridian
+func rectBox(rect s2.Rect) Box {
+	return Box{South: rect.Lo().Lat.Degrees(), West: rect.Lo().Lng.Degrees(), North: rect.Hi().Lat.Degrees(), East: rect.Hi().Lng.Degrees()}
+}
 
-// 	return links, nil
-// }
+// Reports whether the bounds of a granule intersect any cell of a cover
+func intersectsCover(granule GranuleBounds, cover s2.CellUnion) bool {
+	rect := granuleRect(granule)
+	for _, id := range cover {
+		if rect.IntersectsCell(s2.CellFromCellID(id)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fetches the image folders of the granules within a radius in km of a point
+// The granules of the bounding box of the cap of the radius are queried as an area, keeping those that intersect a cover of the cap
+// A radius of 0 is the point itself, which finds the granules of the plain point query
+// Truncated tells whether the bounding box has more granules than maxResults, of which only the first are within the radius
+func getImagesByRadius(lat, lng string, radiusKm float64, filter GranuleFilter, r *http.Request) (Links, bool, error) {
+	latitude, latErr := strconv.ParseFloat(lat, 64)
+	longitude, lngErr := strconv.ParseFloat(lng, 64)
+	if err := firstError(latErr, lngErr); err != nil {
+		return nil, false, err
+	}
+	circle := radiusCap(latitude, longitude, radiusKm)
+	rect := circle.RectBound()
+	links, granules, truncated, err := getImageBaseURL(rectBox(rect), filter, Layout{}, r)
+	if err != nil {
+		return nil, false, err
+	}
+
+	cover := (&s2.RegionCoverer{MaxLevel: radiusCoverLevel, MaxCells: radiusCoverCells}).Covering(circle)
+	within := Links{}
+	for i, granule := range granules {
+		if intersectsCover(granule, cover) {
+			within = append(within, links[i])
+		}
+	}
+	log.Printf("Granules within %v km of latitude '%s' and longitude '%s': %d of %d in bounding box", radiusKm, lat, lng, len(within), len(links))
+	return within, truncated, nil
+}
+
+// NearestRadiusKm is the max distance in km from a point to the center of its nearest granule
+var NearestRadiusKm = 100.0
+
+// NearestGranule is the granule whose center is closest to a location, together with the great-circle distance to its center
+type NearestGranule struct {
+	GranuleID  string  `json:"granule_id"`
+	Link       string  `json:"link"`
+	DistanceKm float64 `json:"distanceKm"`
+	Source
+}
+
+// Returns the index of the granule whose center is closest to a point and the distance to its center in km
+// The index is -1 if there are no granules
+func nearestGranule(point s2.LatLng, granules []GranuleBounds) (int, float64) {
+	nearest, distance := -1, math.Inf(1)
+	for i, granule := range granules {
+		if d := point.Distance(granuleRect(granule).Center()).Radians() * earthMeanRadiusKm; d < distance {
+			nearest, distance = i, d
+		}
+	}
+	return nearest, distance
+}
+
+// Fetches the granule whose center is closest to a point, e.g. when the point itself has no coverage
+// The candidates are a granule of each footprint of the bounding box of the cap of NearestRadiusKm,
+// which contains every granule with a center within that radius
+// ErrNoGranules is returned if no granule has a center within NearestRadiusKm
+func getNearestGranule(lat, lng string, filter GranuleFilter, r *http.Request) (NearestGranule, error) {
+	latitude, latErr := strconv.ParseFloat(lat, 64)
+	longitude, lngErr := strconv.ParseFloat(lng, 64)
+	if err := firstError(latErr, lngErr); err != nil {
+		return NearestGranule{}, err
+	}
+	rect := radiusCap(latitude, longitude, NearestRadiusKm).RectBound()
+	links, granules, truncated, err := getFootprintGranules(rectBox(rect), filter, r)
+	if err != nil {
+		return NearestGranule{}, err
+	}
+	if truncated {
+		return NearestGranule{}, fmt.Errorf("more than %d footprints within %v km, the nearest granule is unknown", len(granules), NearestRadiusKm)
+	}
+
+	nearest, distance := nearestGranule(s2.LatLngFromDegrees(latitude, longitude), granules)
+	if nearest < 0 || distance > NearestRadiusKm {
+		return NearestGranule{}, ErrNoGranules
+	}
+	return NearestGranule{GranuleID: granules[nearest].GranuleID, Link: links[nearest], DistanceKm: distance}, nil
+}
@@ -0,0 +1,935 @@
+// Package satservice : this contains unit tests of the geometry helpers used to cover countries with S2 cells
+package satservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/golang/geo/s2"
+)
+
+// Creates granules with the given ids and empty bounds
+func granules(ids ...string) []GranuleBounds {
+	granules := []GranuleBounds{}
+	for _, id := range ids {
+		granules = append(granules, GranuleBounds{GranuleID: id})
+	}
+	return granules
+}
+
+// Counts per cell token should be kept apart and add up to the aggregate count of the region
+func TestRegionCount_CellBreakdown(t *testing.T) {
+	imageCount := newRegionCount()
+	imageCount.add("4c", granules("granule-1", "granule-2"))
+	imageCount.add("54", granules("granule-3", "granule-4", "granule-5"))
+	imageCount.add("4c", granules("granule-6"))
+
+	expected := map[string]int{"4c": 3 * bucketGranuleSize, "54": 3 * bucketGranuleSize}
+	sum := 0
+	for token, count := range imageCount.Cells {
+		if count != expected[token] {
+			t.Errorf("cell %v has wrong count: got %v want %v", token, count, expected[token])
+		}
+		sum += count
+	}
+	if len(imageCount.Cells) != len(expected) || sum != imageCount.Total {
+		t.Errorf("cell counts do not match aggregate: got %v want %v", sum, imageCount.Total)
+	}
+}
+
+// A granule shared by two overlapping cells should only be counted once
+func TestRegionCount_Deduplicate(t *testing.T) {
+	imageCount := newRegionCount()
+	imageCount.add("4c", granules("granule-1", "granule-2"))
+	imageCount.add("54", granules("granule-2", "granule-3"))
+
+	if expected := 3 * bucketGranuleSize; imageCount.Total != expected {
+		t.Errorf("shared granule counted twice: got %v want %v", imageCount.Total, expected)
+	}
+}
+
+// Replaces the count of images of granules and clears the sampled size until the returned function restores them
+func withGranuleImages(count func(r *http.Request, granuleID string) (int, error)) func() {
+	previous := countGranuleImages
+	countGranuleImages = count
+	sampledGranuleSize.images, sampledGranuleSize.fallbackUntil = 0, time.Time{}
+	return func() {
+		countGranuleImages = previous
+		sampledGranuleSize.images, sampledGranuleSize.fallbackUntil = 0, time.Time{}
+	}
+}
+
+// Sampled images per granule should replace the estimate of bucketGranuleSize, falling back to it when the sample fails
+func TestImagesPerGranule_Sample(t *testing.T) {
+	r := httptest.NewRequest("GET", "/geo", nil)
+	failed := 0
+	defer withGranuleImages(func(r *http.Request, granuleID string) (int, error) {
+		failed++
+		return 8, errors.New("bucket unavailable")
+	})()
+	for i := 0; i < 2; i++ {
+		if size := imagesPerGranule(r, granules("granule-1")); size != bucketGranuleSize {
+			t.Errorf("failed sample did not fall back: got %v want %v", size, bucketGranuleSize)
+		}
+	}
+	if failed != 1 {
+		t.Errorf("fallback of a failed sample was not cached: got %v samples want 1", failed)
+	}
+	sampledGranuleSize.fallbackUntil = time.Now().Add(-time.Second)
+	if imagesPerGranule(r, granules("granule-1")); failed != 2 {
+		t.Errorf("granules were not sampled again once the fallback expired: got %v samples want 2", failed)
+	}
+
+	sampled := map[string]bool{}
+	defer withGranuleImages(func(r *http.Request, granuleID string) (int, error) {
+		sampled[granuleID] = true
+		return map[string]int{"granule-1": 14, "granule-2": 15, "granule-3": 16}[granuleID], nil
+	})()
+	imageCount := newRegionCount()
+	imageCount.add("4c", granules("granule-1", "granule-2"))
+	imageCount.add("54", granules("granule-3", "granule-4"))
+	if estimated := 4 * bucketGranuleSize; imageCount.Total != estimated {
+		t.Errorf("wrong estimated count: got %v want %v", imageCount.Total, estimated)
+	}
+	imageCount.resize(imagesPerGranule(r, imageCount.uniqueGranules()))
+	if sampledCount := 4 * 15; imageCount.Total != sampledCount || imageCount.Cells["4c"] != 2*15 || imageCount.Cells["54"] != 2*15 {
+		t.Errorf("wrong sampled count: got %v %v want %v", imageCount.Total, imageCount.Cells, sampledCount)
+	}
+	if len(sampled) != GranuleSampleSize || sampled["granule-4"] {
+		t.Errorf("wrong granules sampled: %v", sampled)
+	}
+
+	delete(sampled, "granule-1")
+	if size := imagesPerGranule(r, granules("granule-1")); size != 15 || sampled["granule-1"] {
+		t.Errorf("sampled size was not cached: got %v", size)
+	}
+}
+
+// Concurrent requests should share a single sample, without blocking requests that do not sample on the folders being listed
+func TestImagesPerGranule_Concurrent(t *testing.T) {
+	r := httptest.NewRequest("GET", "/geo", nil)
+	var sampled int32
+	listing, release := make(chan struct{}, GranuleSampleSize), make(chan struct{})
+	defer withGranuleImages(func(r *http.Request, granuleID string) (int, error) {
+		atomic.AddInt32(&sampled, 1)
+		listing <- struct{}{}
+		<-release
+		return 14, nil
+	})()
+
+	var wg sync.WaitGroup
+	sizes := make(chan int, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sizes <- imagesPerGranule(r, granules("granule-1"))
+		}()
+	}
+	<-listing
+	done := make(chan int)
+	go func() { done <- imagesPerGranule(r, nil) }()
+	select {
+	case size := <-done:
+		if size != bucketGranuleSize {
+			t.Errorf("wrong size without granules: got %v want %v", size, bucketGranuleSize)
+		}
+	case <-time.After(time.Second):
+		t.Error("request without granules was blocked by a sample in flight")
+	}
+	time.Sleep(50 * time.Millisecond) // Other requests join the sample in flight
+	close(release)
+	wg.Wait()
+	close(sizes)
+	for size := range sizes {
+		if size != 14 {
+			t.Errorf("wrong sampled size: got %v want 14", size)
+		}
+	}
+	if sampled != 1 {
+		t.Errorf("concurrent requests did not share the sample: got %v listings want 1", sampled)
+	}
+}
+
+// Common variants of country names should map to the slugs used by Geofabrik
+func TestNormalizeCountry(t *testing.T) {
+	variants := map[string]string{
+		"Denmark":          "denmark",
+		"Great Britain":    "great-britain",
+		"united  kingdom":  "great-britain",
+		"USA":              "us",
+		" The Netherlands": "netherlands",
+		"Czech Republic":   "czech-republic",
+	}
+	for country, expected := range variants {
+		if slug := normalizeCountry(country); slug != expected {
+			t.Errorf("country %q normalized wrongly: got %q want %q", country, slug, expected)
+		}
+	}
+}
+
+// Continents should be normalized like countries and validated against the continents of Geofabrik
+func TestValidContinent(t *testing.T) {
+	valid := map[string]string{"": "", "europe": "europe", "North America": "north-america", " Australia  Oceania ": "australia-oceania"}
+	for continent, expected := range valid {
+		if slug, ok := validContinent(continent); !ok || slug != expected {
+			t.Errorf("continent %q validated wrongly: got %q %v want %q true", continent, slug, ok, expected)
+		}
+	}
+	for _, continent := range []string{"atlantis", "../europe", "europe/denmark"} {
+		if _, ok := validContinent(continent); ok {
+			t.Errorf("unknown continent %q accepted", continent)
+		}
+	}
+}
+
+// Countries that are not slugs of Geofabrik should be rejected before they are interpolated into a URL
+func TestValidCountry(t *testing.T) {
+	for _, country := range []string{"Denmark", "United Kingdom", "bosnia-herzegovina"} {
+		if !validCountry(country) {
+			t.Errorf("valid country %q rejected", country)
+		}
+	}
+	for _, country := range []string{"../../etc", "denmark.poly", "denmark?x=1", "-", "denmark/"} {
+		if validCountry(country) {
+			t.Errorf("invalid country %q accepted", country)
+		}
+	}
+}
+
+// A max level that is too coarse should be clamped to the minimum cell level and one that is too fine to the finest level
+// Levels in between are kept
+func TestClampMaxLevel(t *testing.T) {
+	for maxLevel, expected := range map[int]int{
+		MinCellLevel - 4: MinCellLevel,
+		-1:               MinCellLevel,
+		MinCellLevel:     MinCellLevel,
+		defaultMaxLevel:  defaultMaxLevel,
+		s2.MaxLevel:      s2.MaxLevel,
+		s2.MaxLevel + 1:  s2.MaxLevel,
+		1000:             s2.MaxLevel,
+	} {
+		if level := clampMaxLevel(maxLevel); level != expected {
+			t.Errorf("wrong clamped max level of %v: got %v want %v", maxLevel, level, expected)
+		}
+	}
+}
+
+// Each section of a .poly file should become its own ring, so islands are covered without connecting them to the mainland
+func TestParsePoly_TwoRings(t *testing.T) {
+	file, err := os.Open("testdata/two_rings.poly")
+	if err != nil {
+		t.Fatalf("Failed to open fixture: %v", err)
+	}
+	defer file.Close()
+
+	rings, err := parsePoly(file)
+	if err != nil {
+		t.Fatalf("Failed to parse fixture: %v", err)
+	}
+	if len(rings) != 2 || len(rings[0].points) != 5 || len(rings[1].points) != 5 {
+		t.Fatalf("wrong rings: got %v", rings)
+	}
+	if first := rings[0].points[0]; first.Lat.Degrees() != 55 || first.Lng.Degrees() != 10 {
+		t.Errorf("coordinate not read as longitude and latitude: got %v", first)
+	}
+
+	cover, _, _ := regionCover(rings, defaultMaxLevel, 100)
+	for _, point := range []s2.LatLng{s2.LatLngFromDegrees(55.5, 10.5), s2.LatLngFromDegrees(55.25, 12.25)} {
+		if !cover.ContainsPoint(s2.PointFromLatLng(point)) {
+			t.Errorf("cover does not contain %v of a ring", point)
+		}
+	}
+	if between := s2.LatLngFromDegrees(55.75, 11.75); cover.ContainsPoint(s2.PointFromLatLng(between)) {
+		t.Errorf("cover contains %v between the rings", between)
+	}
+}
+
+// A hole section should be subtracted from the ring it is nested in, so a point in the hole is outside the polygon
+func TestParsePoly_Hole(t *testing.T) {
+	file, err := os.Open("testdata/ring_with_hole.poly")
+	if err != nil {
+		t.Fatalf("Failed to open fixture: %v", err)
+	}
+	defer file.Close()
+
+	rings, err := parsePoly(file)
+	if err != nil {
+		t.Fatalf("Failed to parse fixture: %v", err)
+	}
+	polygon := regionPolygon(rings)
+	if ring := s2.LatLngFromDegrees(55.25, 10.25); !polygon.ContainsPoint(s2.PointFromLatLng(ring)) {
+		t.Errorf("polygon does not contain %v of the ring", ring)
+	}
+	if hole := s2.LatLngFromDegrees(56, 11); polygon.ContainsPoint(s2.PointFromLatLng(hole)) {
+		t.Errorf("polygon contains %v of the hole", hole)
+	}
+}
+
+// The area of a coarse outline of Denmark should be close to its land area of about 43,000 km², and its cover slightly larger
+func TestAreaKm2_Denmark(t *testing.T) {
+	file, err := os.Open("testdata/denmark.poly")
+	if err != nil {
+		t.Fatalf("Failed to open fixture: %v", err)
+	}
+	defer file.Close()
+	rings, err := parsePoly(file)
+	if err != nil {
+		t.Fatalf("Failed to parse fixture: %v", err)
+	}
+
+	polygon := areaKm2(regionPolygon(rings).Area())
+	if polygon < 35000 || polygon > 50000 {
+		t.Errorf("implausible area of polygon: got %.0f km²", polygon)
+	}
+	cover, _, _ := regionCover(rings, defaultMaxLevel, defaultMaxCells)
+	if area := areaKm2(cover.ApproxArea()); area < polygon || area > 2*polygon {
+		t.Errorf("implausible area of cover: got %.0f km² for a polygon of %.0f km²", area, polygon)
+	}
+}
+
+// Truncated or malformed .poly files should be rejected
+func TestParsePoly_Invalid(t *testing.T) {
+	for _, poly := range []string{"", "name\n1\n10.0 55.0\n", "name\n1\n10.0 north\nEND\nEND\n", "name\nEND\n", "name\n1\n10.0\nEND\nEND\n", "name\n1\n10.0 55.0 11.0\nEND\nEND\n"} {
+		if _, err := parsePoly(strings.NewReader(poly)); err == nil {
+			t.Errorf("parsed invalid .poly file %q", poly)
+		}
+	}
+}
+
+// A clockwise ring should cover the area of the ring rather than the rest of the globe
+func TestRegionCover_ClockwiseRing(t *testing.T) {
+	counterClockwise := polyRing{points: []s2.LatLng{
+		s2.LatLngFromDegrees(55, 10), s2.LatLngFromDegrees(55, 11), s2.LatLngFromDegrees(56, 11), s2.LatLngFromDegrees(56, 10),
+	}}
+	clockwise := polyRing{}
+	for i := len(counterClockwise.points) - 1; i >= 0; i-- {
+		clockwise.points = append(clockwise.points, counterClockwise.points[i])
+	}
+	if signedArea(clockwise.points) >= 0 || signedArea(counterClockwise.points) <= 0 {
+		t.Fatalf("wrong orientation: got %v and %v", signedArea(clockwise.points), signedArea(counterClockwise.points))
+	}
+
+	area := func(cover s2.CellUnion) float64 {
+		sum := 0.0
+		for _, id := range cover {
+			sum += s2.CellFromCellID(id).ApproxArea()
+		}
+		return sum
+	}
+	counterClockwiseCover, _, _ := regionCover([]polyRing{counterClockwise}, defaultMaxLevel, 100)
+	clockwiseCover, _, _ := regionCover([]polyRing{clockwise}, defaultMaxLevel, 100)
+	expected, got := area(counterClockwiseCover), area(clockwiseCover)
+	if got > 1.5*expected || got < expected/1.5 {
+		t.Errorf("clockwise ring covers wrong area: got %v steradians want about %v", got, expected)
+	}
+}
+
+// More cells in a region cover should issue more BigQuery queries, i.e. one query per cell
+func TestCountCells_MaxCells(t *testing.T) {
+	ring := polyRing{points: []s2.LatLng{
+		s2.LatLngFromDegrees(54.5, 8.0), s2.LatLngFromDegrees(54.5, 12.5), s2.LatLngFromDegrees(57.8, 12.5), s2.LatLngFromDegrees(57.8, 8.0),
+	}}
+	queries := map[int]int{}
+	for _, maxCells := range []int{4, 40} {
+		var mu sync.Mutex
+		cover, _, _ := regionCover([]polyRing{ring}, defaultMaxLevel, maxCells)
+		imageCount, err := countCells(context.Background(), cover, nil, func(ctx context.Context, results chan cellGranules, errChan chan error, token, lat1, lng1, lat2, lng2 string) {
+			mu.Lock()
+			queries[maxCells]++
+			mu.Unlock()
+			results <- cellGranules{token: token}
+		})
+		if err != nil {
+			t.Fatalf("Failed to count cells: %v", err)
+		}
+		if queries[maxCells] != len(cover) || len(imageCount.Cells) != len(cover) {
+			t.Errorf("wrong number of queries for %v max cells: got %v want %v", maxCells, queries[maxCells], len(cover))
+		}
+	}
+	if queries[4] >= queries[40] {
+		t.Errorf("more cells did not issue more queries: got %v for 4 and %v for 40 max cells", queries[4], queries[40])
+	}
+}
+
+// Once emitting a granule fails (e.g. the client of a stream disconnected), the count should stop with the error of the emit
+func TestCountCells_EmitFails(t *testing.T) {
+	ring := polyRing{points: []s2.LatLng{
+		s2.LatLngFromDegrees(54.5, 8.0), s2.LatLngFromDegrees(54.5, 12.5), s2.LatLngFromDegrees(57.8, 12.5), s2.LatLngFromDegrees(57.8, 8.0),
+	}}
+	cover, _, _ := regionCover([]polyRing{ring}, defaultMaxLevel, 20)
+	disconnected := errors.New("write: broken pipe")
+	emitted := 0
+	_, err := countCells(context.Background(), cover, func(granuleID string) error {
+		emitted++
+		return disconnected
+	}, func(ctx context.Context, results chan cellGranules, errChan chan error, token, lat1, lng1, lat2, lng2 string) {
+		results <- cellGranules{token: token, granules: granules(token+"-1", token+"-2")}
+	})
+	if err != disconnected {
+		t.Errorf("wrong error: got %v want %v", err, disconnected)
+	}
+	if emitted != 1 {
+		t.Errorf("granules were emitted after the emit failed: got %v emits want 1", emitted)
+	}
+}
+
+// Tokens of the debug cells should round-trip to the cells of the region cover, with bounds that contain each cell
+func TestCoverCells_Tokens(t *testing.T) {
+	ring := polyRing{points: []s2.LatLng{
+		s2.LatLngFromDegrees(54.5, 8.0), s2.LatLngFromDegrees(54.5, 12.5), s2.LatLngFromDegrees(57.8, 12.5), s2.LatLngFromDegrees(57.8, 8.0),
+	}}
+	cover, _, _ := regionCover([]polyRing{ring}, defaultMaxLevel, 20)
+	cells := coverCells(cover)
+
+	if len(cells) != len(cover) {
+		t.Fatalf("wrong number of cells: got %v want %v", len(cells), len(cover))
+	}
+	for i, cell := range cells {
+		id := s2.CellIDFromToken(cell.Token)
+		if id != cover[i] || !id.IsValid() {
+			t.Errorf("token %v does not round-trip: got %v want %v", cell.Token, id, cover[i])
+		}
+		center := s2.LatLngFromPoint(id.Point())
+		if center.Lat.Degrees() < cell.South || center.Lat.Degrees() > cell.North || center.Lng.Degrees() < cell.West || center.Lng.Degrees() > cell.East {
+			t.Errorf("bounds of cell %v do not contain its center %v: %+v", cell.Token, center, cell)
+		}
+	}
+}
+
+// Cells containing a pole should be queried with valid latitudes and the full band of longitudes
+func TestCellBounds_Polar(t *testing.T) {
+	for _, pole := range []float64{90, -90} {
+		id := s2.CellIDFromLatLng(s2.LatLngFromDegrees(pole, 0)).Parent(6)
+		var bounds []string
+		_, err := countCells(context.Background(), s2.CellUnion{id}, nil, func(ctx context.Context, results chan cellGranules, errChan chan error, token, lat1, lng1, lat2, lng2 string) {
+			bounds = []string{lat1, lng1, lat2, lng2}
+			results <- cellGranules{token: token}
+		})
+		if err != nil {
+			t.Fatalf("Failed to count cell: %v", err)
+		}
+
+		query, err := boxQuery("granule_id", bounds[0], bounds[1], bounds[2], bounds[3])
+		if err != nil {
+			t.Fatalf("Failed to build query of bounds %v: %v", bounds, err)
+		}
+		values := map[string]float64{}
+		for _, param := range query.Parameters {
+			values[param.Name] = param.Value.(float64)
+		}
+		if values["lng1"] != -180 || values["lng2"] != 180 {
+			t.Errorf("cell containing pole %v does not cover all longitudes: %v", pole, values)
+		}
+		if values["lat1"] < -90 || values["lat2"] > 90 || (pole > 0 && values["lat2"] != 90) || (pole < 0 && values["lat1"] != -90) {
+			t.Errorf("cell containing pole %v has invalid latitudes: %v", pole, values)
+		}
+	}
+
+	// Cells away from the poles keep their bounds
+	id := s2.CellIDFromLatLng(s2.LatLngFromDegrees(55.6, 12.5)).Parent(6)
+	if rect := cellBounds(id); rect != s2.CellFromCellID(id).RectBound() {
+		t.Errorf("bounds of cell %v changed: got %v want %v", id.ToToken(), rect, s2.CellFromCellID(id).RectBound())
+	}
+}
+
+// Cells crossing the antimeridian should be queried on each side of ±180° rather than across the full band of longitudes
+func TestCellBounds_Antimeridian(t *testing.T) {
+	id := s2.CellIDFromLatLng(s2.LatLngFromDegrees(-17, 180)).Parent(6)
+	rect := cellBounds(id)
+	if !rect.Lng.IsInverted() || rect.Lng.IsFull() {
+		t.Fatalf("bounds of cell %v do not cross the antimeridian: %v", id.ToToken(), rect)
+	}
+
+	spanning := []bigquery.Value{"L1C_T01KAB_A012345_20171010T103021", -16.2, -17.2, -179.2, 179.8}
+	sides := [][2]float64{}
+	defer withQuerier(querierFunc(func(params map[string]interface{}) [][]bigquery.Value {
+		sides = append(sides, [2]float64{params["lng1"].(float64), params["lng2"].(float64)})
+		return [][]bigquery.Value{spanning}
+	}))()
+	granules, err := queryCell(context.Background(), rect.Lo().Lat.String(), rect.Lo().Lng.String(), rect.Hi().Lat.String(), rect.Hi().Lng.String())
+	if err != nil {
+		t.Fatalf("Failed to query cell: %v", err)
+	}
+	if len(sides) != 2 || sides[0][0] <= 0 || sides[0][1] != 180 || sides[1][0] != -180 || sides[1][1] >= 0 {
+		t.Errorf("cell was not queried on each side of the antimeridian: %v", sides)
+	}
+	if len(granules) != 1 {
+		t.Errorf("granule found on both sides was not merged: %v", granules)
+	}
+}
+
+// fakeIndex is a fake sentinel-2 index of granules on a grid, answering cell queries with the granules that intersect the cell
+type fakeIndex []GranuleBounds
+
+// Creates granules of size x size degrees covering the given bounds
+func newFakeIndex(south, west, north, east, size float64) fakeIndex {
+	index := fakeIndex{}
+	for lat := south; lat < north; lat += size {
+		for lng := west; lng < east; lng += size {
+			index = append(index, GranuleBounds{GranuleID: fmt.Sprintf("%v,%v", lat, lng), South: lat, West: lng, North: lat + size, East: lng + size})
+		}
+	}
+	return index
+}
+
+func (index fakeIndex) countCell(ctx context.Context, results chan cellGranules, errChan chan error, token, lat1, lng1, lat2, lng2 string) {
+	bounds := []float64{}
+	for _, coord := range []string{lat1, lng1, lat2, lng2} {
+		value, err := strconv.ParseFloat(coord, 64)
+		if err != nil {
+			errChan <- err
+			return
+		}
+		bounds = append(bounds, value)
+	}
+	granules := []GranuleBounds{}
+	for _, granule := range index {
+		if bounds[0] < granule.North && granule.South < bounds[2] && bounds[1] < granule.East && granule.West < bounds[3] {
+			granules = append(granules, granule)
+		}
+	}
+	results <- cellGranules{token, granules}
+}
+
+// Counting the bounding box of a country should count at least the images of its region cover in a single query
+func TestCountBox_AtLeastCover(t *testing.T) {
+	triangle := polyRing{points: []s2.LatLng{
+		s2.LatLngFromDegrees(54.5, 8.0), s2.LatLngFromDegrees(54.5, 12.5), s2.LatLngFromDegrees(57.8, 8.0),
+	}}
+	index := newFakeIndex(54, 7, 58, 13, 0.5)
+
+	cover, _, _ := regionCover([]polyRing{triangle}, defaultMaxLevel, defaultMaxCells)
+	coverCount, err := countCells(context.Background(), cover, nil, index.countCell)
+	if err != nil {
+		t.Fatalf("Failed to count cover: %v", err)
+	}
+	queries := 0
+	boxCount, err := countBox(context.Background(), regionPolygon([]polyRing{triangle}).RectBound(), nil, func(ctx context.Context, results chan cellGranules, errChan chan error, token, lat1, lng1, lat2, lng2 string) {
+		queries++
+		index.countCell(ctx, results, errChan, token, lat1, lng1, lat2, lng2)
+	})
+	if err != nil {
+		t.Fatalf("Failed to count bounding box: %v", err)
+	}
+
+	if queries != 1 {
+		t.Errorf("wrong number of bounding box queries: got %v want 1", queries)
+	}
+	if boxCount.Total < coverCount.Total || coverCount.Total == 0 {
+		t.Errorf("bounding box count is below cover count: got %v want at least %v", boxCount.Total, coverCount.Total)
+	}
+	if len(boxCount.Cells) != 0 {
+		t.Errorf("bounding box count has cells: %v", boxCount.Cells)
+	}
+}
+
+// Querying a large region cover should never run more cell queries at the same time than the configured cap
+func TestCountCells_ConcurrencyCap(t *testing.T) {
+	defer func(max int) { MaxCellQueries = max }(MaxCellQueries)
+	MaxCellQueries = 5
+
+	cover := s2.CellUnion{}
+	id := s2.CellIDFromLatLng(s2.LatLngFromDegrees(55.660797, 12.5896)).Parent(10)
+	for i := 0; i < 50; i++ {
+		cover = append(cover, id)
+		id = id.Next()
+	}
+	var active, maxActive int32
+	imageCount, err := countCells(context.Background(), cover, nil, func(ctx context.Context, results chan cellGranules, errChan chan error, token, lat1, lng1, lat2, lng2 string) {
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		for {
+			max := atomic.LoadInt32(&maxActive)
+			if n <= max || atomic.CompareAndSwapInt32(&maxActive, max, n) {
+				break
+			}
+		}
+		time.Sleep(2 * time.Millisecond)
+		results <- cellGranules{token: token}
+	})
+	if err != nil {
+		t.Fatalf("Failed to count cells: %v", err)
+	}
+
+	if len(imageCount.Cells) != len(cover) {
+		t.Errorf("wrong number of cells counted: got %v want %v", len(imageCount.Cells), len(cover))
+	}
+	if maxActive > int32(MaxCellQueries) {
+		t.Errorf("too many concurrent cell queries: got %v want at most %v", maxActive, MaxCellQueries)
+	}
+}
+
+// A failing cell should stop the count without leaking the goroutines of the other cells
+func TestCountCells_NoLeakOnError(t *testing.T) {
+	cover := s2.CellUnion{}
+	id := s2.CellIDFromLatLng(s2.LatLngFromDegrees(55.660797, 12.5896)).Parent(10)
+	for i := 0; i < 50; i++ {
+		cover = append(cover, id)
+		id = id.Next()
+	}
+	failing := cover[0].ToToken()
+	before := runtime.NumGoroutine()
+
+	_, err := countCells(context.Background(), cover, nil, func(ctx context.Context, results chan cellGranules, errChan chan error, token, lat1, lng1, lat2, lng2 string) {
+		if token == failing {
+			errChan <- errors.New("Quota exceeded")
+			return
+		}
+		select {
+		case <-time.After(time.Second): // Slow query that is only finished early if cancelled
+			results <- cellGranules{token: token}
+		case <-ctx.Done():
+			errChan <- ctx.Err()
+		}
+	})
+	if err == nil || err.Error() != "Quota exceeded" {
+		t.Errorf("wrong error: got %v want Quota exceeded", err)
+	}
+
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("goroutines leaked: got %v after count want at most %v", after, before)
+	}
+}
+
+// geofabrikStub answers .poly downloads with a fixture and an ETag, or with 304 Not Modified when the client has the same ETag
+type geofabrikStub struct {
+	downloads, revalidations int
+	body                     string
+}
+
+func (s *geofabrikStub) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("If-None-Match") == `"v1"` {
+		s.revalidations++
+		return &http.Response{StatusCode: http.StatusNotModified, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+	}
+	s.downloads++
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Etag": {`"v1"`}},
+		Body:       ioutil.NopCloser(strings.NewReader(s.body)),
+		Request:    req,
+	}, nil
+}
+
+// A .poly file should only be downloaded once across two requests, where the second request revalidates the cached polygon
+func TestParse_Cache(t *testing.T) {
+	fixture, err := ioutil.ReadFile("testdata/two_rings.poly")
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %v", err)
+	}
+	stub := &geofabrikStub{body: string(fixture)}
+	defer func(client func(context.Context) *http.Client) { polyClient = client }(polyClient)
+	polyClient = func(ctx context.Context) *http.Client { return &http.Client{Transport: stub} }
+	ClearPolyCache()
+	defer ClearPolyCache()
+
+	for i := 0; i < 2; i++ {
+		rings, err := parse(httptest.NewRequest("GET", "/geo?country=denmark", nil), "denmark", "europe")
+		if err != nil {
+			t.Fatalf("Failed to parse: %v", err)
+		}
+		if len(rings) != 2 {
+			t.Errorf("wrong number of rings of request %v: got %v want 2", i+1, len(rings))
+		}
+	}
+	if stub.downloads != 1 || stub.revalidations != 1 {
+		t.Errorf("wrong requests to Geofabrik: got %v downloads and %v revalidations want 1 and 1", stub.downloads, stub.revalidations)
+	}
+	if size := PolyCacheSize(); size != 1 {
+		t.Errorf("wrong cache size: got %v want 1", size)
+	}
+}
+
+// unavailableStub answers every request like Geofabrik answers during an outage
+type unavailableStub struct{}
+
+func (unavailableStub) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusServiceUnavailable,
+		Status:     "503 Service Unavailable",
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+// A cached polygon should be served when the revalidation fails, while an uncached polygon still fails
+func TestParse_StaleIfError(t *testing.T) {
+	fixture, err := ioutil.ReadFile("testdata/two_rings.poly")
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %v", err)
+	}
+	defer func(client func(context.Context) *http.Client) { polyClient = client }(polyClient)
+	stub := &geofabrikStub{body: string(fixture)}
+	polyClient = func(ctx context.Context) *http.Client { return &http.Client{Transport: stub} }
+	ClearPolyCache()
+	defer ClearPolyCache()
+
+	if _, err := parse(httptest.NewRequest("GET", "/geo?country=denmark", nil), "denmark", "europe"); err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	polyClient = func(ctx context.Context) *http.Client { return &http.Client{Transport: unavailableStub{}} }
+	rings, err := parse(httptest.NewRequest("GET", "/geo?country=denmark", nil), "denmark", "europe")
+	if err != nil {
+		t.Fatalf("Failed to serve the cached polygon: %v", err)
+	}
+	if len(rings) != 2 {
+		t.Errorf("wrong number of rings: got %v want 2", len(rings))
+	}
+	if _, err := parse(httptest.NewRequest("GET", "/geo?country=sweden", nil), "sweden", "europe"); err == nil {
+		t.Error("uncached polygon should fail when Geofabrik is unavailable")
+	}
+}
+
+// notFoundStub answers every request like Geofabrik answers an unknown country
+type notFoundStub struct{}
+
+func (notFoundStub) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusNotFound,
+		Status:     "404 Not Found",
+		Header:     http.Header{"Content-Type": {"text/html"}},
+		Body:       ioutil.NopCloser(strings.NewReader("<html><body>Not Found 1.5 2.5</body></html>")),
+		Request:    req,
+	}, nil
+}
+
+// An unknown country should give a clear error instead of parsing the HTML page of Geofabrik
+func TestParse_NotFound(t *testing.T) {
+	defer func(client func(context.Context) *http.Client) { polyClient = client }(polyClient)
+	polyClient = func(ctx context.Context) *http.Client { return &http.Client{Transport: notFoundStub{}} }
+	ClearPolyCache()
+	defer ClearPolyCache()
+
+	if _, err := parse(httptest.NewRequest("GET", "/geo?country=atlantis", nil), "atlantis", ""); err != ErrUnknownRegion {
+		t.Errorf("wrong error: got %v want %v", err, ErrUnknownRegion)
+	}
+	if size := PolyCacheSize(); size != 0 {
+		t.Errorf("unknown country was cached: got cache size %v want 0", size)
+	}
+}
+
+// Rings with too few points to enclose an area should be skipped instead of breaking the region cover
+func TestRegionCover_DegenerateRing(t *testing.T) {
+	square := polyRing{points: []s2.LatLng{
+		s2.LatLngFromDegrees(55, 10), s2.LatLngFromDegrees(55, 11), s2.LatLngFromDegrees(56, 11), s2.LatLngFromDegrees(56, 10),
+	}}
+	degenerate := polyRing{points: []s2.LatLng{s2.LatLngFromDegrees(40, 0), s2.LatLngFromDegrees(40, 0)}}
+
+	expected, _, _ := regionCover([]polyRing{square}, defaultMaxLevel, defaultMaxCells)
+	if got, _, _ := regionCover([]polyRing{square, degenerate}, defaultMaxLevel, defaultMaxCells); !reflect.DeepEqual(got, expected) {
+		t.Errorf("degenerate ring changed the cover: got %v cells want %v", len(got), len(expected))
+	}
+	if got, _, _ := regionCover([]polyRing{degenerate}, defaultMaxLevel, defaultMaxCells); len(got) != 0 {
+		t.Errorf("degenerate ring was covered: got %v cells want 0", len(got))
+	}
+}
+
+// The ceiling of max cells should be read like the other limits, where an invalid ceiling falls back to the default
+func TestParseMaxCoverCells(t *testing.T) {
+	for cells, expected := range map[string]int{"": maxMaxCells, "500": 500, "0": maxMaxCells, "-1": maxMaxCells, "many": maxMaxCells} {
+		if actual := parseMaxCoverCells(cells); actual != expected {
+			t.Errorf("parseMaxCoverCells(%q): got %v want %v", cells, actual, expected)
+		}
+	}
+}
+
+// Absurd max levels and max cells should be clamped to 0-30 and 1-MaxCoverCells, and the cover should respect the clamped values
+func TestRegionCover_Clamp(t *testing.T) {
+	defer func(ceiling int) { MaxCoverCells = ceiling }(MaxCoverCells)
+	MaxCoverCells = 50
+	ring := polyRing{points: []s2.LatLng{
+		s2.LatLngFromDegrees(54.5, 8.0), s2.LatLngFromDegrees(54.5, 12.5), s2.LatLngFromDegrees(57.8, 12.5), s2.LatLngFromDegrees(57.8, 8.0),
+	}}
+	for _, c := range []struct{ maxLevel, maxCells, level, cells int }{
+		{1000, 1000000, s2.MaxLevel, 50},
+		{-5, -5, 0, 1},
+		{defaultMaxLevel, 20, defaultMaxLevel, 20},
+	} {
+		cover, level, cells := regionCover([]polyRing{ring}, c.maxLevel, c.maxCells)
+		if level != c.level || cells != c.cells {
+			t.Errorf("wrong effective values of %v and %v: got %v and %v want %v and %v", c.maxLevel, c.maxCells, level, cells, c.level, c.cells)
+		}
+		for _, id := range cover {
+			if id.Level() > level {
+				t.Errorf("cell at level %v exceeds the effective max level %v", id.Level(), level)
+			}
+		}
+	}
+}
+
+// A radius of 0 should find the granules of the plain point query, and radii out of bounds should be rejected
+func TestImagesByRadius_ZeroRadius(t *testing.T) {
+	FlushLinksCache()
+	defer FlushLinksCache()
+	// Index of granules answering point and box queries like BigQuery, by the bounds of each granule
+	index := [][]bigquery.Value{
+		{"L1C_T32UNG_A012345_20171010T103021", "gs://bucket/32UNG", 56.0, 55.0, 13.0, 12.0},
+		{"L1C_T32UPG_A012345_20171010T103021", "gs://bucket/32UPG", 56.0, 55.0, 14.5, 12.5},
+		{"L1C_T33UUB_A012345_20171010T103021", "gs://bucket/33UUB", 56.0, 55.0, 15.0, 13.0}, // Next to the point
+	}
+	defer withQuerier(querierFunc(func(params map[string]interface{}) [][]bigquery.Value {
+		var rows [][]bigquery.Value
+		for _, granule := range index {
+			north, south, east, west := granule[2].(float64), granule[3].(float64), granule[4].(float64), granule[5].(float64)
+			if lat, ok := params["lat"].(float64); ok { // Point query of granule ids
+				if lng := params["lng"].(float64); lat < north && south < lat && lng < east && west < lng {
+					rows = append(rows, []bigquery.Value{granule[0], "S2A_MSIL1C_20171010T103021"})
+				}
+				continue
+			}
+			if params["lat1"].(float64) < north && south < params["lat2"].(float64) && params["lng1"].(float64) < east && west < params["lng2"].(float64) {
+				rows = append(rows, granule)
+			}
+		}
+		return rows
+	}))()
+	r := httptest.NewRequest("GET", "/images", nil)
+
+	point, err := getLinks("55.660797", "12.5896", GranuleFilter{}, r)
+	if err != nil {
+		t.Fatalf("Failed to query point: %v", err)
+	}
+	radius, _, err := getImagesByRadius("55.660797", "12.5896", 0, GranuleFilter{}, r)
+	if err != nil {
+		t.Fatalf("Failed to query radius: %v", err)
+	}
+	granules := Links{}
+	for _, link := range radius {
+		parts := strings.Split(strings.TrimSuffix(link, "/IMG_DATA/"), "/GRANULE/")
+		granules = append(granules, parts[len(parts)-1])
+	}
+	sort.Strings(point)
+	sort.Strings(granules)
+	if len(point) != 2 || !reflect.DeepEqual(granules, point) {
+		t.Errorf("granules of radius 0 differ from the point query: got %v want %v", granules, point)
+	}
+
+	for _, radius := range []string{"-1", "501", "NaN", "far"} {
+		rr := httptest.NewRecorder()
+		appHandler(images).ServeHTTP(rr, httptest.NewRequest("GET", "/images?lat=55.660797&lng=12.5896&radiusKm="+radius, nil))
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code for radius %v: got %v want %v", radius, status, http.StatusBadRequest)
+		}
+	}
+}
+
+// Granules of the bounding box of a radius should only be kept if they are within the radius, also across the antimeridian
+func TestImagesByRadius_WithinRadius(t *testing.T) {
+	fake := &fakeQuerier{rows: [][]bigquery.Value{
+		{"near", "gs://bucket/near", 0.1, -0.1, 0.1, -0.1},
+		{"corner", "gs://bucket/corner", 0.9, 0.8, 0.9, 0.8}, // Within the bounding box of 100 km, but 126 km away
+	}}
+	defer withQuerier(fake)()
+	links, _, err := getImagesByRadius("0", "0", 100, GranuleFilter{}, httptest.NewRequest("GET", "/images", nil))
+	if err != nil {
+		t.Fatalf("Failed to query radius: %v", err)
+	}
+	if expected := (Links{"bucket/near/GRANULE/near/IMG_DATA/"}); !reflect.DeepEqual(links, expected) {
+		t.Errorf("wrong links within radius: got %v want %v", links, expected)
+	}
+
+	fake.rows = [][]bigquery.Value{{"fiji", "gs://bucket/fiji", -16.5, -17.5, -179.5, 179.5}}
+	if links, _, err = getImagesByRadius("-17", "179.9", 50, GranuleFilter{}, httptest.NewRequest("GET", "/images", nil)); err != nil {
+		t.Fatalf("Failed to query radius: %v", err)
+	}
+	if len(links) != 1 {
+		t.Errorf("wrong links within radius crossing the antimeridian: got %v", links)
+	}
+	if fake.params["lng1"].(float64) != -180 { // The last query is of the side west of the antimeridian
+		t.Errorf("radius crossing the antimeridian was not queried per side: %v", fake.params)
+	}
+}
+
+// The nearest granule should be the candidate with the minimum distance from the point to its center
+func TestNearestHandler_MinimumDistance(t *testing.T) {
+	rows := [][]bigquery.Value{
+		{"far", "gs://bucket/far", 56.5, 56.0, 13.5, 12.5},
+		{"near", "gs://bucket/near", 55.9, 55.0, 13.0, 12.0},
+		{"nearer-edge", "gs://bucket/nearer-edge", 55.7, 54.5, 14.5, 12.7}, // Has the nearest edge, but not the nearest center
+	}
+	fake := &fakeQuerier{rows: rows}
+	defer withQuerier(fake)()
+	rr := httptest.NewRecorder()
+	appHandler(nearest).ServeHTTP(rr, httptest.NewRequest("GET", "/nearest?lat=55.660797&lng=12.5896", nil))
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	for _, clause := range []string{"ARRAY_AGG(STRUCT(granule_id, base_url, " + boundsColumns + ") ORDER BY sensing_time DESC LIMIT 1)", "GROUP BY mgrs_tile"} {
+		if !strings.Contains(fake.sql, clause) {
+			t.Errorf("candidates were not queried once per tile, query does not contain %v: %v", clause, fake.sql)
+		}
+	}
+	response := NearestGranule{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	point := s2.LatLngFromDegrees(55.660797, 12.5896)
+	for _, row := range rows {
+		granule := GranuleBounds{GranuleID: row[0].(string), North: row[2].(float64), South: row[3].(float64), East: row[4].(float64), West: row[5].(float64)}
+		if distance := point.Distance(granuleRect(granule).Center()).Radians() * earthMeanRadiusKm; distance < response.DistanceKm {
+			t.Errorf("granule %v is nearer than %v: %v km < %v km", granule.GranuleID, response.GranuleID, distance, response.DistanceKm)
+		}
+	}
+	if response.GranuleID != "near" || response.Link != "bucket/near/GRANULE/near/IMG_DATA/" || response.Dataset != "sentinel2" {
+		t.Errorf("wrong nearest granule: %+v", response)
+	}
+
+	// Granules whose center is beyond the max radius are not near
+	defer withQuerier(&fakeQuerier{rows: [][]bigquery.Value{{"far", "gs://bucket/far", 57.5, 54.0, 17.0, 12.0}}})()
+	rr = httptest.NewRecorder()
+	appHandler(nearest).ServeHTTP(rr, httptest.NewRequest("GET", "/nearest?lat=55.660797&lng=12.5896", nil))
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code beyond %v km: got %v want %v", NearestRadiusKm, status, http.StatusNotFound)
+	}
+
+	// More footprints than the max results cannot tell the nearest granule
+	defer func(max int) { DefaultMaxResults = max }(DefaultMaxResults)
+	DefaultMaxResults = 2
+	defer withQuerier(&fakeQuerier{rows: rows})()
+	rr = httptest.NewRecorder()
+	appHandler(nearest).ServeHTTP(rr, httptest.NewRequest("GET", "/nearest?lat=55.660797&lng=12.5896", nil))
+	if status := rr.Code; status != http.StatusInternalServerError {
+		t.Errorf("handler returned wrong status code of truncated candidates: got %v want %v", status, http.StatusInternalServerError)
+	}
+}
+
+// Locations outside the coverage of Sentinel-2 should still look for the nearest granule, whereas invalid coordinates are rejected
+func TestNearestHandler_OutOfCoverage(t *testing.T) {
+	fake := &fakeQuerier{rows: [][]bigquery.Value{{"south", "gs://bucket/south", -55.5, -56.5, -68.0, -69.0}}}
+	defer withQuerier(fake)()
+	rr := httptest.NewRecorder()
+	appHandler(nearest).ServeHTTP(rr, httptest.NewRequest("GET", "/nearest?lat=-56.6&lng=-68.5", nil))
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code outside the coverage: got %v want %v", status, http.StatusOK)
+	}
+
+	rr = httptest.NewRecorder()
+	appHandler(nearest).ServeHTTP(rr, httptest.NewRequest("GET", "/nearest?lat=91&lng=-68.5", nil))
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code of an invalid latitude: got %v want %v", status, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,57 @@
+// Package satservice jsonp wraps JSON responses in a call of a callback (JSONP), for embedded map widgets that cannot use CORS
+package satservice
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Callbacks must be JavaScript identifiers, optionally separated by dots (e.g. maps.showImages), so they cannot inject script
+var callbackPattern = regexp.MustCompile(`^[a-zA-Z_$][0-9a-zA-Z_$]*(\.[a-zA-Z_$][0-9a-zA-Z_$]*)*$`)
+
+// Reports whether a callback is safe to write into a JavaScript response
+func validCallback(callback string) bool {
+	return len(callback) <= 128 && callbackPattern.MatchString(callback)
+}
+
+// jsonpWriter buffers the response, so a JSON body can be wrapped in a call of the callback once it is complete
+type jsonpWriter struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+// Creates a writer buffering the response written to w
+func newJSONPWriter(w http.ResponseWriter) *jsonpWriter {
+	return &jsonpWriter{ResponseWriter: w, code: http.StatusOK}
+}
+
+func (jw *jsonpWriter) WriteHeader(code int) {
+	jw.code = code
+}
+
+func (jw *jsonpWriter) Write(b []byte) (int, error) {
+	return jw.body.Write(b)
+}
+
+// Reports whether a media type is a single JSON document, e.g. application/json or application/geo+json but not NDJSON
+func jsonMediaType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// Writes the buffered response, where JSON is wrapped as callback(...) and other formats (e.g. CSV) are written as they are
+func (jw *jsonpWriter) finish(callback string) {
+	header := jw.ResponseWriter.Header()
+	body := jw.body.Bytes()
+	if jsonMediaType(header.Get("Content-Type")) {
+		header.Set("Content-Type", "application/javascript")
+		header.Set("X-Content-Type-Options", "nosniff")
+		body = append(append([]byte("/**/"+callback+"("), bytes.TrimSpace(body)...), ");"...)
+	}
+	jw.ResponseWriter.WriteHeader(jw.code)
+	jw.ResponseWriter.Write(body)
+}
@@ -0,0 +1,62 @@
+// Package satservice : this contains unit tests of wrapping JSON responses in a callback (JSONP)
+package satservice
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// A valid callback should wrap the JSON body in a call of the callback with the JavaScript media type
+func TestServeHTTP_JSONPCallback(t *testing.T) {
+	rr := httptest.NewRecorder()
+	appHandler(granule).ServeHTTP(rr, httptest.NewRequest("GET", "/granule?id=invalid&callback=maps.showGranule", nil))
+
+	if contentType := rr.Header().Get("Content-Type"); contentType != "application/javascript" {
+		t.Errorf("wrong content type: got %v want application/javascript", contentType)
+	}
+	body := rr.Body.String()
+	if !strings.HasPrefix(body, "/**/maps.showGranule({") || !strings.HasSuffix(body, "});") {
+		t.Errorf("body is not wrapped in the callback: %v", body)
+	}
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+}
+
+// Callbacks that are not JavaScript identifiers should be rejected instead of being written into the response
+func TestServeHTTP_MaliciousCallback(t *testing.T) {
+	for _, callback := range []string{"alert(document.cookie)//", "<script>", "a b", "1abc", "x;alert(1)"} {
+		rr := httptest.NewRecorder()
+		target := "/granule?id=invalid&callback=" + url.QueryEscape(callback)
+		appHandler(granule).ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code for %q: got %v want %v", callback, status, http.StatusBadRequest)
+		}
+		if contentType := rr.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("wrong content type for %q: got %v want application/json", callback, contentType)
+		}
+		if strings.Contains(rr.Body.String(), callback) {
+			t.Errorf("callback %q was written into the response: %v", callback, rr.Body.String())
+		}
+	}
+}
+
+// Only single JSON documents should be wrapped, since streamed NDJSON and CSV are not JavaScript expressions
+func TestJSONMediaType(t *testing.T) {
+	for contentType, expected := range map[string]bool{
+		"application/json":                true,
+		"application/geo+json":            true,
+		"application/json; charset=utf-8": true,
+		MediaTypeV2:                       true,
+		MediaTypeNDJSON:                   false,
+		"text/csv":                        false,
+	} {
+		if actual := jsonMediaType(contentType); actual != expected {
+			t.Errorf("jsonMediaType(%q): got %v want %v", contentType, actual, expected)
+		}
+	}
+}
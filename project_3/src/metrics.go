@@ -0,0 +1,133 @@
+// Package satservice metrics records request counts, query and storage latencies, retries and geocoding cache hits,
+// which are exposed to Prometheus at /metrics
+package satservice
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Recorder records operational metrics of the service, which tests replace to assert metrics without a real registry
+type Recorder interface {
+	Request(route string, code int)                        // Handled request and its status code
+	Query(query string, duration time.Duration, err error) // BigQuery query, e.g. point, box or cell
+	Storage(duration time.Duration, err error)             // Listing of the images of a bucket folder
+	Retry()                                                // Attempt after a failed attempt
+	GeocodeCache(hit bool)                                 // Lookup of the geocoding cache
+}
+
+// metrics is the recorder of the service, registered with the default Prometheus registry
+var metrics Recorder = newPrometheusRecorder(prometheus.DefaultRegisterer)
+
+// prometheusRecorder records metrics as Prometheus counters and histograms
+type prometheusRecorder struct {
+	requests      *prometheus.CounterVec
+	queries       *prometheus.HistogramVec
+	queryErrors   *prometheus.CounterVec
+	storage       *prometheus.HistogramVec
+	retries       prometheus.Counter
+	geocodeLookup *prometheus.CounterVec
+}
+
+// Creates the Prometheus metrics of the service and registers them with the registerer
+func newPrometheusRecorder(registerer prometheus.Registerer) *prometheusRecorder {
+	p := &prometheusRecorder{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "satservice_requests_total",
+			Help: "Number of handled requests by route and status code.",
+		}, []string{"route", "code"}),
+		queries: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "satservice_bigquery_query_duration_seconds",
+			Help:    "Duration of BigQuery queries by query.",
+			Buckets: prometheus.ExponentialBuckets(0.25, 2, 10), // 0.25s to 2 minutes
+		}, []string{"query"}),
+		queryErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "satservice_bigquery_query_errors_total",
+			Help: "Number of failed BigQuery queries by query.",
+		}, []string{"query"}),
+		storage: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "satservice_storage_list_duration_seconds",
+			Help:    "Duration of listing the images of a bucket folder by result.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"result"}),
+		retries: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "satservice_retries_total",
+			Help: "Number of attempts after a failed attempt.",
+		}),
+		geocodeLookup: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "satservice_geocode_cache_lookups_total",
+			Help: "Number of lookups of the geocoding cache by result, i.e. hit or miss.",
+		}, []string{"result"}),
+	}
+	registerer.MustRegister(p.requests, p.queries, p.queryErrors, p.storage, p.retries, p.geocodeLookup)
+	return p
+}
+
+func (p *prometheusRecorder) Request(route string, code int) {
+	p.requests.WithLabelValues(route, strconv.Itoa(code)).Inc()
+}
+
+func (p *prometheusRecorder) Query(query string, duration time.Duration, err error) {
+	p.queries.WithLabelValues(query).Observe(duration.Seconds())
+	if err != nil {
+		p.queryErrors.WithLabelValues(query).Inc()
+	}
+}
+
+func (p *prometheusRecorder) Storage(duration time.Duration, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	p.storage.WithLabelValues(result).Observe(duration.Seconds())
+}
+
+func (p *prometheusRecorder) Retry() {
+	p.retries.Inc()
+}
+
+func (p *prometheusRecorder) GeocodeCache(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	p.geocodeLookup.WithLabelValues(result).Inc()
+}
+
+// Records the duration of a query that started at the given time, once its error is known
+func observeQuery(query string, start time.Time, err *error) {
+	metrics.Query(query, time.Since(start), *err)
+}
+
+// Records the duration of listing the images of a bucket folder that started at the given time, once its error is known
+func observeStorage(start time.Time, err *error) {
+	metrics.Storage(time.Since(start), *err)
+}
+
+// statusWriter remembers the status code and size written to the response, so the request can be counted by status code and logged
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+	size int // Bytes of the body written so far
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	sw.code = code
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	n, err := sw.ResponseWriter.Write(b)
+	sw.size += n
+	return n, err
+}
+
+// Flush lets streamed responses (e.g. newline delimited JSON) flush through the status writer
+func (sw *statusWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,327 @@
+// Package satservice openapi describes the routes of the service as an OpenAPI 3 document, served on /openapi.json
+// Response schemas are generated from the Go types the handlers encode, so the document follows changes of the responses
+package satservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// OpenAPI is an OpenAPI 3 document, limited to the parts describing the routes of the service
+type OpenAPI struct {
+	OpenAPI string              `json:"openapi"`
+	Info    OpenAPIInfo         `json:"info"`
+	Paths   map[string]PathItem `json:"paths"`
+}
+
+// OpenAPIInfo is the title and version of the API
+type OpenAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+// PathItem is the operations of a route
+type PathItem struct {
+	Get  *Operation `json:"get,omitempty"`
+	Post *Operation `json:"post,omitempty"`
+}
+
+// Operation is a request of a route, i.e. its query parameters, body and responses by status code
+type Operation struct {
+	Summary     string              `json:"summary"`
+	Parameters  []Parameter         `json:"parameters,omitempty"`
+	RequestBody *RequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]Response `json:"responses"`
+}
+
+// Parameter is a query parameter of an operation
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+// RequestBody is the JSON body of an operation
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+// Response is a response of an operation
+type Response struct {
+	Description string               `json:"description"`
+	Headers     map[string]Header    `json:"headers,omitempty"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+// Header is a header of a response
+type Header struct {
+	Description string  `json:"description"`
+	Schema      *Schema `json:"schema"`
+}
+
+// MediaType is the schema of a body of a media type
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Schema is a JSON schema of a parameter or body
+type Schema struct {
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+}
+
+// Returns the schema of the JSON encoding of a value, where the properties of a struct are its JSON fields
+// Fields of embedded structs (e.g. Source) are properties of the embedding struct, as encoding/json flattens them
+func schemaOf(value interface{}) *Schema {
+	return schemaOfType(reflect.TypeOf(value))
+}
+
+func schemaOfType(t reflect.Type) *Schema {
+	switch {
+	case t == reflect.TypeOf(time.Time{}):
+		return &Schema{Type: "string", Format: "date-time"}
+	case t == reflect.TypeOf(json.Number("")):
+		return &Schema{Type: "number"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOfType(t.Elem())
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: schemaOfType(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: schemaOfType(t.Elem())}
+	case reflect.Struct:
+		schema := &Schema{Type: "object", Properties: map[string]*Schema{}}
+		addProperties(schema, t)
+		return schema
+	}
+	return &Schema{}
+}
+
+// Adds the JSON fields of a struct type as properties of the schema
+func addProperties(schema *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" || (len(field.PkgPath) > 0 && !field.Anonymous) {
+			continue // Not encoded
+		}
+		if field.Anonymous && len(name) == 0 && field.Type.Kind() == reflect.Struct {
+			addProperties(schema, field.Type)
+			continue
+		}
+		if len(name) == 0 {
+			name = field.Name
+		}
+		schema.Properties[name] = schemaOfType(field.Type)
+	}
+}
+
+// Returns a query parameter of the given type, e.g. number or string
+func queryParam(name, schemaType, description string) Parameter {
+	return Parameter{Name: name, In: "query", Description: description, Schema: &Schema{Type: schemaType}}
+}
+
+// Returns a required query parameter of the given type
+func requiredParam(name, schemaType, description string) Parameter {
+	param := queryParam(name, schemaType, description)
+	param.Required = true
+	return param
+}
+
+// Returns the responses of an operation, i.e. a JSON response of the schemas and the error responses of appError
+func jsonResponses(description string, schemas ...*Schema) map[string]Response {
+	schema := schemas[0]
+	if len(schemas) > 1 {
+		schema = &Schema{OneOf: schemas}
+	}
+	errorContent := map[string]MediaType{"application/json": {Schema: schemaOf(errorResponse{})}}
+	return map[string]Response{
+		"200": {Description: description, Content: map[string]MediaType{"application/json": {Schema: schema}}},
+		"400": {Description: "Invalid query parameters", Content: errorContent},
+		"500": {Description: "Internal server error", Content: errorContent},
+	}
+}
+
+// Adds the X-Coordinates header of normalizeCoordinates to the successful response
+func withCoordinatesHeader(responses map[string]Response) map[string]Response {
+	ok := responses["200"]
+	ok.Headers = map[string]Header{"X-Coordinates": {
+		Description: "Comma separated coordinates of the request as queried, rounded to the coordinate precision",
+		Schema:      &Schema{Type: "string"},
+	}}
+	responses["200"] = ok
+	return responses
+}
+
+// Query parameters filtering the granules, as parsed by parseGranuleFilter
+var filterParams = []Parameter{
+	queryParam("maxCloud", "number", "Maximum cloud cover percentage (0-100)"),
+	queryParam("from", "string", "Earliest sensing time, e.g. 2017-01-01 or RFC 3339"),
+	queryParam("to", "string", "Latest sensing time, e.g. 2017-12-31 or RFC 3339"),
+	{Name: "sort", In: "query", Description: "Sort order of the granules", Schema: &Schema{Type: "string", Enum: []string{SortSensingTimeAsc, SortSensingTimeDesc, SortCloudCoverAsc}}},
+	{Name: "dataset", In: "query", Description: "Dataset of the images", Schema: &Schema{Type: "string", Enum: []string{Sentinel2.Name, Landsat8.Name}}},
+}
+
+// Query parameters of a point of the routes without geocoding
+var pointParams = []Parameter{
+	requiredParam("lat", "number", "Latitude of the location"),
+	requiredParam("lng", "number", "Longitude of the location"),
+}
+
+// Query parameters of a location, either coordinates or an address
+var locationParams = []Parameter{
+	queryParam("lat", "number", "Latitude of the location"),
+	queryParam("lng", "number", "Longitude of the location"),
+	queryParam("address", "string", "Address of the location, geocoded instead of lat and lng"),
+}
+
+// Returns the parameters of the groups of parameters in order
+func params(groups ...[]Parameter) []Parameter {
+	all := []Parameter{}
+	for _, group := range groups {
+		all = append(all, group...)
+	}
+	return all
+}
+
+// Returns the OpenAPI document of the routes of the service
+func openAPIDocument() OpenAPI {
+	imageLinks := schemaOf(Links{})
+	return OpenAPI{
+		OpenAPI: "3.0.3",
+		Info:    OpenAPIInfo{Title: "Satellite image service", Version: Version},
+		Paths: map[string]PathItem{
+			"/images": {
+				Get: &Operation{
+					Summary: "Links (i.e. granule ids) of the satellite images of a location",
+					Parameters: params(locationParams, filterParams, []Parameter{
+						queryParam("level", "string", "Processing level of the granules, L1C or L2A"),
+						queryParam("tile", "string", "MGRS tile, e.g. 33UUB, queried instead of a location"),
+						queryParam("tiles", "string", "Comma separated MGRS tiles, e.g. 32UNG, queried instead of a location"),
+						queryParam("latest", "boolean", "Only the most recently sensed granule"),
+						queryParam("resolve", "boolean", "Image folders of the granules instead of granule ids"),
+						queryParam("radiusKm", "number", "Image folders of the granules within the radius of the location"),
+						queryParam("limit", "integer", "Page size of the links"),
+						queryParam("offset", "integer", "Offset of the page of links"),
+						{Name: "format", In: "query", Schema: &Schema{Type: "string", Enum: []string{FormatAddress, FormatCSV}}},
+						queryParam("v", "integer", "Version of the response, where 2 wraps the links in an envelope"),
+					}),
+					Responses: withCoordinatesHeader(jsonResponses("Links of the location", imageLinks, schemaOf(LinksResponse{}), schemaOf(AddressLinks{}), schemaOf(LatestGranule{}), schemaOf(LinksPage{}))),
+				},
+				Post: &Operation{
+					Summary:     "Links of a batch of points",
+					Parameters:  filterParams,
+					RequestBody: &RequestBody{Required: true, Content: map[string]MediaType{"application/json": {Schema: schemaOf(PointsRequest{})}}},
+					Responses:   jsonResponses("Links of each point keyed by its index", schemaOf(map[string]PointLinks{})),
+				},
+			},
+			"/area": {
+				Get: &Operation{
+					Summary: "Number of satellite images within an area of opposite corners",
+					Parameters: params([]Parameter{
+						queryParam("lat1", "number", "Latitude of a corner"),
+						queryParam("lng1", "number", "Longitude of a corner"),
+						queryParam("lat2", "number", "Latitude of the opposite corner"),
+						queryParam("lng2", "number", "Longitude of the opposite corner"),
+						queryParam("address1", "string", "Address of a corner, geocoded instead of lat1 and lng1"),
+						queryParam("address2", "string", "Address of the opposite corner, geocoded instead of lat2 and lng2"),
+						queryParam("antimeridian", "boolean", "Area between the longitudes of the corners across ±180° instead"),
+						queryParam("input_crs", "string", "CRS of the corners, e.g. 4326 or 3857"),
+						queryParam("bands", "string", "Comma separated bands of the images, e.g. B04,B08"),
+						queryParam("resolution", "integer", "Resolution of the L2A images in meters (10, 20 or 60)"),
+						queryParam("level", "string", "Processing level of the granules, L1C or L2A"),
+						queryParam("count", "boolean", "Number of image folders instead of images"),
+						{Name: "format", In: "query", Schema: &Schema{Type: "string", Enum: []string{FormatGeoJSON, FormatCSV}}},
+					}, filterParams),
+					Responses: withCoordinatesHeader(jsonResponses("Number of images of the area", &Schema{Type: "integer"}, schemaOf(AreaCount{}), schemaOf(FeatureCollection{}))),
+				},
+			},
+			"/geo": {
+				Get: &Operation{
+					Summary: "Number of satellite images of a country, counted within the bounding box or region cover of the country",
+					Parameters: []Parameter{
+						requiredParam("country", "string", "Comma separated countries, e.g. denmark"),
+						queryParam("continent", "string", "Continent of the countries, e.g. europe"),
+						{Name: "breakdown", In: "query", Schema: &Schema{Type: "string", Enum: []string{"cell"}}},
+						queryParam("maxLevel", "integer", "Max level of the cells of the region cover"),
+						queryParam("maxCells", "integer", "Max number of cells of the region cover"),
+						queryParam("mode", "string", "Counting mode, e.g. bbox or cover"),
+						queryParam("estimate", "boolean", "Approximate count of a single query"),
+						queryParam("debug", "boolean", "Cells of the region cover"),
+						queryParam("nocache", "boolean", "Download the polygon of the country again"),
+						{Name: "format", In: "query", Schema: &Schema{Type: "string", Enum: []string{FormatGeoJSON}}},
+					},
+					Responses: jsonResponses("Number and area of images of the countries", schemaOf(GeoArea{}), schemaOf(RegionCount{}), schemaOf([]CountryCount{}), schemaOf(FeatureCollection{})),
+				},
+			},
+			"/granule": {
+				Get: &Operation{
+					Summary:    "Metadata of a granule",
+					Parameters: []Parameter{requiredParam("id", "string", "Granule id, e.g. L1C_T32UNG_A012345_20171010T103021")},
+					Responses:  jsonResponses("Metadata of the granule", schemaOf(GranuleMetadata{})),
+				},
+			},
+			"/stats": {
+				Get: &Operation{
+					Summary:    "Coverage statistics of a location",
+					Parameters: params(pointParams, filterParams),
+					Responses:  jsonResponses("Coverage of the location", schemaOf(CoverageStats{})),
+				},
+			},
+			"/nearest": {
+				Get: &Operation{
+					Summary:    "Granule whose center is closest to a location",
+					Parameters: params(pointParams, filterParams),
+					Responses:  jsonResponses("Nearest granule of the location", schemaOf(NearestGranule{})),
+				},
+			},
+			"/geocode": {
+				Post: &Operation{
+					Summary:     "Locations of a batch of addresses",
+					RequestBody: &RequestBody{Required: true, Content: map[string]MediaType{"application/json": {Schema: schemaOf(GeocodeRequest{})}}},
+					Responses:   jsonResponses("Location of each address in order", schemaOf([]GeocodeResult{})),
+				},
+			},
+			"/version": {
+				Get: &Operation{Summary: "Build of the service", Responses: jsonResponses("Build info", schemaOf(BuildInfo{}))},
+			},
+			"/metrics": {
+				Get: &Operation{
+					Summary:   "Prometheus metrics of the service",
+					Responses: map[string]Response{"200": {Description: "Metrics in the Prometheus text format", Content: map[string]MediaType{"text/plain": {Schema: &Schema{Type: "string"}}}}},
+				},
+			},
+			"/openapi.json": {
+				Get: &Operation{Summary: "OpenAPI document of the service", Responses: jsonResponses("This document", &Schema{Type: "object"})},
+			},
+		},
+	}
+}
+
+// Returns the OpenAPI document of the service
+func openAPI(w http.ResponseWriter, r *http.Request) *appError {
+	if err := json.NewEncoder(w).Encode(openAPIDocument()); err != nil {
+		return &appError{err, "Unable to map JSON to response", http.StatusInternalServerError}
+	}
+	return nil // Success
+}
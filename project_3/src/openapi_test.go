@@ -0,0 +1,72 @@
+// Package satservice : this contains unit tests of the OpenAPI document of the service
+package satservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// The document should be a valid OpenAPI 3 document describing every registered route
+func TestOpenAPIHandler_RegisteredPaths(t *testing.T) {
+	rr := httptest.NewRecorder()
+	appHandler(openAPI).ServeHTTP(rr, httptest.NewRequest("GET", "/openapi.json", nil))
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	doc := OpenAPI{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("handler returned invalid JSON: %v", err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") || len(doc.Info.Title) == 0 || len(doc.Info.Version) == 0 {
+		t.Errorf("invalid OpenAPI version or info: %q %+v", doc.OpenAPI, doc.Info)
+	}
+	for route := range registeredRoutes {
+		item, ok := doc.Paths[route]
+		if !ok {
+			t.Errorf("route %v missing from the paths", route)
+			continue
+		}
+		if item.Get == nil && item.Post == nil {
+			t.Errorf("route %v has no operations", route)
+		}
+		for _, operation := range []*Operation{item.Get, item.Post} {
+			if operation == nil {
+				continue
+			}
+			if response, ok := operation.Responses["200"]; !ok || len(response.Content) == 0 {
+				t.Errorf("route %v has no 200 response", route)
+			}
+			for _, param := range operation.Parameters {
+				if param.In != "query" || len(param.Name) == 0 || param.Schema == nil {
+					t.Errorf("route %v has an invalid parameter %+v", route, param)
+				}
+			}
+		}
+	}
+	for path := range doc.Paths {
+		if _, ok := registeredRoutes[path]; !ok {
+			t.Errorf("path %v is not a registered route", path)
+		}
+	}
+	for _, path := range []string{"/images", "/area"} {
+		if _, ok := doc.Paths[path].Get.Responses["200"].Headers["X-Coordinates"]; !ok {
+			t.Errorf("route %v does not document the X-Coordinates header", path)
+		}
+	}
+}
+
+// Schemas of responses should have the JSON fields of their types, including those of an embedded Source
+func TestSchemaOf_JSONFields(t *testing.T) {
+	schema := schemaOf(NearestGranule{})
+	for _, property := range []string{"granule_id", "distanceKm", "dataset", "satellite"} {
+		if _, ok := schema.Properties[property]; !ok {
+			t.Errorf("schema missing property %v: %+v", property, schema.Properties)
+		}
+	}
+	if links := schemaOf(Links{}); links.Type != "array" || links.Items.Type != "string" {
+		t.Errorf("wrong schema of links: %+v", links)
+	}
+}
@@ -24,10 +24,12 @@ func NewTask(f func() error) *Task {
 }
 
 // Run runs a Task and does appropriate accounting via a
-// given sync.WorkGroup.
+// given sync.WorkGroup. A panic of the task is recovered
+// into its Err.
 func (t *Task) Run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer recoverPanic(&t.Err)
 	t.Err = t.f()
-	wg.Done()
 }
 
 // Pool is a worker group that runs a number of tasks at a
@@ -0,0 +1,244 @@
+// Package satservice : this contains unit tests of the worker pool fetching images from buckets concurrently
+package satservice
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Images of all folders should be merged into the result, even when a worker drains several jobs
+func TestRunPool_KeepsAllResults(t *testing.T) {
+	links := Links{}
+	for _, granule := range []string{"A", "B", "C", "D", "E"} {
+		links = append(links, "gcp-public-data-sentinel-2/tiles/32/U/NG/S2A.SAFE/GRANULE/"+granule+"/IMG_DATA/")
+	}
+	fetch := func(bucketName, objectName string) (Links, error) {
+		return Links{bucketName + "/" + objectName + "/B04.jp2"}, nil
+	}
+
+	result := runPool(context.Background(), links, 2, fetch)
+	if result.Error != nil {
+		t.Fatalf("Failed to fetch images: %v", result.Error)
+	}
+
+	sort.Strings(result.Links)
+	if len(result.Links) != len(links) {
+		t.Fatalf("wrong number of images: got %v want %v", len(result.Links), len(links))
+	}
+	for i, link := range links {
+		if expected := link + "B04.jp2"; result.Links[i] != expected {
+			t.Errorf("missing image: got %v want %v", result.Links[i], expected)
+		}
+	}
+}
+
+// The number of concurrent fetches should never exceed the number of workers
+func TestRunPool_BoundsWorkers(t *testing.T) {
+	links := Links{}
+	for i := 0; i < 20; i++ {
+		links = append(links, fmt.Sprintf("gcp-public-data-sentinel-2/tiles/GRANULE/%d/IMG_DATA/", i))
+	}
+	var active, maxActive int32
+	fetch := func(bucketName, objectName string) (Links, error) {
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		for {
+			max := atomic.LoadInt32(&maxActive)
+			if n <= max || atomic.CompareAndSwapInt32(&maxActive, max, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		return Links{objectName}, nil
+	}
+
+	workers := 3
+	result := runPool(context.Background(), links, workers, fetch)
+	if len(result.Links) != len(links) {
+		t.Errorf("wrong number of images: got %v want %v", len(result.Links), len(links))
+	}
+	if maxActive > int32(workers) {
+		t.Errorf("too many concurrent fetches: got %v want at most %v", maxActive, workers)
+	}
+}
+
+// A number of workers below 1 should be raised to 1 rather than leaving the pool without workers
+func TestParseMaxWorkers(t *testing.T) {
+	fallback := runtime.NumCPU() * 4
+	for workers, expected := range map[string]int{"": fallback, "16": 16, "1": 1, "0": 1, "-3": 1, "many": fallback} {
+		if actual := parseMaxWorkers(workers); actual != expected {
+			t.Errorf("parseMaxWorkers(%q): got %v want %v", workers, actual, expected)
+		}
+	}
+}
+
+// Cancelling the context should make the pool return promptly with a cancellation error
+func TestRunPool_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	links := Links{}
+	for i := 0; i < 10; i++ {
+		links = append(links, fmt.Sprintf("gcp-public-data-sentinel-2/tiles/GRANULE/%d/IMG_DATA/", i))
+	}
+	fetch := func(bucketName, objectName string) (Links, error) {
+		<-ctx.Done() // Slow bucket that only returns once the client disconnects
+		return nil, ctx.Err()
+	}
+
+	done := make(chan Result)
+	go func() { done <- runPool(ctx, links, 2, fetch) }()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case result := <-done:
+		if result.Error != context.Canceled {
+			t.Errorf("pool returned wrong error: got %v want %v", result.Error, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pool did not return after the context was cancelled")
+	}
+}
+
+// The pool should fetch the images of every folder with the object lister, so the whole pool runs without a bucket
+func TestPool_FakeLister(t *testing.T) {
+	defer func(lister func(context.Context) (ObjectLister, error)) { newObjectLister = lister }(newObjectLister)
+	links := Links{}
+	names := []string{}
+	for _, granule := range []string{"A", "B", "C"} {
+		folder := "tiles/32/U/NG/S2A.SAFE/GRANULE/" + granule + "/IMG_DATA"
+		links = append(links, "gcp-public-data-sentinel-2/"+folder+"/")
+		names = append(names, folder+"/T32UNG_20171010T103021_B04.jp2", folder+"/T32UNG_20171010T103021_B08.jp2")
+	}
+	newObjectLister = func(ctx context.Context) (ObjectLister, error) {
+		return &fakeLister{names: names}, nil
+	}
+
+	result := pool(links, ImageFilter{Bands: []string{"B08"}}, nil, httptest.NewRequest("GET", "/area", nil))
+	if result.Error != nil {
+		t.Fatalf("Failed to fetch images: %v", result.Error)
+	}
+	sort.Strings(result.Links)
+	expected := []string{}
+	for i := 1; i < len(names); i += 2 {
+		expected = append(expected, "gcp-public-data-sentinel-2/"+names[i])
+	}
+	if !reflect.DeepEqual(result.Links, expected) {
+		t.Errorf("wrong images: got %v want %v", result.Links, expected)
+	}
+}
+
+// Streamed images should reach the client as lines while the pool is still fetching, instead of once all folders are fetched
+func TestStreamLinks_Incremental(t *testing.T) {
+	links := Links{}
+	for i := 0; i < 3; i++ {
+		links = append(links, fmt.Sprintf("gcp-public-data-sentinel-2/tiles/GRANULE/%d/IMG_DATA/", i))
+	}
+	read := make(chan struct{})
+	var fetched int32
+	fetch := func(bucketName, objectName string) (Links, error) {
+		if atomic.AddInt32(&fetched, 1) > 1 {
+			select {
+			case <-read: // Next folder is only fetched once the client has read the image of the previous one
+			case <-time.After(time.Second):
+				return nil, errors.New("client did not receive image before the pool finished")
+			}
+		}
+		return Links{bucketName + "/" + objectName + "/B04.jp2"}, nil
+	}
+
+	done := make(chan Result, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		done <- runPool(r.Context(), links, 1, streamLinks(fetch, newNDJSONWriter(w)))
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to get: %v", err)
+	}
+	defer resp.Body.Close()
+	if contentType := resp.Header.Get("Content-Type"); contentType != MediaTypeNDJSON {
+		t.Errorf("wrong content type: got %v want %v", contentType, MediaTypeNDJSON)
+	}
+
+	lines := bufio.NewScanner(resp.Body)
+	for i := range links {
+		if !lines.Scan() {
+			t.Fatalf("stream ended after %v images: %v", i, lines.Err())
+		}
+		var link string
+		if err := json.Unmarshal(lines.Bytes(), &link); err != nil || link != links[i]+"B04.jp2" {
+			t.Errorf("wrong line %v: got %s want %q", i, lines.Bytes(), links[i]+"B04.jp2")
+		}
+		if i < len(links)-1 {
+			read <- struct{}{}
+		}
+	}
+	if lines.Scan() {
+		t.Errorf("unexpected line after all images: %s", lines.Bytes())
+	}
+	if result := <-done; result.Error != nil || len(result.Links) > 0 {
+		t.Errorf("streamed images should not be collected: got %+v", result)
+	}
+}
+
+// Results beyond the max of the route should not be held in memory, and the result should be flagged as truncated
+func TestMaxResults_Truncated(t *testing.T) {
+	defer func(lister func(context.Context) (ObjectLister, error)) { newObjectLister = lister }(newObjectLister)
+	defer func(max int) { MaxResults["/area"] = max }(MaxResults["/area"])
+	MaxResults["/area"] = 100
+	r := httptest.NewRequest("GET", "/area", nil)
+	folders, names := Links{}, []string{}
+	for folder := 0; folder < 10; folder++ {
+		prefix := fmt.Sprintf("tiles/32/U/NG/S2A.SAFE/GRANULE/%d/IMG_DATA", folder)
+		folders = append(folders, "gcp-public-data-sentinel-2/"+prefix+"/")
+		for image := 0; image < 1000; image++ {
+			names = append(names, fmt.Sprintf("%s/T32UNG_%04d_B04.jp2", prefix, image))
+		}
+	}
+	lister := &fakeLister{names: names}
+	newObjectLister = func(ctx context.Context) (ObjectLister, error) { return lister, nil }
+
+	images, truncated, err := getImagesFromBucket(lister, "gcp-public-data-sentinel-2", "tiles", ImageFilter{}, 100, r)
+	if err != nil || len(images) != 100 || !truncated {
+		t.Errorf("images of 10k objects were not truncated: got %d images, truncated %v, %v", len(images), truncated, err)
+	}
+	if images, truncated, _ := getImagesFromBucket(lister, "gcp-public-data-sentinel-2", "tiles", ImageFilter{}, noLimit, r); len(images) != 10000 || truncated {
+		t.Errorf("images without limit were truncated: got %d images, truncated %v", len(images), truncated)
+	}
+
+	result := pool(folders, ImageFilter{}, nil, r)
+	if result.Error != nil || len(result.Links) != 100 || !result.Truncated {
+		t.Errorf("pool of 10k images was not truncated: got %d images, truncated %v, %v", len(result.Links), result.Truncated, result.Error)
+	}
+
+	rows := [][]bigquery.Value{}
+	for i := 0; i < 10000; i++ {
+		rows = append(rows, []bigquery.Value{fmt.Sprintf("granule-%d", i), "gs://bucket/S2A.SAFE", 56.0, 55.0, 13.0, 12.0})
+	}
+	defer withQuerier(&fakeQuerier{rows: rows})()
+	links, granules, truncated, err := getImageBaseURL(Box{South: 55, West: 12, North: 56, East: 13}, GranuleFilter{}, Layout{}, r)
+	if err != nil || len(links) != 100 || len(granules) != 100 || !truncated {
+		t.Errorf("granules of 10k rows were not truncated: got %d links, truncated %v, %v", len(links), truncated, err)
+	}
+
+	rr := httptest.NewRecorder()
+	appHandler(area).ServeHTTP(rr, httptest.NewRequest("GET", "/area?lat1=55&lng1=12&lat2=56&lng2=13", nil))
+	response := AreaCount{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil || !response.Truncated { // The fake granules have no images in the fake bucket
+		t.Errorf("truncated area count was not flagged: got %v, %v", rr.Body.String(), err)
+	}
+}
@@ -0,0 +1,125 @@
+// Package satservice pprof serves the profiling endpoints under /debug/pprof/ when ENABLE_PPROF=true
+// Profiles expose internals of the service, so every request must also carry PPROF_TOKEN as &token=<secret>
+// The profiles are written with runtime/pprof, since importing net/http/pprof registers unguarded endpoints on the default mux
+package satservice
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime/pprof"
+	"runtime/trace"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Whether the profiling endpoints are served, and the shared secret requests of them must carry
+// Without a token the endpoints are not served even if enabled
+var (
+	PprofEnabled = os.Getenv("ENABLE_PPROF") == "true"
+	PprofToken   = os.Getenv("PPROF_TOKEN")
+)
+
+// Limit of the duration of CPU profiles and traces, which block the request while they are recorded
+const maxProfileSeconds = 60
+
+// Registers the profiling endpoints on the mux, guarded by pprofGuard, e.g. for go tool pprof "<host>/debug/pprof/heap?token=<secret>"
+func registerPprof(mux *http.ServeMux) {
+	mux.Handle("/debug/pprof/", pprofGuard(http.HandlerFunc(pprofIndex)))
+	mux.Handle("/debug/pprof/cmdline", pprofGuard(http.HandlerFunc(pprofCmdline)))
+	mux.Handle("/debug/pprof/profile", pprofGuard(http.HandlerFunc(pprofCPU)))
+	mux.Handle("/debug/pprof/trace", pprofGuard(http.HandlerFunc(pprofTrace)))
+}
+
+// pprofGuard answers 404 unless profiling is enabled and the request carries the token, so disabled endpoints look absent
+func pprofGuard(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if !PprofEnabled || len(PprofToken) == 0 || subtle.ConstantTimeCompare([]byte(token), []byte(PprofToken)) != 1 {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Writes a named profile (e.g. /debug/pprof/heap or /debug/pprof/goroutine?debug=1), or lists the profiles without a name
+func pprofIndex(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/")
+	if len(name) == 0 {
+		names := []string{}
+		for _, profile := range pprof.Profiles() {
+			names = append(names, fmt.Sprintf("%s (%d)", profile.Name(), profile.Count()))
+		}
+		sort.Strings(names)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, strings.Join(append(names, "profile (CPU, &seconds=30)", "trace (&seconds=1)", "cmdline"), "\n"))
+		return
+	}
+	profile := pprof.Lookup(name)
+	if profile == nil {
+		http.Error(w, "Unknown profile", http.StatusNotFound)
+		return
+	}
+	debug, _ := strconv.Atoi(r.URL.Query().Get("debug"))
+	if debug > 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	}
+	profile.WriteTo(w, debug)
+}
+
+// Writes the command line of the service, with arguments separated by NUL bytes
+func pprofCmdline(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, strings.Join(os.Args, "\x00"))
+}
+
+// Returns the duration of a CPU profile or trace given as &seconds=<n>, limited to maxProfileSeconds
+func profileDuration(r *http.Request, fallback int) time.Duration {
+	seconds, err := strconv.Atoi(r.URL.Query().Get("seconds"))
+	if err != nil || seconds <= 0 {
+		seconds = fallback
+	}
+	return time.Duration(clamp(seconds, 1, maxProfileSeconds)) * time.Second
+}
+
+// Sleeps for the duration of a profile, unless the client disconnects
+func sleepProfile(r *http.Request, duration time.Duration) {
+	select {
+	case <-time.After(duration):
+	case <-r.Context().Done():
+	}
+}
+
+// Writes a CPU profile of the given number of seconds, e.g. /debug/pprof/profile?seconds=30
+func pprofCPU(w http.ResponseWriter, r *http.Request) {
+	duration := profileDuration(r, 30)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+	if err := pprof.StartCPUProfile(w); err != nil {
+		http.Error(w, "Could not enable CPU profiling: "+err.Error(), http.StatusInternalServerError) // E.g. already profiling
+		return
+	}
+	sleepProfile(r, duration)
+	pprof.StopCPUProfile()
+}
+
+// Writes an execution trace of the given number of seconds, e.g. /debug/pprof/trace?seconds=5
+func pprofTrace(w http.ResponseWriter, r *http.Request) {
+	duration := profileDuration(r, 1)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="trace"`)
+	if err := trace.Start(w); err != nil {
+		http.Error(w, "Could not enable tracing: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sleepProfile(r, duration)
+	trace.Stop()
+}
@@ -0,0 +1,39 @@
+// Package satservice : this contains unit tests of guarding the profiling endpoints
+package satservice
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Profiling endpoints should be 404 when disabled or without the token, and reachable with the token when enabled
+func TestPprof_Guard(t *testing.T) {
+	defer func(enabled bool, token string) { PprofEnabled, PprofToken = enabled, token }(PprofEnabled, PprofToken)
+	mux := http.NewServeMux()
+	registerPprof(mux)
+
+	cases := []struct {
+		enabled  bool
+		token    string
+		target   string
+		expected int
+	}{
+		{false, "secret", "/debug/pprof/?token=secret", http.StatusNotFound},
+		{true, "", "/debug/pprof/?token=", http.StatusNotFound},
+		{true, "secret", "/debug/pprof/", http.StatusNotFound},
+		{true, "secret", "/debug/pprof/?token=wrong", http.StatusNotFound},
+		{true, "secret", "/debug/pprof/?token=secret", http.StatusOK},
+		{true, "secret", "/debug/pprof/goroutine?debug=1&token=secret", http.StatusOK},
+		{true, "secret", "/debug/pprof/cmdline?token=secret", http.StatusOK},
+		{true, "secret", "/debug/pprof/unknown?token=secret", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		PprofEnabled, PprofToken = c.enabled, c.token
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", c.target, nil))
+		if status := rr.Code; status != c.expected {
+			t.Errorf("wrong status code of %v (enabled %v, token %q): got %v want %v", c.target, c.enabled, c.token, status, c.expected)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Package satservice precision rounds the coordinates of requests to COORDINATE_PRECISION decimals before they are validated and queried
+// Clients send coordinates of varying precision, e.g. 12.5 and 12.58960001, where digits beyond a few decimals only fragment the caches
+package satservice
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Decimals of coordinates when COORDINATE_PRECISION is not set, i.e. about 0.1 m which is well below the 10 m resolution of Sentinel-2
+const defaultCoordinatePrecision = 6
+
+// Highest precision of coordinates, beyond which a float64 has no more decimals of a longitude
+const maxCoordinatePrecision = 12
+
+// CoordinatePrecision is the number of decimals of normalized coordinates, e.g. COORDINATE_PRECISION=4
+var CoordinatePrecision = parseCoordinatePrecision(os.Getenv("COORDINATE_PRECISION"))
+
+// Parses the precision of coordinates, where an invalid precision falls back to the default
+func parseCoordinatePrecision(precision string) int {
+	if len(precision) == 0 {
+		return defaultCoordinatePrecision
+	}
+	decimals, err := strconv.Atoi(precision)
+	if err != nil || decimals < 0 || decimals > maxCoordinatePrecision {
+		log.Printf("Warning: invalid COORDINATE_PRECISION %q, coordinates are rounded to %v decimals", precision, defaultCoordinatePrecision)
+		return defaultCoordinatePrecision
+	}
+	return decimals
+}
+
+// Returns the coordinate rounded to CoordinatePrecision decimals without trailing zeros, e.g. 12.58960001 becomes 12.5896
+// Other forms of numbers are written as decimals, e.g. 1e1 becomes 10, whereas values that are not finite numbers are returned unchanged
+func normalizeCoordinate(coord string) string {
+	value, err := strconv.ParseFloat(coord, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return coord
+	}
+	normalized := strconv.FormatFloat(value, 'f', CoordinatePrecision, 64)
+	if strings.Contains(normalized, ".") {
+		normalized = strings.TrimRight(strings.TrimRight(normalized, "0"), ".")
+	}
+	if normalized == "-0" {
+		return "0" // Negative coordinates rounding to zero
+	}
+	return normalized
+}
+
+// Returns the coordinates normalized by normalizeCoordinate and reports them in the X-Coordinates header of the response,
+// so clients know which coordinates were queried
+func normalizeCoordinates(w http.ResponseWriter, coords ...*string) {
+	normalized := []string{}
+	for _, coord := range coords {
+		*coord = normalizeCoordinate(*coord)
+		normalized = append(normalized, *coord)
+	}
+	w.Header().Set("X-Coordinates", strings.Join(normalized, ","))
+}
@@ -0,0 +1,60 @@
+// Package satservice : this contains unit tests of the normalization of coordinates
+package satservice
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Coordinates differing beyond CoordinatePrecision decimals should share the cache key and query, and be reported to the client
+func TestImages_NormalizedCoordinates(t *testing.T) {
+	defer func(query func(string, string, GranuleFilter, *http.Request) (Links, error)) { queryLinks = query }(queryLinks)
+	defer func(precision int) { LinksCachePrecision = precision }(LinksCachePrecision)
+	LinksCachePrecision = 10 // Finer than the coordinates, so only the normalization lets the requests share the cached links
+	FlushLinksCache()
+	defer FlushLinksCache()
+	queried := [][2]string{}
+	queryLinks = func(lat, lng string, filter GranuleFilter, r *http.Request) (Links, error) {
+		queried = append(queried, [2]string{lat, lng})
+		return Links{"L1C_T32UNG_A012345_20171010T103021"}, nil
+	}
+
+	for _, lng := range []string{"12.58960001", "12.58960002"} {
+		rr := httptest.NewRecorder()
+		appHandler(images).ServeHTTP(rr, httptest.NewRequest("GET", "/images?lat=55.660797&lng="+lng, nil))
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+		if coords := rr.Header().Get("X-Coordinates"); coords != "55.660797,12.5896" {
+			t.Errorf("wrong normalized coordinates of %v: got %q want %q", lng, coords, "55.660797,12.5896")
+		}
+	}
+	// The second request hits the links cached by the first request
+	if len(queried) != 1 || queried[0] != [2]string{"55.660797", "12.5896"} {
+		t.Errorf("wrong queried coordinates: got %v want one query of 55.660797,12.5896", queried)
+	}
+}
+
+// Decimal coordinates should be rounded without trailing zeros, whereas other values are left for validation
+func TestNormalizeCoordinate(t *testing.T) {
+	for coord, expected := range map[string]string{
+		"12.5":         "12.5",
+		"12.5000000":   "12.5",
+		"12.589600049": "12.5896",
+		"-0.0000001":   "0",
+		"+90":          "90",
+		"1e1":          "10",
+		"5.5e-1":       "0.55",
+		"Inf":          "Inf",
+		"NaN":          "NaN",
+		"":             "",
+	} {
+		if normalized := normalizeCoordinate(coord); normalized != expected {
+			t.Errorf("wrong normalized coordinate of %q: got %q want %q", coord, normalized, expected)
+		}
+	}
+	if precision := parseCoordinatePrecision("13"); precision != defaultCoordinatePrecision {
+		t.Errorf("invalid precision not ignored: got %v", precision)
+	}
+}
@@ -3,47 +3,947 @@ package satservice
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"log"
+	"math"
+	"net"
 	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"cloud.google.com/go/bigquery"
 	"cloud.google.com/go/storage"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
-	"google.golang.org/appengine"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
 )
 
 // Position of granule id column in table
 const (
 	granuleIDColumn = 0
 	baseURLColumn   = 1
+	productIDColumn = 1             // Point queries select product id instead of base url
 	projectID       = "tvao-178408" // TODO: os.GetEnv()
 )
 
 // Links encapsulates the links (i.e. granule ids)  fetched from Google Cloud via BigQuery
 type Links []string
 
+// Sentinel-2 bands come in 10m, 20m and 60m resolution, where the L2A layout stores each resolution in its own directory
+var resolutionFolders = map[int]string{10: "R10m", 20: "R20m", 60: "R60m"}
+
+// ImageFilter narrows the images fetched from a bucket to a set of spectral bands (e.g. B04, B08, TCI) and a resolution
+// An empty filter matches all images
+type ImageFilter struct {
+	Bands      []string
+	Resolution int // 10, 20 or 60 meters, 0 means any resolution
+}
+
+// Match reports whether an object name (e.g. ".../IMG_DATA/R10m/T32UNG_20180101T103421_B04_10m.jp2") matches both band and resolution
+func (f ImageFilter) Match(objectName string) bool {
+	if f.Resolution > 0 && !strings.Contains(objectName, "/"+resolutionFolders[f.Resolution]+"/") {
+		return false
+	}
+	if len(f.Bands) == 0 {
+		return true
+	}
+	name := strings.TrimSuffix(objectName, path.Ext(objectName))
+	for resolution := range resolutionFolders {
+		name = strings.TrimSuffix(name, fmt.Sprintf("_%dm", resolution)) // L2A file names also carry the resolution
+	}
+	for _, band := range f.Bands {
+		if strings.HasSuffix(name, "_"+band) {
+			return true
+		}
+	}
+	return false
+}
+
+// newBigQueryClient creates the BigQuery client shared by all requests, which tests replace to count the clients created
+var newBigQueryClient = func(ctx context.Context) (*bigquery.Client, error) {
+	return bigquery.NewClient(ctx, projectID)
+}
+
+// The BigQuery client shared by all requests, which is created by the first query
+var (
+	bigQueryMu     sync.Mutex
+	sharedBigQuery *bigquery.Client
+)
+
+// Returns the BigQuery client shared by all requests, since creating a client re-establishes auth and connections
+// The client is safe for concurrent use by request goroutines and is created again if creating it failed
+func bigQueryClient(ctx context.Context) (*bigquery.Client, error) {
+	bigQueryMu.Lock()
+	defer bigQueryMu.Unlock()
+	if sharedBigQuery != nil {
+		return sharedBigQuery, nil
+	}
+	client, err := newBigQueryClient(withoutCancel(ctx)) // The client outlives the request that creates it
+	if err != nil {
+		return nil, err
+	}
+	sharedBigQuery = client
+	return client, nil
+}
+
+// CloseBigQueryClient closes the BigQuery client shared by all requests, e.g. on shutdown
+func CloseBigQueryClient() error {
+	bigQueryMu.Lock()
+	defer bigQueryMu.Unlock()
+	if sharedBigQuery == nil {
+		return nil
+	}
+	err := sharedBigQuery.Close()
+	sharedBigQuery = nil
+	return err
+}
+
+// Querier runs a standard SQL query with named parameters and returns its rows
+// The service runs queries as BigQuery jobs, whereas tests replace the querier with fakes returning canned rows
+type Querier interface {
+	RunQuery(ctx context.Context, sql string, params []bigquery.QueryParameter) (rowIterator, error)
+}
+
+// querier runs the queries of the sentinel-2 index
+var querier Querier = bigQueryQuerier{}
+
+// bigQueryQuerier runs queries as jobs of the BigQuery client shared by all requests
+type bigQueryQuerier struct{}
+
+func (bigQueryQuerier) RunQuery(ctx context.Context, sql string, params []bigquery.QueryParameter) (rowIterator, error) {
+	client, err := bigQueryClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	query := client.Query(sql)
+	query.QueryConfig.UseStandardSQL = true
+	query.Parameters = params
+	rows, err := readQuery(ctx, query)
+	if err != nil {
+		return nil, err // Not a nil *bigquery.RowIterator, which would be a non-nil rowIterator
+	}
+	return rows, nil
+}
+
+// QueryRetry is used to run a query again when BigQuery fails with a transient error, e.g. a backend error while reading the rows
+var QueryRetry = NewRetry(3, time.Second).WithBackoffMultiplier(2)
+
+// Runs a query built by the query builders (e.g. pointQuery) with the querier
+// Transient errors are retried as configured by QueryRetry, whereas permanent errors (e.g. invalid SQL or denied access) are returned right away
+func runQuery(ctx context.Context, query *bigquery.Query) (rows rowIterator, err error) {
+	rows, err = querier.RunQuery(ctx, query.Q, query.Parameters)
+	if err == nil || !transientQueryError(err) || ctx.Err() != nil {
+		return rows, err
+	}
+	retry(ctx, QueryRetry, func() error {
+		rows, err = querier.RunQuery(ctx, query.Q, query.Parameters)
+		if err != nil && transientQueryError(err) {
+			return err
+		}
+		return nil // Success or permanent error
+	})
+	return rows, err
+}
+
+// Reasons of BigQuery errors that are transient, even though the status is not 5xx
+var transientReasons = map[string]bool{"backendError": true, "internalError": true, "jobBackendError": true, "jobInternalError": true}
+
+// Reports whether a query failed with an error that may not recur, i.e. a 5xx Google API error, a transient reason or a network timeout
+// Rate limiting is not retried here, since it is returned as 429 Too Many Requests for clients to back off
+func transientQueryError(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		if apiErr.Code >= http.StatusInternalServerError {
+			return true
+		}
+		for _, item := range apiErr.Errors {
+			if transientReasons[item.Reason] {
+				return true
+			}
+		}
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout() && !errors.Is(err, context.DeadlineExceeded) // Queries over QueryTimeout time out again
+}
+
+// Builds a standard SQL query, which holds the SQL and parameters to run with the querier
+func newQuery(sql string) *bigquery.Query {
+	query := &bigquery.Query{}
+	query.Q = sql
+	query.UseStandardSQL = true
+	return query
+}
+
+// QueryTimeout bounds how long a BigQuery job may run before it is cancelled
+var QueryTimeout = 2 * time.Minute
+
+// cancellableJob is the part of a BigQuery job used to await its completion or cancel it server-side
+type cancellableJob interface {
+	Wait(ctx context.Context) (*bigquery.JobStatus, error)
+	Cancel(ctx context.Context) error
+}
+
+// Runs the query as a job and reads its rows once the job is done
+// The job is cancelled if it does not finish within QueryTimeout or the request is cancelled
+// Queries estimated to scan more than QueryByteBudget are not run at all
+func readQuery(ctx context.Context, query *bigquery.Query) (*bigquery.RowIterator, error) {
+	if err := checkQueryBudget(ctx, query); err != nil {
+		return nil, err
+	}
+	job, err := query.Run(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := awaitJob(ctx, job, QueryTimeout); err != nil {
+		return nil, err
+	}
+	return job.Read(ctx)
+}
+
+// Waits for the job to finish and explicitly cancels it on timeout or cancellation,
+// since the job otherwise keeps running (and is billed) after the client gives up
+func awaitJob(ctx context.Context, job cancellableJob, timeout time.Duration) error {
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	_, err := job.Wait(waitCtx)
+	if waitCtx.Err() != nil {
+		if cancelErr := job.Cancel(context.Background()); cancelErr != nil {
+			log.Printf("Unable to cancel BigQuery job: %v", cancelErr)
+		}
+		return waitCtx.Err()
+	}
+	return err
+}
+
+// Limits of the cache of links of locations: the number of decimals coordinates are rounded to, the max number of locations and how long links are kept
+// 4 decimals are roughly 11 meters, which is far below the size of a granule
+var (
+	LinksCachePrecision = 4
+	LinksCacheSize      = 10000
+	LinksCacheTTL       = 10 * time.Minute
+)
+
+// Cache of links of locations keyed by the rounded coordinates and the filter
+var pointLinks = newTTLCache()
+
+// FlushLinksCache removes all cached links of locations, e.g. between tests
+func FlushLinksCache() {
+	pointLinks.flush()
+}
+
+// Returns the key of the cached links of a location, where coordinates are rounded to LinksCachePrecision decimals
+func linksCacheKey(lat, lng string, filter GranuleFilter) string {
+	round := func(coord string) string {
+		value, err := strconv.ParseFloat(coord, 64)
+		if err != nil {
+			return coord
+		}
+		return strconv.FormatFloat(value, 'f', LinksCachePrecision, 64)
+	}
+	return round(lat) + "," + round(lng) + "/" + filter.cacheKey()
+}
+
+// Returns a key of the conditions of the filter, e.g. to cache results of queries with the filter
+func (f GranuleFilter) cacheKey() string {
+	maxCloud := ""
+	if f.MaxCloud != nil {
+		maxCloud = strconv.FormatFloat(*f.MaxCloud, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%s/%s/%s/%s/%s/%s", maxCloud, f.From.Format(time.RFC3339), f.To.Format(time.RFC3339), f.Level, f.Sort, f.dataset().Name)
+}
+
+// Identical queries in flight, which concurrent requests share instead of running the same BigQuery job
+// Results are only shared while the query is in flight, e.g. errors are not kept for later requests
+var (
+	pointFlights singleflight.Group
+	cellFlights  singleflight.Group
+)
+
+// flightJoined is called once a caller has joined the flight of a key, which tests replace to wait for callers sharing a flight
+var flightJoined = func(key string) {}
+
+// Runs the query of a key once for all concurrent callers and returns its result, unless ctx is done first
+// The query runs on a context detached from the caller that started it and bounded by QueryTimeout,
+// so a caller giving up (e.g. a disconnected client or a failed cell of a region cover) does not fail the other callers
+func shareFlight(ctx context.Context, flights *singleflight.Group, key string, query func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	flight := flights.DoChan(key, func() (interface{}, error) {
+		flightCtx, cancel := context.WithTimeout(withoutCancel(ctx), QueryTimeout)
+		defer cancel()
+		return query(flightCtx)
+	})
+	flightJoined(key)
+	select {
+	case result := <-flight:
+		return result.Val, result.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 // Retrieves links (i.e. granule ids) of all satellite images via a location based on a latitude and longitude
-func getLinks(lat, lng string, r *http.Request) (Links, error) {
-	granuleQuery := strings.TrimSpace(fmt.Sprintf(
+// Links are cached for LinksCacheTTL, since the granules of a location rarely change
+// Concurrent requests of the same location share a single query
+func getLinks(lat, lng string, filter GranuleFilter, r *http.Request) (Links, error) {
+	key := linksCacheKey(lat, lng, filter)
+	if links, ok := pointLinks.get(key, time.Now()); ok {
+		return links.(Links), nil
+	}
+	links, err := shareFlight(contextFromRequest(r), &pointFlights, key, func(ctx context.Context) (interface{}, error) {
+		links, err := queryLinks(lat, lng, filter, r.WithContext(ctx))
+		if err == nil {
+			pointLinks.put(key, links, LinksCacheTTL, LinksCacheSize, time.Now())
+		}
+		return links, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return links.(Links), nil
+}
+
+// queryLinks queries the links of a location without the cache, which tests replace to observe queries
+var queryLinks = queryPointLinks
+
+// Queries links (i.e. granule ids) of all satellite images via a location based on a latitude and longitude
+func queryPointLinks(lat, lng string, filter GranuleFilter, r *http.Request) (links Links, err error) {
+	defer observeQuery("point", time.Now(), &err)
+	rows, err := queryPoint(lat, lng, filter, r)
+	if err != nil {
+		return nil, err
+	}
+	return readGranuleIDs(rows)
+}
+
+// Retrieves granules of all satellite images via a location together with their processing level
+// If level is specified (L1C or L2A) only granules of that processing level are returned
+func getGranules(lat, lng, level string, filter GranuleFilter, r *http.Request) ([]Granule, error) {
+	rows, err := queryPoint(lat, lng, filter, r)
+	if err != nil {
+		return nil, err
+	}
+	return readGranules(rows, level)
+}
+
+// Queries granule id and product id of all granules that contain a location based on a latitude and longitude
+func queryPoint(lat, lng string, filter GranuleFilter, r *http.Request) (rowIterator, error) {
+	ctx := contextFromRequest(r)
+	dataset := filter.dataset()
+	query, err := dataset.pointQuery(dataset.IDColumn+", product_id", lat, lng)
+	if err != nil {
+		return nil, err
+	}
+	filter.apply(query)
+	filter.order(query)
+	return runQuery(ctx, query)
+}
+
+// LinksPage is a page of links (i.e. granule ids) of a location, where total is the number of links across all pages
+type LinksPage struct {
+	Links  Links `json:"links"`
+	Total  int   `json:"total"`
+	Offset int   `json:"offset"`
+	Limit  int   `json:"limit"`
+	Source
+}
+
+// Retrieves a page of links (i.e. granule ids) of all satellite images via a location, ordered by granule id
+// The total is counted by a query of its own, so it is also known for pages past the last granule
+func getLinksPage(lat, lng string, limit, offset int, filter GranuleFilter, r *http.Request) (LinksPage, error) {
+	page := LinksPage{Links: Links{}, Offset: offset, Limit: limit}
+	ctx := contextFromRequest(r)
+	query, err := pageCountQuery(lat, lng, filter)
+	if err != nil {
+		return page, err
+	}
+	rows, err := runQuery(ctx, query)
+	if err != nil {
+		return page, err
+	}
+	var row []bigquery.Value
+	if err := rows.Next(&row); err != nil {
+		return page, err
+	}
+	total, err := countColumn(row, 0)
+	if err != nil {
+		return page, err
+	}
+	page.Total = int(total)
+
+	query, err = pageQuery(lat, lng, limit, offset, filter)
+	if err != nil {
+		return page, err
+	}
+	rows, err = runQuery(ctx, query)
+	if err != nil {
+		return page, err
+	}
+	for {
+		var row []bigquery.Value
+		err := rows.Next(&row) // No rows left
+		if err == iterator.Done {
+			return page, nil // Returns result
+		}
+		if err != nil {
+			return page, err
+		}
+		granuleID, err := stringColumn(row, granuleIDColumn)
+		if err == ErrNullColumn {
+			continue
+		}
+		if err != nil {
+			return page, err
+		}
+		page.Links = append(page.Links, granuleID)
+	}
+}
+
+// Builds query of the total count of granules that contain a location, which is the count of granules across all pages
+func pageCountQuery(lat, lng string, filter GranuleFilter) (*bigquery.Query, error) {
+	query, err := pointQuery("COUNT(granule_id)", lat, lng)
+	if err != nil {
+		return nil, err
+	}
+	filter.apply(query)
+	return query, nil
+}
+
+// Builds query of a page of granule ids that contain a location
+// Granules are ordered by id so pages never overlap
+func pageQuery(lat, lng string, limit, offset int, filter GranuleFilter) (*bigquery.Query, error) {
+	query, err := pointQuery("granule_id", lat, lng)
+	if err != nil {
+		return nil, err
+	}
+	filter.apply(query)
+	order := "granule_id"
+	if clause, ok := sortOrders[filter.Sort]; ok {
+		order = clause + ", granule_id" // Ties are ordered by granule id, so pages never overlap
+	}
+	query.Q = strings.TrimSuffix(query.Q, ";") + "\n\t\t ORDER BY " + order + "\n\t\t LIMIT @limit OFFSET @offset;"
+	query.Parameters = append(query.Parameters,
+		bigquery.QueryParameter{Name: "limit", Value: limit},
+		bigquery.QueryParameter{Name: "offset", Value: offset})
+	return query, nil
+}
+
+// ErrNoGranules is returned when a location has no granules at all
+var ErrNoGranules = errors.New("no granules")
+
+// LatestGranule is the most recently sensed granule of a location
+type LatestGranule struct {
+	GranuleID   string    `json:"granule_id"`
+	SensingTime time.Time `json:"sensing_time"`
+	Source
+}
+
+// Retrieves the most recently sensed granule of a location, or ErrNoGranules if the location has no granules
+func getLatestGranule(lat, lng string, filter GranuleFilter, r *http.Request) (latest LatestGranule, err error) {
+	defer observeQuery("latest", time.Now(), &err)
+	ctx := contextFromRequest(r)
+	query, err := latestQuery(lat, lng, filter)
+	if err != nil {
+		return LatestGranule{}, err
+	}
+	rows, err := runQuery(ctx, query)
+	if err != nil {
+		return LatestGranule{}, err
+	}
+	return readLatestGranule(rows)
+}
+
+// CoverageStats summarizes the granules that contain a location, where all fields are zero and NoCoverage is set without granules
+type CoverageStats struct {
+	GranuleCount int64     `json:"granuleCount"`
+	Earliest     time.Time `json:"earliest"`
+	Latest       time.Time `json:"latest"`
+	MinCloud     float64   `json:"minCloud"`
+	MaxCloud     float64   `json:"maxCloud"`
+	NoCoverage   bool      `json:"no_coverage"`
+	Source
+}
+
+// Retrieves the coverage statistics of a location with a single aggregation query
+func getCoverageStats(lat, lng string, filter GranuleFilter, r *http.Request) (stats CoverageStats, err error) {
+	defer observeQuery("stats", time.Now(), &err)
+	ctx := contextFromRequest(r)
+	query, err := statsQuery(lat, lng, filter)
+	if err != nil {
+		return CoverageStats{}, err
+	}
+	rows, err := runQuery(ctx, query)
+	if err != nil {
+		return CoverageStats{}, err
+	}
+	return readCoverageStats(rows)
+}
+
+// Builds query aggregating the count, sensing times and cloud cover of the granules that contain a location
+func statsQuery(lat, lng string, filter GranuleFilter) (*bigquery.Query, error) {
+	query, err := pointQuery("COUNT(granule_id), MIN(sensing_time), MAX(sensing_time), MIN(cloud_cover), MAX(cloud_cover)", lat, lng)
+	if err != nil {
+		return nil, err
+	}
+	filter.apply(query)
+	return query, nil
+}
+
+// Reads the single row of an aggregation query, whose minimums and maximums are NULL without granules
+func readCoverageStats(rows rowIterator) (CoverageStats, error) {
+	row := []bigquery.Value{}
+	err := rows.Next(&row)
+	if err == iterator.Done {
+		return CoverageStats{NoCoverage: true}, nil
+	}
+	if err != nil {
+		return CoverageStats{}, err
+	}
+	if len(row) < 5 {
+		return CoverageStats{}, fmt.Errorf("unexpected column count: %d columns, 5 expected", len(row))
+	}
+	count, err := countColumn(row, 0)
+	if err != nil {
+		return CoverageStats{}, err
+	}
+	if count == 0 {
+		return CoverageStats{NoCoverage: true}, nil
+	}
+	stats := CoverageStats{GranuleCount: count}
+	stats.Earliest, _ = row[1].(time.Time)
+	stats.Latest, _ = row[2].(time.Time)
+	stats.MinCloud, _ = row[3].(float64) // Missing cloud cover is read as 0, as with granule metadata
+	stats.MaxCloud, _ = row[4].(float64)
+	return stats, nil
+}
+
+// Builds query of the granule id and sensing time of the most recently sensed granule that contains a location
+func latestQuery(lat, lng string, filter GranuleFilter) (*bigquery.Query, error) {
+	dataset := filter.dataset()
+	query, err := dataset.pointQuery(dataset.IDColumn+", sensing_time", lat, lng)
+	if err != nil {
+		return nil, err
+	}
+	filter.apply(query)
+	query.Q = strings.TrimSuffix(query.Q, ";") + "\n\t\t ORDER BY sensing_time DESC\n\t\t LIMIT 1;"
+	return query, nil
+}
+
+// Reads the granule id and sensing time of the first row
+func readLatestGranule(rows rowIterator) (LatestGranule, error) {
+	var row []bigquery.Value
+	err := rows.Next(&row)
+	if err == iterator.Done {
+		return LatestGranule{}, ErrNoGranules
+	}
+	if err != nil {
+		return LatestGranule{}, err
+	}
+	granuleID, err := stringColumn(row, granuleIDColumn)
+	if err != nil {
+		return LatestGranule{}, err
+	}
+	latest := LatestGranule{GranuleID: granuleID}
+	latest.SensingTime, _ = row[1].(time.Time)
+	return latest, nil
+}
+
+// Sentinel-2 index table in the public BigQuery datasets
+const defaultSentinelTable = "bigquery-public-data.cloud_storage_geo_index.sentinel_2_index"
+
+// SentinelTable is the fully-qualified table queried for granules, e.g. BIGQUERY_TABLE=my-project.mirror.sentinel_2_index
+// for a regional copy of the index, where an unset environment variable means the public Sentinel-2 index
+var SentinelTable = parseTable(os.Getenv("BIGQUERY_TABLE"))
+
+// Fully-qualified table names of the form project.dataset.table, which are quoted into queries rather than bound
+var tablePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+(:[A-Za-z0-9_-]+)?\.[A-Za-z0-9_]+\.[A-Za-z0-9_]+$`)
+
+// Parses the table of queries, where an invalid name is ignored rather than quoted into every query
+func parseTable(table string) string {
+	if len(table) == 0 {
+		return defaultSentinelTable
+	}
+	if !tablePattern.MatchString(table) {
+		log.Printf("Warning: invalid BIGQUERY_TABLE %q, querying %s", table, defaultSentinelTable)
+		return defaultSentinelTable
+	}
+	return table
+}
+
+// Returns the quoted table of queries
+func sentinelTable() string {
+	return "`" + SentinelTable + "`"
+}
+
+// Builds query selecting columns of all granules that contain a location
+// The location is bound as query parameters, so input can never alter the query itself
+func pointQuery(columns, lat, lng string) (*bigquery.Query, error) {
+	return Sentinel2.pointQuery(columns, lat, lng)
+}
+
+// Builds query selecting columns of all products of the dataset that contain a location
+func (d *Dataset) pointQuery(columns, lat, lng string) (*bigquery.Query, error) {
+	params, err := coordParameters([]string{"lat", "lng"}, lat, lng)
+	if err != nil {
+		return nil, err
+	}
+
+	query := newQuery(strings.TrimSpace(fmt.Sprintf(
+		`SELECT %s
+		 FROM %s
+		 WHERE @lat < north_lat
+		 AND south_lat < @lat
+		 AND @lng < east_lon
+		 AND west_lon < @lng;`, columns, d.Table())))
+	query.Parameters = params
+	return d.where(query), nil
+}
+
+// Builds query selecting columns of all granules that intersect bounds, e.g. of a cell, where the bounds are bound as query parameters
+// The bounds are south, west, north and east as of an s2.Rect, so a west east of the east crosses the antimeridian, see parseBounds
+func boxQuery(columns, south, west, north, east string) (*bigquery.Query, error) {
+	box, err := parseBounds(south, west, north, east)
+	if err != nil {
+		return nil, err
+	}
+	return newBoxQuery(columns, box), nil
+}
+
+// Builds query selecting columns of all granules that intersect a parsed bounding box
+func newBoxQuery(columns string, box Box) *bigquery.Query {
+	return Sentinel2.boxQuery(columns, box)
+}
+
+// Builds query selecting columns of all products of the dataset that intersect a parsed bounding box
+// A box crossing the antimeridian selects the products of either side of ±180° in the same query
+func (d *Dataset) boxQuery(columns string, box Box) *bigquery.Query {
+	params := []bigquery.QueryParameter{
+		{Name: "lat1", Value: box.South},
+		{Name: "lng1", Value: box.West},
+		{Name: "lat2", Value: box.North},
+		{Name: "lng2", Value: box.East},
+	}
+	lng := "@lng1 < east_lon\n\t\tAND west_lon < @lng2"
+	if box.CrossesAntimeridian() {
+		lng = "(@lng1 < east_lon OR west_lon < @lng2)"
+	}
+
+	query := newQuery(strings.TrimSpace(fmt.Sprintf(
+		`SELECT %s
+		FROM %s
+		WHERE @lat1 < north_lat
+		AND south_lat < @lat2
+		AND %s;`, columns, d.Table(), lng)))
+	query.Parameters = params
+	return d.where(query)
+}
+
+// Box is a bounding box in degrees, where West is greater than East if the box crosses the antimeridian
+type Box struct {
+	South, West, North, East float64
+}
+
+// CrossesAntimeridian reports whether the box spans the ±180° longitude line
+func (b Box) CrossesAntimeridian() bool {
+	return b.West > b.East
+}
+
+// Splits a box crossing the antimeridian into the boxes on each side of ±180°, otherwise the box is returned as is
+func (b Box) split() []Box {
+	if !b.CrossesAntimeridian() {
+		return []Box{b}
+	}
+	return []Box{{b.South, b.West, b.North, 180}, {b.South, -180, b.North, b.East}}
+}
+
+// Returns the box between the same longitudes the other way around the globe, i.e. crossing the antimeridian,
+// e.g. the corners 177° and -178.5° span 177° to -178.5° around Fiji rather than the 355.5° between them
+func (b Box) aroundAntimeridian() Box {
+	if !b.CrossesAntimeridian() {
+		b.West, b.East = b.East, b.West
+	}
+	return b
+}
+
+// Empty reports whether the box has no area, i.e. its corners share a latitude or longitude
+func (b Box) Empty() bool {
+	return b.South == b.North || b.West == b.East
+}
+
+// Parses the box of a pair of opposite corners in any order, e.g. north west and south east, rejecting coordinates that are not numbers
+// The box spans the longitudes between the corners, however wide, so a box crossing the antimeridian must be asked for, see aroundAntimeridian
+func parseBox(lat1, lng1, lat2, lng2 string) (Box, error) {
+	box, err := parseBounds(lat1, lng1, lat2, lng2)
+	if err != nil {
+		return Box{}, err
+	}
+	box.West, box.East = math.Min(box.West, box.East), math.Max(box.West, box.East)
+	return box, nil
+}
+
+// Parses the bounds of a box as south, west, north and east, e.g. of an s2.Rect, where the latitudes may be given in any order
+// A west east of the east is a box crossing the antimeridian, e.g. the bounds of a cell around Fiji
+func parseBounds(south, west, north, east string) (Box, error) {
+	params, err := coordParameters([]string{"lat1", "lng1", "lat2", "lng2"}, south, west, north, east)
+	if err != nil {
+		return Box{}, err
+	}
+	coords := make([]float64, len(params))
+	for i, param := range params {
+		coords[i] = param.Value.(float64)
+	}
+	return Box{
+		South: math.Min(coords[0], coords[2]),
+		West:  coords[1],
+		North: math.Max(coords[0], coords[2]),
+		East:  coords[3],
+	}, nil
+}
+
+// Builds named query parameters of coordinates, rejecting coordinates that are not numbers
+func coordParameters(names []string, coords ...string) ([]bigquery.QueryParameter, error) {
+	params := []bigquery.QueryParameter{}
+	for i, coord := range coords {
+		value, err := strconv.ParseFloat(coord, 64)
+		if err != nil {
+			return nil, fmt.Errorf("coordinate %s is not a number: %q", names[i], coord)
+		}
+		params = append(params, bigquery.QueryParameter{Name: names[i], Value: value})
+	}
+	return params, nil
+}
+
+// GranuleFilter narrows the granules of a location query by their metadata
+// An empty filter matches all granules
+type GranuleFilter struct {
+	MaxCloud *float64  // Maximum cloud cover percentage (0-100)
+	From, To time.Time // Sensing time range, where a zero time means the range is open-ended
+	Level    string    // Processing level (L1C or L2A) of the product of the granule, empty means any level
+	Sort     string    // Sort order of listed granules (e.g. sensing_time_desc), empty means the order BigQuery yields
+	Dataset  *Dataset  // Dataset of the granules, where nil means Sentinel-2
+}
+
+// Returns the dataset of the filter, which is Sentinel-2 unless another dataset is selected
+func (f GranuleFilter) dataset() *Dataset {
+	if f.Dataset == nil {
+		return Sentinel2
+	}
+	return f.Dataset
+}
+
+// Sort orders of listed granules
+const (
+	SortSensingTimeAsc  = "sensing_time_asc"
+	SortSensingTimeDesc = "sensing_time_desc"
+	SortCloudCoverAsc   = "cloud_cover_asc"
+)
+
+// ORDER BY clauses of the sort orders, so only these fixed clauses are ever added to a query
+var sortOrders = map[string]string{
+	SortSensingTimeAsc:  "sensing_time ASC",
+	SortSensingTimeDesc: "sensing_time DESC",
+	SortCloudCoverAsc:   "cloud_cover ASC",
+}
+
+// Adds the conditions of the filter to the WHERE clause of a query, binding their values as query parameters
+func (f GranuleFilter) apply(query *bigquery.Query) {
+	conditions := []string{}
+	if f.MaxCloud != nil {
+		conditions = append(conditions, "cloud_cover <= @maxCloud")
+		query.Parameters = append(query.Parameters, bigquery.QueryParameter{Name: "maxCloud", Value: *f.MaxCloud})
+	}
+	if !f.From.IsZero() {
+		conditions = append(conditions, "@from <= sensing_time")
+		query.Parameters = append(query.Parameters, bigquery.QueryParameter{Name: "from", Value: f.From})
+	}
+	if !f.To.IsZero() {
+		conditions = append(conditions, "sensing_time <= @to")
+		query.Parameters = append(query.Parameters, bigquery.QueryParameter{Name: "to", Value: f.To})
+	}
+	if len(f.Level) > 0 {
+		conditions = append(conditions, "STRPOS(product_id, @level) > 0")
+		query.Parameters = append(query.Parameters, bigquery.QueryParameter{Name: "level", Value: "MSI" + f.Level})
+	}
+	if len(conditions) == 0 {
+		return
+	}
+	query.Q = strings.TrimSuffix(query.Q, ";") + "\n\t\t AND " + strings.Join(conditions, "\n\t\t AND ") + ";"
+}
+
+// Appends the ORDER BY clause of the sort order of the filter to a query filtered by apply, unless there is no sort order
+func (f GranuleFilter) order(query *bigquery.Query) {
+	if clause, ok := sortOrders[f.Sort]; ok {
+		query.Q = strings.TrimSuffix(query.Q, ";") + "\n\t\t ORDER BY " + clause + ";"
+	}
+}
+
+// Sentinel-2 processing levels: L1C (top-of-atmosphere) and L2A (surface reflectance)
+const (
+	LevelL1C = "L1C"
+	LevelL2A = "L2A"
+)
+
+// Granule is a granule id and the processing level of its product
+type Granule struct {
+	GranuleID string `json:"granule_id"`
+	Level     string `json:"level"`
+}
+
+// Derives the processing level from a product id, e.g. "S2A_MSIL2A_20180101T103421_N0206_R108_T32UNG_20180101T124911"
+func processingLevel(productID string) string {
+	if strings.Contains(productID, "MSI"+LevelL2A) {
+		return LevelL2A
+	}
+	return LevelL1C
+}
+
+// Reads granule id and product id columns of all rows into granules, skipping granules not of the given level
+func readGranules(rows rowIterator, level string) ([]Granule, error) {
+	granules := []Granule{}
+	for {
+		var row []bigquery.Value
+		err := rows.Next(&row) // No rows left
+		if err == iterator.Done {
+			return granules, nil // Returns result
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		granuleID, err := stringColumn(row, granuleIDColumn)
+		if err == ErrNullColumn {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		productID, err := stringColumn(row, productIDColumn)
+		if err != nil && err != ErrNullColumn {
+			return nil, err
+		}
+		granule := Granule{GranuleID: granuleID, Level: processingLevel(productID)}
+		if len(level) > 0 && granule.Level != level {
+			continue
+		}
+		granules = append(granules, granule)
+	}
+}
+
+// Maximum number of MGRS tiles that can be queried at once
+const maxTiles = 20
+
+// Retrieves links (i.e. granule ids) of all satellite images within any of the given MGRS tiles (e.g. 32UNG, 33UUB)
+func getLinksByTiles(tiles []string, filter GranuleFilter, r *http.Request) (Links, error) {
+	if len(tiles) > maxTiles {
+		return nil, fmt.Errorf("at most %d tiles can be queried, got %d", maxTiles, len(tiles))
+	}
+
+	ctx := contextFromRequest(r)
+	query := tilesQuery(tiles)
+	filter.apply(query)
+	filter.order(query)
+	rows, err := runQuery(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return readGranuleIDs(rows)
+}
+
+// Builds query selecting granules of the given tiles, where tiles are bound as a query parameter
+func tilesQuery(tiles []string) *bigquery.Query {
+	query := newQuery(strings.TrimSpace(
 		`SELECT granule_id
-		 FROM %[1]sbigquery-public-data.cloud_storage_geo_index.sentinel_2_index%[1]s
-		 WHERE %[2]s < north_lat
-		 AND south_lat < %[2]s
-		 AND %[3]s < east_lon
-		 AND west_lon < %[3]s;`, "`", lat, lng))
+		FROM ` + sentinelTable() + `
+		WHERE mgrs_tile IN UNNEST(@tiles);`))
+	query.Parameters = []bigquery.QueryParameter{{Name: "tiles", Value: tiles}}
+	return query
+}
 
-	var links Links
-	ctx := appengine.NewContext(r)
-	client, err := bigquery.NewClient(ctx, projectID)
+// rowIterator iterates the rows of a query result (e.g. bigquery.RowIterator)
+type rowIterator interface {
+	Next(dst interface{}) error
+}
+
+// ErrNullColumn is returned for a NULL value of a column that rows cannot be read without
+// Readers of many rows skip such rows, since the public index has a few incomplete entries
+var ErrNullColumn = errors.New("unexpected NULL column")
+
+// Returns the value of a column of a row, which is ErrNullColumn for a NULL value
+func columnValue(row []bigquery.Value, column int) (bigquery.Value, error) {
+	if column >= len(row) {
+		return nil, fmt.Errorf("unexpected column count: %d columns, column %d requested", len(row), column)
+	}
+	if row[column] == nil {
+		return nil, ErrNullColumn
+	}
+	return row[column], nil
+}
+
+// Error of a value of a column not of the type of the schema of the query
+func columnTypeError(column int, value bigquery.Value, expected string) error {
+	return fmt.Errorf("unexpected column type: column %d is %T, expected %s", column, value, expected)
+}
+
+// Reads a STRING column of a row
+func stringColumn(row []bigquery.Value, column int) (string, error) {
+	value, err := columnValue(row, column)
 	if err != nil {
-		return links, err
+		return "", err
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", columnTypeError(column, value, "STRING")
 	}
+	return s, nil
+}
 
-	query := client.Query(granuleQuery)
-	query.QueryConfig.UseStandardSQL = true
-	rows, err := query.Read(ctx)
+// Reads an INT64 column of a row
+func int64Column(row []bigquery.Value, column int) (int64, error) {
+	value, err := columnValue(row, column)
+	if err != nil {
+		return 0, err
+	}
+	i, ok := value.(int64)
+	if !ok {
+		return 0, columnTypeError(column, value, "INT64")
+	}
+	return i, nil
+}
+
+// Reads a FLOAT64 column of a row
+func float64Column(row []bigquery.Value, column int) (float64, error) {
+	value, err := columnValue(row, column)
+	if err != nil {
+		return 0, err
+	}
+	f, ok := value.(float64)
+	if !ok {
+		return 0, columnTypeError(column, value, "FLOAT64")
+	}
+	return f, nil
+}
+
+// Reads a count column of a row, where NULL is read as 0
+func countColumn(row []bigquery.Value, column int) (int64, error) {
+	count, err := int64Column(row, column)
+	if err == ErrNullColumn {
+		return 0, nil
+	}
+	return count, err
+}
 
+// Reads the granule id column of all rows into links
+func readGranuleIDs(rows rowIterator) (Links, error) {
+	var links Links
 	for {
 		var row []bigquery.Value
 		err := rows.Next(&row) // No rows left
@@ -54,125 +954,562 @@ func getLinks(lat, lng string, r *http.Request) (Links, error) {
 			return nil, err
 		}
 
-		granuleID := row[granuleIDColumn].(string)
+		granuleID, err := stringColumn(row, granuleIDColumn)
+		if err == ErrNullColumn {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
 		links = append(links, granuleID)
 	}
 }
 
+// Bounding box columns of a granule, which are read by the WHERE clause of location queries anyway
+const boundsColumns = "north_lat, south_lat, east_lon, west_lon"
+
+// GranuleBounds is a granule id and the bounding box of the granule in degrees
+type GranuleBounds struct {
+	GranuleID                string
+	North, South, East, West float64
+}
+
+// Reads the granule id column and the bounds columns, starting at the given column, of a row
+func rowBounds(row []bigquery.Value, column int) (GranuleBounds, error) {
+	granuleID, err := stringColumn(row, granuleIDColumn)
+	if err != nil {
+		return GranuleBounds{}, err
+	}
+	var bounds [4]float64
+	for i := range bounds {
+		if bounds[i], err = float64Column(row, column+i); err != nil {
+			return GranuleBounds{}, err
+		}
+	}
+	return GranuleBounds{GranuleID: granuleID, North: bounds[0], South: bounds[1], East: bounds[2], West: bounds[3]}, nil
+}
+
+// Reads the granule id column and the bounds columns, starting at the given column, of all rows
+func readGranuleBounds(rows rowIterator, column int) ([]GranuleBounds, error) {
+	granules := []GranuleBounds{}
+	for {
+		var row []bigquery.Value
+		err := rows.Next(&row) // No rows left
+		if err == iterator.Done {
+			return granules, nil // Returns result
+		}
+		if err != nil {
+			return nil, err
+		}
+		granule, err := rowBounds(row, column)
+		if err == ErrNullColumn {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		granules = append(granules, granule)
+	}
+}
+
 // Project 2 : Image data in geographic location
 // Fetches all sentinel-2 image folders that contain image data within the specified area of interest, using the Big Query Api
-func getImageBaseURL(lat1, lng1, lat2, lng2 string, r *http.Request) (Links, error) {
-	imageURLQuery := strings.TrimSpace(fmt.Sprintf(
-		`SELECT base_url, granule_id 
-		FROM %[1]sbigquery-public-data.cloud_storage_geo_index.sentinel_2_index%[1]s
-		WHERE %[2]s < north_lat
-		AND south_lat < %[4]s
-		AND %[3]s < east_lon
-		AND west_lon < %[5]s;`, "`", lat1, lng1, lat2, lng2)) // Argument 2, 3, 4, 5
-	links := Links{}
-	client, err := bigquery.NewClient(r.Context(), projectID)
+// The bounds of each granule are returned as well, e.g. to return the granules as GeoJSON
+// A box crossing the antimeridian is queried per side, merging the granules of both sides, which are each ordered by the filter
+// At most maxResults granules of the route of the request are read, where truncated tells whether the area has more granules
+func getImageBaseURL(box Box, filter GranuleFilter, layout Layout, r *http.Request) (links Links, granules []GranuleBounds, truncated bool, err error) {
+	defer observeQuery("box", time.Now(), &err)
+	limit := maxResults(r.URL.Path)
+	dataset := filter.dataset()
+	layout.Flat = dataset.Flat
+	links, granules = Links{}, []GranuleBounds{}
+	found := map[string]bool{}
+	for _, side := range box.split() {
+		query := dataset.boxQuery(dataset.IDColumn+", base_url, "+boundsColumns, side)
+		filter.apply(query)
+		filter.order(query)
+		rows, err := runQuery(r.Context(), query)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		sideLinks, sideGranules, sideTruncated, err := readImageBaseURLs(rows, layout, limit-len(links))
+		if err != nil {
+			return nil, nil, false, err
+		}
+		for i, granule := range sideGranules {
+			if found[granule.GranuleID] {
+				continue // Granule spanning the antimeridian, found on both sides
+			}
+			found[granule.GranuleID] = true
+			links, granules = append(links, sideLinks[i]), append(granules, granule)
+		}
+		if sideTruncated {
+			return links, granules, true, nil
+		}
+	}
+	return links, granules, false, nil
+}
+
+// Fetches the image folder and bounds of a single granule of each footprint (e.g. MGRS tile) within a bounding box
+// Revisits of a footprint share its bounds, so only its latest granule is read, or the first in the sort order of the filter
+// At most maxResults footprints of the route of the request are read, where truncated tells whether the box has more footprints
+func getFootprintGranules(box Box, filter GranuleFilter, r *http.Request) (links Links, granules []GranuleBounds, truncated bool, err error) {
+	defer observeQuery("footprint", time.Now(), &err)
+	rows, err := runQuery(r.Context(), footprintQuery(box, filter))
 	if err != nil {
-		return nil, err
+		return nil, nil, false, err
 	}
+	return readImageBaseURLs(rows, Layout{Flat: filter.dataset().Flat}, maxResults(r.URL.Path))
+}
 
-	query := client.Query(imageURLQuery)
-	query.QueryConfig.UseStandardSQL = true
-	rows, err := query.Read(r.Context())
+// Builds query of the granule id, base url and bounds of a single granule of each footprint of the dataset within a box
+func footprintQuery(box Box, filter GranuleFilter) *bigquery.Query {
+	dataset := filter.dataset()
+	order := "sensing_time DESC"
+	if clause, ok := sortOrders[filter.Sort]; ok {
+		order = clause
+	}
+	query := dataset.boxQuery(fmt.Sprintf("ARRAY_AGG(STRUCT(%s, base_url, %s) ORDER BY %s LIMIT 1)[OFFSET(0)] AS granule",
+		dataset.IDColumn, boundsColumns, order), box)
+	filter.apply(query)
+	query.Q = "SELECT granule.*\n\t\tFROM (" + strings.TrimSuffix(query.Q, ";") + "\n\t\t GROUP BY " + dataset.Footprint + ");"
+	return query
+}
+
+// Layout is how the images of the granules of a processing level are stored in the buckets
+// L1C granules store all bands in IMG_DATA, whereas L2A granules nest the bands in a folder per resolution (R10m, R20m, R60m)
+type Layout struct {
+	Level      string // L1C or L2A, where empty means the L1C layout
+	Resolution int    // Resolution folder of L2A granules, 0 means all resolution folders
+	Flat       bool   // Images are stored right in the base url folder, e.g. the scenes of Landsat 8
+}
+
+// Returns the image folder of a granule, e.g. gcp-public-data-sentinel-2/tiles/32/U/NG/<product>.SAFE/GRANULE/<granule>/IMG_DATA/
+// The image folder of an L2A granule of a resolution is the resolution folder, e.g. .../IMG_DATA/R10m/
+// The image folder of a flat layout is the base url, e.g. gcp-public-data-landsat/LC08/01/044/034/<scene>/
+func (l Layout) imageFolder(baseURL, granuleID string) string {
+	imageBaseURL := strings.Replace(baseURL, "gs://", "", 1) // Removes trailing gs:// from bucket name
+	if l.Flat {
+		return strings.TrimSuffix(imageBaseURL, "/") + "/"
+	}
+	folder := imageBaseURL + "/GRANULE/" + granuleID + "/IMG_DATA/"
+	if l.Level == LevelL2A && l.Resolution > 0 {
+		folder += resolutionFolders[l.Resolution] + "/"
+	}
+	return folder
+}
+
+// Splits a link of an image folder into its bucket and the object prefix of the folder within the bucket
+// The bucket is the first path segment, e.g. gcp-public-data-sentinel-2 of both tiles/... (L1C) and L2/tiles/... (L2A) folders
+func splitLink(link string) (string, string) {
+	link = strings.TrimPrefix(link, "gs://")
+	if i := strings.Index(link, "/"); i >= 0 {
+		return link[:i], strings.Trim(link[i:], "/")
+	}
+	return link, ""
+}
+
+// Reads the image folder and bounds of each granule, where each row is a granule id, base url and bounds
+// Rows are read until limit granules are read, where truncated tells whether there are more rows
+func readImageBaseURLs(rows rowIterator, layout Layout, limit int) (links Links, granules []GranuleBounds, truncated bool, err error) {
+	links, granules = Links{}, []GranuleBounds{}
+	row := []bigquery.Value{}
+	for {
+		err := rows.Next(&row) // No rows left
+		if err == iterator.Done {
+			return links, granules, false, nil // Returns result
+		}
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if len(links) >= limit {
+			return links, granules, true, nil // Rows beyond the limit are not read
+		}
+		granule, err := rowBounds(row, baseURLColumn+1)
+		if err == ErrNullColumn {
+			continue
+		}
+		if err != nil {
+			return nil, nil, false, err
+		}
+		baseURL, err := stringColumn(row, baseURLColumn)
+		if err == ErrNullColumn {
+			continue
+		}
+		if err != nil {
+			return nil, nil, false, err
+		}
+		links = append(links, layout.imageFolder(baseURL, granule.GranuleID))
+		granules = append(granules, granule)
+	}
+}
+
+// Counts the sentinel-2 image folders within the specified area of interest with a single COUNT query
+// The count is the number of links of getImageBaseURL, without listing the images of every folder in the buckets
+// A box crossing the antimeridian is counted in the same query, so granules found on both sides of ±180° are counted once
+func getImageCountByBox(box Box, filter GranuleFilter, r *http.Request) (int64, error) {
+	rows, err := runQuery(r.Context(), boxCountQuery(box, filter))
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
+	return readCount(rows)
+}
+
+// Builds the query counting the distinct granules of the same bounding box and filter as getImageBaseURL
+func boxCountQuery(box Box, filter GranuleFilter) *bigquery.Query {
+	dataset := filter.dataset()
+	query := dataset.boxQuery("COUNT(DISTINCT "+dataset.IDColumn+")", box)
+	filter.apply(query)
+	return query
+}
 
+// Reads the single count of a COUNT query
+func readCount(rows rowIterator) (int64, error) {
 	row := []bigquery.Value{}
-	imageBaseURL, granuleID, fullImageURL := "", "", ""
+	if err := rows.Next(&row); err != nil {
+		return 0, err
+	}
+	return countColumn(row, 0)
+}
+
+// ErrGranuleNotFound is returned when no granule of the sentinel-2 index has the requested id
+var ErrGranuleNotFound = errors.New("granule not found")
+
+// GranuleMetadata holds the metadata of a granule in the sentinel-2 index
+type GranuleMetadata struct {
+	GranuleID   string    `json:"granule_id"`
+	BaseURL     string    `json:"base_url"`
+	SensingTime time.Time `json:"sensing_time"`
+	CloudCover  *float64  `json:"cloud_cover"` // NULL when the cloud cover is unknown
+	North       float64   `json:"north_lat"`
+	South       float64   `json:"south_lat"`
+	East        float64   `json:"east_lon"`
+	West        float64   `json:"west_lon"`
+}
+
+// Retrieves the metadata of a granule by its id, or ErrGranuleNotFound if there is no such granule
+func getGranule(id string, r *http.Request) (GranuleMetadata, error) {
+	ctx := contextFromRequest(r)
+	rows, err := runQuery(ctx, granuleQuery(id))
+	if err != nil {
+		return GranuleMetadata{}, err
+	}
+	return readGranuleMetadata(rows)
+}
+
+// Columns of the metadata of a granule, read by rowGranuleMetadata
+const metadataColumns = "granule_id, base_url, sensing_time, cloud_cover, " + boundsColumns
+
+// Retrieves the metadata of all granules within the specified area of interest, e.g. to export the granules as CSV
+// A box crossing the antimeridian is queried per side as by getImageBaseURL
+func getAreaGranules(box Box, filter GranuleFilter, r *http.Request) (granules []GranuleMetadata, err error) {
+	defer observeQuery("box", time.Now(), &err)
+	granules = []GranuleMetadata{}
+	found := map[string]bool{}
+	for _, side := range box.split() {
+		query := filter.dataset().boxQuery(filter.dataset().metadataColumns(), side)
+		filter.apply(query)
+		filter.order(query)
+		rows, err := runQuery(r.Context(), query)
+		if err != nil {
+			return nil, err
+		}
+		sideGranules, err := readGranulesMetadata(rows)
+		if err != nil {
+			return nil, err
+		}
+		for _, granule := range sideGranules {
+			if !found[granule.GranuleID] {
+				found[granule.GranuleID] = true // Granules spanning the antimeridian are found on both sides
+				granules = append(granules, granule)
+			}
+		}
+	}
+	return granules, nil
+}
+
+// Reads the metadata of all rows
+func readGranulesMetadata(rows rowIterator) ([]GranuleMetadata, error) {
+	granules := []GranuleMetadata{}
 	for {
+		var row []bigquery.Value
 		err := rows.Next(&row) // No rows left
 		if err == iterator.Done {
-			return links, nil // Returns result
+			return granules, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		granule, err := rowGranuleMetadata(row)
+		if err == ErrNullColumn {
+			continue
 		}
 		if err != nil {
 			return nil, err
 		}
-		imageBaseURL = strings.Replace(row[0].(string), "gs://", "", 1) // Removes trailing gs:// from bucket name
-		granuleID = row[1].(string)
-		fullImageURL = imageBaseURL + "/GRANULE/" + granuleID + "/IMG_DATA/"
-		links = append(links, fullImageURL)
+		granules = append(granules, granule)
+	}
+}
+
+// Builds query selecting the metadata of a granule, where the granule id is bound as a query parameter
+func granuleQuery(id string) *bigquery.Query {
+	query := newQuery(strings.TrimSpace(
+		`SELECT ` + metadataColumns + `
+		FROM ` + sentinelTable() + `
+		WHERE granule_id = @id
+		LIMIT 1;`))
+	query.Parameters = []bigquery.QueryParameter{{Name: "id", Value: id}}
+	return query
+}
+
+// Reads the metadata of the first row
+func readGranuleMetadata(rows rowIterator) (GranuleMetadata, error) {
+	var row []bigquery.Value
+	err := rows.Next(&row)
+	if err == iterator.Done {
+		return GranuleMetadata{}, ErrGranuleNotFound
 	}
+	if err != nil {
+		return GranuleMetadata{}, err
+	}
+	return rowGranuleMetadata(row)
+}
+
+// Reads the metadata of a row of the metadata columns, where a missing cloud cover is read as 0
+func rowGranuleMetadata(row []bigquery.Value) (GranuleMetadata, error) {
+	bounds, err := rowBounds(row, 4)
+	if err != nil {
+		return GranuleMetadata{}, err
+	}
+	baseURL, err := stringColumn(row, baseURLColumn)
+	if err != nil {
+		return GranuleMetadata{}, err
+	}
+	granule := GranuleMetadata{
+		GranuleID: bounds.GranuleID,
+		BaseURL:   baseURL,
+		North:     bounds.North,
+		South:     bounds.South,
+		East:      bounds.East,
+		West:      bounds.West,
+	}
+	granule.SensingTime, _ = row[2].(time.Time)
+	if cloudCover, ok := row[3].(float64); ok {
+		granule.CloudCover = &cloudCover
+	}
+	return granule, nil
+}
+
+// cellGranules are the granules found within the bounds of a region cover cell, identified by its token
+type cellGranules struct {
+	token    string
+	granules []GranuleBounds
 }
 
 // Project 3 : Fetch all links to granules containing a subfolder of images that match specified area of interest, using Big query API
 // This version works in parallel by using goroutines and channels
+// Granule ids are returned rather than a count, since granules may intersect several cells of a region cover
 // TODO: refactor getImageBaseUrl to support setting concurrency level for fetching links in parallel
-func getImageCount(client *bigquery.Client, r *http.Request, channel chan int, errors chan error, lat1, lng1, lat2, lng2 string) {
-	count := 0
-	imageURLQuery := strings.TrimSpace(fmt.Sprintf(
-		`SELECT COUNT(granule_id)  
-		FROM %[1]sbigquery-public-data.cloud_storage_geo_index.sentinel_2_index%[1]s
-		WHERE %[2]s < north_lat
-		AND south_lat < %[4]s
-		AND %[3]s < east_lon
-		AND west_lon < %[5]s;`, "`", lat1, lng1, lat2, lng2))
-
-	query := client.Query(imageURLQuery)
-	query.QueryConfig.UseStandardSQL = true
-	rows, err := query.Read(r.Context())
+// Concurrent requests of the same cell (e.g. of the region cover of the same country) share a single query
+func getImageCount(ctx context.Context, channel chan cellGranules, errors chan error, token, lat1, lng1, lat2, lng2 string) {
+	key := strings.Join([]string{token, lat1, lng1, lat2, lng2}, ",")
+	granules, err := shareFlight(ctx, &cellFlights, key, func(ctx context.Context) (interface{}, error) {
+		return queryCell(ctx, lat1, lng1, lat2, lng2)
+	})
 	if err != nil {
 		errors <- err
+		return
 	}
+	channel <- cellGranules{token, granules.([]GranuleBounds)} // Write granules to channel instead of returning
+}
 
-	row := []bigquery.Value{}
-	for {
-		err := rows.Next(&row) // No rows left
-		if err == iterator.Done {
-			channel <- count // Write image count to channel instead of returning
-			break
+// Queries the granule ids and bounds of all granules within the bounding box of a cell
+// The bounds of a cell crossing the antimeridian are queried per side, merging the granules found on both sides
+func queryCell(ctx context.Context, lat1, lng1, lat2, lng2 string) (granules []GranuleBounds, err error) {
+	defer observeQuery("cell", time.Now(), &err)
+	box, err := parseBounds(lat1, lng1, lat2, lng2)
+	if err != nil {
+		return nil, err
+	}
+	granules = []GranuleBounds{}
+	found := map[string]bool{}
+	for _, side := range box.split() {
+		rows, err := runQuery(ctx, newBoxQuery("granule_id, "+boundsColumns, side))
+		if err != nil {
+			return nil, err
 		}
+		sideGranules, err := readGranuleBounds(rows, granuleIDColumn+1)
 		if err != nil {
-			errors <- err
+			return nil, err
+		}
+		for _, granule := range sideGranules {
+			if !found[granule.GranuleID] {
+				found[granule.GranuleID] = true // Granules spanning the antimeridian are found on both sides
+				granules = append(granules, granule)
+			}
 		}
-		imgCount := int(row[0].(int64))
-		count += imgCount
 	}
+	return granules, nil
+}
+
+// Project 3 : Estimates the number of granules within a bounding box, using approximate aggregation in a single query
+// This is much faster than counting each cell of a region cover, but the count is only approximate
+func getImageEstimate(r *http.Request, lat1, lng1, lat2, lng2 string) (int, error) {
+	query, err := boxQuery("APPROX_COUNT_DISTINCT(granule_id)", lat1, lng1, lat2, lng2)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := runQuery(r.Context(), query)
+	if err != nil {
+		return 0, err
+	}
+
+	row := []bigquery.Value{}
+	err = rows.Next(&row)
+	if err == iterator.Done {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	count, err := countColumn(row, 0)
+	return int(count), err
+}
+
+// TransportConfig tunes the connection pooling of the HTTP transport used by a Google Cloud client
+type TransportConfig struct {
+	MaxConnsPerHost     int // 0 means no limit
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+}
+
+// StorageTransport configures the connections of the storage client shared by the workers fetching images from buckets
+var StorageTransport = TransportConfig{MaxConnsPerHost: 0, MaxIdleConnsPerHost: 100, IdleConnTimeout: 90 * time.Second}
+
+// Creates HTTP transport with the configured connection limits
+func (c TransportConfig) transport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxConnsPerHost = c.MaxConnsPerHost
+	transport.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = c.IdleConnTimeout
+	return transport
+}
+
+// storageOptions are further options of the shared storage client, e.g. the endpoint of a fake bucket in tests
+var storageOptions []option.ClientOption
+
+// The storage client shared by all requests, which is created by the first listing, and its base transport
+var (
+	storageMu        sync.Mutex
+	sharedStorage    *storage.Client
+	storageTransport *http.Transport
+)
+
+// Returns the storage client shared by all requests, so StorageTransport limits the connections of the whole service
+// The client is safe for concurrent use by request goroutines and is created again if creating it failed
+func storageClient(ctx context.Context) (*storage.Client, error) {
+	storageMu.Lock()
+	defer storageMu.Unlock()
+	if sharedStorage != nil {
+		return sharedStorage, nil
+	}
+	base := StorageTransport.transport()
+	client, err := newStorageClient(withoutCancel(ctx), base) // The client outlives the request that creates it
+	if err != nil {
+		return nil, err
+	}
+	sharedStorage, storageTransport = client, base
+	return client, nil
+}
+
+// Creates a storage client with read-only access whose connections go through the base transport
+func newStorageClient(ctx context.Context, base *http.Transport) (*storage.Client, error) {
+	transport, err := htransport.NewTransport(ctx, base, append([]option.ClientOption{option.WithScopes(storage.ScopeReadOnly)}, storageOptions...)...)
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewClient(ctx, append([]option.ClientOption{option.WithHTTPClient(&http.Client{Transport: transport})}, storageOptions...)...)
+}
+
+// CloseStorageClient closes the storage client shared by all requests and its idle connections, e.g. on shutdown
+func CloseStorageClient() error {
+	storageMu.Lock()
+	defer storageMu.Unlock()
+	if sharedStorage == nil {
+		return nil
+	}
+	err := sharedStorage.Close()
+	storageTransport.CloseIdleConnections()
+	sharedStorage, storageTransport = nil, nil
+	return err
+}
+
+// ObjectLister lists the objects of a bucket matching a query, e.g. the objects of an image folder by its prefix
+// The service lists objects with the Storage client, whereas tests replace the lister with fakes returning canned objects
+type ObjectLister interface {
+	ListObjects(ctx context.Context, bucketName string, query *storage.Query) objectIterator
+}
+
+// objectIterator iterates the objects of a bucket (e.g. storage.ObjectIterator)
+type objectIterator interface {
+	Next() (*storage.ObjectAttrs, error)
+}
+
+// storageLister lists the objects of buckets with a storage client
+type storageLister struct {
+	client *storage.Client
+}
+
+func (l storageLister) ListObjects(ctx context.Context, bucketName string, query *storage.Query) objectIterator {
+	return l.client.Bucket(bucketName).Objects(ctx, query)
+}
+
+// newObjectLister creates the object lister of the workers fetching images from buckets on the shared storage client, which tests replace with fakes
+var newObjectLister = func(ctx context.Context) (ObjectLister, error) {
+	client, err := storageClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return storageLister{client}, nil
 }
 
+// noLimit is the limit of listing all images of a folder
+const noLimit = -1
+
 // Project 2 : Image data in geographic location
 // Fetches a complete list of image ids from a specified image folder in the sentinel-2 folder, using the Cloud Bucket Storage API
-func getImagesFromBucket(client *storage.Client, bucketName, objectName string, r *http.Request) (Links, error) {
+// Images are listed until limit images are found, where truncated tells whether the folder has more images, and noLimit lists all images
+func getImagesFromBucket(lister ObjectLister, bucketName, objectName string, filter ImageFilter, limit int, r *http.Request) (links Links, truncated bool, err error) {
+	defer observeStorage(time.Now(), &err)
 	query := storage.Query{Prefix: objectName, Versions: false}
-	links := Links{}
+	links = Links{}
+	seen := map[string]bool{} // Object names already linked, since the listing may yield an object more than once
 	fullImageURL := bytes.Buffer{}
 
-	it := client.Bucket(bucketName).Objects(r.Context(), &query)
+	it := lister.ListObjects(r.Context(), bucketName, &query)
 	for {
+		if err := r.Context().Err(); err != nil {
+			return nil, false, err // Request cancelled between pages of objects
+		}
 		attrs, err := it.Next()
 		if err == iterator.Done {
 			break
 		}
 
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
 
+		if !filter.Match(attrs.Name) || seen[attrs.Name] {
+			continue // Band or resolution not requested, or image already linked
+		}
+		seen[attrs.Name] = true
+		if limit != noLimit && len(links) >= limit {
+			return links, true, nil // Objects beyond the limit are not listed
+		}
 		fullImageURL.WriteString(bucketName + "/" + attrs.Name)
 		links = append(links, fullImageURL.String())
 		fullImageURL.Reset()
 	}
-	return links, nil
+	return links, false, nil
 }
-
-// Project 3 : Helper function (https://www.dotnetperls.com/duplicates-go)
-// Remove potentially duplicated granules in region cover to avoid counting images twice
-// func removeDuplicatesUnordered(elements []string) []string {
-// 	encountered := map[string]bool{}
-
-// 	// Create a map of all unique elements.
-// 	for v := range elements {
-// 		encountered[elements[v]] = true
-// 	}
-
-// 	// Place all keys from the map into a slice.
-// 	result := []string{}
-// 	for key := range encountered {
-// 		result = append(result, key)
-// 	}
-// 	return result
-// }
@@ -0,0 +1,1281 @@
+// Package satservice : this contains unit tests of the query helpers that do not require an App Engine instance
+package satservice
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+	"github.com/golang/geo/s2"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// Filtering bucket objects to band B04 at 10m resolution should only keep the matching L2A object
+func TestImageFilter_BandAndResolution(t *testing.T) {
+	objects := []string{
+		"L2/tiles/32/U/NG/S2A.SAFE/GRANULE/L2A_T32UNG/IMG_DATA/R10m/T32UNG_20180101T103421_B04_10m.jp2",
+		"L2/tiles/32/U/NG/S2A.SAFE/GRANULE/L2A_T32UNG/IMG_DATA/R10m/T32UNG_20180101T103421_B08_10m.jp2",
+		"L2/tiles/32/U/NG/S2A.SAFE/GRANULE/L2A_T32UNG/IMG_DATA/R20m/T32UNG_20180101T103421_B04_20m.jp2",
+		"L2/tiles/32/U/NG/S2A.SAFE/GRANULE/L2A_T32UNG/IMG_DATA/R60m/T32UNG_20180101T103421_B04_60m.jp2",
+	}
+	filter := ImageFilter{Bands: []string{"B04"}, Resolution: 10}
+
+	matches := []string{}
+	for _, object := range objects {
+		if filter.Match(object) {
+			matches = append(matches, object)
+		}
+	}
+
+	if len(matches) != 1 || matches[0] != objects[0] {
+		t.Errorf("filter returned unexpected objects: got %v want [%v]", matches, objects[0])
+	}
+}
+
+// slowJob is a fake BigQuery job that never finishes before its context is done
+type slowJob struct {
+	cancelled bool
+}
+
+func (j *slowJob) Wait(ctx context.Context) (*bigquery.JobStatus, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (j *slowJob) Cancel(ctx context.Context) error {
+	j.cancelled = true
+	return nil
+}
+
+// A job that outlives the query timeout should be cancelled server-side
+func TestAwaitJob_CancelsOnTimeout(t *testing.T) {
+	job := &slowJob{}
+	err := awaitJob(context.Background(), job, 10*time.Millisecond)
+
+	if err != context.DeadlineExceeded {
+		t.Errorf("awaitJob returned wrong error: got %v want %v", err, context.DeadlineExceeded)
+	}
+	if !job.cancelled {
+		t.Error("awaitJob did not cancel the job on timeout")
+	}
+}
+
+// fakeRows is a fake query result that yields the given rows
+type fakeRows struct {
+	rows [][]bigquery.Value
+}
+
+func (f *fakeRows) Next(dst interface{}) error {
+	if len(f.rows) == 0 {
+		return iterator.Done
+	}
+	*dst.(*[]bigquery.Value) = f.rows[0]
+	f.rows = f.rows[1:]
+	return nil
+}
+
+// Querying multiple tiles should bind exactly the requested tiles and return the granules of those tiles only
+func TestTilesQuery(t *testing.T) {
+	tiles := []string{"32UNG", "33UUB"}
+	query := tilesQuery(tiles)
+
+	if !strings.HasSuffix(query.Q, "WHERE mgrs_tile IN UNNEST(@tiles);") {
+		t.Errorf("query is not filtered by the tiles alone: %v", query.Q)
+	}
+	if len(query.Parameters) != 1 || !reflect.DeepEqual(query.Parameters[0].Value, tiles) {
+		t.Errorf("query has wrong tile parameters: got %v want %v", query.Parameters, tiles)
+	}
+
+	// Index of granules answering the tile predicate like BigQuery, including a granule of another tile
+	index := map[string]string{
+		"L1C_T32UNG_A012345_20171010T103021": "32UNG",
+		"L1C_T33UUB_A012345_20171010T103021": "33UUB",
+		"L1C_T34VCJ_A012345_20171010T103021": "34VCJ",
+	}
+	defer withQuerier(querierFunc(func(params map[string]interface{}) [][]bigquery.Value {
+		var rows [][]bigquery.Value
+		for granuleID, tile := range index {
+			for _, requested := range params["tiles"].([]string) {
+				if tile == requested {
+					rows = append(rows, []bigquery.Value{granuleID})
+				}
+			}
+		}
+		return rows
+	}))()
+	links, err := getLinksByTiles(tiles, GranuleFilter{}, httptest.NewRequest("GET", "/images", nil))
+	if err != nil {
+		t.Fatalf("Failed to query tiles: %v", err)
+	}
+	sort.Strings(links)
+	if expected := (Links{"L1C_T32UNG_A012345_20171010T103021", "L1C_T33UUB_A012345_20171010T103021"}); !reflect.DeepEqual(links, expected) {
+		t.Errorf("wrong granules of the tiles: got %v want %v", links, expected)
+	}
+}
+
+// Filtering granules to L2A should exclude the L1C granules of the same location
+func TestReadGranules_Level(t *testing.T) {
+	rows := &fakeRows{rows: [][]bigquery.Value{
+		{"L1C_T32UNG_A012345_20171010T103021", "S2A_MSIL1C_20171010T103021_N0205_R108_T32UNG_20171010T103021"},
+		{"L2A_T32UNG_A012345_20171010T103021", "S2A_MSIL2A_20171010T103021_N0205_R108_T32UNG_20171010T103021"},
+	}}
+	granules, err := readGranules(rows, LevelL2A)
+	if err != nil {
+		t.Fatalf("Failed to read granules: %v", err)
+	}
+
+	expected := []Granule{{GranuleID: "L2A_T32UNG_A012345_20171010T103021", Level: LevelL2A}}
+	if !reflect.DeepEqual(granules, expected) {
+		t.Errorf("wrong granules: got %v want %v", granules, expected)
+	}
+}
+
+// Concurrent requests should share a single storage client, whose connections to the bucket are limited by StorageTransport
+func TestStorageClient_MaxConnsPerHost(t *testing.T) {
+	var mu sync.Mutex
+	open, maxOpen := 0, 0
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"kind": "storage#objects", "items": [{"name": "GRANULE/IMG_DATA/T32UNG_B04.jp2"}]}`))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch state {
+		case http.StateNew:
+			open++
+			if open > maxOpen {
+				maxOpen = open
+			}
+		case http.StateClosed, http.StateHijacked:
+			open--
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	defer func(old TransportConfig) { StorageTransport = old }(StorageTransport)
+	defer func(old []option.ClientOption) { storageOptions = old }(storageOptions)
+	StorageTransport = TransportConfig{MaxConnsPerHost: 2, MaxIdleConnsPerHost: 2}
+	storageOptions = []option.ClientOption{option.WithEndpoint(server.URL + "/storage/v1/"), option.WithoutAuthentication()}
+	CloseStorageClient()
+	defer CloseStorageClient()
+
+	clients := make([]*storage.Client, 10)
+	wg := sync.WaitGroup{}
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", "/area", nil) // Each listing belongs to a request of its own
+			lister, err := newObjectLister(r.Context())
+			if err != nil {
+				t.Errorf("Failed to create object lister: %v", err)
+				return
+			}
+			clients[i] = lister.(storageLister).client
+			links, _, err := getImagesFromBucket(lister, "gcp-public-data-sentinel-2", "GRANULE/", ImageFilter{}, noLimit, r)
+			if err != nil || len(links) != 1 {
+				t.Errorf("Failed to list images: got %v links and error %v", len(links), err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i, client := range clients {
+		if client != clients[0] {
+			t.Errorf("request %v did not share the storage client", i)
+		}
+	}
+	if maxOpen > StorageTransport.MaxConnsPerHost {
+		t.Errorf("too many concurrent connections: got %v want at most %v", maxOpen, StorageTransport.MaxConnsPerHost)
+	}
+	if err := CloseStorageClient(); err != nil || sharedStorage != nil {
+		t.Errorf("storage client was not closed: %v", err)
+	}
+}
+
+// The estimate query should use approximate aggregation over the whole bounding box in a single query, and flag its count as approximate
+func TestEstimateQuery(t *testing.T) {
+	query, err := boxQuery("APPROX_COUNT_DISTINCT(granule_id)", "54.5", "8.0", "57.8", "15.2")
+	if err != nil {
+		t.Fatalf("Failed to build query: %v", err)
+	}
+
+	if !strings.HasPrefix(query.Q, "SELECT APPROX_COUNT_DISTINCT(granule_id)") {
+		t.Errorf("query is not approximate: %v", query.Q)
+	}
+	expected := []float64{54.5, 8.0, 57.8, 15.2}
+	for i, param := range query.Parameters {
+		if param.Value != expected[i] {
+			t.Errorf("query has wrong bound %v: got %v want %v", param.Name, param.Value, expected[i])
+		}
+	}
+
+	fake := &fakeQuerier{rows: [][]bigquery.Value{{int64(12)}}}
+	defer withQuerier(fake)()
+	defer withGranuleImages(func(r *http.Request, granuleID string) (int, error) { return 0, errors.New("not sampled") })()
+	cover := s2.CellUnion{s2.CellIDFromLatLng(s2.LatLngFromDegrees(55.660797, 12.5896)).Parent(8)}
+	imageCount, err := estimateImagesByRegion(cover, httptest.NewRequest("GET", "/geo", nil))
+	if err != nil {
+		t.Fatalf("Failed to estimate: %v", err)
+	}
+	if !imageCount.Approximate || imageCount.Total != 12*bucketGranuleSize {
+		t.Errorf("wrong estimate: got total %v and approximate %v want %v and true", imageCount.Total, imageCount.Approximate, 12*bucketGranuleSize)
+	}
+	if !strings.HasPrefix(fake.sql, "SELECT APPROX_COUNT_DISTINCT(granule_id)") {
+		t.Errorf("estimate was not queried approximately: %v", fake.sql)
+	}
+}
+
+// Coordinates must be bound as numeric parameters, so malicious input never reaches the query string
+func TestPointQuery_Injection(t *testing.T) {
+	if query, err := pointQuery("granule_id", "55.6'; DROP", "12.5896"); err == nil {
+		t.Errorf("query accepted non-numeric latitude: %v", query.Q)
+	}
+	if query, err := boxQuery("granule_id", "55.6", "12.5", "55.7'; DROP", "12.6"); err == nil {
+		t.Errorf("query accepted non-numeric latitude: %v", query.Q)
+	}
+
+	query, err := pointQuery("granule_id", "55.660797", "12.5896")
+	if err != nil {
+		t.Fatalf("Failed to build query: %v", err)
+	}
+	if strings.Contains(query.Q, "55.660797") || strings.Contains(query.Q, "12.5896") {
+		t.Errorf("coordinates are part of the query string: %v", query.Q)
+	}
+	if len(query.Parameters) != 2 || query.Parameters[0].Value != 55.660797 || query.Parameters[1].Value != 12.5896 {
+		t.Errorf("query has wrong parameters: %v", query.Parameters)
+	}
+}
+
+// Consecutive pages should be ordered by granule id with offsets a full page apart, so the second page never repeats the first
+func TestPageQuery(t *testing.T) {
+	first, err := pageQuery("55.660797", "12.5896", 100, 0, GranuleFilter{})
+	if err != nil {
+		t.Fatalf("Failed to build query: %v", err)
+	}
+	second, err := pageQuery("55.660797", "12.5896", 100, 100, GranuleFilter{})
+	if err != nil {
+		t.Fatalf("Failed to build query: %v", err)
+	}
+
+	if !strings.Contains(first.Q, "ORDER BY granule_id") || !strings.HasSuffix(first.Q, "LIMIT @limit OFFSET @offset;") {
+		t.Errorf("query is not paginated by granule id: %v", first.Q)
+	}
+	params := map[string]interface{}{}
+	for _, param := range second.Parameters {
+		params[param.Name] = param.Value
+	}
+	if params["limit"] != 100 || params["offset"] != 100 {
+		t.Errorf("second page has wrong limit and offset: %v", params)
+	}
+}
+
+// Consecutive pages should not overlap, and the total should be counted even for a page past the last granule
+func TestGetLinksPage(t *testing.T) {
+	granules := []string{"G1", "G2", "G3", "G4", "G5"}
+	defer withQuerier(querierFunc(func(params map[string]interface{}) [][]bigquery.Value {
+		if _, ok := params["limit"]; !ok {
+			return [][]bigquery.Value{{int64(len(granules))}} // Count query
+		}
+		var rows [][]bigquery.Value
+		for i := params["offset"].(int); i < len(granules) && len(rows) < params["limit"].(int); i++ {
+			rows = append(rows, []bigquery.Value{granules[i]})
+		}
+		return rows
+	}))()
+	r := httptest.NewRequest("GET", "/images", nil)
+
+	seen := map[string]int{}
+	for _, offset := range []int{0, 2, 4} {
+		page, err := getLinksPage("55.660797", "12.5896", 2, offset, GranuleFilter{}, r)
+		if err != nil {
+			t.Fatalf("Failed to get page at offset %v: %v", offset, err)
+		}
+		if page.Total != len(granules) {
+			t.Errorf("wrong total at offset %v: got %v want %v", offset, page.Total, len(granules))
+		}
+		for _, link := range page.Links {
+			if previous, ok := seen[link]; ok {
+				t.Errorf("pages at offsets %v and %v overlap in %v", previous, offset, link)
+			}
+			seen[link] = offset
+		}
+	}
+	if len(seen) != len(granules) {
+		t.Errorf("pages missed granules: got %v want %v", len(seen), len(granules))
+	}
+
+	page, err := getLinksPage("55.660797", "12.5896", 2, 10, GranuleFilter{}, r)
+	if err != nil {
+		t.Fatalf("Failed to get page past the last granule: %v", err)
+	}
+	if len(page.Links) != 0 || page.Total != len(granules) {
+		t.Errorf("wrong page past the last granule: got %v links and total %v want 0 and %v", len(page.Links), page.Total, len(granules))
+	}
+}
+
+// The latest granule should be queried by descending sensing time limited to a single row, and no rows means no granules
+func TestLatestQuery(t *testing.T) {
+	query, err := latestQuery("55.660797", "12.5896", GranuleFilter{})
+	if err != nil {
+		t.Fatalf("Failed to build query: %v", err)
+	}
+	if !strings.Contains(query.Q, "ORDER BY sensing_time DESC") || !strings.HasSuffix(query.Q, "LIMIT 1;") {
+		t.Errorf("query does not select the latest granule: %v", query.Q)
+	}
+
+	sensingTime := time.Date(2017, 10, 10, 10, 30, 21, 0, time.UTC)
+	latest, err := readLatestGranule(&fakeRows{rows: [][]bigquery.Value{{"L1C_T32UNG_A012345_20171010T103021", sensingTime}}})
+	if err != nil || latest != (LatestGranule{GranuleID: "L1C_T32UNG_A012345_20171010T103021", SensingTime: sensingTime}) {
+		t.Errorf("wrong latest granule: got %+v, %v", latest, err)
+	}
+	if _, err := readLatestGranule(&fakeRows{}); err != ErrNoGranules {
+		t.Errorf("wrong error without rows: got %v want %v", err, ErrNoGranules)
+	}
+}
+
+// A configured table should be queried by the point, box and granule query builders, while invalid names fall back to the default
+func TestSentinelTable_Configured(t *testing.T) {
+	defer func(table string) { SentinelTable = table }(SentinelTable)
+	SentinelTable = parseTable("my-project.mirror_eu.sentinel_2_index")
+
+	point, err := pointQuery("granule_id", "55.660797", "12.5896")
+	if err != nil {
+		t.Fatalf("Failed to build point query: %v", err)
+	}
+	box, err := boxQuery("granule_id", "55.616879", "12.506052", "55.698473", "12.652524")
+	if err != nil {
+		t.Fatalf("Failed to build box query: %v", err)
+	}
+	for name, query := range map[string]*bigquery.Query{"point": point, "box": box, "granule": granuleQuery("L1C_T32UNG_A012345_20171010T103021"), "tiles": tilesQuery([]string{"32UNG"})} {
+		if !strings.Contains(query.Q, "FROM `my-project.mirror_eu.sentinel_2_index`") || strings.Contains(query.Q, defaultSentinelTable) {
+			t.Errorf("%s query does not select from the configured table: %v", name, query.Q)
+		}
+	}
+
+	for _, table := range []string{"", "sentinel_2_index", "my-project.mirror.index`; DROP TABLE x; --", "a.b.c.d"} {
+		if got := parseTable(table); got != defaultSentinelTable {
+			t.Errorf("table %q was not replaced by the default: got %v", table, got)
+		}
+	}
+}
+
+// The stats query should aggregate the granules of the location in a single row, which is read as no coverage without granules
+func TestStatsQuery(t *testing.T) {
+	maxCloud := 20.0
+	query, err := statsQuery("55.660797", "12.5896", GranuleFilter{MaxCloud: &maxCloud})
+	if err != nil {
+		t.Fatalf("Failed to build query: %v", err)
+	}
+	sql := query.Q
+	for _, part := range []string{"SELECT COUNT(granule_id), MIN(sensing_time), MAX(sensing_time), MIN(cloud_cover), MAX(cloud_cover)",
+		"FROM " + sentinelTable(), "@lat < north_lat", "west_lon < @lng", "cloud_cover <= @maxCloud"} {
+		if !strings.Contains(sql, part) {
+			t.Errorf("query is missing %q: %v", part, sql)
+		}
+	}
+	if strings.Count(sql, "(") != strings.Count(sql, ")") || strings.Count(sql, ";") != 1 || !strings.HasSuffix(sql, ";") {
+		t.Errorf("query is malformed: %v", sql)
+	}
+	if strings.Contains(sql, "GROUP BY") || strings.Contains(sql, "LIMIT") {
+		t.Errorf("query should aggregate all granules into one row: %v", sql)
+	}
+
+	earliest, latest := time.Date(2015, 7, 4, 10, 30, 0, 0, time.UTC), time.Date(2017, 10, 10, 10, 30, 21, 0, time.UTC)
+	stats, err := readCoverageStats(&fakeRows{rows: [][]bigquery.Value{{int64(42), earliest, latest, 0.5, 97.25}}})
+	expected := CoverageStats{GranuleCount: 42, Earliest: earliest, Latest: latest, MinCloud: 0.5, MaxCloud: 97.25}
+	if err != nil || stats != expected {
+		t.Errorf("wrong stats: got %+v, %v want %+v", stats, err, expected)
+	}
+	for _, rows := range [][][]bigquery.Value{{{int64(0), nil, nil, nil, nil}}, {}} {
+		if stats, err := readCoverageStats(&fakeRows{rows: rows}); err != nil || stats != (CoverageStats{NoCoverage: true}) {
+			t.Errorf("wrong stats without granules: got %+v, %v", stats, err)
+		}
+	}
+	if _, err := readCoverageStats(&fakeRows{rows: [][]bigquery.Value{{int64(1)}}}); err == nil {
+		t.Errorf("expected error of a row without all aggregates")
+	}
+}
+
+// Metadata of a granule should be read from its row, and a query without rows should report the granule as not found
+func TestReadGranuleMetadata(t *testing.T) {
+	sensingTime := time.Date(2017, 10, 10, 10, 30, 21, 0, time.UTC)
+	rows := &fakeRows{rows: [][]bigquery.Value{
+		{"L1C_T32UNG_A012345_20171010T103021", "gs://gcp-public-data-sentinel-2/tiles/32/U/NG/S2A.SAFE", sensingTime, 12.5, 55.9, 54.9, 12.6, 10.9},
+	}}
+	granule, err := readGranuleMetadata(rows)
+	if err != nil {
+		t.Fatalf("Failed to read granule: %v", err)
+	}
+	cloudCover := 12.5
+	expected := GranuleMetadata{
+		GranuleID:   "L1C_T32UNG_A012345_20171010T103021",
+		BaseURL:     "gs://gcp-public-data-sentinel-2/tiles/32/U/NG/S2A.SAFE",
+		SensingTime: sensingTime,
+		CloudCover:  &cloudCover,
+		North:       55.9, South: 54.9, East: 12.6, West: 10.9,
+	}
+	if !reflect.DeepEqual(granule, expected) {
+		t.Errorf("wrong granule: got %+v want %+v", granule, expected)
+	}
+
+	if _, err := readGranuleMetadata(&fakeRows{}); err != ErrGranuleNotFound {
+		t.Errorf("wrong error without rows: got %v want %v", err, ErrGranuleNotFound)
+	}
+}
+
+// The cloud cover condition should only be added to a query when maxCloud is present and a valid percentage
+func TestGranuleFilter_MaxCloud(t *testing.T) {
+	for maxCloud, valid := range map[string]bool{"": true, "20": true, "0": true, "100": true, "-1": false, "150": false, "cloudy": false, "NaN": false} {
+		req := httptest.NewRequest("GET", "/images", nil)
+		req.Form = url.Values{"maxCloud": {maxCloud}}
+		filter, appErr := parseGranuleFilter(req)
+		if (appErr == nil) != valid {
+			t.Errorf("maxCloud %q accepted is %v, want %v", maxCloud, appErr == nil, valid)
+			continue
+		}
+		if !valid {
+			continue
+		}
+
+		query, err := pointQuery("granule_id", "55.660797", "12.5896")
+		if err != nil {
+			t.Fatalf("Failed to build query: %v", err)
+		}
+		filter.apply(query)
+		if included := strings.Contains(query.Q, "cloud_cover <= @maxCloud"); included != (len(maxCloud) > 0) {
+			t.Errorf("cloud cover condition included is %v for maxCloud %q: %v", included, maxCloud, query.Q)
+		}
+		if !strings.HasSuffix(query.Q, ";") {
+			t.Errorf("query is not terminated: %v", query.Q)
+		}
+	}
+}
+
+// Sensing time conditions should be added for the bounds that are given, and inverted ranges should be rejected
+func TestGranuleFilter_DateRange(t *testing.T) {
+	cases := []struct {
+		from, to   string
+		valid      bool
+		conditions []string
+	}{
+		{"2018-01-01", "2018-06-30T12:00:00Z", true, []string{"@from <= sensing_time", "sensing_time <= @to"}},
+		{"2018-01-01", "", true, []string{"@from <= sensing_time"}},
+		{"2018-06-30", "2018-01-01", false, nil},
+		{"yesterday", "", false, nil},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/images", nil)
+		req.Form = url.Values{"from": {c.from}, "to": {c.to}}
+		filter, appErr := parseGranuleFilter(req)
+		if (appErr == nil) != c.valid {
+			t.Errorf("range %q to %q accepted is %v, want %v", c.from, c.to, appErr == nil, c.valid)
+			continue
+		}
+		if !c.valid {
+			continue
+		}
+
+		query, err := pointQuery("granule_id", "55.660797", "12.5896")
+		if err != nil {
+			t.Fatalf("Failed to build query: %v", err)
+		}
+		filter.apply(query)
+		for _, condition := range c.conditions {
+			if !strings.Contains(query.Q, condition) {
+				t.Errorf("query of range %q to %q does not contain %q: %v", c.from, c.to, condition, query.Q)
+			}
+		}
+		if len(query.Parameters) != 2+len(c.conditions) {
+			t.Errorf("query of range %q to %q has wrong parameters: %v", c.from, c.to, query.Parameters)
+		}
+		for _, param := range query.Parameters[2:] {
+			if _, ok := param.Value.(time.Time); !ok {
+				t.Errorf("parameter %v is not a timestamp: %v", param.Name, param.Value)
+			}
+		}
+	}
+}
+
+// The count of an area should be the number of folders of the full path, i.e. the count query has the same conditions as the full query
+func TestBoxCountQuery(t *testing.T) {
+	maxCloud := 20.0
+	filter := GranuleFilter{MaxCloud: &maxCloud}
+	full, err := boxQuery("granule_id, base_url, "+boundsColumns, "55.616879", "12.506052", "55.698473", "12.652524")
+	if err != nil {
+		t.Fatalf("Failed to build query: %v", err)
+	}
+	filter.apply(full)
+	box, err := parseBox("55.616879", "12.506052", "55.698473", "12.652524")
+	if err != nil {
+		t.Fatalf("Failed to parse box: %v", err)
+	}
+	count := boxCountQuery(box, filter)
+
+	if !strings.HasPrefix(count.Q, "SELECT COUNT(DISTINCT granule_id)") {
+		t.Errorf("query does not count granules: %v", count.Q)
+	}
+	conditions := func(q string) string { return q[strings.Index(q, "FROM"):] }
+	if conditions(count.Q) != conditions(full.Q) || !reflect.DeepEqual(count.Parameters, full.Parameters) {
+		t.Errorf("count query differs from full query: got %v want %v", count.Q, full.Q)
+	}
+
+	rows := [][]bigquery.Value{
+		{"L1C_T32UNG_A012345_20171010T103021", "gs://gcp-public-data-sentinel-2/tiles/32/U/NG/S2A.SAFE", 55.9, 54.9, 12.6, 10.9},
+		{"L1C_T33UUB_A012345_20171010T103021", "gs://gcp-public-data-sentinel-2/tiles/33/U/UB/S2A.SAFE", 55.9, 54.9, 13.5, 11.8},
+	}
+	links, _, _, err := readImageBaseURLs(&fakeRows{rows: rows}, Layout{}, DefaultMaxResults)
+	if err != nil {
+		t.Fatalf("Failed to read image folders: %v", err)
+	}
+	n, err := readCount(&fakeRows{rows: [][]bigquery.Value{{int64(len(rows))}}})
+	if err != nil || n != int64(len(links)) {
+		t.Errorf("count differs from the full path: got %v %v want %v", n, err, len(links))
+	}
+	if _, err := readCount(&fakeRows{rows: [][]bigquery.Value{{"two"}}}); err == nil {
+		t.Error("count that is not an integer accepted")
+	}
+}
+
+// Several handler invocations should share a single BigQuery client instead of creating a client per query
+func TestBigQueryClient_Shared(t *testing.T) {
+	// Fake BigQuery API rejecting every job, so the handlers fail fast without connecting to Google Cloud
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":{"code":400,"message":"invalid query"}}`))
+	}))
+	defer server.Close()
+
+	defer func(factory func(context.Context) (*bigquery.Client, error)) { newBigQueryClient = factory }(newBigQueryClient)
+	CloseBigQueryClient()
+	defer CloseBigQueryClient()
+	var created int32
+	newBigQueryClient = func(ctx context.Context) (*bigquery.Client, error) {
+		atomic.AddInt32(&created, 1)
+		return bigquery.NewClient(ctx, projectID, option.WithoutAuthentication(), option.WithEndpoint(server.URL))
+	}
+
+	for _, target := range []string{"/images?lat=55.660797&lng=12.5896", "/images?lat=40.457375&lng=-80.009353",
+		"/area?lat1=55.616879&lng1=12.506052&lat2=55.698473&lng2=12.652524&count=true"} {
+		rr := httptest.NewRecorder()
+		handler := appHandler(images)
+		if strings.HasPrefix(target, "/area") {
+			handler = appHandler(area)
+		}
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+		if status := rr.Code; status != http.StatusInternalServerError {
+			t.Errorf("handler returned wrong status code for %v: got %v want %v", target, status, http.StatusInternalServerError)
+		}
+	}
+	if created != 1 {
+		t.Errorf("wrong number of BigQuery clients: got %v want 1", created)
+	}
+}
+
+// Corners given in any order should query the same south west and north east corners and return the same granules
+func TestBoxQuery_SwappedCorners(t *testing.T) {
+	fake := &fakeQuerier{rows: [][]bigquery.Value{{"L1C_T32UNG_A012345_20171010T103021", "gs://gcp-public-data-sentinel-2/tiles/32/U/NG/S2A.SAFE", 55.9, 54.9, 12.6, 10.9}}}
+	defer withQuerier(fake)()
+	r := httptest.NewRequest("GET", "/area", nil)
+	expected := map[string]interface{}{"lat1": 55.616879, "lng1": 12.506052, "lat2": 55.698473, "lng2": 12.652524}
+
+	var first Links
+	for _, corners := range [][]string{
+		{"55.616879", "12.506052", "55.698473", "12.652524"}, // South west and north east
+		{"55.698473", "12.652524", "55.616879", "12.506052"}, // North east and south west
+		{"55.698473", "12.506052", "55.616879", "12.652524"}, // North west and south east
+		{"55.616879", "12.652524", "55.698473", "12.506052"}, // South east and north west
+	} {
+		box, err := parseBox(corners[0], corners[1], corners[2], corners[3])
+		if err != nil {
+			t.Fatalf("Failed to parse corners %v: %v", corners, err)
+		}
+		links, _, _, err := getImageBaseURL(box, GranuleFilter{}, Layout{}, r)
+		if err != nil {
+			t.Fatalf("Failed to query corners %v: %v", corners, err)
+		}
+		if !reflect.DeepEqual(fake.params, expected) {
+			t.Errorf("corners %v were not normalized: got %v want %v", corners, fake.params, expected)
+		}
+		if first == nil {
+			first = links
+		}
+		if !reflect.DeepEqual(links, first) {
+			t.Errorf("corners %v returned different links: got %v want %v", corners, links, first)
+		}
+	}
+
+	if box, err := parseBox("55.6", "12.5", "55.6", "12.6"); err != nil || !box.Empty() {
+		t.Errorf("box without height is not empty: %+v, %v", box, err)
+	}
+}
+
+// querierFunc is a fake querier answering each query with a function of its parameters
+type querierFunc func(params map[string]interface{}) [][]bigquery.Value
+
+func (f querierFunc) RunQuery(ctx context.Context, sql string, params []bigquery.QueryParameter) (rowIterator, error) {
+	values := map[string]interface{}{}
+	for _, param := range params {
+		values[param.Name] = param.Value
+	}
+	return &fakeRows{rows: f(values)}, nil
+}
+
+// A box around Fiji crossing the antimeridian should query both sides of ±180° and merge their granules without duplicates
+func TestBoxQuery_Antimeridian(t *testing.T) {
+	wide, err := parseBox("-19.5", "177.0", "-15.5", "-178.5")
+	if err != nil || wide.CrossesAntimeridian() || wide.West != -178.5 || wide.East != 177 {
+		t.Fatalf("corners were not read as the box between them: %+v, %v", wide, err)
+	}
+	box := wide.aroundAntimeridian()
+	if !box.CrossesAntimeridian() || box.West != 177 || box.East != -178.5 || box.aroundAntimeridian() != box {
+		t.Fatalf("box was not read as crossing the antimeridian: %+v", box)
+	}
+
+	spanning := []bigquery.Value{"L1C_T01KAB_A012345_20171010T103021", "gs://gcp-public-data-sentinel-2/tiles/01/K/AB/S2A.SAFE", -16.2, -17.2, -179.2, 179.8}
+	sides := [][2]float64{}
+	defer withQuerier(querierFunc(func(params map[string]interface{}) [][]bigquery.Value {
+		west, east := params["lng1"].(float64), params["lng2"].(float64)
+		sides = append(sides, [2]float64{west, east})
+		if west == 177 {
+			return [][]bigquery.Value{{"L1C_T60KXF_A012345_20171010T103021", "gs://gcp-public-data-sentinel-2/tiles/60/K/XF/S2A.SAFE", -16.2, -17.2, 178.9, 177.8}, spanning}
+		}
+		return [][]bigquery.Value{spanning, {"L1C_T01KBV_A012345_20171010T103021", "gs://gcp-public-data-sentinel-2/tiles/01/K/BV/S2A.SAFE", -16.2, -17.2, -178.1, -179.1}}
+	}))()
+
+	r := httptest.NewRequest("GET", "/area", nil)
+	links, granules, _, err := getImageBaseURL(box, GranuleFilter{}, Layout{}, r)
+	if err != nil {
+		t.Fatalf("Failed to query box: %v", err)
+	}
+	if expected := [][2]float64{{177, 180}, {-180, -178.5}}; !reflect.DeepEqual(sides, expected) {
+		t.Errorf("wrong sides queried: got %v want %v", sides, expected)
+	}
+	ids := []string{}
+	for _, granule := range granules {
+		ids = append(ids, granule.GranuleID)
+	}
+	expected := []string{"L1C_T60KXF_A012345_20171010T103021", "L1C_T01KAB_A012345_20171010T103021", "L1C_T01KBV_A012345_20171010T103021"}
+	if !reflect.DeepEqual(ids, expected) || len(links) != len(expected) {
+		t.Errorf("wrong merged granules: got %v %v want %v", ids, links, expected)
+	}
+
+	if swapped, err := parseBox("-15.5", "-178.5", "-19.5", "177.0"); err != nil || swapped.aroundAntimeridian() != box {
+		t.Errorf("swapped corners were read as another box: got %+v want %+v", swapped, box)
+	}
+}
+
+// Corners more than 180° of longitude apart should be read as the wide box between them unless the antimeridian is asked for
+func TestParseBox_Wide(t *testing.T) {
+	box, err := parseBox("-40", "-100", "40", "100")
+	if err != nil || box.CrossesAntimeridian() || box.West != -100 || box.East != 100 {
+		t.Errorf("wide box was read as crossing the antimeridian: %+v, %v", box, err)
+	}
+	if bounds, err := parseBounds("-19.5", "177.0", "-15.5", "-178.5"); err != nil || !bounds.CrossesAntimeridian() {
+		t.Errorf("bounds with a west east of the east were not read as crossing the antimeridian: %+v, %v", bounds, err)
+	}
+}
+
+// A box crossing the antimeridian should be counted by a single query of both sides, so granules found on both sides are counted once
+func TestBoxCountQuery_Antimeridian(t *testing.T) {
+	fake := &fakeQuerier{rows: [][]bigquery.Value{{int64(3)}}}
+	defer withQuerier(fake)()
+	box := Box{South: -19.5, West: 177, North: -15.5, East: -178.5}
+	count, err := getImageCountByBox(box, GranuleFilter{}, httptest.NewRequest("GET", "/area", nil))
+	if err != nil || count != 3 {
+		t.Fatalf("wrong count: got %v, %v want 3", count, err)
+	}
+	for _, clause := range []string{"COUNT(DISTINCT granule_id)", "(@lng1 < east_lon OR west_lon < @lng2)"} {
+		if !strings.Contains(fake.sql, clause) {
+			t.Errorf("count query does not contain %v: %v", clause, fake.sql)
+		}
+	}
+	if fake.params["lng1"] != 177.0 || fake.params["lng2"] != -178.5 {
+		t.Errorf("wrong longitudes of count query: %v", fake.params)
+	}
+}
+
+// Resolving a location should query the box where the location is both corners and link to the image folder of each granule
+func TestImageFolders_Resolve(t *testing.T) {
+	query, err := boxQuery("granule_id, base_url, "+boundsColumns, "55.660797", "12.5896", "55.660797", "12.5896")
+	if err != nil {
+		t.Fatalf("Failed to build query: %v", err)
+	}
+	values := map[string]interface{}{}
+	for _, param := range query.Parameters {
+		values[param.Name] = param.Value
+	}
+	if values["lat1"] != values["lat2"] || values["lng1"] != values["lng2"] || values["lat1"] != 55.660797 {
+		t.Errorf("location is not both corners: %v", values)
+	}
+
+	granuleID := "L1C_T32UNG_A012345_20171010T103021"
+	links, _, _, err := readImageBaseURLs(&fakeRows{rows: [][]bigquery.Value{
+		{granuleID, "gs://gcp-public-data-sentinel-2/tiles/32/U/NG/S2A.SAFE", 55.9, 54.9, 12.6, 10.9},
+	}}, Layout{}, DefaultMaxResults)
+	if err != nil || len(links) != 1 {
+		t.Fatalf("wrong links: got %v %v", links, err)
+	}
+	if !strings.Contains(links[0], "/GRANULE/"+granuleID+"/") || strings.HasPrefix(links[0], "gs://") {
+		t.Errorf("link is not the image folder of the granule: %v", links[0])
+	}
+}
+
+// Image folders of L1C granules should be their IMG_DATA folder, whereas L2A granules of a resolution should be its resolution folder
+func TestLayout_ImageFolder(t *testing.T) {
+	l1c := Layout{Level: LevelL1C, Resolution: 10}.imageFolder("gs://gcp-public-data-sentinel-2/tiles/32/U/NG/S2A_MSIL1C_20171010T103021.SAFE", "L1C_T32UNG_A012345_20171010T103021")
+	if expected := "gcp-public-data-sentinel-2/tiles/32/U/NG/S2A_MSIL1C_20171010T103021.SAFE/GRANULE/L1C_T32UNG_A012345_20171010T103021/IMG_DATA/"; l1c != expected {
+		t.Errorf("wrong L1C folder: got %v want %v", l1c, expected)
+	}
+	base := "gs://gcp-public-data-sentinel-2/L2/tiles/32/U/NG/S2A_MSIL2A_20180101T103421.SAFE"
+	l2a := Layout{Level: LevelL2A, Resolution: 20}.imageFolder(base, "L2A_T32UNG_A013345_20180101T103421")
+	if expected := "gcp-public-data-sentinel-2/L2/tiles/32/U/NG/S2A_MSIL2A_20180101T103421.SAFE/GRANULE/L2A_T32UNG_A013345_20180101T103421/IMG_DATA/R20m/"; l2a != expected {
+		t.Errorf("wrong L2A folder: got %v want %v", l2a, expected)
+	}
+	if all := (Layout{Level: LevelL2A}).imageFolder(base, "L2A_T32UNG_A013345_20180101T103421"); !strings.HasSuffix(all, "/IMG_DATA/") {
+		t.Errorf("L2A folder of all resolutions is not IMG_DATA: %v", all)
+	}
+
+	for link, expected := range map[string][2]string{
+		l1c: {"gcp-public-data-sentinel-2", "tiles/32/U/NG/S2A_MSIL1C_20171010T103021.SAFE/GRANULE/L1C_T32UNG_A012345_20171010T103021/IMG_DATA"},
+		l2a: {"gcp-public-data-sentinel-2", "L2/tiles/32/U/NG/S2A_MSIL2A_20180101T103421.SAFE/GRANULE/L2A_T32UNG_A013345_20180101T103421/IMG_DATA/R20m"},
+	} {
+		if bucket, object := splitLink(link); bucket != expected[0] || object != expected[1] {
+			t.Errorf("wrong split of %v: got %v %v want %v %v", link, bucket, object, expected[0], expected[1])
+		}
+	}
+}
+
+// Filtering by processing level should only keep granules whose product is of that level
+func TestGranuleFilter_Level(t *testing.T) {
+	query, err := boxQuery("granule_id", "55.616879", "12.506052", "55.698473", "12.652524")
+	if err != nil {
+		t.Fatalf("Failed to build query: %v", err)
+	}
+	GranuleFilter{Level: LevelL2A}.apply(query)
+	if !strings.Contains(query.Q, "STRPOS(product_id, @level) > 0") {
+		t.Errorf("query does not filter by level: %v", query.Q)
+	}
+	if last := query.Parameters[len(query.Parameters)-1]; last.Name != "level" || last.Value != "MSIL2A" {
+		t.Errorf("wrong level parameter: %+v", last)
+	}
+}
+
+// Each sort order should append its ORDER BY clause after the conditions of the filter, and no sort order should leave the query unordered
+func TestGranuleFilter_Sort(t *testing.T) {
+	for sort, expected := range map[string]string{
+		SortSensingTimeAsc:  "ORDER BY sensing_time ASC;",
+		SortSensingTimeDesc: "ORDER BY sensing_time DESC;",
+		SortCloudCoverAsc:   "ORDER BY cloud_cover ASC;",
+		"":                  "AND west_lon < @lng2\n\t\t AND cloud_cover <= @maxCloud;",
+	} {
+		query, err := boxQuery("granule_id", "55.616879", "12.506052", "55.698473", "12.652524")
+		if err != nil {
+			t.Fatalf("Failed to build query: %v", err)
+		}
+		maxCloud := 20.0
+		filter := GranuleFilter{MaxCloud: &maxCloud, Sort: sort}
+		filter.apply(query)
+		filter.order(query)
+		if !strings.HasSuffix(query.Q, expected) {
+			t.Errorf("wrong order of sort %q: got %v want suffix %v", sort, query.Q, expected)
+		}
+	}
+}
+
+// Unknown sort orders should be rejected, since only the fixed ORDER BY clauses may be added to a query
+func TestParseGranuleFilter_Sort(t *testing.T) {
+	for query, code := range map[string]int{"sort=sensing_time_desc": 0, "sort=granule_id%20DESC": http.StatusBadRequest, "sort=cloud_cover_desc": http.StatusBadRequest} {
+		r := httptest.NewRequest("GET", "/images?"+query, nil)
+		r.ParseForm()
+		_, appErr := parseGranuleFilter(r)
+		if (appErr == nil && code != 0) || (appErr != nil && appErr.Code != code) {
+			t.Errorf("wrong result of %v: got %v want code %v", query, appErr, code)
+		}
+	}
+}
+
+// The same coordinates should be queried once, where coordinates rounding to the same key share the cached links
+func TestGetLinks_Cache(t *testing.T) {
+	defer func(query func(string, string, GranuleFilter, *http.Request) (Links, error)) { queryLinks = query }(queryLinks)
+	FlushLinksCache()
+	defer FlushLinksCache()
+	queried := 0
+	queryLinks = func(lat, lng string, filter GranuleFilter, r *http.Request) (Links, error) {
+		queried++
+		return Links{"L1C_T32UNG_A012345_20171010T103021"}, nil
+	}
+
+	req := httptest.NewRequest("GET", "/images", nil)
+	for i, coords := range [][2]string{{"55.660797", "12.5896"}, {"55.660797", "12.5896"}, {"55.66081", "12.58961"}, {"55.6612", "12.5896"}} {
+		links, err := getLinks(coords[0], coords[1], GranuleFilter{}, req)
+		if err != nil || len(links) != 1 {
+			t.Fatalf("wrong links: got %v %v", links, err)
+		}
+		if expected := []int{1, 1, 1, 2}[i]; queried != expected {
+			t.Errorf("wrong number of queries after %v: got %v want %v", coords, queried, expected)
+		}
+	}
+
+	maxCloud := 20.0
+	if _, err := getLinks("55.660797", "12.5896", GranuleFilter{MaxCloud: &maxCloud}, req); err != nil || queried != 3 {
+		t.Errorf("links of another filter were shared: got %v queries want 3", queried)
+	}
+}
+
+// Distinct locations should not grow the links cache beyond LinksCacheSize, evicting the least recently used location
+func TestGetLinks_CacheSize(t *testing.T) {
+	defer func(query func(string, string, GranuleFilter, *http.Request) (Links, error)) { queryLinks = query }(queryLinks)
+	defer func(size int) { LinksCacheSize = size }(LinksCacheSize)
+	LinksCacheSize = 2
+	FlushLinksCache()
+	defer FlushLinksCache()
+	queried := 0
+	queryLinks = func(lat, lng string, filter GranuleFilter, r *http.Request) (Links, error) {
+		queried++
+		return Links{"L1C_T32UNG_A012345_20171010T103021"}, nil
+	}
+
+	req := httptest.NewRequest("GET", "/images", nil)
+	for _, lat := range []string{"55.1", "55.2", "55.3", "55.1"} {
+		if _, err := getLinks(lat, "12.5896", GranuleFilter{}, req); err != nil {
+			t.Fatalf("Failed to get links: %v", err)
+		}
+	}
+	if size := pointLinks.len(); size != 2 {
+		t.Errorf("wrong links cache size: got %v want 2", size)
+	}
+	if queried != 4 {
+		t.Errorf("evicted location was not queried again: got %v queries want 4", queried)
+	}
+}
+
+// Concurrent requests of the same location should share a single query, whereas errors should not be kept after the query
+func TestGetLinks_Singleflight(t *testing.T) {
+	defer func(query func(string, string, GranuleFilter, *http.Request) (Links, error)) { queryLinks = query }(queryLinks)
+	FlushLinksCache()
+	defer FlushLinksCache()
+	var queried int32
+	release := make(chan struct{})
+	queryLinks = func(lat, lng string, filter GranuleFilter, r *http.Request) (Links, error) {
+		atomic.AddInt32(&queried, 1)
+		<-release // Query stays in flight until all requests are waiting for it
+		return Links{"L1C_T32UNG_A012345_20171010T103021"}, nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			links, err := getLinks("55.660797", "12.5896", GranuleFilter{}, httptest.NewRequest("GET", "/images", nil))
+			if err == nil && len(links) != 1 {
+				err = errors.New("wrong number of links")
+			}
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Failed to get links: %v", err)
+		}
+	}
+	if queried != 1 {
+		t.Errorf("wrong number of queries of concurrent identical requests: got %v want 1", queried)
+	}
+
+	queried = 0
+	queryLinks = func(lat, lng string, filter GranuleFilter, r *http.Request) (Links, error) {
+		atomic.AddInt32(&queried, 1)
+		return nil, errors.New("backend unavailable")
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := getLinks("40.457375", "-80.009353", GranuleFilter{}, httptest.NewRequest("GET", "/images", nil)); err == nil {
+			t.Error("error of the query was not returned")
+		}
+	}
+	if queried != 2 {
+		t.Errorf("error was kept after the query: got %v queries want 2", queried)
+	}
+}
+
+// A caller giving up on a shared query should neither cancel the query nor fail the other callers waiting for it
+func TestGetLinks_SingleflightCancelled(t *testing.T) {
+	defer func(query func(string, string, GranuleFilter, *http.Request) (Links, error)) { queryLinks = query }(queryLinks)
+	FlushLinksCache()
+	defer FlushLinksCache()
+	defer func(joined func(string)) { flightJoined = joined }(flightJoined)
+	joined := make(chan struct{}, 2)
+	flightJoined = func(key string) { joined <- struct{}{} }
+	started, release := make(chan struct{}), make(chan struct{})
+	queryLinks = func(lat, lng string, filter GranuleFilter, r *http.Request) (Links, error) {
+		close(started)
+		<-release
+		if err := r.Context().Err(); err != nil {
+			return nil, err
+		}
+		return Links{"L1C_T32UNG_A012345_20171010T103021"}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := getLinks("55.660797", "12.5896", GranuleFilter{}, httptest.NewRequest("GET", "/images", nil).WithContext(ctx))
+		first <- err
+	}()
+	<-started
+	second := make(chan Links, 1)
+	go func() {
+		links, err := getLinks("55.660797", "12.5896", GranuleFilter{}, httptest.NewRequest("GET", "/images", nil))
+		if err != nil {
+			t.Errorf("second caller failed with the first: %v", err)
+		}
+		second <- links
+	}()
+	<-joined
+	<-joined // Both callers share the query in flight
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Errorf("cancelled caller returned wrong error: got %v want %v", err, context.Canceled)
+	}
+	close(release)
+	if links := <-second; len(links) != 1 {
+		t.Errorf("second caller returned wrong links: got %v", links)
+	}
+}
+
+// fakeQuerier returns the same canned rows for every query and records the SQL and parameters of the last query
+type fakeQuerier struct {
+	mu     sync.Mutex
+	rows   [][]bigquery.Value
+	sql    string
+	params map[string]interface{}
+}
+
+func (f *fakeQuerier) RunQuery(ctx context.Context, sql string, params []bigquery.QueryParameter) (rowIterator, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sql, f.params = sql, map[string]interface{}{}
+	for _, param := range params {
+		f.params[param.Name] = param.Value
+	}
+	return &fakeRows{rows: append([][]bigquery.Value{}, f.rows...)}, nil
+}
+
+// Replaces the querier until the returned function restores it
+func withQuerier(q Querier) func() {
+	previous := querier
+	querier = q
+	return func() { querier = previous }
+}
+
+// Each query function should run its query with the querier and read the canned rows, without BigQuery or App Engine
+func TestQueries_FakeQuerier(t *testing.T) {
+	FlushLinksCache()
+	defer FlushLinksCache()
+	r := httptest.NewRequest("GET", "/", nil)
+	sensingTime := time.Date(2017, 10, 10, 10, 30, 21, 0, time.UTC)
+	granuleID := "L1C_T32UNG_A012345_20171010T103021"
+	baseURL := "gs://gcp-public-data-sentinel-2/tiles/32/U/NG/S2A.SAFE"
+	cloudCover := 12.5
+	metadata := GranuleMetadata{GranuleID: granuleID, BaseURL: baseURL, SensingTime: sensingTime, CloudCover: &cloudCover, North: 55.9, South: 54.9, East: 12.6, West: 10.9}
+	bounds := GranuleBounds{GranuleID: granuleID, North: 55.9, South: 54.9, East: 12.6, West: 10.9}
+
+	cases := []struct {
+		name     string
+		rows     [][]bigquery.Value
+		run      func() (interface{}, error)
+		expected interface{}
+		sql      string // Part of the SQL of the query
+	}{
+		{"getLinks", [][]bigquery.Value{{granuleID, "S2A_MSIL1C_20171010T103021"}},
+			func() (interface{}, error) { return getLinks("55.660797", "12.5896", GranuleFilter{}, r) },
+			Links{granuleID}, "@lat < north_lat"},
+		{"getGranules", [][]bigquery.Value{{granuleID, "S2A_MSIL1C_20171010T103021"}, {"L2A_T32UNG", "S2A_MSIL2A_20171010T103021"}},
+			func() (interface{}, error) { return getGranules("55.660797", "12.5896", LevelL2A, GranuleFilter{}, r) },
+			[]Granule{{GranuleID: "L2A_T32UNG", Level: LevelL2A}}, "granule_id, product_id"},
+		{"getLatestGranule", [][]bigquery.Value{{granuleID, sensingTime}},
+			func() (interface{}, error) { return getLatestGranule("55.660797", "12.5896", GranuleFilter{}, r) },
+			LatestGranule{GranuleID: granuleID, SensingTime: sensingTime}, "ORDER BY sensing_time DESC"},
+		{"getLinksByTiles", [][]bigquery.Value{{granuleID}},
+			func() (interface{}, error) { return getLinksByTiles([]string{"32UNG"}, GranuleFilter{}, r) },
+			Links{granuleID}, "mgrs_tile IN UNNEST(@tiles)"},
+		{"getImageBaseURL", [][]bigquery.Value{{granuleID, baseURL, 55.9, 54.9, 12.6, 10.9}},
+			func() (interface{}, error) {
+				links, _, _, err := getImageBaseURL(Box{South: 55.616879, West: 12.506052, North: 55.698473, East: 12.652524}, GranuleFilter{}, Layout{}, r)
+				return links, err
+			},
+			Links{"gcp-public-data-sentinel-2/tiles/32/U/NG/S2A.SAFE/GRANULE/" + granuleID + "/IMG_DATA/"}, "granule_id, base_url"},
+		{"getImageCountByBox", [][]bigquery.Value{{int64(7)}},
+			func() (interface{}, error) {
+				return getImageCountByBox(Box{South: 55.616879, West: 12.506052, North: 55.698473, East: 12.652524}, GranuleFilter{}, r)
+			},
+			int64(7), "COUNT(DISTINCT granule_id)"},
+		{"getGranule", [][]bigquery.Value{{granuleID, baseURL, sensingTime, 12.5, 55.9, 54.9, 12.6, 10.9}},
+			func() (interface{}, error) { return getGranule(granuleID, r) },
+			metadata, "granule_id = @id"},
+		{"getAreaGranules", [][]bigquery.Value{{granuleID, baseURL, sensingTime, 12.5, 55.9, 54.9, 12.6, 10.9}},
+			func() (interface{}, error) {
+				return getAreaGranules(Box{South: 55.616879, West: 12.506052, North: 55.698473, East: 12.652524}, GranuleFilter{}, r)
+			},
+			[]GranuleMetadata{metadata}, metadataColumns},
+		{"getImageCount", [][]bigquery.Value{{granuleID, 55.9, 54.9, 12.6, 10.9}},
+			func() (interface{}, error) {
+				results, errChan := make(chan cellGranules, 1), make(chan error, 1)
+				getImageCount(context.Background(), results, errChan, "4653", "55.616879", "12.506052", "55.698473", "12.652524")
+				select {
+				case cell := <-results:
+					return cell, nil
+				case err := <-errChan:
+					return nil, err
+				}
+			},
+			cellGranules{token: "4653", granules: []GranuleBounds{bounds}}, "granule_id, " + boundsColumns},
+		{"getImageEstimate", [][]bigquery.Value{{int64(12)}},
+			func() (interface{}, error) { return getImageEstimate(r, "54.5", "8.0", "57.8", "15.2") },
+			12, "APPROX_COUNT_DISTINCT(granule_id)"},
+	}
+	for _, c := range cases {
+		fake := &fakeQuerier{rows: c.rows}
+		restore := withQuerier(fake)
+		actual, err := c.run()
+		restore()
+		if err != nil {
+			t.Errorf("%v failed: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("%v returned wrong result: got %+v want %+v", c.name, actual, c.expected)
+		}
+		if !strings.Contains(fake.sql, c.sql) {
+			t.Errorf("%v ran wrong query: got %v want it to contain %v", c.name, fake.sql, c.sql)
+		}
+	}
+}
+
+// Queries without rows should be reported as not found by the query functions of a single granule
+func TestQueries_FakeQuerierNoRows(t *testing.T) {
+	defer withQuerier(&fakeQuerier{})()
+	r := httptest.NewRequest("GET", "/", nil)
+	if _, err := getGranule("L1C_T32UNG_A012345_20171010T103021", r); err != ErrGranuleNotFound {
+		t.Errorf("wrong error of getGranule: got %v want %v", err, ErrGranuleNotFound)
+	}
+	if _, err := getLatestGranule("55.660797", "12.5896", GranuleFilter{}, r); err != ErrNoGranules {
+		t.Errorf("wrong error of getLatestGranule: got %v want %v", err, ErrNoGranules)
+	}
+}
+
+// Rows with NULL columns should be skipped or defaulted and columns of other types should be errors instead of panics
+func TestQueries_ColumnTypes(t *testing.T) {
+	granuleID := "L1C_T32UNG_A012345_20171010T103021"
+	baseURL := "gs://gcp-public-data-sentinel-2/tiles/32/U/NG/S2A.SAFE"
+	r := httptest.NewRequest("GET", "/", nil)
+
+	defer withQuerier(&fakeQuerier{rows: [][]bigquery.Value{{nil, baseURL, 55.9, 54.9, 12.6, 10.9}, {granuleID, baseURL, 55.9, 54.9, 12.6, nil}, {granuleID, baseURL, 55.9, 54.9, 12.6, 10.9}}})()
+	links, granules, _, err := getImageBaseURL(Box{South: 55.616879, West: 12.506052, North: 55.698473, East: 12.652524}, GranuleFilter{}, Layout{}, r)
+	if err != nil || len(links) != 1 || len(granules) != 1 {
+		t.Errorf("NULL rows were not skipped: got %v %v %v", links, granules, err)
+	}
+	defer withQuerier(&fakeQuerier{rows: [][]bigquery.Value{{nil}}})()
+	if n, err := getImageEstimate(r, "54.5", "8.0", "57.8", "15.2"); err != nil || n != 0 {
+		t.Errorf("NULL count was not read as 0: got %v %v", n, err)
+	}
+
+	wrongTypes := []struct {
+		name string
+		rows [][]bigquery.Value
+		call func() error
+	}{
+		{"getImageBaseURL", [][]bigquery.Value{{granuleID, int64(1), 55.9, 54.9, 12.6, 10.9}},
+			func() error {
+				_, _, _, err := getImageBaseURL(Box{South: 55.616879, West: 12.506052, North: 55.698473, East: 12.652524}, GranuleFilter{}, Layout{}, r)
+				return err
+			}},
+		{"getImageEstimate", [][]bigquery.Value{{"12"}},
+			func() error {
+				_, err := getImageEstimate(r, "54.5", "8.0", "57.8", "15.2")
+				return err
+			}},
+		{"getGranule", [][]bigquery.Value{{granuleID, baseURL, nil, nil, "55.9", 54.9, 12.6, 10.9}},
+			func() error {
+				_, err := getGranule(granuleID, r)
+				return err
+			}},
+		{"readGranules", nil,
+			func() error {
+				_, err := readGranules(&fakeRows{rows: [][]bigquery.Value{{granuleID, 2.5}}}, "")
+				return err
+			}},
+		{"readCount", nil,
+			func() error {
+				_, err := readCount(&fakeRows{rows: [][]bigquery.Value{{}}})
+				return err
+			}},
+	}
+	for _, test := range wrongTypes {
+		restore := withQuerier(&fakeQuerier{rows: test.rows})
+		err := test.call()
+		restore()
+		if err == nil || !strings.Contains(err.Error(), "unexpected column") {
+			t.Errorf("%s: expected unexpected column error, got %v", test.name, err)
+		}
+	}
+}
+
+// fakeLister is a fake bucket listing the objects whose names start with the prefix of the query
+type fakeLister struct {
+	names []string
+	err   error // Error of the iterator after the objects, e.g. a failing bucket
+}
+
+func (f *fakeLister) ListObjects(ctx context.Context, bucketName string, query *storage.Query) objectIterator {
+	objects := &fakeObjects{err: f.err}
+	for _, name := range f.names {
+		if strings.HasPrefix(name, query.Prefix) {
+			objects.names = append(objects.names, name)
+		}
+	}
+	return objects
+}
+
+// fakeObjects iterates the names of fake objects and then returns the error, or iterator.Done without an error
+type fakeObjects struct {
+	names []string
+	err   error
+}
+
+func (f *fakeObjects) Next() (*storage.ObjectAttrs, error) {
+	if len(f.names) == 0 {
+		if f.err != nil {
+			return nil, f.err
+		}
+		return nil, iterator.Done
+	}
+	attrs := &storage.ObjectAttrs{Name: f.names[0]}
+	f.names = f.names[1:]
+	return attrs, nil
+}
+
+// Images of a folder should be linked with the bucket, keeping only objects of the folder prefix that match the filter
+func TestGetImagesFromBucket_FakeLister(t *testing.T) {
+	folder := "L2/tiles/32/U/NG/S2A.SAFE/GRANULE/L2A_T32UNG/IMG_DATA/R10m"
+	lister := &fakeLister{names: []string{
+		folder + "/T32UNG_20180101T103421_B04_10m.jp2",
+		folder + "/T32UNG_20180101T103421_B08_10m.jp2",
+		"L2/tiles/32/U/NG/S2A.SAFE/GRANULE/L2A_T32UNG/IMG_DATA/R20m/T32UNG_20180101T103421_B04_20m.jp2",
+		"L2/tiles/33/U/UB/S2A.SAFE/GRANULE/L2A_T33UUB/IMG_DATA/R10m/T33UUB_20180101T103421_B04_10m.jp2",
+	}}
+	r := httptest.NewRequest("GET", "/area", nil)
+
+	links, _, err := getImagesFromBucket(lister, "gcp-public-data-sentinel-2", folder, ImageFilter{Bands: []string{"B04"}}, noLimit, r)
+	expected := Links{"gcp-public-data-sentinel-2/" + folder + "/T32UNG_20180101T103421_B04_10m.jp2"}
+	if err != nil || !reflect.DeepEqual(links, expected) {
+		t.Errorf("wrong images: got %v %v want %v", links, err, expected)
+	}
+
+	lister.err = errors.New("bucket unavailable")
+	if _, _, err := getImagesFromBucket(lister, "gcp-public-data-sentinel-2", folder, ImageFilter{}, noLimit, r); err != lister.err {
+		t.Errorf("wrong error of failing bucket: got %v want %v", err, lister.err)
+	}
+}
+
+// An object yielded twice by the listing should be linked once
+func TestGetImagesFromBucket_Duplicates(t *testing.T) {
+	folder := "tiles/32/U/NG/S2A.SAFE/GRANULE/L1C_T32UNG_A012345_20171010T103021/IMG_DATA"
+	image := folder + "/T32UNG_20171010T103021_B04.jp2"
+	lister := &fakeLister{names: []string{image, folder + "/T32UNG_20171010T103021_B08.jp2", image}}
+
+	links, _, err := getImagesFromBucket(lister, "gcp-public-data-sentinel-2", folder, ImageFilter{Bands: []string{"B04"}}, noLimit, httptest.NewRequest("GET", "/area", nil))
+	if expected := (Links{"gcp-public-data-sentinel-2/" + image}); err != nil || !reflect.DeepEqual(links, expected) {
+		t.Errorf("wrong images of duplicated object: got %v %v want %v", links, err, expected)
+	}
+}
+
+// flakyQuerier fails with the given errors before it returns the canned rows, counting the queries it ran
+type flakyQuerier struct {
+	errs    []error
+	rows    [][]bigquery.Value
+	queries int
+}
+
+func (f *flakyQuerier) RunQuery(ctx context.Context, sql string, params []bigquery.QueryParameter) (rowIterator, error) {
+	f.queries++
+	if f.queries <= len(f.errs) {
+		return nil, f.errs[f.queries-1]
+	}
+	return &fakeRows{rows: append([][]bigquery.Value{}, f.rows...)}, nil
+}
+
+// Queries failing with transient errors should be run again until they succeed, whereas permanent errors are returned right away
+func TestRunQuery_TransientErrors(t *testing.T) {
+	FlushLinksCache()
+	defer FlushLinksCache()
+	defer func(retry RequestRetrySession) { QueryRetry = retry }(QueryRetry)
+	QueryRetry.clock = &fakeClock{now: time.Now()}
+	r := httptest.NewRequest("GET", "/", nil)
+	backendErr := &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "Backend unavailable"}
+	row := []bigquery.Value{"L1C_T32UNG_A012345_20171010T103021", "gs://bucket/S2A.SAFE", 56.0, 55.0, 13.0, 12.0}
+
+	flaky := &flakyQuerier{errs: []error{backendErr, &googleapi.Error{Code: http.StatusBadRequest, Errors: []googleapi.ErrorItem{{Reason: "backendError"}}}}, rows: [][]bigquery.Value{row}}
+	defer withQuerier(flaky)()
+	if links, err := getLinks("55.5", "12.5", GranuleFilter{}, r); err != nil || len(links) != 1 || flaky.queries != 3 {
+		t.Errorf("point query was not retried until it succeeded: got %v, %v after %d queries", links, err, flaky.queries)
+	}
+	flaky.queries = 0
+	if links, _, _, err := getImageBaseURL(Box{South: 55, West: 12, North: 56, East: 13}, GranuleFilter{}, Layout{}, r); err != nil || len(links) != 1 || flaky.queries != 3 {
+		t.Errorf("box query was not retried until it succeeded: got %v, %v after %d queries", links, err, flaky.queries)
+	}
+
+	flaky.rows, flaky.queries = [][]bigquery.Value{{row[0], 56.0, 55.0, 13.0, 12.0}}, 0
+	results, errChan := make(chan cellGranules, 1), make(chan error, 1)
+	getImageCount(context.Background(), results, errChan, "4653", "55", "12", "56", "13")
+	select {
+	case cell := <-results:
+		if len(cell.granules) != 1 || flaky.queries != 3 {
+			t.Errorf("cell query was not retried until it succeeded: got %v after %d queries", cell.granules, flaky.queries)
+		}
+	case err := <-errChan:
+		t.Errorf("cell query was not retried until it succeeded: got %v after %d queries", err, flaky.queries)
+	}
+
+	flaky.rows, flaky.queries = [][]bigquery.Value{{int64(4)}}, 0
+	if count, err := getImageCountByBox(Box{South: 55, West: 12, North: 56, East: 13}, GranuleFilter{}, r); err != nil || count != 4 || flaky.queries != 3 {
+		t.Errorf("count query was not retried until it succeeded: got %v, %v after %d queries", count, err, flaky.queries)
+	}
+
+	for _, permanent := range []error{
+		&googleapi.Error{Code: http.StatusBadRequest, Errors: []googleapi.ErrorItem{{Reason: "invalidQuery"}}},
+		&googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "accessDenied"}}},
+		&googleapi.Error{Code: http.StatusTooManyRequests},
+		context.DeadlineExceeded,
+		errors.New("invalid SQL"),
+	} {
+		flaky.errs, flaky.queries = []error{permanent}, 0
+		if _, err := runQuery(context.Background(), newQuery("SELECT 1")); err != permanent || flaky.queries != 1 {
+			t.Errorf("permanent error %v was retried: got %v after %d queries", permanent, err, flaky.queries)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+// Package satservice recover turns panics of handlers and worker goroutines into errors, so one bad request cannot crash the instance
+// E.g. a type assertion of a row failing on an unexpected BigQuery schema
+package satservice
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+)
+
+// PanicError is a recovered panic, with the stack of the goroutine that panicked for the logs
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// Recovers a panic into a PanicError and logs it with its stack, e.g. defer recoverPanic(&err)
+// It must be deferred directly, since recover only stops a panic when called by a deferred function
+func recoverPanic(err *error) {
+	if value := recover(); value != nil {
+		panicErr := &PanicError{Value: value, Stack: debug.Stack()}
+		log.Printf("Recovered from %v\n%s", panicErr, panicErr.Stack)
+		*err = panicErr
+	}
+}
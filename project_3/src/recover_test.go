@@ -0,0 +1,65 @@
+// Package satservice : this contains unit tests of recovering panics of handlers and worker goroutines
+package satservice
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/golang/geo/s2"
+)
+
+// A panicking handler should return 500 without leaking the panic, and later requests should still be served
+func TestServeHTTP_Panic(t *testing.T) {
+	panicking := func(w http.ResponseWriter, r *http.Request) *appError {
+		var row []interface{}
+		_ = row[0].(string) // Index out of range, as with an unexpected schema
+		return nil
+	}
+	rr := httptest.NewRecorder()
+	appHandler(panicking).ServeHTTP(rr, httptest.NewRequest("GET", "/images?lat=55.660797&lng=12.5896", nil))
+	if status := rr.Code; status != http.StatusInternalServerError {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusInternalServerError)
+	}
+	if body := rr.Body.String(); strings.Contains(body, "index out of range") || strings.Contains(body, "goroutine") {
+		t.Errorf("panic leaked to the client: %v", body)
+	}
+
+	rr = httptest.NewRecorder()
+	appHandler(granule).ServeHTTP(rr, httptest.NewRequest("GET", "/granule?id=invalid", nil))
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler after the panic returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+}
+
+// Panics of worker goroutines should fail the pool, the cell count or the task with a PanicError instead of the instance
+func TestWorkers_Panic(t *testing.T) {
+	fetch := func(bucketName, objectName string) (Links, error) {
+		panic("unexpected object")
+	}
+	result := runPool(context.Background(), Links{"gcp-public-data-sentinel-2/tiles/A/", "gcp-public-data-sentinel-2/tiles/B/"}, 2, fetch)
+	if _, ok := result.Error.(*PanicError); !ok {
+		t.Errorf("wrong error of panicking pool: got %v", result.Error)
+	}
+
+	cover := s2.CellUnion{s2.CellIDFromToken("4653"), s2.CellIDFromToken("465c")}
+	_, err := countCells(context.Background(), cover, nil, func(ctx context.Context, results chan cellGranules, errChan chan error, token, lat1, lng1, lat2, lng2 string) {
+		panic(fmt.Sprintf("unexpected cell %s", token))
+	})
+	if _, ok := err.(*PanicError); !ok {
+		t.Errorf("wrong error of panicking cell count: got %v", err)
+	}
+
+	task := NewTask(func() error { panic("unexpected address") })
+	var wg sync.WaitGroup
+	wg.Add(1)
+	task.Run(&wg)
+	wg.Wait()
+	if panicErr, ok := task.Err.(*PanicError); !ok || len(panicErr.Stack) == 0 {
+		t.Errorf("wrong error of panicking task: got %v", task.Err)
+	}
+}
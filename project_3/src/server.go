@@ -0,0 +1,68 @@
+// Package satservice server serves the handlers standalone (e.g. on Cloud Run), rather than under the App Engine harness
+// The handlers are registered by init, so a standalone server only listens and shuts down gracefully
+package satservice
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Port of a standalone server when PORT is not set
+const defaultPort = "8080"
+
+// ShutdownTimeout bounds how long in-flight requests may take to finish once a standalone server shuts down
+var ShutdownTimeout = 10 * time.Second
+
+// ListenAddress returns the address of a standalone server, which listens on the PORT environment variable as on Cloud Run
+func ListenAddress() string {
+	port := os.Getenv("PORT")
+	if len(port) == 0 {
+		port = defaultPort
+	}
+	return ":" + port
+}
+
+// ListenAndServe serves the registered handlers on the address until the context is done, e.g. on SIGTERM
+// In-flight requests are then given ShutdownTimeout to finish before the server is closed
+func ListenAndServe(ctx context.Context, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return serve(ctx, listener)
+}
+
+// Serves the registered handlers on the listener until the context is done and shuts down gracefully
+func serve(ctx context.Context, listener net.Listener) error {
+	server := &http.Server{Handler: http.DefaultServeMux}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(listener) }()
+	log.Printf("Serving on %v", listener.Addr())
+
+	select {
+	case err := <-served:
+		return err // Server failed before shutdown
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down, waiting up to %v for requests to finish", ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := CloseBigQueryClient(); err != nil {
+		log.Printf("Unable to close BigQuery client: %v", err) // Requests are done, so closing is only cleanup
+	}
+	if err := CloseStorageClient(); err != nil {
+		log.Printf("Unable to close storage client: %v", err)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+// Package satservice : this contains unit tests of the standalone server
+package satservice
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/option"
+)
+
+// A standalone server should serve the registered handlers and shut down cleanly once its context is done, closing the BigQuery and storage clients
+func TestServe_Shutdown(t *testing.T) {
+	FlushLinksCache()
+	defer FlushLinksCache()
+	defer withQuerier(&fakeQuerier{rows: [][]bigquery.Value{{"L1C_T32UNG_A012345_20171010T103021", "S2A_MSIL1C_20171010T103021"}}})()
+	defer CloseBigQueryClient()
+	client, err := bigquery.NewClient(context.Background(), projectID, option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("Failed to create BigQuery client: %v", err)
+	}
+	bigQueryMu.Lock()
+	sharedBigQuery = client
+	bigQueryMu.Unlock()
+	defer func(old []option.ClientOption) { storageOptions = old }(storageOptions)
+	storageOptions = []option.ClientOption{option.WithoutAuthentication()}
+	defer CloseStorageClient()
+	if _, err := storageClient(context.Background()); err != nil {
+		t.Fatalf("Failed to create storage client: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serve(ctx, listener) }()
+
+	resp, err := http.Get("http://" + listener.Addr().String() + "/images?lat=55.660797&lng=12.5896")
+	if err != nil {
+		cancel()
+		t.Fatalf("Failed to request /images: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "L1C_T32UNG_A012345_20171010T103021") {
+		t.Errorf("server returned wrong response: got %v %s", resp.StatusCode, body)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("server did not shut down cleanly: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not shut down")
+	}
+	if _, err := http.Get("http://" + listener.Addr().String() + "/images"); err == nil {
+		t.Errorf("server still serves after shutdown")
+	}
+	bigQueryMu.Lock()
+	defer bigQueryMu.Unlock()
+	if sharedBigQuery != nil {
+		t.Errorf("BigQuery client was not closed on shutdown")
+	}
+	storageMu.Lock()
+	defer storageMu.Unlock()
+	if sharedStorage != nil {
+		t.Errorf("storage client was not closed on shutdown")
+	}
+}
+
+// A standalone server should listen on the PORT environment variable, as on Cloud Run
+func TestListenAddress_Port(t *testing.T) {
+	defer os.Setenv("PORT", os.Getenv("PORT"))
+	os.Setenv("PORT", "9090")
+	if addr := ListenAddress(); addr != ":9090" {
+		t.Errorf("wrong address: got %v want :9090", addr)
+	}
+	os.Unsetenv("PORT")
+	if addr := ListenAddress(); addr != ":"+defaultPort {
+		t.Errorf("wrong default address: got %v want :%v", addr, defaultPort)
+	}
+}
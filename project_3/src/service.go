@@ -16,24 +16,30 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
 	"net/http"
-	_ "net/http/pprof" // Profiling
+	"os"
 	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"cloud.google.com/go/storage"
+	"github.com/golang/geo/s2"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
-	"google.golang.org/appengine"
+	"google.golang.org/api/googleapi"
 )
 
 // RequestRetrySession represents a user session where requests may be retried to improve resiliency
 type RequestRetrySession struct {
-	MaxRetries int
-	Duration   time.Duration
-	//Backoff
-	//Session
+	MaxRetries        int
+	Duration          time.Duration // Base sleep between attempts, which grows by backoff and jitter before each retry
+	BackoffMultiplier float64       // Growth of the sleep after each retry, on top of random jitter
+	MaxElapsed        time.Duration // Total time after which no more retries are attempted, 0 means no limit
+	clock             clock
 }
 
 // NewRetry creates a new retry session based on a given max attempt count and duration for each attempt
@@ -41,31 +47,151 @@ func NewRetry(retries int, duration time.Duration) RequestRetrySession {
 	retrySession := RequestRetrySession{}
 	retrySession.MaxRetries = retries
 	retrySession.Duration = duration
+	retrySession.BackoffMultiplier = 1
 	return retrySession
 }
 
+// WithBackoffMultiplier returns a copy of the retry session where the sleep is multiplied after each retry
+func (s RequestRetrySession) WithBackoffMultiplier(multiplier float64) RequestRetrySession {
+	s.BackoffMultiplier = multiplier
+	return s
+}
+
+// WithMaxElapsed returns a copy of the retry session that stops retrying once the given time has elapsed
+func (s RequestRetrySession) WithMaxElapsed(maxElapsed time.Duration) RequestRetrySession {
+	s.MaxElapsed = maxElapsed
+	return s
+}
+
 // DefaultRetry returns parameters used by default to retry requests
 func DefaultRetry() RequestRetrySession {
-	return RequestRetrySession{MaxRetries: 5, Duration: 10}
+	return NewRetry(5, 10*time.Second)
 }
 
+// clock tells the time and waits, which tests replace to observe retries without waiting
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the clock of the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// HandlerRetry is used to re-run idempotent GET requests that fail with a transient server error (5xx)
+// By default a request is attempted once, i.e. it is not retried
+var HandlerRetry = NewRetry(1, time.Second)
+
 // init is run before the application starts serving
 func init() {
 	http.HandleFunc("/", redirect)
-	http.Handle("/images", appHandler(images))
-	http.Handle("/area", appHandler(area))
-	http.Handle("/geo", appHandler(geo))
+	handle("/images", cors(etag(appHandler(images))))
+	handle("/area", cors(etag(appHandler(area))))
+	handle("/geo", cors(etag(appHandler(geo))))
+	handle("/granule", cors(etag(appHandler(granule))))
+	handle("/stats", cors(etag(appHandler(stats))))
+	handle("/nearest", cors(etag(appHandler(nearest))))
+	handle("/geocode", cors(appHandler(geocodeBatch)))
+	handle("/version", cors(appHandler(version)))
+	handle("/openapi.json", cors(appHandler(openAPI)))
+	handle("/metrics", promhttp.Handler())
+	registerPprof(http.DefaultServeMux)
+	route, err := validDefaultRoute(DefaultRoute)
+	if err != nil {
+		log.Fatalf("Invalid DEFAULT_ROUTE: %v", err)
+	}
+	DefaultRoute = route
+}
+
+// Routes registered by init, which are the routes clients may be redirected to
+var registeredRoutes = map[string]bool{}
+
+// Registers the handler of a route
+func handle(route string, handler http.Handler) {
+	registeredRoutes[route] = true
+	http.Handle(route, handler)
+}
+
+// Route clients are redirected to when DEFAULT_ROUTE is not set
+const defaultLandingRoute = "/geo"
+
+// DefaultRoute is the route clients are redirected to from all unknown routes, e.g. DEFAULT_ROUTE=/images
+var DefaultRoute = os.Getenv("DEFAULT_ROUTE")
+
+// Registered routes for machines rather than clients, which are never landing routes
+var machineRoutes = map[string]bool{"/metrics": true, "/openapi.json": true}
+
+// Returns the default route if it is a registered route, where an unset route falls back to defaultLandingRoute
+// An unknown route is an error, since a misconfigured service would otherwise redirect clients to a route it does not serve
+func validDefaultRoute(route string) (string, error) {
+	if len(route) == 0 {
+		return defaultLandingRoute, nil
+	}
+	if !registeredRoutes[route] {
+		return "", fmt.Errorf("%q is not a route of the service", route)
+	}
+	if machineRoutes[route] {
+		return "", fmt.Errorf("%q is not a landing route", route)
+	}
+	return route, nil
 }
 
-// redirect ensures that client is redirected to correct route
+// BaseURL is the scheme and host clients are redirected to, e.g. BASE_URL=https://example.com, where empty means the host of the request
+var BaseURL = strings.TrimSuffix(os.Getenv("BASE_URL"), "/")
+
+// redirect ensures that client is redirected to correct route, i.e. DefaultRoute
 func redirect(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, "https://tvao-178408.appspot.com/geo", 301)
+	http.Redirect(w, r, baseURL(r)+DefaultRoute, 301)
+}
+
+// Returns the base URL of redirects, which is BaseURL if configured or else the host of the request
+// The scheme is that of X-Forwarded-Proto, set by proxies terminating TLS (e.g. App Engine or Cloud Run), or else that of the connection
+func baseURL(r *http.Request) string {
+	if len(BaseURL) > 0 {
+		return BaseURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := strings.ToLower(r.Header.Get("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+// CoordinateRange is the range of valid values of a coordinate in degrees, bounds included
+type CoordinateRange struct {
+	Min, Max float64
+}
+
+// Ranges of valid latitudes and longitudes
+var (
+	LatitudeRange  = CoordinateRange{Min: -90, Max: 90}
+	LongitudeRange = CoordinateRange{Min: -180, Max: 180}
+)
+
+// Reports whether the coordinate is a number within the range, in any form ParseFloat accepts (e.g. 55.66, +12 or 1e1)
+// NaN and infinities are never within the range
+func (c CoordinateRange) valid(coord string) bool {
+	value, err := strconv.ParseFloat(coord, 64)
+	return err == nil && c.Min <= value && value <= c.Max
 }
 
 // Basic regular expressions for validating user input and column number for granules
 const (
-	Latitude  string = "^[-+]?([1-8]?\\d(\\.\\d+)?|90(\\.0+)?)$"
-	Longitude string = "^[-+]?(180(\\.0+)?|((1[0-7]\\d)|([1-9]?\\d))(\\.\\d+)?)$"
+	Tile string = "^[0-9]{1,2}[C-HJ-NP-X][A-HJ-NP-Z]{2}$" // MGRS tile: UTM zone, latitude band and 100 km square (e.g. 32UNG)
+	// Granule id of the compact (e.g. L1C_T32UNG_A012345_20171010T103021) or the older naming convention
+	// (e.g. S2A_OPER_MSI_L1C_TL_SGS__20160120T123311_A002960_T32UNG_N02.01)
+	GranuleID string = "^((L1C|L2A)_T[0-9]{2}[A-Z]{3}_A[0-9]{6}_[0-9]{8}T[0-9]{6}|S2[AB]_OPER_MSI_(L1C|L2A)_TL_[A-Z0-9_]+_A[0-9]{6}_T[0-9]{2}[A-Z]{3}_N[0-9]{2}\\.[0-9]{2})$"
+)
+
+// Compiled regular expressions of the tiles and granule ids, which are compiled once rather than on every request
+var (
+	tilePattern      = regexp.MustCompile(Tile)
+	granuleIDPattern = regexp.MustCompile(GranuleID)
 )
 
 // Define custom HTTP appHandler that includes error return value to reduce repetition in error handling
@@ -78,195 +204,1587 @@ type appError struct {
 	Code    int // Server (500 Internal Error) or Client (400 Bad Request Error)
 }
 
+// Debug includes the underlying error in error responses, which should not be exposed to clients in production
+var Debug = os.Getenv("DEBUG") == "true"
+
+// JSON representation of an appError returned to the client
+type errorResponse struct {
+	Error   string `json:"error,omitempty"`
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+// Returns the JSON representation of the error returned to the client
+func (e *appError) response() errorResponse {
+	response := errorResponse{Message: e.Message, Code: e.Code}
+	if Debug && e.Error != nil {
+		response.Error = e.Error.Error()
+	}
+	return response
+}
+
+// Writes the error as a JSON object with the status code of the error
+func (e *appError) write(w http.ResponseWriter) {
+	response := e.response()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Code)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Unable to write error response: %v", err)
+	}
+}
+
+// RouteTimeouts is the deadline of requests of each route, where routes without a timeout use DefaultTimeout
+// Lookups of a location are fast, whereas region covers of large countries may run many queries
+var RouteTimeouts = map[string]time.Duration{
+	"/images":  30 * time.Second,
+	"/granule": 30 * time.Second,
+	"/area":    5 * time.Minute,
+	"/geo":     10 * time.Minute,
+}
+
+// DefaultTimeout is the deadline of requests of routes without a timeout in RouteTimeouts
+var DefaultTimeout = 5 * time.Minute
+
+// Returns the deadline of requests of a route
+func routeTimeout(route string) time.Duration {
+	if timeout, ok := RouteTimeouts[route]; ok {
+		return timeout
+	}
+	return DefaultTimeout
+}
+
+// MaxResults is the max number of results held in memory by requests of each route, where routes without a max use DefaultMaxResults
+// Results beyond the max (e.g. image folders of a huge area, or their images) are dropped and the response is flagged as truncated
+var MaxResults = map[string]int{
+	"/area": 100000,
+}
+
+// DefaultMaxResults is the max number of results of routes without a max in MaxResults
+var DefaultMaxResults = 10000
+
+// Returns the max number of results of requests of a route
+func maxResults(route string) int {
+	if max, ok := MaxResults[route]; ok {
+		return max
+	}
+	return DefaultMaxResults
+}
+
 // Implement ServeHTTP to comply with the http.Handler interface
 // Go functional feature: fn is a first order function that invokes the underlying http request function (e.g. get)
-func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// Each request is counted by route and status code, and logged to the access log with its latency
+func (fn appHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	instrument(rw, r, fn.handle)
+}
+
+// Counts the request by route and the status code of the response written by handle, and logs it to the access log
+func instrument(rw http.ResponseWriter, r *http.Request, handle http.HandlerFunc) {
+	sw := &statusWriter{ResponseWriter: rw, code: http.StatusOK}
+	defer func(start time.Time) {
+		metrics.Request(r.URL.Path, sw.code)
+		logAccess(r, sw, time.Since(start))
+	}(time.Now())
+	handle(sw, r)
+}
+
+// Runs the handler with the deadline of its route and writes its error, if any
+// With &callback=<name> JSON responses are wrapped in a call of the callback (JSONP) for legacy browser clients
+func (fn appHandler) handle(w http.ResponseWriter, r *http.Request) {
+	if callback := r.URL.Query().Get("callback"); len(callback) > 0 {
+		if !validCallback(callback) {
+			(&appError{errors.New("Invalid callback"), "Please provide a JavaScript identifier as callback, e.g. &callback=showImages", http.StatusBadRequest}).write(w)
+			return
+		}
+		jw := newJSONPWriter(w)
+		defer jw.finish(callback)
+		w = jw
+	}
 	w.Header().Set("Content-Type", "application/json")
-	ctx := appengine.NewContext(r)
-	ctxWithDeadline, cancel := context.WithTimeout(ctx, 5*time.Minute)
-	if err := fn(w, r.WithContext(ctxWithDeadline)); err != nil {
-		http.Error(w, err.Message, err.Code)
+	ctx := contextFromRequest(r)
+	ctxWithDeadline, cancel := context.WithTimeout(ctx, routeTimeout(r.URL.Path))
+	if err := fn.serve(w, r.WithContext(ctxWithDeadline)); err != nil {
+		err.write(w)
 	}
 	defer cancel() // Cancel ctx as soon as request returns
 	defer r.Body.Close()
 }
 
+// Runs the handler and retries GET requests on transient server errors, as configured by HandlerRetry
+// Client errors (4xx) are returned right away, since running the same request again gives the same result
+// Failures after the handler wrote to the response (e.g. streamed some links) are not retried, since the response cannot be taken back
+func (fn appHandler) serve(w http.ResponseWriter, r *http.Request) *appError {
+	if r.Method != http.MethodGet || HandlerRetry.MaxRetries <= 1 {
+		return fn.call(w, r)
+	}
+	var appErr *appError
+	aw := &attemptWriter{ResponseWriter: w}
+	retry(r.Context(), HandlerRetry, func() error {
+		appErr = fn.call(aw, r)
+		if appErr != nil && appErr.Code >= http.StatusInternalServerError && !aw.written {
+			return errors.New(appErr.Message)
+		}
+		return nil // Success, client error or a partly written response
+	})
+	return appErr
+}
+
+// attemptWriter remembers whether an attempt of a handler wrote the status code, a byte of the body or flushed the response
+type attemptWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (aw *attemptWriter) WriteHeader(code int) {
+	aw.written = true
+	aw.ResponseWriter.WriteHeader(code)
+}
+
+func (aw *attemptWriter) Write(b []byte) (int, error) {
+	aw.written = true
+	return aw.ResponseWriter.Write(b)
+}
+
+// Flush lets streamed responses (e.g. newline delimited JSON) flush through the attempt writer
+func (aw *attemptWriter) Flush() {
+	aw.written = true
+	if flusher, ok := aw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Runs the handler, where errors of BigQuery rate limiting are returned as 429 Too Many Requests with a Retry-After header
+// Clients then back off instead of retrying right away, which only makes the rate limiting worse
+// Queries over the byte budget are returned as 400 Bad Request with the estimate, since the same request always exceeds it
+func (fn appHandler) call(w http.ResponseWriter, r *http.Request) *appError {
+	appErr := fn.recover(w, r)
+	if appErr == nil {
+		return nil
+	}
+	var budgetErr *BudgetError
+	if errors.As(appErr.Error, &budgetErr) {
+		return &appError{appErr.Error, fmt.Sprintf("Query too expensive: estimated %d bytes scanned exceeds the budget of %d bytes, please narrow the request", budgetErr.Estimate, budgetErr.Budget), http.StatusBadRequest}
+	}
+	if !rateLimited(appErr.Error) {
+		return appErr
+	}
+	w.Header().Set("Retry-After", retryAfter(DefaultRetry()))
+	return &appError{appErr.Error, "Too many requests, please retry later", http.StatusTooManyRequests}
+}
+
+// Runs the handler, where a panic is returned as 500 Internal Server Error
+// The panic and its stack are logged, but never written to the client
+func (fn appHandler) recover(w http.ResponseWriter, r *http.Request) (appErr *appError) {
+	var err error
+	defer func() {
+		if err != nil {
+			appErr = &appError{err, "Internal server error", http.StatusInternalServerError}
+		}
+	}()
+	defer recoverPanic(&err)
+	return fn(w, r)
+}
+
+// Reasons of Google API errors that report rate limiting or exceeded quota
+var rateLimitReasons = map[string]bool{"rateLimitExceeded": true, "userRateLimitExceeded": true, "quotaExceeded": true}
+
+// Reports whether an error is a Google API error of rate limiting, i.e. 429 or 403 with a rate limit reason
+func rateLimited(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.Code == http.StatusTooManyRequests {
+		return true
+	}
+	if apiErr.Code != http.StatusForbidden {
+		return false
+	}
+	for _, item := range apiErr.Errors {
+		if rateLimitReasons[item.Reason] {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the Retry-After header value in seconds of the first sleep of a retry session
+func retryAfter(session RequestRetrySession) string {
+	sleep := time.Duration(float64(session.Duration) * session.BackoffMultiplier)
+	return strconv.Itoa(int(math.Ceil(sleep.Seconds())))
+}
+
 // Project 1 - Exercise 2 and 4: Returns JSON array with links to all satellite images (i.e. granule ids) based on a location
 // Location is based on a latitude and longitude or address provided as query parameters
+// With &resolve=true the image folders of the granules are returned instead of granule ids
+// With &format=csv the granule ids are returned as CSV instead
+// With &tile=33UUB the granules of the MGRS tile are returned instead of those of a location
+// With &latest=true only the granule id and sensing time of the most recent granule are returned
+// With &sort=sensing_time_asc, sensing_time_desc or cloud_cover_asc the granules are returned in that order
+// With POST the links of a batch of points are returned instead, see imagesBatch
+// With &dataset=landsat8 the scene ids of Landsat 8 are returned instead, which does not support tiles, levels and pages
 func images(w http.ResponseWriter, r *http.Request) *appError {
 	if err := r.ParseForm(); err != nil {
 		return &appError{err, "Cannot parse data", http.StatusInternalServerError}
 	}
 
+	filter, appErr := parseGranuleFilter(r)
+	if appErr != nil {
+		return appErr
+	}
+	if filter.Dataset, appErr = parseDataset(r); appErr != nil {
+		return appErr
+	}
+	if _, level := r.Form["level"]; filter.Dataset != Sentinel2 && (level || r.Form.Get("tile") != "" || r.Form.Get("tiles") != "" || r.Form.Get("limit") != "" || r.Form.Get("offset") != "") {
+		return &appError{errors.New("Unsupported dataset"), "Tiles, levels and pages are only supported for &dataset=sentinel2", http.StatusBadRequest}
+	}
+	if r.Method == http.MethodPost {
+		return imagesBatch(w, filter, r)
+	}
+	format, appErr := parseFormat(r, FormatAddress, FormatCSV)
+	if appErr != nil {
+		return appErr
+	}
+
+	if tile := r.Form.Get("tile"); len(tile) > 0 {
+		return imagesByTile(w, tile, filter, r)
+	}
+	if tiles := r.Form.Get("tiles"); len(tiles) > 0 {
+		return imagesByTiles(w, strings.Split(tiles, ","), filter, r)
+	}
+
 	address := r.Form.Get("address")
 	lat, lng, err := convertAddressToCoords(address, r)
 
 	if err != nil {
 		lat, lng = r.Form.Get("lat"), r.Form.Get("lng")
 	}
+	normalizeCoordinates(w, &lat, &lng)
 
-	validLat, validLng := regexp.MustCompile(Latitude).MatchString(lat), regexp.MustCompile(Longitude).MatchString(lng)
+	if appErr := validateLocation(lat, lng); appErr != nil {
+		return appErr
+	}
 
-	if !validLat && !validLng {
-		return &appError{errors.New("Invalid coordinates"), "Please provide a valid latitude and longitude", http.StatusBadRequest}
+	if radius := r.Form.Get("radiusKm"); len(radius) > 0 {
+		return imagesByRadius(w, lat, lng, radius, filter, r)
+	}
+
+	if latest := r.Form.Get("latest"); len(latest) > 0 {
+		latest, err := strconv.ParseBool(latest)
+		if err != nil {
+			return &appError{err, "Please provide a valid latest flag, e.g. &latest=true", http.StatusBadRequest}
+		}
+		if latest {
+			return latestImage(w, lat, lng, filter, r)
+		}
+	}
+
+	if r.Form.Get("limit") != "" || r.Form.Get("offset") != "" {
+		return imagesPage(w, lat, lng, filter, r)
+	}
+
+	if level, ok := r.Form["level"]; ok {
+		return imagesByLevel(w, lat, lng, strings.ToUpper(level[0]), filter, r)
+	}
+
+	if resolve := r.Form.Get("resolve"); len(resolve) > 0 {
+		resolve, err := strconv.ParseBool(resolve)
+		if err != nil {
+			return &appError{err, "Please provide a valid resolve flag, e.g. &resolve=true", http.StatusBadRequest}
+		}
+		if resolve {
+			return imageFolders(w, lat, lng, filter, r)
+		}
 	}
 
-	links, err := getLinks(lat, lng, r)
+	links, err := getLinks(lat, lng, filter, r)
 	if err != nil {
 		return &appError{err, "Unable to retrieve links", http.StatusInternalServerError}
 	}
 
-	if err := json.NewEncoder(w).Encode(links); err != nil {
-		return &appError{err, "Unable to map JSON to response", http.StatusInternalServerError}
+	if format == FormatAddress {
+		return imagesWithAddress(w, lat, lng, links, filter.dataset(), r)
+	}
+	if format == FormatCSV {
+		return writeCSV(w, "images.csv", linksCSV(links))
+	}
+
+	if appErr := writeLinks(w, links, filter.dataset(), r); appErr != nil {
+		return appErr
 	}
 
 	log.Printf("Success: granule links fetched from latitude '%s' and longitude '%s'", lat, lng)
 	return nil // Success
 }
 
-// Project 2 : Image data in geographic location
-// Returns a JSON array with links to all satellite images within a marked area of interest specified with a pair of lat/lng coordinates.
-// Area of interest is specified by a pair of latitude and longitude coordinates as query parameters.
-func area(w http.ResponseWriter, r *http.Request) *appError {
-	if err := r.ParseForm(); err != nil {
-		return &appError{err, "Cannot parse data", http.StatusInternalServerError}
+// FormatAddress is the format query parameter value of /images responses that echo the address of the location
+const FormatAddress = "address"
+
+// AddressLinks are links (i.e. granule ids) of a location together with the human-readable address of the location
+// The address is omitted when the location cannot be reverse geocoded
+type AddressLinks struct {
+	Address string `json:"address,omitempty"`
+	Links   Links  `json:"links"`
+	Source
+}
+
+// Returns JSON object with links to all satellite images of a location and the address of the location
+// The links are returned without address if reverse geocoding fails, since the address only describes the links
+func imagesWithAddress(w http.ResponseWriter, lat, lng string, links Links, dataset *Dataset, r *http.Request) *appError {
+	address, err := convertCoordsToAddress(lat, lng, r)
+	if err != nil {
+		log.Printf("Unable to convert latitude '%s' and longitude '%s' to address: %v", lat, lng, err)
 	}
 
-	lat1, lng1, lat2, lng2 := r.Form.Get("lat1"), r.Form.Get("lng1"), r.Form.Get("lat2"), r.Form.Get("lng2")
-	if !regexp.MustCompile(Latitude).MatchString(lat1) || !regexp.MustCompile(Latitude).MatchString(lat2) ||
-		!regexp.MustCompile(Longitude).MatchString(lng1) || !regexp.MustCompile(Longitude).MatchString(lng2) {
-		return &appError{errors.New("Invalid coordinates"), "Please provide a valid pair of latitude and longitude bands \n" +
-			" Example: https://tvao-178408.appspot.com/area?lat1=55.698473&lng1=12.506052&lat2=55.616879&lng2=12.652524", http.StatusBadRequest}
+	if err := json.NewEncoder(w).Encode(AddressLinks{Address: address, Links: links, Source: dataset.source()}); err != nil {
+		return &appError{err, "Unable to map JSON to response", http.StatusInternalServerError}
+	}
+	return nil // Success
+}
+
+// Sentinel-2 acquires images between latitudes 56° south and 84° north, so valid coordinates outside have no granules
+// The response returned for such coordinates is configurable to distinguish it from an empty result within coverage
+var (
+	CoverageSouth        = -56.0
+	CoverageNorth        = 84.0
+	OutOfCoverageCode    = http.StatusNotFound
+	OutOfCoverageMessage = "Location is outside Sentinel-2 coverage (latitudes 56° south to 84° north)"
+)
+
+// Validates the coordinates of a location, naming the invalid coordinate, and rejects locations outside the coverage of Sentinel-2
+func validateLocation(lat, lng string) *appError {
+	if appErr := validateCoordinates(lat, lng); appErr != nil {
+		return appErr
+	}
+	if !inCoverage(lat) {
+		return &appError{errors.New("Out of coverage"), OutOfCoverageMessage, OutOfCoverageCode}
+	}
+	return nil
+}
+
+// Validates the coordinates of a location, naming the invalid coordinate, regardless of the coverage of Sentinel-2
+func validateCoordinates(lat, lng string) *appError {
+	validLat, validLng := LatitudeRange.valid(lat), LongitudeRange.valid(lng)
+
+	switch {
+	case !validLat && !validLng:
+		return &appError{errors.New("Invalid coordinates"), "Please provide a valid latitude and longitude", http.StatusBadRequest}
+	case !validLat:
+		return &appError{errors.New("Invalid latitude"), "Please provide a valid latitude between -90 and 90", http.StatusBadRequest}
+	case !validLng:
+		return &appError{errors.New("Invalid longitude"), "Please provide a valid longitude between -180 and 180", http.StatusBadRequest}
 	}
+	return nil
+}
+
+// Reports whether a valid latitude is within the coverage envelope of Sentinel-2
+func inCoverage(lat string) bool {
+	latitude, err := strconv.ParseFloat(lat, 64)
+	return err == nil && CoverageSouth <= latitude && latitude <= CoverageNorth
+}
 
-	links, err := getImageBaseURL(lat1, lng1, lat2, lng2, r)
+// Returns JSON object with the granule id and sensing time of the most recent granule of a location
+func latestImage(w http.ResponseWriter, lat, lng string, filter GranuleFilter, r *http.Request) *appError {
+	latest, err := getLatestGranule(lat, lng, filter, r)
+	if err == ErrNoGranules {
+		return &appError{err, fmt.Sprintf("No granules found at latitude %s and longitude %s", lat, lng), http.StatusNotFound}
+	}
 	if err != nil {
-		return &appError{err, "Unable to retrieve granulelinks", http.StatusInternalServerError}
+		return &appError{err, "Unable to retrieve latest granule", http.StatusInternalServerError}
 	}
 
-	imageResult := pool(links, r)
-	if err := imageResult.Error; err != nil {
-		return &appError{err, "Could not fetch pictures from granules", http.StatusInternalServerError}
+	latest.Source = filter.dataset().source()
+	if err := json.NewEncoder(w).Encode(latest); err != nil {
+		return &appError{err, "Unable to map JSON to response", http.StatusInternalServerError}
 	}
-	// Encode JSON result
-	encodeErr := json.NewEncoder(w).Encode(len(imageResult.Links))
-	if encodeErr != nil {
-		return &appError{err, "Unable to encode JSON", http.StatusInternalServerError}
+	return nil // Success
+}
+
+// Limits of the page size of paginated /images results
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// Returns JSON object with a page of links to satellite images (i.e. granule ids) of a location
+// The page is specified by the limit and offset query parameters
+func imagesPage(w http.ResponseWriter, lat, lng string, filter GranuleFilter, r *http.Request) *appError {
+	limit, offset := defaultPageLimit, 0
+	var limitErr, offsetErr error
+	if l := r.Form.Get("limit"); len(l) > 0 {
+		limit, limitErr = strconv.Atoi(l)
+	}
+	if o := r.Form.Get("offset"); len(o) > 0 {
+		offset, offsetErr = strconv.Atoi(o)
+	}
+	if firstError(limitErr, offsetErr) != nil || limit < 1 || limit > maxPageLimit || offset < 0 {
+		return &appError{errors.New("Invalid page"), fmt.Sprintf("Please provide a limit between 1 and %d and a non-negative offset, e.g. &limit=100&offset=200", maxPageLimit), http.StatusBadRequest}
+	}
+
+	page, err := getLinksPage(lat, lng, limit, offset, filter, r)
+	if err != nil {
+		return &appError{err, "Unable to retrieve links", http.StatusInternalServerError}
+	}
+
+	page.Source = filter.dataset().source()
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		return &appError{err, "Unable to map JSON to response", http.StatusInternalServerError}
 	}
 	return nil // Success
 }
 
-// Project 3 : Fetch and parse PSLG data of country user inputs from Geofabrik
-// Returns count of images associated with bounding box of country
-func geo(w http.ResponseWriter, r *http.Request) *appError {
-	if err := r.ParseForm(); err != nil || !(len(r.Form.Get("country")) > 0) {
-		return &appError{err, "Could not parse specified country location.", http.StatusBadRequest}
+// Returns JSON array with all granules of a location and their processing level, filtered to the level if specified
+func imagesByLevel(w http.ResponseWriter, lat, lng, level string, filter GranuleFilter, r *http.Request) *appError {
+	if len(level) > 0 && level != LevelL1C && level != LevelL2A {
+		return &appError{errors.New("Invalid level"), "Please provide a valid processing level, e.g. &level=L1C or &level=L2A", http.StatusBadRequest}
 	}
 
-	country := r.Form.Get("country")
-	continent := r.Form.Get("continent")
-	coords, err := parse(r, country, continent)
+	granules, err := getGranules(lat, lng, level, filter, r)
 	if err != nil {
-		return &appError{err, "Could not fetch PSLG data", http.StatusInternalServerError}
+		return &appError{err, "Unable to retrieve links", http.StatusInternalServerError}
+	}
+
+	if err := json.NewEncoder(w).Encode(granules); err != nil {
+		return &appError{err, "Unable to map JSON to response", http.StatusInternalServerError}
+	}
+	return nil // Success
+}
+
+// Returns JSON array with links to all satellite images (i.e. granule ids) within any of the given MGRS tiles
+func imagesByTiles(w http.ResponseWriter, tiles []string, filter GranuleFilter, r *http.Request) *appError {
+	for i, tile := range tiles {
+		tiles[i] = strings.ToUpper(strings.TrimSpace(tile))
+		if !tilePattern.MatchString(tiles[i]) {
+			return &appError{errors.New("Invalid tile"), "Please provide valid MGRS tiles, e.g. &tiles=32UNG,33UUB", http.StatusBadRequest}
+		}
+	}
+	if len(tiles) > maxTiles {
+		return &appError{errors.New("Too many tiles"), fmt.Sprintf("Please provide at most %d tiles", maxTiles), http.StatusBadRequest}
 	}
 
-	cover := regionCover(coords, 15, 100)
-	imageCount, err := imagesByRegion(cover, r)
+	links, err := getLinksByTiles(tiles, filter, r)
 	if err != nil {
-		return &appError{err, "Could not get granules", http.StatusInternalServerError}
+		return &appError{err, "Unable to retrieve links", http.StatusInternalServerError}
 	}
+	return writeLinks(w, links, filter.dataset(), r)
+}
 
-	encodeErr := json.NewEncoder(w).Encode(imageCount)
-	if encodeErr != nil {
-		return &appError{encodeErr, "Unable to find region cover", http.StatusInternalServerError}
+// Returns JSON array with links to all satellite images (i.e. granule ids) of a single MGRS tile, e.g. 33UUB
+// The tile is looked up like the tiles of imagesByTiles, where several tiles belong in &tiles
+func imagesByTile(w http.ResponseWriter, tile string, filter GranuleFilter, r *http.Request) *appError {
+	if strings.Contains(tile, ",") {
+		return &appError{errors.New("Invalid tile"), "Please provide a single MGRS tile, e.g. &tile=33UUB, or several tiles with &tiles=32UNG,33UUB", http.StatusBadRequest}
 	}
-	return nil
+	return imagesByTiles(w, []string{tile}, filter, r)
 }
 
-// Result represents links and wraps errors that may occur
-type Result struct {
-	Links []string
-	Error error
+// Statuses of v2 /images responses, where no_coverage means the query succeeded without any granules
+const (
+	StatusOK         = "ok"
+	StatusNoCoverage = "no_coverage"
+)
+
+// MediaTypeV2 is the media type of the Accept header requesting v2 responses, as an alternative to &v=2
+const MediaTypeV2 = "application/vnd.satservice.v2+json"
+
+// LinksResponse is the v2 response of /images, which wraps the links so an empty result can be told apart
+type LinksResponse struct {
+	Links     Links  `json:"links"`
+	Count     int    `json:"count"`
+	Status    string `json:"status"`
+	Truncated bool   `json:"truncated,omitempty"`
+	Source
 }
 
-// Worker pool used to fetch images from subfolders in Google Cloud Bucket concurrently using goroutines
-func pool(links Links, r *http.Request) Result {
-	// Create a set of worker jobs for each link
-	numberOfJobs := len(links)
-	jobs := make(chan string)
-	results := make(chan Result)
-	imageResult := Result{}
+// Reports whether the client requested v2 responses with &v=2 or the Accept header
+func wantsV2(r *http.Request) bool {
+	return r.Form.Get("v") == "2" || strings.Contains(r.Header.Get("Accept"), MediaTypeV2)
+}
 
-	// Clients should be reused instead of created as needed. The methods of Client are safe for concurrent use by multiple goroutines.
-	client, err := storage.NewClient(r.Context())
-	if err != nil {
-		imageResult.Error = err
-		return imageResult // Error propagated
+// Writes links as a JSON array, or wrapped in a LinksResponse of the dataset of the links if the client requested v2 responses
+func writeLinks(w http.ResponseWriter, links Links, dataset *Dataset, r *http.Request) *appError {
+	return writeTruncatedLinks(w, links, false, dataset, r)
+}
+
+// Writes links as writeLinks, where truncated links are always wrapped in a LinksResponse, so the truncation is flagged
+func writeTruncatedLinks(w http.ResponseWriter, links Links, truncated bool, dataset *Dataset, r *http.Request) *appError {
+	var response interface{} = links
+	if wantsV2(r) || truncated {
+		v2 := LinksResponse{Links: Links{}, Count: len(links), Status: StatusOK, Truncated: truncated, Source: dataset.source()}
+		v2.Links = append(v2.Links, links...)
+		if v2.Count == 0 {
+			v2.Status = StatusNoCoverage
+		}
+		response = v2
 	}
 
-	// Start goroutine workers
-	for i := 0; i <= numberOfJobs; i++ {
-		go worker(client, r, jobs, results)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		return &appError{err, "Unable to map JSON to response", http.StatusInternalServerError}
 	}
+	return nil // Success
+}
 
-	// Send jobs
-	for _, imgLink := range links {
-		jobs <- imgLink
+// Returns a JSON object with the metadata of the granule with the id given as query parameter, e.g. /granule?id=<granule_id>
+func granule(w http.ResponseWriter, r *http.Request) *appError {
+	if err := r.ParseForm(); err != nil {
+		return &appError{err, "Cannot parse data", http.StatusInternalServerError}
 	}
-	close(jobs) // Close do indicate this is all work to be done
 
-	// Collect worker results and write them to JSON result
-	for i := 0; i <= numberOfJobs; i++ {
-		result := <-results
-		imageResult.Links = append(imageResult.Links, result.Links...)
+	id := r.Form.Get("id")
+	if !granuleIDPattern.MatchString(id) {
+		return &appError{errors.New("Invalid granule id"), "Please provide a valid granule id, e.g. &id=L1C_T32UNG_A012345_20171010T103021", http.StatusBadRequest}
 	}
-	close(results)
-	return imageResult
-}
 
-// Worker receives work on jobs channel and send images for each folder job to result
-func worker(client *storage.Client, r *http.Request, jobs <-chan string, results chan<- Result) {
-	folderImages := Result{}
-	for imgLink := range jobs {
-		linkAndGranule := strings.SplitAfter(imgLink, "gcp-public-data-sentinel-2")
-		bucketName := linkAndGranule[0]
-		imageObject := strings.Trim(linkAndGranule[1], "/")
-		//bucketHandle := client.Bucket(bucketName)
-		result, err := getImagesFromBucket(client, bucketName, imageObject, r)
-
-		// Retry for better resilience
-		if err != nil {
-			err := retry(DefaultRetry().MaxRetries, DefaultRetry().Duration*time.Second, func() (err error) {
-				result, err = getImagesFromBucket(client, bucketName, imageObject, r)
-				return
-			})
-			if err != nil {
-				folderImages.Error = err
-			}
-		}
-		folderImages.Links = result
+	metadata, err := getGranule(id, r)
+	if err == ErrGranuleNotFound {
+		return &appError{err, fmt.Sprintf("Granule %s not found", id), http.StatusNotFound}
+	}
+	if err != nil {
+		return &appError{err, "Unable to retrieve granule", http.StatusInternalServerError}
+	}
+
+	if err := json.NewEncoder(w).Encode(metadata); err != nil {
+		return &appError{err, "Unable to map JSON to response", http.StatusInternalServerError}
 	}
-	results <- folderImages
+	return nil // Success
 }
 
-// Google Client API may fail in which we want to enforce a retry mechanism to improve the resiliency
-// Credits: https://blog.abourget.net/en/2016/01/04/my-favorite-golang-retry-function/
-// http://sethammons.com/post/pester/
-func retry(attempts int, sleep time.Duration, callback func() error) (err error) {
-	for i := 0; ; i++ {
-		err = callback()
-		if err == nil {
-			return
-		}
+// Returns JSON object summarizing the granules of a location, i.e. their count, sensing times and cloud cover
+// Locations without granules have zeroed fields and no_coverage set, instead of an error
+func stats(w http.ResponseWriter, r *http.Request) *appError {
+	if err := r.ParseForm(); err != nil {
+		return &appError{err, "Cannot parse data", http.StatusInternalServerError}
+	}
 
-		if i >= (attempts - 1) {
-			break
-		}
-		/// Add randomness to prevent Thundering Herd: https://upgear.io/blog/simple-golang-retry-function/
-		jitter := time.Duration(rand.Int63n(int64(sleep)))
-		sleep = sleep + jitter/2
-		time.Sleep(sleep)
+	filter, appErr := parseGranuleFilter(r)
+	if appErr != nil {
+		return appErr
+	}
+	lat, lng := r.Form.Get("lat"), r.Form.Get("lng")
+	if appErr := validateLocation(lat, lng); appErr != nil {
+		return appErr
+	}
+
+	coverage, err := getCoverageStats(lat, lng, filter, r)
+	if err != nil {
+		return &appError{err, "Unable to retrieve coverage statistics", http.StatusInternalServerError}
+	}
+	coverage.Source = filter.dataset().source()
+
+	if err := json.NewEncoder(w).Encode(coverage); err != nil {
+		return &appError{err, "Unable to map JSON to response", http.StatusInternalServerError}
+	}
+	return nil // Success
+}
+
+// Returns the granule whose center is closest to a location, e.g. when the location itself has no coverage
+func nearest(w http.ResponseWriter, r *http.Request) *appError {
+	if err := r.ParseForm(); err != nil {
+		return &appError{err, "Cannot parse data", http.StatusInternalServerError}
+	}
+
+	filter, appErr := parseGranuleFilter(r)
+	if appErr != nil {
+		return appErr
+	}
+	if filter.Dataset, appErr = parseDataset(r); appErr != nil {
+		return appErr
+	}
+	lat, lng := r.Form.Get("lat"), r.Form.Get("lng")
+	// Locations outside the coverage are valid, since the nearest granule is what the user wants to find there
+	if appErr := validateCoordinates(lat, lng); appErr != nil {
+		return appErr
+	}
+
+	granule, err := getNearestGranule(lat, lng, filter, r)
+	if err == ErrNoGranules {
+		return &appError{err, fmt.Sprintf("No granules found within %v km of latitude %s and longitude %s", NearestRadiusKm, lat, lng), http.StatusNotFound}
+	}
+	if err != nil {
+		return &appError{err, "Unable to retrieve nearest granule", http.StatusInternalServerError}
+	}
+	granule.Source = filter.dataset().source()
+
+	if err := json.NewEncoder(w).Encode(granule); err != nil {
+		return &appError{err, "Unable to map JSON to response", http.StatusInternalServerError}
+	}
+	return nil // Success
+}
+
+// Project 2 : Image data in geographic location
+// Returns a JSON array with links to all satellite images within a marked area of interest specified with a pair of lat/lng coordinates.
+// Area of interest is specified by a pair of latitude and longitude coordinates as query parameters.
+// The corners may also be specified by a pair of addresses (address1 and address2), which are geocoded into coordinates.
+// With &level=L1C or &level=L2A only granules of that processing level are returned, using the bucket layout of the level.
+// With &format=geojson the granules of the area are returned as a GeoJSON FeatureCollection instead.
+// With &format=csv the metadata of the granules of the area are returned as CSV instead.
+// With the Accept header application/x-ndjson each image link is streamed as a JSON line instead.
+// With &sort=sensing_time_asc, sensing_time_desc or cloud_cover_asc the granules of GeoJSON and CSV are returned in that order,
+// while images are fetched from the granules in that order but combined as they are fetched.
+// With &dataset=landsat8 the images of the Landsat 8 scenes of the area are returned instead, which does not support levels.
+// With &antimeridian=true the area spans the longitudes between the corners across ±180°, e.g. lng1=177&lng2=-178.5 around Fiji.
+func area(w http.ResponseWriter, r *http.Request) *appError {
+	if err := r.ParseForm(); err != nil {
+		return &appError{err, "Cannot parse data", http.StatusInternalServerError}
+	}
+	format, appErr := parseFormat(r, FormatGeoJSON, FormatCSV)
+	if appErr != nil {
+		return appErr
+	}
+
+	lat1, lng1, lat2, lng2 := r.Form.Get("lat1"), r.Form.Get("lng1"), r.Form.Get("lat2"), r.Form.Get("lng2")
+	if address1, address2 := r.Form.Get("address1"), r.Form.Get("address2"); len(address1) > 0 || len(address2) > 0 {
+		if lat1, lng1, lat2, lng2, appErr = areaCorners(address1, address2, r); appErr != nil {
+			return appErr
+		}
+	} else if crs := r.Form.Get("input_crs"); len(crs) > 0 {
+		var err1, err2 error
+		lat1, lng1, err1 = reproject(crs, lat1, lng1)
+		lat2, lng2, err2 = reproject(crs, lat2, lng2)
+		if err := firstError(err1, err2); err != nil {
+			return &appError{err, "Please provide coordinates in a supported input CRS, e.g. &input_crs=4326 or &input_crs=3857", http.StatusBadRequest}
+		}
+	}
+	normalizeCoordinates(w, &lat1, &lng1, &lat2, &lng2)
+	if !LatitudeRange.valid(lat1) || !LatitudeRange.valid(lat2) || !LongitudeRange.valid(lng1) || !LongitudeRange.valid(lng2) {
+		return &appError{errors.New("Invalid coordinates"), "Please provide a valid pair of latitude and longitude bands \n" +
+			" Example: https://tvao-178408.appspot.com/area?lat1=55.698473&lng1=12.506052&lat2=55.616879&lng2=12.652524", http.StatusBadRequest}
+	}
+	box, err := parseBox(lat1, lng1, lat2, lng2)
+	if err != nil {
+		return &appError{err, "Please provide a valid pair of latitude and longitude bands", http.StatusBadRequest}
+	}
+	if box.Empty() {
+		return &appError{errors.New("Empty area"), "Please provide opposite corners of an area, the corners share a latitude or longitude \n" +
+			" Example: https://tvao-178408.appspot.com/area?lat1=55.698473&lng1=12.506052&lat2=55.616879&lng2=12.652524", http.StatusBadRequest}
+	}
+	if antimeridian := r.Form.Get("antimeridian"); len(antimeridian) > 0 {
+		crossing, err := strconv.ParseBool(antimeridian)
+		if err != nil {
+			return &appError{err, "Please provide a valid antimeridian flag, e.g. &antimeridian=true", http.StatusBadRequest}
+		}
+		if crossing {
+			box = box.aroundAntimeridian()
+		}
+	}
+
+	filter, err := parseImageFilter(r.Form.Get("bands"), r.Form.Get("resolution"))
+	if err != nil {
+		return &appError{err, "Please provide a resolution of 10, 20 or 60 meters, e.g. &bands=B04,B08&resolution=10", http.StatusBadRequest}
+	}
+	granuleFilter, appErr := parseGranuleFilter(r)
+	if appErr != nil {
+		return appErr
+	}
+	if granuleFilter.Dataset, appErr = parseDataset(r); appErr != nil {
+		return appErr
+	}
+	if level := strings.ToUpper(r.Form.Get("level")); len(level) > 0 {
+		if granuleFilter.Dataset != Sentinel2 {
+			return &appError{errors.New("Unsupported dataset"), "Processing levels are only supported for &dataset=sentinel2", http.StatusBadRequest}
+		}
+		if level != LevelL1C && level != LevelL2A {
+			return &appError{errors.New("Invalid level"), "Please provide a valid processing level, e.g. &level=L1C or &level=L2A", http.StatusBadRequest}
+		}
+		granuleFilter.Level = level
+	}
+
+	if countOnly := r.Form.Get("count"); len(countOnly) > 0 {
+		countOnly, err := strconv.ParseBool(countOnly)
+		if err != nil {
+			return &appError{err, "Please provide a valid count flag, e.g. &count=true", http.StatusBadRequest}
+		}
+		if countOnly {
+			return areaCount(w, box, granuleFilter, r)
+		}
+	}
+
+	if format == FormatCSV {
+		granules, err := getAreaGranules(box, granuleFilter, r)
+		if err != nil {
+			return &appError{err, "Unable to retrieve granulelinks", http.StatusInternalServerError}
+		}
+		return writeCSV(w, "area.csv", granulesCSV(granules))
+	}
+
+	links, granules, truncated, err := getImageBaseURL(box, granuleFilter, Layout{Level: granuleFilter.Level, Resolution: filter.Resolution}, r)
+	if err != nil {
+		return &appError{err, "Unable to retrieve granulelinks", http.StatusInternalServerError}
+	}
+	if format == FormatGeoJSON {
+		collection := newFeatureCollection(granules, granuleFilter.dataset())
+		collection.Truncated = truncated
+		return writeGeoJSON(w, collection)
+	}
+
+	var stream *ndjsonWriter
+	if wantsNDJSON(r) {
+		stream = newNDJSONWriter(w) // Links are written as they are fetched instead of counted
+	}
+	imageResult := pool(links, filter, stream, r)
+	if err := imageResult.Error; err != nil && stream != nil {
+		return stream.fail(&appError{err, "Could not fetch pictures from granules", http.StatusInternalServerError})
+	}
+	if err := imageResult.Error; err != nil {
+		return &appError{err, "Could not fetch pictures from granules", http.StatusInternalServerError}
+	}
+	if stream != nil {
+		return nil // Success
+	}
+	// Encode JSON result, where a truncated count is wrapped so the truncation is flagged
+	var response interface{} = len(imageResult.Links)
+	if truncated || imageResult.Truncated {
+		response = AreaCount{Count: int64(len(imageResult.Links)), Truncated: true, Source: granuleFilter.dataset().source()}
+	}
+	encodeErr := json.NewEncoder(w).Encode(response)
+	if encodeErr != nil {
+		return &appError{encodeErr, "Unable to encode JSON", http.StatusInternalServerError}
+	}
+	return nil // Success
+}
+
+// Writes the image folders (e.g. gcp-public-data-sentinel-2/tiles/.../GRANULE/<id>/IMG_DATA/) of the granules of a location
+// The folders are those of a bounding box where the location is both corners
+func imageFolders(w http.ResponseWriter, lat, lng string, filter GranuleFilter, r *http.Request) *appError {
+	box, err := parseBox(lat, lng, lat, lng)
+	if err != nil {
+		return &appError{err, "Please provide a valid location", http.StatusBadRequest}
+	}
+	links, _, truncated, err := getImageBaseURL(box, filter, Layout{}, r)
+	if err != nil {
+		return &appError{err, "Unable to retrieve links", http.StatusInternalServerError}
+	}
+	return writeTruncatedLinks(w, links, truncated, filter.dataset(), r)
+}
+
+// Writes the image folders of the granules within a radius in km of a location, rather than those of the location only
+func imagesByRadius(w http.ResponseWriter, lat, lng, radius string, filter GranuleFilter, r *http.Request) *appError {
+	radiusKm, err := strconv.ParseFloat(radius, 64)
+	if err != nil || !(0 <= radiusKm && radiusKm <= MaxRadiusKm) { // Also rejects NaN
+		return &appError{errors.New("Invalid radius"), fmt.Sprintf("Please provide a radius between 0 and %v km, e.g. &radiusKm=10", MaxRadiusKm), http.StatusBadRequest}
+	}
+	links, truncated, err := getImagesByRadius(lat, lng, radiusKm, filter, r)
+	if err != nil {
+		return &appError{err, "Unable to retrieve links", http.StatusInternalServerError}
+	}
+	return writeTruncatedLinks(w, links, truncated, filter.dataset(), r)
+}
+
+// Geocodes the addresses of opposite corners of an area of interest into a pair of latitude and longitude coordinates
+// The error tells which address could not be geocoded, since one address may resolve while the other does not
+func areaCorners(address1, address2 string, r *http.Request) (string, string, string, string, *appError) {
+	if len(address1) == 0 || len(address2) == 0 {
+		return "", "", "", "", &appError{errors.New("Missing address"), "Please provide the addresses of both corners, e.g. &address1=Amalienborg&address2=Rued Langgaards Vej 7", http.StatusBadRequest}
+	}
+	lat1, lng1, err := convertAddressToCoords(address1, r)
+	if err != nil {
+		return "", "", "", "", &appError{err, fmt.Sprintf("Could not geocode address1 %q", address1), http.StatusBadRequest}
+	}
+	lat2, lng2, err := convertAddressToCoords(address2, r)
+	if err != nil {
+		return "", "", "", "", &appError{err, fmt.Sprintf("Could not geocode address2 %q", address2), http.StatusBadRequest}
+	}
+	return lat1, lng1, lat2, lng2, nil
+}
+
+// Limits of batch geocoding: the max number of addresses of a request and how many are geocoded concurrently
+var (
+	MaxBatchAddresses      = 100
+	maxConcurrentGeocoding = 8
+)
+
+// MaxBatchBytes bounds the JSON body of batch requests, so a huge body is rejected before it is decoded into memory
+var MaxBatchBytes int64 = 1 << 20
+
+// Decodes the JSON body of a batch request of at most MaxBatchBytes, where usage tells the client how to fix an invalid body
+func decodeBatch(w http.ResponseWriter, r *http.Request, request interface{}, usage string) *appError {
+	r.Body = http.MaxBytesReader(w, r.Body, MaxBatchBytes)
+	err := json.NewDecoder(r.Body).Decode(request)
+	if err != nil && err.Error() == "http: request body too large" {
+		return &appError{err, fmt.Sprintf("Please POST a JSON body of at most %d bytes", MaxBatchBytes), http.StatusRequestEntityTooLarge}
+	}
+	if err != nil {
+		return &appError{err, usage, http.StatusBadRequest}
+	}
+	return nil
+}
+
+// GeocodeRequest is the JSON body of a POST to /geocode, e.g. {"addresses":["Amalienborg","Rued Langgaards Vej 7"]}
+type GeocodeRequest struct {
+	Addresses []string `json:"addresses"`
+}
+
+// GeocodeResult is the location of an address of a batch, or the error that occurred while geocoding it
+type GeocodeResult struct {
+	Address string      `json:"address"`
+	Lat     json.Number `json:"lat,omitempty"`
+	Lng     json.Number `json:"lng,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// Geocodes a batch of addresses posted as JSON, so clients plotting many points avoid a request per address
+// Addresses are geocoded concurrently and results keep the order of the addresses, where a failing address does not fail the others
+func geocodeBatch(w http.ResponseWriter, r *http.Request) *appError {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		return &appError{errors.New("Method not allowed"), "Please POST a JSON body of addresses, e.g. {\"addresses\":[\"Amalienborg\"]}", http.StatusMethodNotAllowed}
+	}
+	var request GeocodeRequest
+	usage := "Please POST a JSON body of addresses, e.g. {\"addresses\":[\"Amalienborg\"]}"
+	if appErr := decodeBatch(w, r, &request, usage); appErr != nil {
+		return appErr
+	}
+	if len(request.Addresses) == 0 {
+		return &appError{errors.New("No addresses"), usage, http.StatusBadRequest}
+	}
+	if len(request.Addresses) > MaxBatchAddresses {
+		return &appError{errors.New("Too many addresses"), fmt.Sprintf("Please provide at most %d addresses", MaxBatchAddresses), http.StatusBadRequest}
+	}
+
+	results := make([]GeocodeResult, len(request.Addresses))
+	tasks := make([]*Task, len(request.Addresses))
+	for i, address := range request.Addresses {
+		i, address := i, address
+		tasks[i] = NewTask(func() error {
+			results[i].Address = address
+			lat, lng, err := convertAddressToCoords(address, r)
+			if err != nil {
+				// Errors of the Geocoding API may describe its request, so clients only get a fixed message
+				log.Printf("Unable to geocode address %q of batch: %v", address, err)
+				results[i].Error = "geocoding failed"
+				if errors.Is(err, errNoGeocodingMatch) {
+					results[i].Error = "no geocoding match"
+				}
+				return err
+			}
+			results[i].Lat, results[i].Lng = json.Number(lat), json.Number(lng)
+			return nil
+		})
+	}
+	NewPool(tasks, maxConcurrentGeocoding).Run()
+
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		return &appError{err, "Unable to encode JSON", http.StatusInternalServerError}
+	}
+	return nil // Success
+}
+
+// Limits of batch images: the max number of points of a request and how many are queried concurrently
+var (
+	MaxBatchPoints      = 100
+	maxConcurrentPoints = 8
+)
+
+// PointsRequest is the JSON body of a POST to /images, e.g. {"points":[{"lat":55.660797,"lng":12.5896}]}
+type PointsRequest struct {
+	Points []Point `json:"points"`
+}
+
+// Point is a location of a batch, where the coordinates are kept as written to validate them like query parameters
+type Point struct {
+	Lat json.Number `json:"lat"`
+	Lng json.Number `json:"lng"`
+}
+
+// PointLinks are the links (i.e. granule ids) of a point of a batch, or the error that occurred while querying them
+type PointLinks struct {
+	Links Links  `json:"links,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Returns JSON object mapping the index of each posted point to its links, so programmatic clients avoid a request per point
+// Points are queried concurrently, where an invalid or failing point does not fail the others
+func imagesBatch(w http.ResponseWriter, filter GranuleFilter, r *http.Request) *appError {
+	var request PointsRequest
+	usage := "Please POST a JSON body of points, e.g. {\"points\":[{\"lat\":55.660797,\"lng\":12.5896}]}"
+	if appErr := decodeBatch(w, r, &request, usage); appErr != nil {
+		return appErr
+	}
+	if len(request.Points) == 0 {
+		return &appError{errors.New("No points"), usage, http.StatusBadRequest}
+	}
+	if len(request.Points) > MaxBatchPoints {
+		return &appError{errors.New("Too many points"), fmt.Sprintf("Please provide at most %d points", MaxBatchPoints), http.StatusBadRequest}
+	}
+
+	results := make([]PointLinks, len(request.Points))
+	tasks := make([]*Task, len(request.Points))
+	for i, point := range request.Points {
+		i, lat, lng := i, point.Lat.String(), point.Lng.String()
+		tasks[i] = NewTask(func() error {
+			if appErr := validateLocation(lat, lng); appErr != nil {
+				results[i].Error = appErr.Message
+				return appErr.Error
+			}
+			links, err := getLinks(lat, lng, filter, r)
+			if err != nil {
+				results[i].Error = "Unable to retrieve links"
+				return err
+			}
+			results[i].Links = links
+			return nil
+		})
+	}
+	NewPool(tasks, maxConcurrentPoints).Run()
+
+	byIndex := make(map[int]PointLinks, len(results))
+	for i, result := range results {
+		if tasks[i].Err != nil && len(result.Error) == 0 {
+			result.Error = "Internal server error" // Recovered panic of the task
+		}
+		byIndex[i] = result
+	}
+	if err := json.NewEncoder(w).Encode(byIndex); err != nil {
+		return &appError{err, "Unable to encode JSON", http.StatusInternalServerError}
+	}
+	return nil // Success
+}
+
+// AreaCount is the response of /area with &count=true
+type AreaCount struct {
+	Count     int64 `json:"count"`
+	Truncated bool  `json:"truncated,omitempty"`
+	Source
+}
+
+// Writes the number of image folders within the area of interest, counted by a single BigQuery query
+// This avoids fetching the images of every folder from the buckets when the caller only needs a number
+func areaCount(w http.ResponseWriter, box Box, filter GranuleFilter, r *http.Request) *appError {
+	count, err := getImageCountByBox(box, filter, r)
+	if err != nil {
+		return &appError{err, "Unable to count granules", http.StatusInternalServerError}
+	}
+	if err := json.NewEncoder(w).Encode(AreaCount{Count: count, Source: filter.dataset().source()}); err != nil {
+		return &appError{err, "Unable to encode JSON", http.StatusInternalServerError}
+	}
+	return nil // Success
+}
+
+// MediaTypeNDJSON is the media type of the Accept header requesting results streamed as newline delimited JSON
+const MediaTypeNDJSON = "application/x-ndjson"
+
+// Reports whether the client requested results streamed as newline delimited JSON
+func wantsNDJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), MediaTypeNDJSON)
+}
+
+// ndjsonWriter writes values as lines of JSON, flushing each line so clients receive results as they are produced
+// It is safe for concurrent use by multiple workers
+type ndjsonWriter struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+	flusher http.Flusher // nil if the response writer cannot flush
+	started bool         // Whether a line was written, which sent the status of the response
+}
+
+// Creates a writer streaming newline delimited JSON to the response
+func newNDJSONWriter(w http.ResponseWriter) *ndjsonWriter {
+	w.Header().Set("Content-Type", MediaTypeNDJSON)
+	flusher, _ := w.(http.Flusher)
+	return &ndjsonWriter{encoder: json.NewEncoder(w), flusher: flusher}
+}
+
+// Writes a value as a single line of JSON and flushes it to the client
+func (nw *ndjsonWriter) write(v interface{}) error {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.started = true
+	if err := nw.encoder.Encode(v); err != nil { // Encode terminates each value with a newline
+		return err
+	}
+	if nw.flusher != nil {
+		nw.flusher.Flush()
+	}
+	return nil
+}
+
+// Ends a stream that failed with the error as its last line, since the status of the response was sent with the first line
+// A stream without lines returns the error, which is then written as an error response with its status code
+func (nw *ndjsonWriter) fail(e *appError) *appError {
+	nw.mu.Lock()
+	started := nw.started
+	nw.mu.Unlock()
+	if !started {
+		return e
+	}
+	log.Printf("Stream failed: %s: %v", e.Message, e.Error)
+	if err := nw.write(e.response()); err != nil {
+		log.Printf("Unable to write error to stream: %v", err)
+	}
+	return nil
+}
+
+// Parses the optional output format of a request, which must be one of the formats allowed by the handler
+// The default format is plain JSON
+func parseFormat(r *http.Request, allowed ...string) (string, *appError) {
+	format := strings.ToLower(r.Form.Get("format"))
+	if len(format) == 0 {
+		return format, nil
+	}
+	for _, f := range allowed {
+		if format == f {
+			return format, nil
+		}
+	}
+	return "", &appError{errors.New("Invalid format"), "Please provide a valid format, e.g. &format=" + allowed[0], http.StatusBadRequest}
+}
+
+// Writes a feature collection with the GeoJSON media type
+func writeGeoJSON(w http.ResponseWriter, collection FeatureCollection) *appError {
+	w.Header().Set("Content-Type", "application/geo+json")
+	if err := json.NewEncoder(w).Encode(collection); err != nil {
+		return &appError{err, "Unable to encode JSON", http.StatusInternalServerError}
+	}
+	return nil // Success
+}
+
+// Parses the optional granule filter of a request, e.g. &maxCloud=20 for granules with at most 20% cloud cover
+// or &from=2018-01-01&to=2018-06-30 for granules sensed in the first half of 2018
+func parseGranuleFilter(r *http.Request) (GranuleFilter, *appError) {
+	filter := GranuleFilter{}
+	if maxCloud := r.Form.Get("maxCloud"); len(maxCloud) > 0 {
+		cloud, err := strconv.ParseFloat(maxCloud, 64)
+		if err != nil || !(0 <= cloud && cloud <= 100) { // Also rejects NaN
+			return filter, &appError{errors.New("Invalid max cloud cover"), "Please provide a max cloud cover percentage between 0 and 100, e.g. &maxCloud=20", http.StatusBadRequest}
+		}
+		filter.MaxCloud = &cloud
+	}
+
+	var fromErr, toErr error
+	if from := r.Form.Get("from"); len(from) > 0 {
+		filter.From, fromErr = parseTime(from, false)
+	}
+	if to := r.Form.Get("to"); len(to) > 0 {
+		filter.To, toErr = parseTime(to, true)
+	}
+	if err := firstError(fromErr, toErr); err != nil {
+		return filter, &appError{err, "Please provide dates as RFC3339 or YYYY-MM-DD, e.g. &from=2018-01-01&to=2018-06-30", http.StatusBadRequest}
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && filter.From.After(filter.To) {
+		return filter, &appError{errors.New("Inverted date range"), "Please provide a from date before the to date", http.StatusBadRequest}
+	}
+	if sort := r.Form.Get("sort"); len(sort) > 0 {
+		if _, ok := sortOrders[sort]; !ok {
+			return filter, &appError{errors.New("Invalid sort"), fmt.Sprintf("Please provide a sort order of %s, %s or %s, e.g. &sort=%s", SortSensingTimeAsc, SortSensingTimeDesc, SortCloudCoverAsc, SortSensingTimeDesc), http.StatusBadRequest}
+		}
+		filter.Sort = sort
+	}
+	return filter, nil
+}
+
+// Parses a time given as RFC3339 (e.g. 2018-01-01T10:30:00Z) or a date (e.g. 2018-01-01)
+// A date at the end of a range includes the whole day
+func parseTime(value string, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return t, fmt.Errorf("invalid date %q", value)
+	}
+	if end {
+		t = t.Add(24*time.Hour - time.Microsecond) // Last timestamp of the day at BigQuery precision
+	}
+	return t, nil
+}
+
+// Parse comma separated bands (e.g. "B04,B08,TCI") and resolution (10, 20 or 60 meters) into an image filter
+func parseImageFilter(bands, resolution string) (ImageFilter, error) {
+	filter := ImageFilter{}
+	if len(bands) > 0 {
+		for _, band := range strings.Split(bands, ",") {
+			filter.Bands = append(filter.Bands, strings.ToUpper(strings.TrimSpace(band)))
+		}
+	}
+	if len(resolution) > 0 {
+		res, err := strconv.Atoi(resolution)
+		if _, ok := resolutionFolders[res]; err != nil || !ok {
+			return filter, fmt.Errorf("invalid resolution %q", resolution)
+		}
+		filter.Resolution = res
+	}
+	return filter, nil
+}
+
+// Project 3 : Fetch and parse PSLG data of country user inputs from Geofabrik
+// Returns the count of images associated with the country together with the area of its region cover in km²
+// With &format=geojson the granules of a single country are returned as a GeoJSON FeatureCollection instead
+// With the Accept header application/x-ndjson each granule of a single country is streamed as a JSON line instead
+func geo(w http.ResponseWriter, r *http.Request) *appError {
+	if err := r.ParseForm(); err != nil || !(len(r.Form.Get("country")) > 0) {
+		return &appError{err, "Could not parse specified country location.", http.StatusBadRequest}
+	}
+	format, appErr := parseFormat(r, FormatGeoJSON)
+	if appErr != nil {
+		return appErr
+	}
+
+	countries := r.Form["country"]
+	for _, country := range countries {
+		if !validCountry(country) {
+			return &appError{errors.New("Invalid country"), "Please provide a valid country name, e.g. &country=denmark", http.StatusBadRequest}
+		}
+	}
+	continent, ok := validContinent(r.Form.Get("continent"))
+	if !ok {
+		return &appError{errors.New("Unknown continent"), "Please provide a known continent, e.g. &continent=europe", http.StatusBadRequest}
+	}
+	options := geoOptions{continent: continent, maxLevel: defaultMaxLevel, maxCells: defaultMaxCells}
+	breakdown := r.Form.Get("breakdown")
+	if len(breakdown) > 0 && breakdown != "cell" {
+		return &appError{errors.New("Invalid breakdown"), "Please provide a valid breakdown, e.g. &breakdown=cell", http.StatusBadRequest}
+	}
+
+	if level := r.Form.Get("maxLevel"); len(level) > 0 {
+		var err error
+		if options.maxLevel, err = strconv.Atoi(level); err != nil || options.maxLevel < 0 || options.maxLevel > s2.MaxLevel {
+			return &appError{errors.New("Invalid max level"), "Please provide a max level between 0 and 30, e.g. &maxLevel=15", http.StatusBadRequest}
+		}
+	}
+	options.maxLevel = clampMaxLevel(options.maxLevel)
+
+	if cells := r.Form.Get("maxCells"); len(cells) > 0 {
+		var err error
+		if options.maxCells, err = strconv.Atoi(cells); err != nil || options.maxCells < 1 || options.maxCells > MaxCoverCells {
+			return &appError{errors.New("Invalid max cells"), fmt.Sprintf("Please provide max cells between 1 and %d, e.g. &maxCells=100", MaxCoverCells), http.StatusBadRequest}
+		}
+	}
+
+	if estimate := r.Form.Get("estimate"); len(estimate) > 0 {
+		var err error
+		if options.estimate, err = strconv.ParseBool(estimate); err != nil {
+			return &appError{err, "Please provide a valid estimate flag, e.g. &estimate=true", http.StatusBadRequest}
+		}
+	}
+	if options.mode = strings.ToLower(r.Form.Get("mode")); len(options.mode) > 0 && options.mode != ModeCover && options.mode != ModeBBox {
+		return &appError{errors.New("Invalid mode"), "Please provide a valid mode, e.g. &mode=cover or &mode=bbox", http.StatusBadRequest}
+	}
+	if nocache := r.Form.Get("nocache"); len(nocache) > 0 {
+		var err error
+		if options.nocache, err = strconv.ParseBool(nocache); err != nil {
+			return &appError{err, "Please provide a valid nocache flag, e.g. &nocache=true", http.StatusBadRequest}
+		}
+	}
+	if debug := r.Form.Get("debug"); len(debug) > 0 {
+		var err error
+		if options.debug, err = strconv.ParseBool(debug); err != nil {
+			return &appError{err, "Please provide a valid debug flag, e.g. &debug=true", http.StatusBadRequest}
+		}
+	}
+	if format == FormatGeoJSON && (len(countries) > 1 || options.estimate) {
+		return &appError{errors.New("Invalid format"), "GeoJSON is only supported for an exact count of a single country", http.StatusBadRequest}
+	}
+	var stream *ndjsonWriter
+	if wantsNDJSON(r) {
+		if len(countries) > 1 || options.estimate {
+			return &appError{errors.New("Invalid format"), "NDJSON is only supported for an exact count of a single country", http.StatusBadRequest}
+		}
+		stream = newNDJSONWriter(w)
+		options.emit = func(granuleID string) error { return stream.write(granuleID) }
+	}
+
+	var response interface{}
+	if len(countries) > 1 {
+		response = countCountries(countries, breakdown == "cell", func(country string) (RegionCount, *appError) {
+			return countCountry(r, country, options)
+		})
+	} else {
+		imageCount, err := countCountry(r, countries[0], options)
+		if err != nil && stream != nil {
+			return stream.fail(err)
+		}
+		if err != nil {
+			return err
+		}
+		if format == FormatGeoJSON {
+			return writeGeoJSON(w, newFeatureCollection(imageCount.uniqueGranules(), Sentinel2))
+		}
+		if options.emit != nil {
+			return nil // Granules already streamed
+		}
+		// Image count and area of the region cover, together with the count per cell keyed by cell token or the approximate count
+		response = GeoArea{ImageCount: imageCount.Total, AreaKm2: imageCount.AreaKm2, Source: Sentinel2.source()}
+		if breakdown == "cell" || options.estimate || options.debug || len(options.mode) > 0 {
+			imageCount.Source = Sentinel2.source() // Countries are only counted in the Sentinel-2 index
+			response = imageCount
+		}
+	}
+
+	encodeErr := json.NewEncoder(w).Encode(response)
+	if encodeErr != nil {
+		return &appError{encodeErr, "Unable to find region cover", http.StatusInternalServerError}
+	}
+	return nil
+}
+
+// GeoArea is the response of /geo for a single country, where the area lets clients check that the polygon of the country was parsed correctly
+type GeoArea struct {
+	ImageCount int     `json:"imageCount"`
+	AreaKm2    float64 `json:"areaKm2"`
+	Source
+}
+
+// geoOptions are the options of a /geo query that apply to each country of the query
+type geoOptions struct {
+	continent string
+	maxLevel  int
+	maxCells  int
+	mode      string                       // Count each cell of the region cover (cover) or the bounding box of the polygon (bbox)
+	estimate  bool                         // Approximate count of bounding box instead of exact count of each cell
+	debug     bool                         // Include the cells of the region cover in the count
+	nocache   bool                         // Count the country again instead of using a cached count
+	emit      func(granuleID string) error // Called with each unique granule as it is found, if set, where an error stops the count
+}
+
+// Limits of the cache of image counts of countries: the max number of counts and how long a count is kept
+// Counts are kept for long, since polygons never change and imagery changes slowly
+var (
+	GeoCacheSize = 1000
+	GeoCacheTTL  = time.Hour
+)
+
+// Cache of image counts of countries keyed by the country and the options of the count
+var geoResults = newTTLCache()
+
+// FlushGeoCache removes all cached image counts of countries, e.g. between tests
+func FlushGeoCache() {
+	geoResults.flush()
+}
+
+// Returns the key of the cached image count of a country, which includes every option that changes the count
+func (o geoOptions) cacheKey(country string) string {
+	return fmt.Sprintf("%s/%s/%d/%d/%s/%t/%t", o.continent, normalizeCountry(country), o.maxLevel, o.maxCells, o.mode, o.estimate, o.debug)
+}
+
+// Counts images within the region cover of a country, where counts are cached for GeoCacheTTL
+// Streamed counts and counts with the nocache option are neither read from nor written to the cache
+func countCountry(r *http.Request, country string, options geoOptions) (RegionCount, *appError) {
+	cached := !options.nocache && options.emit == nil
+	key := options.cacheKey(country)
+	if imageCount, ok := geoResults.get(key, time.Now()); ok && cached {
+		return imageCount.(RegionCount), nil
+	}
+
+	imageCount, err := countRegion(r, country, options)
+	if err == nil && cached {
+		geoResults.put(key, imageCount, GeoCacheTTL, GeoCacheSize, time.Now())
+	}
+	return imageCount, err
+}
+
+// countRegion counts images within the region cover of a country without the cache, which tests replace to observe queries
+var countRegion = countCountryRegion
+
+// Counts images within the region cover of a country
+func countCountryRegion(r *http.Request, country string, options geoOptions) (RegionCount, *appError) {
+	rings, err := parse(r, country, options.continent)
+	if err == ErrUnknownRegion {
+		return RegionCount{}, &appError{err, fmt.Sprintf("Unknown country or continent: %s", country), http.StatusNotFound}
+	}
+	if err != nil {
+		return RegionCount{}, &appError{err, "Could not fetch PSLG data", http.StatusInternalServerError}
+	}
+
+	if options.mode == ModeBBox && !options.estimate {
+		imageCount, err := imagesByBox(regionPolygon(rings).RectBound(), options.emit, r)
+		if err != nil {
+			return RegionCount{}, &appError{err, "Could not get granules", http.StatusInternalServerError}
+		}
+		imageCount.Mode = ModeBBox
+		imageCount.AreaKm2 = areaKm2(regionPolygon(rings).Area())
+		return imageCount, nil
+	}
+
+	var cover s2.CellUnion
+	cover, options.maxLevel, options.maxCells = regionCover(rings, options.maxLevel, options.maxCells)
+	var imageCount RegionCount
+	if options.estimate {
+		imageCount, err = estimateImagesByRegion(cover, r)
+		imageCount.Mode = ModeBBox // Estimates are always of the bounding box of the region cover
+	} else {
+		imageCount, err = imagesByRegion(cover, options.emit, r)
+		imageCount.Mode = ModeCover
+	}
+	if err != nil {
+		return RegionCount{}, &appError{err, "Could not get granules", http.StatusInternalServerError}
+	}
+	imageCount.AreaKm2 = areaKm2(cover.ApproxArea())
+	imageCount.Cover = &CoverMetadata{MaxLevel: options.maxLevel, MaxCells: options.maxCells, Cells: len(cover), Tradeoff: coverTradeoff}
+	if options.debug {
+		imageCount.CoverCells = coverCells(cover)
+	}
+	return imageCount, nil
+}
+
+// Maximum number of countries counted concurrently in a single /geo request
+const maxConcurrentCountries = 4
+
+// CountryCount is the image count of one of multiple countries, or the error that occurred while counting it
+type CountryCount struct {
+	Count       int            `json:"count"`
+	AreaKm2     float64        `json:"areaKm2,omitempty"`
+	Cells       map[string]int `json:"cells,omitempty"`
+	Approximate bool           `json:"approximate,omitempty"`
+	Mode        string         `json:"mode,omitempty"`
+	Cover       *CoverMetadata `json:"cover,omitempty"`
+	CoverCells  []CoverCell    `json:"coverCells,omitempty"`
+	Error       string         `json:"error,omitempty"`
+	Source
+}
+
+// Counts images of several countries concurrently using the worker pool, where a failing country does not fail the others
+func countCountries(countries []string, breakdown bool, count func(country string) (RegionCount, *appError)) map[string]CountryCount {
+	counts := make([]CountryCount, len(countries))
+	tasks := make([]*Task, len(countries))
+	for i := range countries {
+		i := i
+		tasks[i] = NewTask(func() error {
+			imageCount, err := count(countries[i])
+			if err != nil {
+				counts[i].Error = err.Message
+				return err.Error
+			}
+			counts[i].Source = Sentinel2.source()
+			counts[i].Count = imageCount.Total
+			counts[i].AreaKm2 = imageCount.AreaKm2
+			counts[i].Approximate = imageCount.Approximate
+			counts[i].Mode = imageCount.Mode
+			counts[i].Cover = imageCount.Cover
+			counts[i].CoverCells = imageCount.CoverCells
+			if breakdown {
+				counts[i].Cells = imageCount.Cells
+			}
+			return nil
+		})
+	}
+	NewPool(tasks, maxConcurrentCountries).Run()
+
+	result := map[string]CountryCount{}
+	for i, country := range countries {
+		result[country] = counts[i]
+	}
+	return result
+}
+
+// Result represents links and wraps errors that may occur
+type Result struct {
+	Links     []string
+	Error     error
+	Truncated bool // Images beyond maxResults were dropped
+}
+
+// MaxWorkers bounds the number of goroutines fetching images concurrently in the worker pool, e.g. MAX_WORKERS=16
+// Each worker drains jobs from a channel, so countries with thousands of folders do not trigger rate limiting of the Storage API
+var MaxWorkers = parseMaxWorkers(os.Getenv("MAX_WORKERS"))
+
+// Parses the number of pool workers, where an unset or invalid number falls back to 4 workers per CPU
+// Less than 1 worker is raised to 1, since a pool without workers never finishes its jobs
+func parseMaxWorkers(workers string) int {
+	if len(workers) == 0 {
+		return runtime.NumCPU() * 4
+	}
+	n, err := strconv.Atoi(workers)
+	if err != nil {
+		log.Printf("Warning: invalid MAX_WORKERS %q, the pool runs %d workers", workers, runtime.NumCPU()*4)
+		return runtime.NumCPU() * 4
+	}
+	if n < 1 {
+		log.Printf("Warning: MAX_WORKERS %d is less than 1, the pool runs 1 worker", n)
+		return 1
+	}
+	return n
+}
+
+// fetchFunc fetches the images of an image folder in a bucket
+type fetchFunc func(bucketName, objectName string) (Links, error)
+
+// Worker pool used to fetch images from subfolders in Google Cloud Bucket concurrently using goroutines
+// If a stream is given, images are written to the stream as they are fetched rather than collected in the result
+func pool(links Links, filter ImageFilter, stream *ndjsonWriter, r *http.Request) Result {
+	// Clients should be reused instead of created as needed. The methods of Client are safe for concurrent use by multiple goroutines.
+	lister, err := newObjectLister(r.Context())
+	if err != nil {
+		return Result{Error: err} // Error propagated
+	}
+
+	// Streamed images are not held in memory, so only returned images are limited by maxResults
+	budget := &resultBudget{remaining: maxResults(r.URL.Path)}
+	if stream != nil {
+		budget.remaining = noLimit
+	}
+	var fetch fetchFunc = func(bucketName, objectName string) (Links, error) {
+		images, truncated, err := getImagesFromBucket(lister, bucketName, objectName, filter, budget.limit(), r)
+		return budget.take(images, truncated), err
+	}
+	if stream != nil {
+		fetch = streamLinks(fetch, stream)
+	}
+	workers := MaxWorkers
+	if len(links) < workers {
+		workers = len(links) // No idle workers
+	}
+	result := runPool(r.Context(), links, workers, fetch)
+	result.Truncated = budget.truncated
+	return result
+}
+
+// resultBudget is the number of images the workers of a pool may still return, safe for concurrent use by the workers
+type resultBudget struct {
+	mu        sync.Mutex
+	remaining int // noLimit means images are not limited
+	truncated bool
+}
+
+// Returns the number of images a worker may list
+func (b *resultBudget) limit() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.remaining
+}
+
+// Takes the images of a folder out of the budget, dropping images beyond it, where truncated tells whether the folder has more images
+func (b *resultBudget) take(images Links, truncated bool) Links {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.remaining == noLimit {
+		return images
+	}
+	if len(images) > b.remaining {
+		images, truncated = images[:b.remaining], true // Another worker took the budget while the folder was listed
+	}
+	b.remaining -= len(images)
+	b.truncated = b.truncated || truncated
+	return images
+}
+
+// Wraps fetch to write the images of each folder to the stream as soon as they are fetched
+// Streamed images are not returned, so the pool never holds all images in memory
+func streamLinks(fetch fetchFunc, stream *ndjsonWriter) fetchFunc {
+	return func(bucketName, objectName string) (Links, error) {
+		links, err := fetch(bucketName, objectName)
+		if err != nil {
+			return nil, err
+		}
+		for _, link := range links {
+			if err := stream.write(link); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}
+}
+
+// Runs a number of workers that fetch the images of each link and merges their results
+// The first error of any worker is kept in the result, and the pool stops early if the context is cancelled
+func runPool(ctx context.Context, links Links, workers int, fetch fetchFunc) Result {
+	jobs := make(chan string)
+	results := make(chan Result, workers) // Buffered so workers never block on a pool that stopped early
+	imageResult := Result{}
+
+	// Start goroutine workers
+	for i := 0; i < workers; i++ {
+		go worker(ctx, fetch, jobs, results)
+	}
+
+	// Send jobs
+	for _, imgLink := range links {
+		select {
+		case jobs <- imgLink:
+		case <-ctx.Done():
+			close(jobs)
+			return Result{Error: ctx.Err()} // Client disconnected or deadline passed
+		}
+	}
+	close(jobs) // Close do indicate this is all work to be done
+
+	// Collect worker results and write them to JSON result
+	for i := 0; i < workers; i++ {
+		select {
+		case result := <-results:
+			imageResult.Links = append(imageResult.Links, result.Links...)
+			if result.Error != nil && imageResult.Error == nil {
+				imageResult.Error = result.Error
+			}
+		case <-ctx.Done():
+			return Result{Error: ctx.Err()}
+		}
+	}
+	return imageResult
+}
+
+// Worker receives work on jobs channel and send images for each folder job to result
+// A worker may drain several jobs, so images of all its jobs are accumulated before sending them
+func worker(ctx context.Context, fetch fetchFunc, jobs <-chan string, results chan<- Result) {
+	folderImages := Result{}
+	defer func() { results <- folderImages }()
+	defer recoverPanic(&folderImages.Error) // A panicking fetch fails the pool instead of the instance
+	for {
+		var imgLink string
+		select {
+		case <-ctx.Done():
+			if folderImages.Error == nil {
+				folderImages.Error = ctx.Err()
+			}
+			return
+		case link, ok := <-jobs:
+			if !ok {
+				return // All work is done
+			}
+			imgLink = link
+		}
+
+		bucketName, imageObject := splitLink(imgLink)
+		result, err := fetch(bucketName, imageObject)
+
+		// Retry for better resilience, unless the request is cancelled
+		if err != nil && ctx.Err() == nil {
+			err = retry(ctx, DefaultRetry(), func() (err error) {
+				result, err = fetch(bucketName, imageObject)
+				return
+			})
+		}
+		if err != nil && folderImages.Error == nil {
+			folderImages.Error = err
+		}
+		folderImages.Links = append(folderImages.Links, result...)
+	}
+}
+
+// Google Client API may fail in which we want to enforce a retry mechanism to improve the resiliency
+// Credits: https://blog.abourget.net/en/2016/01/04/my-favorite-golang-retry-function/
+// http://sethammons.com/post/pester/
+// Sleeping between attempts is aborted with the error of the context once it is done, e.g. when the request deadline passes
+func retry(ctx context.Context, session RequestRetrySession, callback func() error) (err error) {
+	clock := session.clock
+	if clock == nil {
+		clock = realClock{}
+	}
+	start, sleep, i := clock.Now(), session.Duration, 0
+	for ; ; i++ {
+		err = callback()
+		if err == nil {
+			return
+		}
+
+		if i >= (session.MaxRetries - 1) {
+			break
+		}
+		/// Add randomness to prevent Thundering Herd: https://upgear.io/blog/simple-golang-retry-function/
+		jitter := time.Duration(0)
+		if sleep > 0 {
+			jitter = time.Duration(rand.Int63n(int64(sleep)))
+		}
+		sleep = time.Duration(float64(sleep)*session.BackoffMultiplier) + jitter/2
+		if session.MaxElapsed > 0 && clock.Now().Sub(start)+sleep > session.MaxElapsed {
+			break // Next attempt would exceed max elapsed time
+		}
+		select {
+		case <-clock.After(sleep):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		metrics.Retry()
 		//log.Println("retrying after error:", err)
 	}
-	return fmt.Errorf("after %d attempts, last error: %s", attempts, err)
+	return fmt.Errorf("after %d attempts, last error: %w", i+1, err)
 }
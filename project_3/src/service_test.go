@@ -2,12 +2,24 @@
 package satservice
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/appengine/aetest"
 )
 
@@ -40,7 +52,7 @@ func TestImageHandler_BadRequest(t *testing.T) {
 	}
 
 	//Check the response body is what we expect.
-	expected := "Please provide a valid latitude and longitude"
+	expected := `{"message":"Please provide a valid latitude and longitude","code":400}`
 	if strings.TrimSpace(rr.Body.String()) != strings.TrimSpace(expected) {
 		t.Errorf("handler returned unexpected body: got '%v' want '%v'",
 			rr.Body.String(), expected)
@@ -107,3 +119,864 @@ func TestAreaHandler_ValidRequest(t *testing.T) {
 			status, http.StatusOK)
 	}
 }
+
+// A GET request failing with a transient server error should be retried and succeed on the second attempt
+func TestAppHandler_RetriesTransientFailure(t *testing.T) {
+	defer func(retry RequestRetrySession) { HandlerRetry = retry }(HandlerRetry)
+	HandlerRetry = NewRetry(2, time.Millisecond)
+
+	attempts := 0
+	flaky := appHandler(func(w http.ResponseWriter, r *http.Request) *appError {
+		attempts++
+		if attempts == 1 {
+			return &appError{errors.New("Backend unavailable"), "Unable to retrieve links", http.StatusInternalServerError}
+		}
+		return nil
+	})
+
+	rr := httptest.NewRecorder()
+	flaky.ServeHTTP(rr, httptest.NewRequest("GET", "/images", nil))
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	if attempts != 2 {
+		t.Errorf("handler was attempted wrong number of times: got %v want %v", attempts, 2)
+	}
+}
+
+// A GET request failing after it wrote part of the response should not be retried, which would write the response again
+func TestAppHandler_NoRetryAfterWrite(t *testing.T) {
+	defer func(retry RequestRetrySession) { HandlerRetry = retry }(HandlerRetry)
+	HandlerRetry = NewRetry(2, time.Millisecond)
+
+	for name, write := range map[string]func(w http.ResponseWriter){
+		"body":  func(w http.ResponseWriter) { w.Write([]byte(`"link"` + "\n")) },
+		"flush": func(w http.ResponseWriter) { w.(http.Flusher).Flush() },
+	} {
+		attempts := 0
+		partial := appHandler(func(w http.ResponseWriter, r *http.Request) *appError {
+			attempts++
+			write(w)
+			return &appError{errors.New("Backend unavailable"), "Could not fetch pictures from granules", http.StatusInternalServerError}
+		})
+
+		rr := httptest.NewRecorder()
+		partial.ServeHTTP(rr, httptest.NewRequest("GET", "/area", nil))
+		if attempts != 1 {
+			t.Errorf("handler writing its %v was attempted wrong number of times: got %v want 1", name, attempts)
+		}
+		if strings.Count(rr.Body.String(), "link") > 1 {
+			t.Errorf("handler writing its %v wrote the response twice: %v", name, rr.Body.String())
+		}
+	}
+}
+
+// A valid coordinate near the north pole is outside Sentinel-2 coverage and should not be queried
+func TestImageHandler_OutOfCoverage(t *testing.T) {
+	req := httptest.NewRequest("GET", "/images", nil)
+	req.Form = url.Values{"lat": {"88.5"}, "lng": {"12.5896"}}
+
+	rr := httptest.NewRecorder()
+	handler := http.Handler(appHandler(images))
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != OutOfCoverageCode {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, OutOfCoverageCode)
+	}
+	response := errorResponse{}
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil || response.Message != OutOfCoverageMessage {
+		t.Errorf("handler returned unexpected body: got '%+v' want message '%v'",
+			response, OutOfCoverageMessage)
+	}
+}
+
+// Counting two countries should return a count for both of them, even if a third one fails
+func TestCountCountries(t *testing.T) {
+	expected := map[string]int{"denmark": 26, "sweden": 39}
+	counts := countCountries([]string{"denmark", "sweden", "atlantis"}, false, func(country string) (RegionCount, *appError) {
+		if country == "atlantis" {
+			return RegionCount{}, &appError{errors.New("Not found"), "Could not fetch PSLG data", http.StatusInternalServerError}
+		}
+		return RegionCount{Total: expected[country]}, nil
+	})
+
+	for country, count := range expected {
+		if counts[country].Count != count || len(counts[country].Error) > 0 {
+			t.Errorf("wrong count for %v: got %+v want %v", country, counts[country], count)
+		}
+	}
+	if counts["atlantis"].Error != "Could not fetch PSLG data" {
+		t.Errorf("wrong error for atlantis: got %+v", counts["atlantis"])
+	}
+}
+
+// Errors should be returned as JSON objects, where the underlying error is only included in debug mode
+func TestAppError_JSON(t *testing.T) {
+	defer func(debug bool) { Debug = debug }(Debug)
+	appErr := &appError{errors.New("Invalid coordinates"), "Please provide a valid latitude and longitude", http.StatusBadRequest}
+
+	for _, debug := range []bool{false, true} {
+		Debug = debug
+		rr := httptest.NewRecorder()
+		appErr.write(rr)
+
+		if contentType := rr.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("wrong content type: got %v want application/json", contentType)
+		}
+		response := errorResponse{}
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatalf("Failed to decode error: %v", err)
+		}
+		expected := errorResponse{Message: appErr.Message, Code: http.StatusBadRequest}
+		if debug {
+			expected.Error = "Invalid coordinates"
+		}
+		if response != expected {
+			t.Errorf("wrong error response: got %+v want %+v", response, expected)
+		}
+	}
+}
+
+// Negative or absurdly large page limits should be rejected
+func TestImageHandler_InvalidPage(t *testing.T) {
+	for _, limit := range []string{"-1", "100000"} {
+		req := httptest.NewRequest("GET", "/images", nil)
+		req.Form = url.Values{"lat": {"55.660797"}, "lng": {"12.5896"}, "limit": {limit}}
+
+		rr := httptest.NewRecorder()
+		handler := http.Handler(appHandler(images))
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code for limit %v: got %v want %v",
+				limit, status, http.StatusBadRequest)
+		}
+	}
+}
+
+// fakeClock records sleeps instead of sleeping
+type fakeClock struct {
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.sleeps = append(c.sleeps, d)
+	c.now = c.now.Add(d)
+	after := make(chan time.Time, 1)
+	after <- c.now
+	return after
+}
+
+// Sleeps between retries should grow by the backoff multiplier and stop once max elapsed time is reached
+func TestRetry_Backoff(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	session := NewRetry(10, time.Second).WithBackoffMultiplier(2).WithMaxElapsed(time.Minute)
+	session.clock = clock
+
+	err := retry(context.Background(), session, func() error { return errors.New("Backend unavailable") })
+	if err == nil {
+		t.Fatal("retry succeeded although every attempt failed")
+	}
+
+	if len(clock.sleeps) == 0 || clock.sleeps[0] < 2*time.Second {
+		t.Fatalf("wrong first sleep: got %v want at least %v", clock.sleeps, 2*time.Second)
+	}
+	elapsed := clock.sleeps[0]
+	for i := 1; i < len(clock.sleeps); i++ {
+		if clock.sleeps[i] < 2*clock.sleeps[i-1] {
+			t.Errorf("sleep %v did not back off: got %v after %v", i, clock.sleeps[i], clock.sleeps[i-1])
+		}
+		elapsed += clock.sleeps[i]
+	}
+	if elapsed > time.Minute {
+		t.Errorf("retried longer than max elapsed: got %v want at most %v", elapsed, time.Minute)
+	}
+}
+
+// The error after the last attempt should wrap the error of the attempt, so callers can still inspect it
+func TestRetry_WrapsLastError(t *testing.T) {
+	session := NewRetry(3, time.Second)
+	session.clock = &fakeClock{now: time.Now()}
+	last := &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "Backend unavailable"}
+
+	err := retry(context.Background(), session, func() error { return last })
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr != last {
+		t.Errorf("retry error does not wrap the last error: got %v", err)
+	}
+	if !strings.Contains(err.Error(), "after 3 attempts") {
+		t.Errorf("retry error does not tell the attempts: got %v", err)
+	}
+}
+
+// A retry loop should abort as soon as its context deadline passes instead of sleeping its full interval
+func TestRetry_ContextDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := retry(ctx, NewRetry(5, 10*time.Second), func() error { return errors.New("Backend unavailable") })
+	if err != context.DeadlineExceeded {
+		t.Errorf("retry returned wrong error: got %v want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("retry did not abort at the deadline: took %v", elapsed)
+	}
+}
+
+// Malformed granule ids should be rejected before querying, while both granule naming conventions are accepted
+func TestGranuleHandler_InvalidID(t *testing.T) {
+	for _, id := range []string{"", "L1C_T32UNG", "L1C_T32UNG_A012345_20171010T103021' OR '1'='1"} {
+		req := httptest.NewRequest("GET", "/granule", nil)
+		req.Form = url.Values{"id": {id}}
+
+		rr := httptest.NewRecorder()
+		handler := http.Handler(appHandler(granule))
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code for id %q: got %v want %v",
+				id, status, http.StatusBadRequest)
+		}
+	}
+
+	valid := regexp.MustCompile(GranuleID)
+	for _, id := range []string{"L1C_T32UNG_A012345_20171010T103021", "S2A_OPER_MSI_L1C_TL_SGS__20160120T123311_A002960_T32UNG_N02.01"} {
+		if !valid.MatchString(id) {
+			t.Errorf("valid granule id %q rejected", id)
+		}
+	}
+}
+
+// A valid latitude with an invalid longitude should be rejected, naming the longitude as the invalid coordinate
+func TestImageHandler_InvalidLongitude(t *testing.T) {
+	req := httptest.NewRequest("GET", "/images", nil)
+	req.Form = url.Values{"lat": {"55.660797"}, "lng": {"12.5896'; DROP"}}
+
+	rr := httptest.NewRecorder()
+	handler := http.Handler(appHandler(images))
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusBadRequest)
+	}
+	response := errorResponse{}
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil || !strings.Contains(response.Message, "longitude") {
+		t.Errorf("handler returned unexpected body: got '%+v' want message naming the longitude", response)
+	}
+}
+
+// Coordinates should be valid in any numeric form within range, e.g. scientific notation, whereas NaN and values out of range are invalid
+func TestCoordinateRange_Valid(t *testing.T) {
+	cases := []struct {
+		lat, lng string
+		valid    bool
+	}{
+		{"55.660797", "12.5896", true},
+		{"5.5660797e1", "1.25896E1", true},
+		{"+90", "-180", true},
+		{"90.0000001", "12.5896", false},
+		{"55.660797", "180.5", false},
+		{"-1e2", "12.5896", false},
+		{"NaN", "12.5896", false},
+		{"55.660797", "Inf", false},
+		{"55.660797", "", false},
+	}
+	for _, c := range cases {
+		if valid := LatitudeRange.valid(c.lat) && LongitudeRange.valid(c.lng); valid != c.valid {
+			t.Errorf("wrong validity of %v,%v: got %v want %v", c.lat, c.lng, valid, c.valid)
+		}
+	}
+}
+
+// Coordinates in scientific notation should be queried as decimals, whereas an area with a corner out of range should be rejected
+func TestHandlers_ScientificNotation(t *testing.T) {
+	defer func(query func(string, string, GranuleFilter, *http.Request) (Links, error)) { queryLinks = query }(queryLinks)
+	FlushLinksCache()
+	defer FlushLinksCache()
+	queried := [2]string{}
+	queryLinks = func(lat, lng string, filter GranuleFilter, r *http.Request) (Links, error) {
+		queried = [2]string{lat, lng}
+		return Links{"L1C_T32UNG_A012345_20171010T103021"}, nil
+	}
+
+	rr := httptest.NewRecorder()
+	appHandler(images).ServeHTTP(rr, httptest.NewRequest("GET", "/images?lat=5.5660797e1&lng=1.25896e1", nil))
+	if rr.Code != http.StatusOK || queried != [2]string{"55.660797", "12.5896"} {
+		t.Errorf("wrong query of scientific notation: got %v %v", rr.Code, queried)
+	}
+
+	rr = httptest.NewRecorder()
+	appHandler(area).ServeHTTP(rr, httptest.NewRequest("GET", "/area?lat1=55.616879&lng1=12.506052&lat2=9.1e1&lng2=12.652524", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code for a latitude out of range: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+// Links should only be wrapped in a v2 response when requested, where an empty result has the no_coverage status
+func TestWriteLinks_V2(t *testing.T) {
+	cases := []struct {
+		links    Links
+		expected LinksResponse
+	}{
+		{Links{"L1C_T32UNG_A012345_20171010T103021"}, LinksResponse{Links{"L1C_T32UNG_A012345_20171010T103021"}, 1, StatusOK, false, Sentinel2.source()}},
+		{nil, LinksResponse{Links{}, 0, StatusNoCoverage, false, Sentinel2.source()}},
+	}
+	for _, c := range cases {
+		for _, req := range []*http.Request{httptest.NewRequest("GET", "/images?v=2", nil), httptest.NewRequest("GET", "/images", nil)} {
+			req.ParseForm()
+			if req.Form.Get("v") != "2" {
+				req.Header.Set("Accept", MediaTypeV2)
+			}
+			rr := httptest.NewRecorder()
+			if err := writeLinks(rr, c.links, Sentinel2, req); err != nil {
+				t.Fatalf("Failed to write links: %v", err.Error)
+			}
+			response := LinksResponse{}
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if !reflect.DeepEqual(response, c.expected) {
+				t.Errorf("wrong v2 response: got %+v want %+v", response, c.expected)
+			}
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/images", nil)
+	req.ParseForm()
+	writeLinks(rr, Links{"L1C_T32UNG_A012345_20171010T103021"}, Sentinel2, req)
+	if body := strings.TrimSpace(rr.Body.String()); body != `["L1C_T32UNG_A012345_20171010T103021"]` {
+		t.Errorf("links without v2 are not a JSON array: got %v", body)
+	}
+}
+
+// A second identical /geo request should be answered from the cache without counting the country again, unless nocache is set
+func TestGeoHandler_Cache(t *testing.T) {
+	defer func(count func(*http.Request, string, geoOptions) (RegionCount, *appError)) { countRegion = count }(countRegion)
+	FlushGeoCache()
+	defer FlushGeoCache()
+	counted := 0
+	countRegion = func(r *http.Request, country string, options geoOptions) (RegionCount, *appError) {
+		counted++
+		return RegionCount{Total: 26}, nil
+	}
+
+	for i, query := range []string{"country=Denmark", "country=denmark", "country=denmark&nocache=true"} {
+		rr := httptest.NewRecorder()
+		appHandler(geo).ServeHTTP(rr, httptest.NewRequest("GET", "/geo?"+query, nil))
+		if status := rr.Code; status != http.StatusOK || !strings.Contains(rr.Body.String(), `"imageCount":26`) {
+			t.Errorf("handler returned wrong response for %v: got %v %v want %v with an image count of 26", query, status, rr.Body.String(), http.StatusOK)
+		}
+		if expected := []int{1, 1, 2}[i]; counted != expected {
+			t.Errorf("wrong number of counts after %v: got %v want %v", query, counted, expected)
+		}
+	}
+}
+
+// The count of a country should always be returned together with the area of its region cover, also with a breakdown of cells
+func TestGeoHandler_Area(t *testing.T) {
+	defer func(count func(*http.Request, string, geoOptions) (RegionCount, *appError)) { countRegion = count }(countRegion)
+	FlushGeoCache()
+	defer FlushGeoCache()
+	countRegion = func(r *http.Request, country string, options geoOptions) (RegionCount, *appError) {
+		return RegionCount{Total: 26, AreaKm2: 43094.5, Cells: map[string]int{"4c": 26}}, nil
+	}
+
+	rr := httptest.NewRecorder()
+	appHandler(geo).ServeHTTP(rr, httptest.NewRequest("GET", "/geo?country=Denmark", nil))
+	if expected := `{"imageCount":26,"areaKm2":43094.5,"dataset":"sentinel2","satellite":"sentinel-2"}`; rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != expected {
+		t.Errorf("handler returned wrong response: got %v %v want %v", rr.Code, rr.Body.String(), expected)
+	}
+	rr = httptest.NewRecorder()
+	appHandler(geo).ServeHTTP(rr, httptest.NewRequest("GET", "/geo?country=Denmark&breakdown=cell", nil))
+	if body := rr.Body.String(); rr.Code != http.StatusOK || !strings.Contains(body, `"imageCount":26,"areaKm2":43094.5`) {
+		t.Errorf("handler returned wrong response with breakdown: got %v %v", rr.Code, body)
+	}
+}
+
+// Counts per cell should only be returned with &breakdown=cell and add up to the total, while other breakdowns are rejected
+func TestGeoHandler_Breakdown(t *testing.T) {
+	defer func(count func(*http.Request, string, geoOptions) (RegionCount, *appError)) { countRegion = count }(countRegion)
+	FlushGeoCache()
+	defer FlushGeoCache()
+	countRegion = func(r *http.Request, country string, options geoOptions) (RegionCount, *appError) {
+		return RegionCount{Total: 26, Cells: map[string]int{"4c": 10, "54": 16}}, nil
+	}
+
+	rr := httptest.NewRecorder()
+	appHandler(geo).ServeHTTP(rr, httptest.NewRequest("GET", "/geo?country=Denmark", nil))
+	if body := rr.Body.String(); rr.Code != http.StatusOK || !strings.Contains(body, `"imageCount":26`) || strings.Contains(body, "cells") {
+		t.Errorf("handler returned wrong response without breakdown: got %v %v want %v with only the image count of 26", rr.Code, body, http.StatusOK)
+	}
+
+	rr = httptest.NewRecorder()
+	appHandler(geo).ServeHTTP(rr, httptest.NewRequest("GET", "/geo?country=Denmark&breakdown=cell", nil))
+	var imageCount RegionCount
+	if err := json.Unmarshal(rr.Body.Bytes(), &imageCount); rr.Code != http.StatusOK || err != nil {
+		t.Fatalf("handler returned wrong response with breakdown: got %v %v", rr.Code, rr.Body.String())
+	}
+	sum := 0
+	for _, count := range imageCount.Cells {
+		sum += count
+	}
+	if expected := map[string]int{"4c": 10, "54": 16}; !reflect.DeepEqual(imageCount.Cells, expected) || sum != imageCount.Total {
+		t.Errorf("wrong cell counts: got %v with total %v want %v with total 26", imageCount.Cells, imageCount.Total, expected)
+	}
+
+	rr = httptest.NewRecorder()
+	appHandler(geo).ServeHTTP(rr, httptest.NewRequest("GET", "/geo?country=Denmark&breakdown=tile", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code for an invalid breakdown: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+// A count failing after granules were streamed should end the stream with the error, since the status was already sent
+// A count failing before any granule was streamed should still get the status code of the error
+func TestGeoHandler_StreamFails(t *testing.T) {
+	defer func(count func(*http.Request, string, geoOptions) (RegionCount, *appError)) { countRegion = count }(countRegion)
+	defer func(retry RequestRetrySession) { HandlerRetry = retry }(HandlerRetry)
+	HandlerRetry = NewRetry(1, time.Millisecond)
+	FlushGeoCache()
+	defer FlushGeoCache()
+
+	for _, streamed := range []bool{true, false} {
+		countRegion = func(r *http.Request, country string, options geoOptions) (RegionCount, *appError) {
+			if streamed {
+				options.emit("L1C_T32UNG_A012345_20171010T103021")
+			}
+			return RegionCount{}, &appError{errors.New("Backend unavailable"), "Could not get granules", http.StatusInternalServerError}
+		}
+		req := httptest.NewRequest("GET", "/geo?country=denmark", nil)
+		req.Header.Set("Accept", MediaTypeNDJSON)
+		rr := httptest.NewRecorder()
+		appHandler(geo).ServeHTTP(rr, req)
+
+		lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+		var response errorResponse
+		if err := json.Unmarshal([]byte(lines[len(lines)-1]), &response); err != nil || response.Message != "Could not get granules" {
+			t.Errorf("stream with granules %v did not end with the error: %v", streamed, rr.Body.String())
+		}
+		if expected := map[bool]int{true: http.StatusOK, false: http.StatusInternalServerError}[streamed]; rr.Code != expected {
+			t.Errorf("wrong status code of stream with granules %v: got %v want %v", streamed, rr.Code, expected)
+		}
+		if expected := map[bool]int{true: 2, false: 1}[streamed]; len(lines) != expected {
+			t.Errorf("wrong number of lines of stream with granules %v: got %v want %v", streamed, len(lines), expected)
+		}
+	}
+}
+
+// Unknown continents and countries that are not slugs should be rejected without fetching from Geofabrik
+func TestGeoHandler_InvalidRegion(t *testing.T) {
+	for _, query := range []string{"country=denmark&continent=atlantis", "country=../../etc", "country=denmark&country=..%2Fetc"} {
+		rr := httptest.NewRecorder()
+		appHandler(geo).ServeHTTP(rr, httptest.NewRequest("GET", "/geo?"+query, nil))
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code for %v: got %v want %v", query, status, http.StatusBadRequest)
+		}
+	}
+}
+
+// fakeRecorder counts the requests of each route and status code instead of recording them in a Prometheus registry
+type fakeRecorder struct {
+	mu       sync.Mutex
+	requests map[string]int
+}
+
+func (f *fakeRecorder) Request(route string, code int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests[fmt.Sprintf("%s %d", route, code)]++
+}
+func (f *fakeRecorder) Query(query string, duration time.Duration, err error) {}
+func (f *fakeRecorder) Storage(duration time.Duration, err error)             {}
+func (f *fakeRecorder) Retry()                                                {}
+func (f *fakeRecorder) GeocodeCache(hit bool)                                 {}
+
+// A handled request should be counted by its route and status code
+func TestServeHTTP_CountsRequests(t *testing.T) {
+	defer func(recorder Recorder) { metrics = recorder }(metrics)
+	recorder := &fakeRecorder{requests: map[string]int{}}
+	metrics = recorder
+
+	for i := 1; i <= 2; i++ {
+		rr := httptest.NewRecorder()
+		appHandler(granule).ServeHTTP(rr, httptest.NewRequest("GET", "/granule?id=invalid", nil))
+		if count := recorder.requests["/granule 400"]; count != i {
+			t.Errorf("wrong request count after %v requests: got %v want %v", i, count, i)
+		}
+	}
+}
+
+// A slow handler should be cancelled at the deadline of its route rather than the default deadline
+func TestServeHTTP_RouteTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { DefaultTimeout = timeout }(DefaultTimeout)
+	DefaultTimeout = time.Minute
+	RouteTimeouts["/slow"] = 20 * time.Millisecond
+	defer delete(RouteTimeouts, "/slow")
+
+	slow := func(w http.ResponseWriter, r *http.Request) *appError {
+		select {
+		case <-r.Context().Done():
+			return &appError{r.Context().Err(), "Request timed out", http.StatusGatewayTimeout}
+		case <-time.After(time.Second):
+			return nil
+		}
+	}
+	start := time.Now()
+	rr := httptest.NewRecorder()
+	appHandler(slow).ServeHTTP(rr, httptest.NewRequest("GET", "/slow", nil))
+
+	if status := rr.Code; status != http.StatusGatewayTimeout {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusGatewayTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("handler was not cancelled at the deadline of its route: took %v", elapsed)
+	}
+}
+
+// addressTransport answers Geocoding API requests with the location of known addresses and no match for other addresses
+type addressTransport map[string][2]float64
+
+func (a addressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := `{"results":[],"status":"ZERO_RESULTS"}`
+	if location, ok := a[req.URL.Query().Get("address")]; ok {
+		body = fmt.Sprintf(`{"results":[{"geometry":{"location":{"lat":%v,"lng":%v}}}],"status":"OK"}`, location[0], location[1])
+	}
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(body)), Request: req}, nil
+}
+
+// Addresses of both corners of an area should be geocoded into coordinates, and an address without match should be named in the error
+func TestAreaCorners_Addresses(t *testing.T) {
+	defer func(client func(context.Context) *http.Client) { geocodeClient = client }(geocodeClient)
+	geocodeClient = func(ctx context.Context) *http.Client {
+		return &http.Client{Transport: addressTransport{"Amalienborg": {55.684, 12.593}, "Rued Langgaards Vej 7": {55.659687, 12.591335}}}
+	}
+	ClearGeocodeCache()
+	defer ClearGeocodeCache()
+
+	req := httptest.NewRequest("GET", "/area", nil)
+	lat1, lng1, lat2, lng2, appErr := areaCorners("Rued Langgaards Vej 7", "Amalienborg", req)
+	if appErr != nil {
+		t.Fatalf("Failed to geocode corners: %v", appErr.Message)
+	}
+	if got := []string{lat1, lng1, lat2, lng2}; !reflect.DeepEqual(got, []string{"55.659687", "12.591335", "55.684000", "12.593000"}) {
+		t.Errorf("wrong corners: got %v", got)
+	}
+
+	for _, query := range []string{"address1=Amalienborg&address2=Atlantis", "address1=Amalienborg"} {
+		rr := httptest.NewRecorder()
+		appHandler(area).ServeHTTP(rr, httptest.NewRequest("GET", "/area?"+query, nil))
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code for %v: got %v want %v", query, status, http.StatusBadRequest)
+		}
+	}
+	rr := httptest.NewRecorder()
+	appHandler(area).ServeHTTP(rr, httptest.NewRequest("GET", "/area?address1=Amalienborg&address2=Atlantis", nil))
+	if !strings.Contains(rr.Body.String(), "address2") {
+		t.Errorf("error does not name the address without match: %v", rr.Body.String())
+	}
+}
+
+// A batch of addresses should be geocoded in order, where an address without match only fails its own result
+func TestGeocodeBatch_PartialFailure(t *testing.T) {
+	defer func(client func(context.Context) *http.Client) { geocodeClient = client }(geocodeClient)
+	geocodeClient = func(ctx context.Context) *http.Client {
+		return &http.Client{Transport: addressTransport{"Amalienborg": {55.684, 12.593}, "Rued Langgaards Vej 7": {55.659687, 12.591335}}}
+	}
+	ClearGeocodeCache()
+	defer ClearGeocodeCache()
+
+	body := `{"addresses":["Rued Langgaards Vej 7","Atlantis","Amalienborg"]}`
+	rr := httptest.NewRecorder()
+	appHandler(geocodeBatch).ServeHTTP(rr, httptest.NewRequest("POST", "/geocode", strings.NewReader(body)))
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %v", status, http.StatusOK, rr.Body.String())
+	}
+
+	var results []GeocodeResult
+	if err := json.NewDecoder(rr.Body).Decode(&results); err != nil {
+		t.Fatalf("Failed to decode results: %v", err)
+	}
+	expected := []GeocodeResult{
+		{Address: "Rued Langgaards Vej 7", Lat: "55.659687", Lng: "12.591335"},
+		{Address: "Atlantis", Error: "no geocoding match"},
+		{Address: "Amalienborg", Lat: "55.684000", Lng: "12.593000"},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("wrong number of results: got %v want %v", len(results), len(expected))
+	}
+	for i, result := range results {
+		if result.Address != expected[i].Address || result.Lat != expected[i].Lat || result.Lng != expected[i].Lng {
+			t.Errorf("wrong result %v: got %+v want %+v", i, result, expected[i])
+		}
+		if result.Error != expected[i].Error {
+			t.Errorf("wrong error of result %v: got %q want %q", i, result.Error, expected[i].Error)
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	appHandler(geocodeBatch).ServeHTTP(rr, httptest.NewRequest("GET", "/geocode", nil))
+	if status := rr.Code; status != http.StatusMethodNotAllowed {
+		t.Errorf("handler returned wrong status code for GET: got %v want %v", status, http.StatusMethodNotAllowed)
+	}
+}
+
+// A failed request to the Geocoding API should only fail its address with a fixed message, which never includes the API key
+func TestGeocodeBatch_FailureHidesKey(t *testing.T) {
+	defer func(key string) { GeocodeKey = key }(GeocodeKey)
+	GeocodeKey = "secret-geocode-key"
+	stub, restore := stubGeocoding("")
+	defer restore()
+	stub.err = errors.New("i/o timeout")
+
+	rr := httptest.NewRecorder()
+	appHandler(geocodeBatch).ServeHTTP(rr, httptest.NewRequest("POST", "/geocode", strings.NewReader(`{"addresses":["Amalienborg"]}`)))
+	if strings.Contains(rr.Body.String(), GeocodeKey) {
+		t.Fatalf("response includes the API key: %v", rr.Body.String())
+	}
+	var results []GeocodeResult
+	if err := json.NewDecoder(rr.Body).Decode(&results); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong response: got %v %v", rr.Code, err)
+	}
+	if len(results) != 1 || results[0].Error != "geocoding failed" {
+		t.Errorf("wrong results: got %+v want a single result failing with %q", results, "geocoding failed")
+	}
+}
+
+// Rate limiting of BigQuery should be returned as 429 with a Retry-After header instead of a server error
+func TestServeHTTP_RateLimited(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected int
+	}{
+		{&googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, http.StatusTooManyRequests},
+		{&googleapi.Error{Code: http.StatusTooManyRequests}, http.StatusTooManyRequests},
+		{&googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "accessDenied"}}}, http.StatusInternalServerError},
+		{errors.New("connection reset"), http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		err, expected := c.err, c.expected
+		failing := func(w http.ResponseWriter, r *http.Request) *appError {
+			return &appError{err, "Unable to retrieve links", http.StatusInternalServerError}
+		}
+		rr := httptest.NewRecorder()
+		appHandler(failing).ServeHTTP(rr, httptest.NewRequest("GET", "/images?lat=55.660797&lng=12.5896", nil))
+
+		if status := rr.Code; status != expected {
+			t.Errorf("handler returned wrong status code for %v: got %v want %v", err, status, expected)
+		}
+		retryAfter := rr.Header().Get("Retry-After")
+		if expected == http.StatusTooManyRequests && retryAfter != strconv.Itoa(int(DefaultRetry().Duration.Seconds())) {
+			t.Errorf("wrong Retry-After for %v: got %q want %v", err, retryAfter, DefaultRetry().Duration.Seconds())
+		}
+		if expected != http.StatusTooManyRequests && len(retryAfter) > 0 {
+			t.Errorf("unexpected Retry-After for %v: %q", err, retryAfter)
+		}
+	}
+}
+
+// The stats of a location should be a single JSON object with zeroed fields and no_coverage set for a location without granules
+func TestStatsHandler_Response(t *testing.T) {
+	cases := []struct {
+		rows     [][]bigquery.Value
+		expected string
+	}{
+		{[][]bigquery.Value{{int64(2), time.Date(2015, 7, 4, 10, 30, 0, 0, time.UTC), time.Date(2017, 10, 10, 10, 30, 21, 0, time.UTC), 1.5, 80.0}},
+			`{"granuleCount":2,"earliest":"2015-07-04T10:30:00Z","latest":"2017-10-10T10:30:21Z","minCloud":1.5,"maxCloud":80,"no_coverage":false,"dataset":"sentinel2","satellite":"sentinel-2"}`},
+		{[][]bigquery.Value{{int64(0), nil, nil, nil, nil}},
+			`{"granuleCount":0,"earliest":"0001-01-01T00:00:00Z","latest":"0001-01-01T00:00:00Z","minCloud":0,"maxCloud":0,"no_coverage":true,"dataset":"sentinel2","satellite":"sentinel-2"}`},
+	}
+	for _, c := range cases {
+		restore := withQuerier(&fakeQuerier{rows: c.rows})
+		rr := httptest.NewRecorder()
+		appHandler(stats).ServeHTTP(rr, httptest.NewRequest("GET", "/stats?lat=55.660797&lng=12.5896", nil))
+		restore()
+
+		if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != c.expected {
+			t.Errorf("wrong response: got %v %v want %v", rr.Code, rr.Body.String(), c.expected)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	appHandler(stats).ServeHTTP(rr, httptest.NewRequest("GET", "/stats?lat=91&lng=12.5896", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code for an invalid latitude: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+// A batch of points should map the index of each point to its links, where an invalid point has an error without failing the batch
+func TestImagesBatch_InvalidPoint(t *testing.T) {
+	defer withQuerier(&fakeQuerier{rows: [][]bigquery.Value{{"L1C_T32UNG_A012345_20171010T103021", "S2A_MSIL1C_20171010T103021_N0205_R108_T32UNG_20171010T103021"}}})()
+	FlushLinksCache()
+	defer FlushLinksCache()
+
+	body := `{"points":[{"lat":55.660797,"lng":12.5896},{"lat":91,"lng":12.5896},{"lat":"55.684","lng":"12.593"}]}`
+	rr := httptest.NewRecorder()
+	appHandler(images).ServeHTTP(rr, httptest.NewRequest("POST", "/images", strings.NewReader(body)))
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %v", status, http.StatusOK, rr.Body.String())
+	}
+
+	var results map[int]PointLinks
+	if err := json.NewDecoder(rr.Body).Decode(&results); err != nil {
+		t.Fatalf("Failed to decode results: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("wrong number of results: got %v want 3", len(results))
+	}
+	for _, i := range []int{0, 2} {
+		if result := results[i]; len(result.Error) > 0 || !reflect.DeepEqual(result.Links, Links{"L1C_T32UNG_A012345_20171010T103021"}) {
+			t.Errorf("wrong result %v: got %+v", i, result)
+		}
+	}
+	if result := results[1]; !strings.Contains(result.Error, "latitude") || len(result.Links) > 0 {
+		t.Errorf("invalid point should only have an error: got %+v", result)
+	}
+
+	rr = httptest.NewRecorder()
+	appHandler(images).ServeHTTP(rr, httptest.NewRequest("POST", "/images", strings.NewReader(`{"points":[]}`)))
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code without points: got %v want %v", status, http.StatusBadRequest)
+	}
+}
+
+// Batch bodies beyond MaxBatchBytes should be rejected as too large before they are decoded
+func TestBatch_BodyTooLarge(t *testing.T) {
+	defer func(max int64) { MaxBatchBytes = max }(MaxBatchBytes)
+	MaxBatchBytes = 64
+	points := `{"points":[` + strings.Repeat(`{"lat":55.660797,"lng":12.5896},`, 10) + `{"lat":55.660797,"lng":12.5896}]}`
+	addresses := `{"addresses":[` + strings.Repeat(`"Rued Langgaards Vej 7",`, 10) + `"Amalienborg"]}`
+	for route, handler := range map[string]appHandler{"/images": images, "/geocode": geocodeBatch} {
+		body := points
+		if route == "/geocode" {
+			body = addresses
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", route, strings.NewReader(body)))
+		if status := rr.Code; status != http.StatusRequestEntityTooLarge {
+			t.Errorf("handler of %v returned wrong status code: got %v want %v", route, status, http.StatusRequestEntityTooLarge)
+		}
+	}
+}
+
+// An area whose corners share a latitude or longitude should be rejected before querying
+func TestAreaHandler_EmptyBox(t *testing.T) {
+	for _, query := range []string{"lat1=55.6&lng1=12.5&lat2=55.6&lng2=12.6", "lat1=55.6&lng1=12.5&lat2=55.7&lng2=12.5"} {
+		rr := httptest.NewRecorder()
+		appHandler(area).ServeHTTP(rr, httptest.NewRequest("GET", "/area?"+query, nil))
+		if status := rr.Code; status != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "opposite corners") {
+			t.Errorf("handler returned wrong response for %v: got %v %v", query, status, rr.Body.String())
+		}
+	}
+}
+
+// Only an area asked to cross the antimeridian should span the longitudes between its corners across ±180°
+func TestAreaHandler_Antimeridian(t *testing.T) {
+	for query, expected := range map[string][2]float64{
+		"":                   {-178.5, 177},
+		"&antimeridian=true": {177, -178.5},
+	} {
+		fake := &fakeQuerier{rows: [][]bigquery.Value{{int64(2)}}}
+		restore := withQuerier(fake)
+		rr := httptest.NewRecorder()
+		appHandler(area).ServeHTTP(rr, httptest.NewRequest("GET", "/area?lat1=-19.5&lng1=177.0&lat2=-15.5&lng2=-178.5&count=true"+query, nil))
+		restore()
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("handler returned wrong status code for %q: got %v want %v: %v", query, status, http.StatusOK, rr.Body.String())
+			continue
+		}
+		if fake.params["lng1"] != expected[0] || fake.params["lng2"] != expected[1] {
+			t.Errorf("wrong longitudes for %q: got %v, %v want %v", query, fake.params["lng1"], fake.params["lng2"], expected)
+		}
+	}
+	rr := httptest.NewRecorder()
+	appHandler(area).ServeHTTP(rr, httptest.NewRequest("GET", "/area?lat1=-19.5&lng1=177.0&lat2=-15.5&lng2=-178.5&antimeridian=maybe", nil))
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code for an invalid flag: got %v want %v", status, http.StatusBadRequest)
+	}
+}
+
+// Redirects should stay on the host of the request, keeping the scheme of the proxy, unless a base URL is configured
+func TestRedirect_RequestHost(t *testing.T) {
+	defer func(base string) { BaseURL = base }(BaseURL)
+	cases := []struct {
+		base, proto, expected string
+	}{
+		{"", "", "http://satellites.example.com/geo"},
+		{"", "https", "https://satellites.example.com/geo"},
+		{"", "gopher", "http://satellites.example.com/geo"},
+		{"https://images.example.org", "http", "https://images.example.org/geo"},
+	}
+	for _, c := range cases {
+		BaseURL = c.base
+		req := httptest.NewRequest("GET", "http://satellites.example.com/unknown", nil)
+		if len(c.proto) > 0 {
+			req.Header.Set("X-Forwarded-Proto", c.proto)
+		}
+		rr := httptest.NewRecorder()
+		redirect(rr, req)
+		if location := rr.Header().Get("Location"); rr.Code != http.StatusMovedPermanently || location != c.expected {
+			t.Errorf("wrong redirect of %+v: got %v %v want %v %v", c, rr.Code, location, http.StatusMovedPermanently, c.expected)
+		}
+		if strings.Contains(rr.Header().Get("Location"), "appspot.com") {
+			t.Errorf("redirect of %+v leaves the host of the request: %v", c, rr.Header().Get("Location"))
+		}
+	}
+}
+
+// Redirects should follow the default route, where an unset route falls back to the landing route
+// Unknown routes and routes for machines are rejected
+func TestRedirect_DefaultRoute(t *testing.T) {
+	defer func(route string) { DefaultRoute = route }(DefaultRoute)
+	for route, expected := range map[string]string{"": "/geo", "/images": "/images", "/area": "/area"} {
+		var err error
+		if DefaultRoute, err = validDefaultRoute(route); err != nil {
+			t.Fatalf("valid default route %q was rejected: %v", route, err)
+		}
+		rr := httptest.NewRecorder()
+		redirect(rr, httptest.NewRequest("GET", "http://satellites.example.com/", nil))
+		if location := rr.Header().Get("Location"); location != "http://satellites.example.com"+expected {
+			t.Errorf("wrong redirect of default route %q: got %v want %v", route, location, expected)
+		}
+	}
+	for _, route := range []string{"/unknown", "images", "/metrics", "/openapi.json"} {
+		if _, err := validDefaultRoute(route); err == nil {
+			t.Errorf("default route %q was accepted", route)
+		}
+	}
+}
+
+// A valid MGRS tile should be queried by the tile column, whereas an invalid tile or several tiles are rejected
+func TestImagesHandler_Tile(t *testing.T) {
+	fake := &fakeQuerier{rows: [][]bigquery.Value{{"L1C_T33UUB_A012345_20171010T103021"}, {"L2A_T33UUB_A012345_20171010T103021"}}}
+	defer withQuerier(fake)()
+
+	rr := httptest.NewRecorder()
+	appHandler(images).ServeHTTP(rr, httptest.NewRequest("GET", "/images?tile=33uub", nil))
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %v", status, http.StatusOK, rr.Body.String())
+	}
+	links := Links{}
+	if err := json.NewDecoder(rr.Body).Decode(&links); err != nil || len(links) != 2 {
+		t.Fatalf("wrong links: got %v %v", links, err)
+	}
+	if tiles := fake.params["tiles"]; !reflect.DeepEqual(tiles, []string{"33UUB"}) || !strings.Contains(fake.sql, "mgrs_tile") {
+		t.Errorf("wrong query of the tile: got %v with %v", fake.sql, tiles)
+	}
+
+	for _, tile := range []string{"33UIB", "333UUB", "33U", "33UUB,32UNG"} {
+		rr := httptest.NewRecorder()
+		appHandler(images).ServeHTTP(rr, httptest.NewRequest("GET", "/images?tile="+url.QueryEscape(tile), nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code for tile %v: got %v want %v", tile, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
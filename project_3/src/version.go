@@ -0,0 +1,33 @@
+// Package satservice version reports the build of the deployed service, so operators can confirm which build runs after a rollout
+// The build info is injected at build time, e.g. go build -tags standalone -ldflags "-X github.com/TVAO/scalability_of_web_systems/project_3/src.Version=1.2.0" ./cmd/standalone
+package satservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+)
+
+// Build info injected with -ldflags, which is "dev" for builds without it
+var (
+	Version   = "dev"
+	Commit    = "dev"
+	BuildTime = "dev"
+)
+
+// BuildInfo is the build of the service and the Go version it was built with
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"buildTime"`
+	Go        string `json:"go"`
+}
+
+// Returns the build info of the deployed service
+func version(w http.ResponseWriter, r *http.Request) *appError {
+	info := BuildInfo{Version: Version, Commit: Commit, BuildTime: BuildTime, Go: runtime.Version()}
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		return &appError{err, "Unable to map JSON to response", http.StatusInternalServerError}
+	}
+	return nil // Success
+}
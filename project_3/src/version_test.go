@@ -0,0 +1,26 @@
+// Package satservice : this contains unit tests of the build info of the service
+package satservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+// The version should be valid JSON with the Go version, where build info that is not injected is dev
+func TestVersionHandler_BuildInfo(t *testing.T) {
+	rr := httptest.NewRecorder()
+	appHandler(version).ServeHTTP(rr, httptest.NewRequest("GET", "/version", nil))
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	info := BuildInfo{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &info); err != nil {
+		t.Fatalf("handler returned invalid JSON %q: %v", rr.Body.String(), err)
+	}
+	if expected := (BuildInfo{Version: "dev", Commit: "dev", BuildTime: "dev", Go: runtime.Version()}); info != expected || len(info.Go) == 0 {
+		t.Errorf("wrong build info: got %+v want %+v", info, expected)
+	}
+}